@@ -0,0 +1,136 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+
+	"github.com/go-chi/chi"
+	"github.com/go-chi/render"
+
+	"github.com/filatovw/ni-storage/cluster"
+	"github.com/filatovw/ni-storage/engine"
+)
+
+// clustered is a storage of a raft cluster node
+type clustered interface {
+	Leader() (string, bool)
+	ReadIndex(context.Context) error
+	CommitIndex(context.Context) (uint64, error)
+	Members() ([]cluster.Member, error)
+	Join(context.Context, cluster.Member) error
+	Leave(context.Context, string) error
+}
+
+// node returns the storage as a cluster node, it renders 409 Conflict when the storage isn't one
+func (s *Server) node(w http.ResponseWriter, r *http.Request) (clustered, bool) {
+	node, ok := s.storage.(clustered)
+	if !ok {
+		render.Status(r, http.StatusConflict)
+		render.JSON(w, r, http.StatusText(http.StatusConflict))
+	}
+	return node, ok
+}
+
+// toLeader redirects requests to the leader of a cluster with 307 Temporary Redirect, so the method and the body are kept.
+// 503 Service Unavailable is returned while the leader is unknown.
+func (s *Server) toLeader(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		node, ok := s.storage.(clustered)
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+		url, leader := node.Leader()
+		if leader {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if url == "" {
+			s.renderError(w, r, engine.ErrNotLeader)
+			return
+		}
+		http.Redirect(w, r, url+r.URL.RequestURI(), http.StatusTemporaryRedirect)
+	})
+}
+
+// consistent makes a cluster node serve reads after all writes committed before them (unless stale=true is passed)
+// and redirects writes to the leader
+func (s *Server) consistent(next http.Handler) http.Handler {
+	writes := s.toLeader(next)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			writes.ServeHTTP(w, r)
+			return
+		}
+		node, ok := s.storage.(clustered)
+		if ok && r.URL.Query().Get("stale") != "true" {
+			if err := node.ReadIndex(r.Context()); err != nil {
+				s.renderError(w, r, err)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// MembersHandler lists members of the cluster (GET /cluster/members)
+func (s *Server) MembersHandler(w http.ResponseWriter, r *http.Request) {
+	node, ok := s.node(w, r)
+	if !ok {
+		return
+	}
+	members, err := node.Members()
+	if err != nil {
+		s.renderError(w, r, err)
+		return
+	}
+	render.JSON(w, r, members)
+}
+
+// JoinHandler adds a node to the cluster (POST /cluster/members {"id":"node2","address":"10.0.0.2:8600","url":"http://10.0.0.2:8555"})
+func (s *Server) JoinHandler(w http.ResponseWriter, r *http.Request) {
+	node, ok := s.node(w, r)
+	if !ok {
+		return
+	}
+	var m cluster.Member
+	if err := json.NewDecoder(r.Body).Decode(&m); err != nil || m.ID == "" || m.Address == "" {
+		render.Status(r, http.StatusBadRequest)
+		render.JSON(w, r, http.StatusText(http.StatusBadRequest))
+		return
+	}
+	if err := node.Join(r.Context(), m); err != nil {
+		s.renderError(w, r, err)
+		return
+	}
+	render.JSON(w, r, http.StatusText(http.StatusOK))
+}
+
+// LeaveHandler removes a node from the cluster (DELETE /cluster/members/{id})
+func (s *Server) LeaveHandler(w http.ResponseWriter, r *http.Request) {
+	node, ok := s.node(w, r)
+	if !ok {
+		return
+	}
+	if err := node.Leave(r.Context(), chi.URLParam(r, "id")); err != nil {
+		s.renderError(w, r, err)
+		return
+	}
+	render.JSON(w, r, http.StatusText(http.StatusOK))
+}
+
+// ReadIndexHandler confirms leadership and returns the raft index of the last command applied by the leader (GET /cluster/read-index)
+// Other nodes serve linearizable reads once they have applied this command.
+func (s *Server) ReadIndexHandler(w http.ResponseWriter, r *http.Request) {
+	node, ok := s.node(w, r)
+	if !ok {
+		return
+	}
+	index, err := node.CommitIndex(r.Context())
+	if err != nil {
+		s.renderError(w, r, err)
+		return
+	}
+	render.JSON(w, r, cluster.ReadIndex{Index: index})
+}
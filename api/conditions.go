@@ -0,0 +1,54 @@
+package api
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/filatovw/ni-storage/engine"
+)
+
+// etag formats version of a record as a strong entity tag
+func etag(version uint64) string {
+	return strconv.Quote(strconv.FormatUint(version, 10))
+}
+
+// parseETags parses a list of entity tags.
+// Weak and malformed tags are turned into version 0 which is never assigned to a record.
+func parseETags(header string) []uint64 {
+	versions := []uint64{}
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "" {
+			continue
+		}
+		var version uint64
+		if v, err := strconv.Unquote(tag); err == nil && strings.HasPrefix(tag, `"`) {
+			version, _ = strconv.ParseUint(v, 10, 64)
+		}
+		versions = append(versions, version)
+	}
+	return versions
+}
+
+// conditionFromRequest builds precondition of a mutation from If-Match and If-None-Match headers
+func conditionFromRequest(r *http.Request) engine.Condition {
+	cond := engine.Condition{}
+	if h := strings.TrimSpace(r.Header.Get("If-Match")); h != "" {
+		if h == "*" {
+			exists := true
+			cond.Exists = &exists
+		} else {
+			cond.Match = parseETags(h)
+		}
+	}
+	if h := strings.TrimSpace(r.Header.Get("If-None-Match")); h != "" {
+		if h == "*" {
+			exists := false
+			cond.Exists = &exists
+		} else {
+			cond.NoneMatch = parseETags(h)
+		}
+	}
+	return cond
+}
@@ -0,0 +1,66 @@
+package api
+
+import (
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// conns keeps open connections of the server.
+// The server sets the write deadline of a connection before every request, so a handler finds its connection
+// by the addresses of the request to move the deadline.
+type conns struct {
+	lock  *sync.Mutex
+	conns map[net.Conn]struct{}
+}
+
+func newConns() *conns {
+	return &conns{lock: &sync.Mutex{}, conns: make(map[net.Conn]struct{})}
+}
+
+// track is http.Server.ConnState hook which remembers new connections and forgets hijacked and closed ones
+func (c *conns) track(conn net.Conn, state http.ConnState) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	switch state {
+	case http.StateNew:
+		c.conns[conn] = struct{}{}
+	case http.StateHijacked, http.StateClosed:
+		delete(c.conns, conn)
+	}
+}
+
+// find returns the connection of a request, open connections don't share both local and remote addresses
+func (c *conns) find(r *http.Request) (net.Conn, bool) {
+	local, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr)
+	if !ok {
+		return nil, false
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for conn := range c.conns {
+		if conn.RemoteAddr().String() == r.RemoteAddr && conn.LocalAddr().String() == local.String() {
+			return conn, true
+		}
+	}
+	return nil, false
+}
+
+// writeTimeout replaces the write deadline of the server for the handler, zero timeout removes the deadline.
+// Requests which don't come through the server with the hook, like in tests, keep their deadline.
+func (c *conns) writeTimeout(timeout time.Duration) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		fn := func(w http.ResponseWriter, r *http.Request) {
+			if conn, ok := c.find(r); ok {
+				var deadline time.Time
+				if timeout > 0 {
+					deadline = time.Now().Add(timeout)
+				}
+				conn.SetWriteDeadline(deadline)
+			}
+			next.ServeHTTP(w, r)
+		}
+		return http.HandlerFunc(fn)
+	}
+}
@@ -0,0 +1,22 @@
+package api
+
+import (
+	"encoding/base64"
+)
+
+// nextCursorHeader holds the cursor of the next page of keys
+const nextCursorHeader = "X-Next-Cursor"
+
+// encodeCursor hides the last key of a page, so clients treat cursor as an opaque token
+func encodeCursor(key string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(key))
+}
+
+// decodeCursor returns the last key of the previous page
+func decodeCursor(cursor string) (string, error) {
+	key, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return "", err
+	}
+	return string(key), nil
+}
@@ -3,11 +3,13 @@ package api
 import (
 	"encoding/json"
 	"io/ioutil"
+	"math"
 	"net/http"
 	"strconv"
 	"time"
 
 	"github.com/go-chi/render"
+	"github.com/pkg/errors"
 
 	"github.com/go-chi/chi"
 
@@ -15,6 +17,13 @@ import (
 	"github.com/filatovw/ni-storage/logger"
 )
 
+const (
+	// defaultContentType is used for values stored without a content type
+	defaultContentType = "application/octet-stream"
+	// textContentType is used for values passed as JSON strings
+	textContentType = "text/plain; charset=utf-8"
+)
+
 // HealthHandler is used for simple health-check/echo requests
 func HealthHandler(log logger.Logger) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -25,9 +34,38 @@ func HealthHandler(log logger.Logger) http.Handler {
 type Server struct {
 	storage engine.Storage
 	log     logger.Logger
+	// token is required from readers of changes and dumps when it's set
+	token string
+}
+
+// renderError maps errors of a storage to HTTP status codes
+func (s *Server) renderError(w http.ResponseWriter, r *http.Request, err error) {
+	status := http.StatusInternalServerError
+	switch errors.Cause(err) {
+	case engine.ErrTooLarge:
+		status = http.StatusRequestEntityTooLarge
+	case engine.ErrNoSpace:
+		status = http.StatusInsufficientStorage
+	case engine.ErrClosed:
+		status = http.StatusServiceUnavailable
+	case engine.ErrPreconditionFailed:
+		status = http.StatusPreconditionFailed
+	case engine.ErrNotFound:
+		status = http.StatusNotFound
+	case engine.ErrCompacted:
+		status = http.StatusGone
+	case engine.ErrReadOnly:
+		status = http.StatusForbidden
+	case engine.ErrNotLeader:
+		status = http.StatusServiceUnavailable
+	default:
+		s.log.Errorf("storage error: %s", err)
+	}
+	render.Status(r, status)
+	render.JSON(w, r, http.StatusText(status))
 }
 
-// GetHandler get a value (GET /keys/{id})
+// GetHandler get a value (GET /keys/{id}), the value is returned as is with its content type and version in ETag
 func (s *Server) GetHandler(w http.ResponseWriter, r *http.Request) {
 	id := chi.URLParam(r, "id")
 	item, ok := s.storage.Get(id)
@@ -36,41 +74,89 @@ func (s *Server) GetHandler(w http.ResponseWriter, r *http.Request) {
 		render.JSON(w, r, http.StatusText(http.StatusNotFound))
 		return
 	}
-	render.JSON(w, r, item.Value)
+	contentType := item.ContentType
+	if contentType == "" {
+		contentType = defaultContentType
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("ETag", etag(item.Version))
+	w.WriteHeader(http.StatusOK)
+	if _, err := w.Write(item.Value); err != nil {
+		s.log.Errorf("failed to write value: %s", err)
+	}
 }
 
-// GetAllHandler get all values (GET /keys)
+// GetAllHandler get all keys in ascending order (GET /keys)
 // support wildcard keys when getting all values (GET /keys?filter=wo$d)
 // (the $ symbol should expand to match any number of characters, e.g: wod, word, world etc.)
+// values are matched the same way with value_filter (GET /keys?value_filter=polar$)
+// Keys can be limited by prefix, start (inclusive) and end (exclusive) and paged through with limit and cursor:
+// when there are more keys the cursor of the next page is returned in X-Next-Cursor header.
 func (s *Server) GetAllHandler(w http.ResponseWriter, r *http.Request) {
-	var (
-		records map[string]engine.Record
-		err     error
-	)
-
-	pattern := r.URL.Query().Get("filter")
-	if pattern != "" {
-		records, err = s.storage.Filter(pattern)
+	query := r.URL.Query()
+	keyPattern := query.Get("filter")
+	valuePattern := query.Get("value_filter")
+	if keyPattern != "" || valuePattern != "" {
+		keys, err := engine.FilterKeys(s.storage, keyPattern, valuePattern)
 		if err != nil {
 			render.Status(r, http.StatusInternalServerError)
 			render.JSON(w, r, http.StatusText(http.StatusInternalServerError))
 			return
 		}
-	} else {
-		records = s.storage.GetAll()
+		render.JSON(w, r, keys)
+		return
+	}
+
+	rng := engine.Range{
+		Prefix: query.Get("prefix"),
+		Start:  query.Get("start"),
+		End:    query.Get("end"),
+	}
+	limit := 0
+	if limitParam := query.Get("limit"); limitParam != "" {
+		var err error
+		limit, err = strconv.Atoi(limitParam)
+		if err != nil || limit < 0 {
+			render.Status(r, http.StatusBadRequest)
+			render.JSON(w, r, http.StatusText(http.StatusBadRequest))
+			return
+		}
+	}
+	if cursor := query.Get("cursor"); cursor != "" {
+		after, err := decodeCursor(cursor)
+		if err != nil {
+			render.Status(r, http.StatusBadRequest)
+			render.JSON(w, r, http.StatusText(http.StatusBadRequest))
+			return
+		}
+		// the smallest key following the last key of the previous page
+		if next := after + "\x00"; next > rng.Start {
+			rng.Start = next
+		}
 	}
 
-	keys := make([]string, len(records))
-	i := 0
-	for k := range records {
-		keys[i] = k
-		i++
+	keys := []string{}
+	more := false
+	s.storage.Scan(rng, func(record engine.Record) bool {
+		if limit > 0 && len(keys) == limit {
+			more = true
+			return false
+		}
+		keys = append(keys, record.Key)
+		return true
+	})
+	if more {
+		w.Header().Set(nextCursorHeader, encodeCursor(keys[len(keys)-1]))
 	}
 
 	render.JSON(w, r, keys)
 }
 
 // SetHandler set a value (PUT /keys/{id}), set an expiry time when adding a value (PUT /keys?expire_in=60)
+// With sliding=true the expiry time is prolonged by expire_in on every read of the value,
+// sliding=<seconds> sets the prolongation apart from the current expire_in (PUT /keys/{id}?expire_in=10&sliding=60).
+// Request body is stored as is along with its Content-Type.
+// If-Match and If-None-Match headers make the update conditional.
 func (s *Server) SetHandler(w http.ResponseWriter, r *http.Request) {
 	expireInParam := r.URL.Query().Get("expire_in")
 	item := engine.Record{}
@@ -83,6 +169,19 @@ func (s *Server) SetHandler(w http.ResponseWriter, r *http.Request) {
 		}
 		ts := time.Now().Add(time.Duration(expireIn) * time.Second)
 		item.ExpirationTime = &ts
+		switch sliding := r.URL.Query().Get("sliding"); sliding {
+		case "", "false":
+		case "true":
+			item.SlidingTTL = time.Duration(expireIn) * time.Second
+		default:
+			window, err := strconv.Atoi(sliding)
+			if err != nil || window <= 0 {
+				render.Status(r, http.StatusBadRequest)
+				render.JSON(w, r, http.StatusText(http.StatusBadRequest))
+				return
+			}
+			item.SlidingTTL = time.Duration(window) * time.Second
+		}
 	}
 
 	id := chi.URLParam(r, "id")
@@ -99,8 +198,12 @@ func (s *Server) SetHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	item.Key = id
-	item.Value = string(body)
-	s.storage.Set(item)
+	item.Value = body
+	item.ContentType = r.Header.Get("Content-Type")
+	if err := s.storage.CompareAndSet(r.Context(), item, conditionFromRequest(r)); err != nil {
+		s.renderError(w, r, err)
+		return
+	}
 	w.WriteHeader(http.StatusCreated)
 
 	render.JSON(w, r, http.StatusText(http.StatusOK))
@@ -128,44 +231,182 @@ func (s *Server) SetMultipleHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	tsNow := time.Now()
+	ops := make([]engine.Op, 0, len(req))
 	for k, v := range req {
 		item := engine.Record{
-			Key:   k,
-			Value: v.Value,
+			Key:         k,
+			Value:       []byte(v.Value),
+			ContentType: textContentType,
 		}
 
 		if v.ExpireIn != nil {
 			ts := tsNow.Add(*v.ExpireIn * time.Second)
 			item.ExpirationTime = &ts
 		}
-		s.storage.Set(item)
+		ops = append(ops, engine.Op{Type: engine.OpSet, Record: item})
+	}
+	if err := s.storage.Batch(r.Context(), ops); err != nil {
+		s.renderError(w, r, err)
+		return
 	}
 	w.WriteHeader(http.StatusCreated)
 	render.JSON(w, r, http.StatusText(http.StatusOK))
 }
 
-// CheckHandler check if a value exists (HEAD /keys/{id})
+// batchOp is a single operation of a batch
+type batchOp struct {
+	Op          string         `json:"op"`
+	Key         string         `json:"key"`
+	Value       string         `json:"value"`
+	ContentType string         `json:"content_type,omitempty"`
+	ExpireIn    *time.Duration `json:"expire_in,omitempty"`
+	// Sliding prolongs expiration on every read of the value
+	Sliding bool `json:"sliding,omitempty"`
+	// IfExists requires the key to exist (true) or to be absent (false)
+	IfExists *bool `json:"if_exists,omitempty"`
+	// IfVersion requires the key to have this version
+	IfVersion *uint64 `json:"if_version,omitempty"`
+}
+
+// BatchHandler applies sets and deletes atomically (POST /batch), either all operations succeed or none of them
+func (s *Server) BatchHandler(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		render.Status(r, http.StatusBadRequest)
+		render.JSON(w, r, http.StatusText(http.StatusBadRequest))
+		return
+	}
+
+	var req []batchOp
+	if err := json.Unmarshal(body, &req); err != nil {
+		render.Status(r, http.StatusBadRequest)
+		render.JSON(w, r, http.StatusText(http.StatusBadRequest))
+		return
+	}
+
+	tsNow := time.Now()
+	ops := make([]engine.Op, 0, len(req))
+	for _, v := range req {
+		if v.Key == "" {
+			render.Status(r, http.StatusBadRequest)
+			render.JSON(w, r, http.StatusText(http.StatusBadRequest))
+			return
+		}
+		op := engine.Op{Record: engine.Record{Key: v.Key}}
+		switch v.Op {
+		case "set":
+			op.Type = engine.OpSet
+			op.Record.Value = []byte(v.Value)
+			op.Record.ContentType = v.ContentType
+			if op.Record.ContentType == "" {
+				op.Record.ContentType = textContentType
+			}
+			if v.ExpireIn != nil {
+				ts := tsNow.Add(*v.ExpireIn * time.Second)
+				op.Record.ExpirationTime = &ts
+				if v.Sliding {
+					op.Record.SlidingTTL = *v.ExpireIn * time.Second
+				}
+			}
+		case "delete":
+			op.Type = engine.OpDelete
+		default:
+			render.Status(r, http.StatusBadRequest)
+			render.JSON(w, r, http.StatusText(http.StatusBadRequest))
+			return
+		}
+		op.Condition.Exists = v.IfExists
+		if v.IfVersion != nil {
+			op.Condition.Match = []uint64{*v.IfVersion}
+		}
+		ops = append(ops, op)
+	}
+	if err := s.storage.Batch(r.Context(), ops); err != nil {
+		s.renderError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+	render.JSON(w, r, http.StatusText(http.StatusOK))
+}
+
+// CheckHandler check if a value exists (HEAD /keys/{id}), version of the value is returned in ETag
 func (s *Server) CheckHandler(w http.ResponseWriter, r *http.Request) {
 	id := chi.URLParam(r, "id")
-	if ok := s.storage.Exists(id); !ok {
+	item, ok := s.storage.Get(id)
+	if !ok {
 		render.Status(r, http.StatusNotFound)
 		render.JSON(w, r, http.StatusText(http.StatusNotFound))
 		return
 	}
+	w.Header().Set("ETag", etag(item.Version))
 	render.JSON(w, r, true)
 }
 
-// DeleteHandler delete a value (DELETE /keys/{id})
+// DeleteHandler delete a value (DELETE /keys/{id}), If-Match and If-None-Match headers make it conditional
 func (s *Server) DeleteHandler(w http.ResponseWriter, r *http.Request) {
 	id := chi.URLParam(r, "id")
-	s.storage.Delete(id)
+	if err := s.storage.CompareAndDelete(r.Context(), id, conditionFromRequest(r)); err != nil {
+		s.renderError(w, r, err)
+		return
+	}
 	render.Status(r, http.StatusAccepted)
 	render.JSON(w, r, http.StatusText(http.StatusAccepted))
 }
 
 // DeleteAllHandler delete all values (DELETE /keys)
 func (s *Server) DeleteAllHandler(w http.ResponseWriter, r *http.Request) {
-	s.storage.DeleteAll()
+	if err := s.storage.DeleteAll(r.Context()); err != nil {
+		s.renderError(w, r, err)
+		return
+	}
 	render.Status(r, http.StatusAccepted)
 	render.JSON(w, r, http.StatusText(http.StatusAccepted))
 }
+
+// ttlResponse shows remaining lifetime of a value in seconds, it's null for permanent values
+type ttlResponse struct {
+	ExpireIn *int64 `json:"expire_in"`
+}
+
+// GetTTLHandler get remaining lifetime of a value (GET /keys/{id}/ttl)
+func (s *Server) GetTTLHandler(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	until, ok := s.storage.TTL(id)
+	if !ok {
+		render.Status(r, http.StatusNotFound)
+		render.JSON(w, r, http.StatusText(http.StatusNotFound))
+		return
+	}
+	resp := ttlResponse{}
+	if until != nil {
+		expireIn := int64(math.Ceil(time.Until(*until).Seconds()))
+		resp.ExpireIn = &expireIn
+	}
+	render.JSON(w, r, resp)
+}
+
+// SetTTLHandler change expiry time of a value without rewriting it (PUT /keys/{id}/ttl?expire_in=60)
+func (s *Server) SetTTLHandler(w http.ResponseWriter, r *http.Request) {
+	expireIn, err := strconv.Atoi(r.URL.Query().Get("expire_in"))
+	if err != nil {
+		render.Status(r, http.StatusBadRequest)
+		render.JSON(w, r, http.StatusText(http.StatusBadRequest))
+		return
+	}
+	id := chi.URLParam(r, "id")
+	if err := s.storage.Expire(r.Context(), id, time.Now().Add(time.Duration(expireIn)*time.Second)); err != nil {
+		s.renderError(w, r, err)
+		return
+	}
+	render.JSON(w, r, http.StatusText(http.StatusOK))
+}
+
+// PersistHandler make a value permanent (DELETE /keys/{id}/ttl)
+func (s *Server) PersistHandler(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	if err := s.storage.Persist(r.Context(), id); err != nil {
+		s.renderError(w, r, err)
+		return
+	}
+	render.JSON(w, r, http.StatusText(http.StatusOK))
+}
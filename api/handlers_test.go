@@ -1,9 +1,11 @@
 package api
 
 import (
+	"bufio"
 	"bytes"
 	"context"
 	"encoding/json"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"reflect"
@@ -12,14 +14,21 @@ import (
 	"testing"
 	"time"
 
+	"github.com/filatovw/ni-storage/config"
 	"github.com/filatovw/ni-storage/engine"
+	"github.com/filatovw/ni-storage/internal/storagetest"
 	"github.com/go-chi/chi"
+	"github.com/pkg/errors"
 	"go.uber.org/zap"
 )
 
 // MockStorage is for testing needs only
 type MockStorage struct {
 	data map[string]engine.Record
+	// err is returned by all mutations when set
+	err error
+	// events are sent to watchers
+	events chan engine.Event
 }
 
 func (s MockStorage) Exists(key string) bool {
@@ -36,22 +45,175 @@ func (s MockStorage) GetAll() map[string]engine.Record {
 	return s.data
 }
 
+func (s MockStorage) Scan(r engine.Range, fn func(engine.Record) bool) {
+	keys := []string{}
+	for k := range s.data {
+		if r.Contains(k) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if !fn(s.data[k]) {
+			return
+		}
+	}
+}
+
 func (s MockStorage) Filter(pattern string) (map[string]engine.Record, error) {
-	return s.data, nil
+	p, err := engine.CompilePattern(pattern)
+	if err != nil {
+		return nil, err
+	}
+	results := make(map[string]engine.Record)
+	for k, v := range s.data {
+		if p.MatchString(k) {
+			results[k] = v
+		}
+	}
+	return results, nil
+}
+
+func (s MockStorage) FilterValues(pattern string) (map[string]engine.Record, error) {
+	p, err := engine.CompilePattern(pattern)
+	if err != nil {
+		return nil, err
+	}
+	results := make(map[string]engine.Record)
+	for k, v := range s.data {
+		if p.Match(v.Value) {
+			results[k] = v
+		}
+	}
+	return results, nil
+}
+
+func (s MockStorage) Set(ctx context.Context, record engine.Record) error {
+	return s.CompareAndSet(ctx, record, engine.Condition{})
 }
 
-func (s MockStorage) Set(record engine.Record) {
+func (s MockStorage) CompareAndSet(ctx context.Context, record engine.Record, cond engine.Condition) error {
+	if s.err != nil {
+		return s.err
+	}
+	current, ok := s.data[record.Key]
+	if !cond.Check(current, ok) {
+		return engine.ErrPreconditionFailed
+	}
+	record.Version = current.Version + 1
 	s.data[record.Key] = record
+	return nil
+}
+
+func (s MockStorage) Delete(ctx context.Context, key string) error {
+	return s.CompareAndDelete(ctx, key, engine.Condition{})
 }
 
-func (s MockStorage) Delete(key string) {
+func (s MockStorage) CompareAndDelete(ctx context.Context, key string, cond engine.Condition) error {
+	if s.err != nil {
+		return s.err
+	}
+	current, ok := s.data[key]
+	if !cond.Check(current, ok) {
+		return engine.ErrPreconditionFailed
+	}
 	delete(s.data, key)
+	return nil
 }
 
-func (s MockStorage) DeleteAll() {
+func (s MockStorage) DeleteAll(ctx context.Context) error {
 	for k := range s.data {
-		s.Delete(k)
+		if err := s.Delete(ctx, k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s MockStorage) Batch(ctx context.Context, ops []engine.Op) error {
+	if s.err != nil {
+		return s.err
+	}
+	// operations are applied to a copy, so a failed batch changes nothing
+	tx := MockStorage{data: make(map[string]engine.Record, len(s.data))}
+	for k, v := range s.data {
+		tx.data[k] = v
+	}
+	for _, op := range ops {
+		var err error
+		switch op.Type {
+		case engine.OpSet:
+			err = tx.CompareAndSet(ctx, op.Record, op.Condition)
+		case engine.OpDelete:
+			err = tx.CompareAndDelete(ctx, op.Record.Key, op.Condition)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	for k := range s.data {
+		delete(s.data, k)
+	}
+	for k, v := range tx.data {
+		s.data[k] = v
+	}
+	return nil
+}
+
+func (s MockStorage) TTL(key string) (*time.Time, bool) {
+	v, ok := s.data[key]
+	return v.ExpirationTime, ok
+}
+
+func (s MockStorage) Expire(ctx context.Context, key string, until time.Time) error {
+	if s.err != nil {
+		return s.err
+	}
+	v, ok := s.data[key]
+	if !ok {
+		return engine.ErrNotFound
+	}
+	v.ExpirationTime = &until
+	s.data[key] = v
+	return nil
+}
+
+func (s MockStorage) Persist(ctx context.Context, key string) error {
+	if s.err != nil {
+		return s.err
+	}
+	v, ok := s.data[key]
+	if !ok {
+		return engine.ErrNotFound
+	}
+	v.ExpirationTime = nil
+	s.data[key] = v
+	return nil
+}
+
+func (s MockStorage) Watch(ctx context.Context, prefix string) <-chan engine.Event {
+	return s.events
+}
+
+func (s MockStorage) Changes(ctx context.Context, since uint64) (<-chan engine.Event, error) {
+	if s.err != nil {
+		return nil, s.err
 	}
+	return s.events, nil
+}
+
+func (s MockStorage) Seq() uint64 {
+	var seq uint64
+	for _, r := range s.data {
+		if r.Version > seq {
+			seq = r.Version
+		}
+	}
+	return seq
+}
+
+func (s MockStorage) Dump() engine.Dump {
+	return engine.Dump{Seq: s.Seq(), Version: s.Seq(), Records: s.GetAll()}
 }
 
 func setupServer(t *testing.T) Server {
@@ -131,8 +293,8 @@ func TestSetMultipleHandler(t *testing.T) {
 
 func TestGetHandlerOK(t *testing.T) {
 	server := setupServer(t)
-	record := engine.Record{Key: "key1", Value: "value1"}
-	server.storage.Set(record)
+	record := engine.Record{Key: "key1", Value: []byte("value1")}
+	server.storage.Set(context.TODO(), record)
 
 	rr := httptest.NewRecorder()
 	req, err := http.NewRequest("GET", "/keys/key1", nil)
@@ -152,11 +314,53 @@ func TestGetHandlerOK(t *testing.T) {
 			status, http.StatusOK)
 	}
 
-	expected := "\"value1\"\n"
+	expected := "value1"
 	if rr.Body.String() != expected {
 		t.Errorf("handler returned unexpected body: got %#v want %#v",
 			rr.Body.String(), expected)
 	}
+	if contentType := rr.Header().Get("Content-Type"); contentType != defaultContentType {
+		t.Errorf("handler returned wrong content type: got %v want %v",
+			contentType, defaultContentType)
+	}
+}
+
+func TestSetGetHandlerBinary(t *testing.T) {
+	server := setupServer(t)
+	value := []byte{0x89, 'P', 'N', 'G', 0x00, 0xff, '"', '\n'}
+
+	rctx := chi.NewRouteContext()
+	rctx.URLParams.Add("id", "image")
+
+	rr := httptest.NewRecorder()
+	req, err := http.NewRequest("PUT", "/keys/image", bytes.NewReader(value))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "image/png")
+	req = req.WithContext(context.WithValue(req.Context(), chi.RouteCtxKey, rctx))
+	http.HandlerFunc(server.SetHandler).ServeHTTP(rr, req)
+	if status := rr.Code; status != http.StatusCreated {
+		t.Errorf("handler returned wrong status code: got %v want %v",
+			status, http.StatusCreated)
+	}
+
+	rr = httptest.NewRecorder()
+	req, err = http.NewRequest("GET", "/keys/image", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req = req.WithContext(context.WithValue(req.Context(), chi.RouteCtxKey, rctx))
+	http.HandlerFunc(server.GetHandler).ServeHTTP(rr, req)
+
+	if !bytes.Equal(rr.Body.Bytes(), value) {
+		t.Errorf("handler returned unexpected body: got %#v want %#v",
+			rr.Body.Bytes(), value)
+	}
+	if contentType := rr.Header().Get("Content-Type"); contentType != "image/png" {
+		t.Errorf("handler returned wrong content type: got %v want %v",
+			contentType, "image/png")
+	}
 }
 
 func TestGetHandlerNotFound(t *testing.T) {
@@ -189,8 +393,8 @@ func TestGetHandlerNotFound(t *testing.T) {
 
 func TestCheckHandlerOK(t *testing.T) {
 	server := setupServer(t)
-	record := engine.Record{Key: "key1", Value: "value1"}
-	server.storage.Set(record)
+	record := engine.Record{Key: "key1", Value: []byte("value1")}
+	server.storage.Set(context.TODO(), record)
 
 	rr := httptest.NewRecorder()
 	req, err := http.NewRequest("GET", "/keys/key1", nil)
@@ -247,8 +451,8 @@ func TestCheckHandlerNotFound(t *testing.T) {
 
 func TestDeleteHandler(t *testing.T) {
 	server := setupServer(t)
-	record := engine.Record{Key: "key1", Value: "value1"}
-	server.storage.Set(record)
+	record := engine.Record{Key: "key1", Value: []byte("value1")}
+	server.storage.Set(context.TODO(), record)
 
 	rr := httptest.NewRecorder()
 	req, err := http.NewRequest("DELETE", "/keys/key1", nil)
@@ -278,11 +482,11 @@ func TestDeleteHandler(t *testing.T) {
 func TestGetAllHandler(t *testing.T) {
 	server := setupServer(t)
 
-	record1 := engine.Record{Key: "key1", Value: "value1"}
-	record2 := engine.Record{Key: "key2", Value: "value2"}
+	record1 := engine.Record{Key: "key1", Value: []byte("value1")}
+	record2 := engine.Record{Key: "key2", Value: []byte("value2")}
 
-	server.storage.Set(record1)
-	server.storage.Set(record2)
+	server.storage.Set(context.TODO(), record1)
+	server.storage.Set(context.TODO(), record2)
 
 	rr := httptest.NewRecorder()
 	req, err := http.NewRequest("GET", "/keys", nil)
@@ -317,8 +521,8 @@ func TestGetAllHandler(t *testing.T) {
 
 func TestDeleteAllHandler(t *testing.T) {
 	server := setupServer(t)
-	record := engine.Record{Key: "key1", Value: "value1"}
-	server.storage.Set(record)
+	record := engine.Record{Key: "key1", Value: []byte("value1")}
+	server.storage.Set(context.TODO(), record)
 
 	rr := httptest.NewRecorder()
 	req, err := http.NewRequest("DELETE", "/keys", nil)
@@ -343,3 +547,607 @@ func TestDeleteAllHandler(t *testing.T) {
 		t.Errorf("expected empty storage, actual size is: %d", len(server.storage.GetAll()))
 	}
 }
+
+func TestSetHandlerStorageErrors(t *testing.T) {
+	testData := []struct {
+		name           string
+		err            error
+		expectedStatus int
+	}{
+		{name: "too large", err: engine.ErrTooLarge, expectedStatus: http.StatusRequestEntityTooLarge},
+		{name: "no space", err: errors.Wrap(engine.ErrNoSpace, "write log"), expectedStatus: http.StatusInsufficientStorage},
+		{name: "closed", err: engine.ErrClosed, expectedStatus: http.StatusServiceUnavailable},
+		{name: "read-only", err: engine.ErrReadOnly, expectedStatus: http.StatusForbidden},
+		{name: "unknown", err: errors.New("unknown"), expectedStatus: http.StatusInternalServerError},
+	}
+	for _, td := range testData {
+		t.Run(td.name, func(t *testing.T) {
+			server := setupServer(t)
+			server.storage = MockStorage{data: make(map[string]engine.Record), err: td.err}
+
+			rr := httptest.NewRecorder()
+			req, err := http.NewRequest("PUT", "/keys/key1", strings.NewReader("value1"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			rctx := chi.NewRouteContext()
+			rctx.URLParams.Add("id", "key1")
+			req = req.WithContext(context.WithValue(req.Context(), chi.RouteCtxKey, rctx))
+
+			handler := http.HandlerFunc(server.SetHandler)
+			handler.ServeHTTP(rr, req)
+
+			if status := rr.Code; status != td.expectedStatus {
+				t.Errorf("handler returned wrong status code: got %v want %v",
+					status, td.expectedStatus)
+			}
+		})
+	}
+}
+
+func TestConditionalRequests(t *testing.T) {
+	server := setupServer(t)
+	server.storage.Set(context.TODO(), engine.Record{Key: "key1", Value: []byte("value1")})
+	server.storage.Set(context.TODO(), engine.Record{Key: "key1", Value: []byte("value2")})
+
+	testData := []struct {
+		name           string
+		method         string
+		handler        http.HandlerFunc
+		headers        map[string]string
+		expectedStatus int
+		expectedETag   string
+	}{
+		{name: "etag on get", method: "GET", handler: server.GetHandler, expectedStatus: http.StatusOK, expectedETag: `"2"`},
+		{name: "etag on head", method: "HEAD", handler: server.CheckHandler, expectedStatus: http.StatusOK, expectedETag: `"2"`},
+		{name: "put stale version", method: "PUT", handler: server.SetHandler, headers: map[string]string{"If-Match": `"1"`}, expectedStatus: http.StatusPreconditionFailed},
+		{name: "put weak tag", method: "PUT", handler: server.SetHandler, headers: map[string]string{"If-Match": `W/"2"`}, expectedStatus: http.StatusPreconditionFailed},
+		{name: "put if absent", method: "PUT", handler: server.SetHandler, headers: map[string]string{"If-None-Match": "*"}, expectedStatus: http.StatusPreconditionFailed},
+		{name: "put current version", method: "PUT", handler: server.SetHandler, headers: map[string]string{"If-Match": `"1", "2"`}, expectedStatus: http.StatusCreated},
+		{name: "delete stale version", method: "DELETE", handler: server.DeleteHandler, headers: map[string]string{"If-Match": `"2"`}, expectedStatus: http.StatusPreconditionFailed},
+		{name: "delete none match", method: "DELETE", handler: server.DeleteHandler, headers: map[string]string{"If-None-Match": `"2"`}, expectedStatus: http.StatusAccepted},
+	}
+	for _, td := range testData {
+		t.Run(td.name, func(t *testing.T) {
+			rr := httptest.NewRecorder()
+			req, err := http.NewRequest(td.method, "/keys/key1", strings.NewReader("value3"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			for k, v := range td.headers {
+				req.Header.Set(k, v)
+			}
+			rctx := chi.NewRouteContext()
+			rctx.URLParams.Add("id", "key1")
+			req = req.WithContext(context.WithValue(req.Context(), chi.RouteCtxKey, rctx))
+
+			td.handler.ServeHTTP(rr, req)
+
+			if status := rr.Code; status != td.expectedStatus {
+				t.Errorf("handler returned wrong status code: got %v want %v",
+					status, td.expectedStatus)
+			}
+			if td.expectedETag != "" && rr.Header().Get("ETag") != td.expectedETag {
+				t.Errorf("handler returned wrong ETag: got %v want %v",
+					rr.Header().Get("ETag"), td.expectedETag)
+			}
+		})
+	}
+}
+
+func TestBatchHandler(t *testing.T) {
+	testData := []struct {
+		name           string
+		body           string
+		expectedStatus int
+		expected       []string
+	}{
+		{
+			name:           "set and delete",
+			body:           `[{"op":"set","key":"key2","value":"value2"},{"op":"delete","key":"key1","if_version":1}]`,
+			expectedStatus: http.StatusCreated,
+			expected:       []string{"key2"},
+		},
+		{
+			name:           "failed precondition",
+			body:           `[{"op":"set","key":"key2","value":"value2"},{"op":"set","key":"key1","value":"new","if_exists":false}]`,
+			expectedStatus: http.StatusPreconditionFailed,
+			expected:       []string{"key1"},
+		},
+		{
+			name:           "unknown operation",
+			body:           `[{"op":"set","key":"key2","value":"value2"},{"op":"increment","key":"key1"}]`,
+			expectedStatus: http.StatusBadRequest,
+			expected:       []string{"key1"},
+		},
+		{
+			name:           "empty key",
+			body:           `[{"op":"delete"}]`,
+			expectedStatus: http.StatusBadRequest,
+			expected:       []string{"key1"},
+		},
+		{
+			name:           "malformed body",
+			body:           `{"op":"delete"}`,
+			expectedStatus: http.StatusBadRequest,
+			expected:       []string{"key1"},
+		},
+	}
+	for _, td := range testData {
+		t.Run(td.name, func(t *testing.T) {
+			server := setupServer(t)
+			server.storage.Set(context.TODO(), engine.Record{Key: "key1", Value: []byte("value1")})
+
+			rr := httptest.NewRecorder()
+			req, err := http.NewRequest("POST", "/batch", strings.NewReader(td.body))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			handler := http.HandlerFunc(server.BatchHandler)
+			handler.ServeHTTP(rr, req)
+
+			if status := rr.Code; status != td.expectedStatus {
+				t.Errorf("handler returned wrong status code: got %v want %v",
+					status, td.expectedStatus)
+			}
+			keys := []string{}
+			for k := range server.storage.GetAll() {
+				keys = append(keys, k)
+			}
+			sort.Strings(keys)
+			if !reflect.DeepEqual(keys, td.expected) {
+				t.Errorf("expected keys: %v, got: %v", td.expected, keys)
+			}
+		})
+	}
+}
+
+func TestGetAllHandlerPaging(t *testing.T) {
+	server := setupServer(t)
+	for _, k := range []string{"a1", "a2", "a3", "b1", "b2", "c1"} {
+		server.storage.Set(context.TODO(), engine.Record{Key: k, Value: []byte(k)})
+	}
+
+	testData := []struct {
+		name           string
+		query          string
+		expectedStatus int
+		expected       [][]string
+	}{
+		{name: "all keys", query: "", expectedStatus: http.StatusOK, expected: [][]string{{"a1", "a2", "a3", "b1", "b2", "c1"}}},
+		{name: "prefix", query: "prefix=b", expectedStatus: http.StatusOK, expected: [][]string{{"b1", "b2"}}},
+		{name: "start and end", query: "start=a2&end=b2", expectedStatus: http.StatusOK, expected: [][]string{{"a2", "a3", "b1"}}},
+		{name: "pages", query: "limit=2", expectedStatus: http.StatusOK, expected: [][]string{{"a1", "a2"}, {"a3", "b1"}, {"b2", "c1"}}},
+		{name: "pages of prefix", query: "prefix=a&limit=2", expectedStatus: http.StatusOK, expected: [][]string{{"a1", "a2"}, {"a3"}}},
+		{name: "empty range", query: "prefix=d", expectedStatus: http.StatusOK, expected: [][]string{{}}},
+		{name: "wrong limit", query: "limit=-1", expectedStatus: http.StatusBadRequest},
+		{name: "wrong cursor", query: "cursor=!!", expectedStatus: http.StatusBadRequest},
+	}
+	for _, td := range testData {
+		t.Run(td.name, func(t *testing.T) {
+			query := td.query
+			pages := [][]string{}
+			for {
+				rr := httptest.NewRecorder()
+				req, err := http.NewRequest("GET", "/keys?"+query, nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+				handler := http.HandlerFunc(server.GetAllHandler)
+				handler.ServeHTTP(rr, req)
+
+				if status := rr.Code; status != td.expectedStatus {
+					t.Fatalf("handler returned wrong status code: got %v want %v",
+						status, td.expectedStatus)
+				}
+				if rr.Code != http.StatusOK {
+					return
+				}
+				var v []string
+				if err := json.Unmarshal(rr.Body.Bytes(), &v); err != nil {
+					t.Fatalf("error on unmarshalling: %s", err)
+				}
+				pages = append(pages, v)
+				cursor := rr.Header().Get(nextCursorHeader)
+				if cursor == "" {
+					break
+				}
+				query = td.query + "&cursor=" + cursor
+			}
+			if !reflect.DeepEqual(pages, td.expected) {
+				t.Errorf("expected pages: %#v, got: %#v", td.expected, pages)
+			}
+		})
+	}
+}
+
+func TestGetAllHandlerFilter(t *testing.T) {
+	server := setupServer(t)
+	records := map[string]string{
+		"wod":   "polar bear",
+		"word":  "brown bear",
+		"world": "polar fox",
+	}
+	for k, v := range records {
+		server.storage.Set(context.TODO(), engine.Record{Key: k, Value: []byte(v)})
+	}
+
+	testData := []struct {
+		name     string
+		query    string
+		expected []string
+	}{
+		{name: "keys", query: "filter=wo$d", expected: []string{"wod", "word", "world"}},
+		{name: "values", query: "value_filter=polar$", expected: []string{"wod", "world"}},
+		{name: "keys and values", query: "filter=wor$&value_filter=polar$", expected: []string{"world"}},
+	}
+	for _, td := range testData {
+		t.Run(td.name, func(t *testing.T) {
+			rr := httptest.NewRecorder()
+			req, err := http.NewRequest("GET", "/keys?"+td.query, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			handler := http.HandlerFunc(server.GetAllHandler)
+			handler.ServeHTTP(rr, req)
+
+			if status := rr.Code; status != http.StatusOK {
+				t.Fatalf("handler returned wrong status code: got %v want %v",
+					status, http.StatusOK)
+			}
+			var v []string
+			if err := json.Unmarshal(rr.Body.Bytes(), &v); err != nil {
+				t.Fatalf("error on unmarshalling: %s", err)
+			}
+			if !reflect.DeepEqual(v, td.expected) {
+				t.Errorf("expected: %#v, got: %#v", td.expected, v)
+			}
+		})
+	}
+}
+
+func TestTTLHandlers(t *testing.T) {
+	server := setupServer(t)
+	server.storage.Set(context.TODO(), engine.Record{Key: "key1", Value: []byte("value1")})
+
+	testData := []struct {
+		name           string
+		method         string
+		handler        http.HandlerFunc
+		key            string
+		query          string
+		expectedStatus int
+		expectedBody   string
+	}{
+		{name: "permanent", method: "GET", handler: server.GetTTLHandler, key: "key1", expectedStatus: http.StatusOK, expectedBody: `{"expire_in":null}`},
+		{name: "set ttl", method: "PUT", handler: server.SetTTLHandler, key: "key1", query: "expire_in=60", expectedStatus: http.StatusOK},
+		{name: "expiring", method: "GET", handler: server.GetTTLHandler, key: "key1", expectedStatus: http.StatusOK, expectedBody: `{"expire_in":60}`},
+		{name: "persist", method: "DELETE", handler: server.PersistHandler, key: "key1", expectedStatus: http.StatusOK},
+		{name: "persisted", method: "GET", handler: server.GetTTLHandler, key: "key1", expectedStatus: http.StatusOK, expectedBody: `{"expire_in":null}`},
+		{name: "wrong ttl", method: "PUT", handler: server.SetTTLHandler, key: "key1", query: "expire_in=soon", expectedStatus: http.StatusBadRequest},
+		{name: "get missing", method: "GET", handler: server.GetTTLHandler, key: "key2", expectedStatus: http.StatusNotFound},
+		{name: "set missing", method: "PUT", handler: server.SetTTLHandler, key: "key2", query: "expire_in=60", expectedStatus: http.StatusNotFound},
+		{name: "persist missing", method: "DELETE", handler: server.PersistHandler, key: "key2", expectedStatus: http.StatusNotFound},
+	}
+	for _, td := range testData {
+		t.Run(td.name, func(t *testing.T) {
+			rr := httptest.NewRecorder()
+			req, err := http.NewRequest(td.method, "/keys/"+td.key+"/ttl?"+td.query, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			rctx := chi.NewRouteContext()
+			rctx.URLParams.Add("id", td.key)
+			req = req.WithContext(context.WithValue(req.Context(), chi.RouteCtxKey, rctx))
+
+			td.handler.ServeHTTP(rr, req)
+
+			if status := rr.Code; status != td.expectedStatus {
+				t.Errorf("handler returned wrong status code: got %v want %v",
+					status, td.expectedStatus)
+			}
+			if td.expectedBody != "" && strings.TrimSpace(rr.Body.String()) != td.expectedBody {
+				t.Errorf("handler returned unexpected body: got %#v want %#v",
+					rr.Body.String(), td.expectedBody)
+			}
+		})
+	}
+}
+
+func TestTTLHandlersETag(t *testing.T) {
+	storage := storagetest.New(t)
+	defer storage.Close()
+	handler := New(storage.Ctx, storage.Log, storage.Service, config.Config{}).Handler
+	if err := storage.Set(context.TODO(), engine.Record{Key: "key1", Value: []byte("value1")}); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	etag := func() string {
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, httptest.NewRequest("GET", "/keys/key1", nil))
+		return rr.Header().Get("ETag")
+	}
+
+	previous := etag()
+	for _, td := range []struct {
+		method string
+		query  string
+	}{
+		{"PUT", "?expire_in=60"},
+		{"DELETE", ""},
+	} {
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, httptest.NewRequest(td.method, "/keys/key1/ttl"+td.query, nil))
+		if rr.Code != http.StatusOK {
+			t.Fatalf("%s: unexpected status code: %d", td.method, rr.Code)
+		}
+		current := etag()
+		if current == "" || current == previous {
+			t.Errorf("%s: expected ETag to change from %s, got %s", td.method, previous, current)
+		}
+		previous = current
+	}
+}
+
+func TestSetHandlerSliding(t *testing.T) {
+	tests := []struct {
+		name     string
+		query    string
+		status   int
+		sliding  time.Duration
+		expireIn time.Duration
+	}{
+		{"prolonged by expire_in", "expire_in=60&sliding=true", http.StatusCreated, time.Minute, time.Minute},
+		{"prolonged by sliding", "expire_in=10&sliding=60", http.StatusCreated, time.Minute, 10 * time.Second},
+		{"not sliding", "expire_in=10&sliding=false", http.StatusCreated, 0, 10 * time.Second},
+		{"bad sliding", "expire_in=10&sliding=soon", http.StatusBadRequest, 0, 0},
+		{"negative sliding", "expire_in=10&sliding=-1", http.StatusBadRequest, 0, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := setupServer(t)
+			rr := httptest.NewRecorder()
+			req, err := http.NewRequest("PUT", "/keys/session?"+tt.query, strings.NewReader("value1"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			rctx := chi.NewRouteContext()
+			rctx.URLParams.Add("id", "session")
+			req = req.WithContext(context.WithValue(req.Context(), chi.RouteCtxKey, rctx))
+			http.HandlerFunc(server.SetHandler).ServeHTTP(rr, req)
+
+			if status := rr.Code; status != tt.status {
+				t.Fatalf("handler returned wrong status code: got %v want %v", status, tt.status)
+			}
+			if tt.status != http.StatusCreated {
+				return
+			}
+			found, _ := server.storage.Get("session")
+			if found.SlidingTTL != tt.sliding || found.ExpirationTime == nil {
+				t.Fatalf("unexpected expiration: %v", found)
+			}
+			if left := time.Until(*found.ExpirationTime); left > tt.expireIn || left < tt.expireIn-time.Second {
+				t.Errorf("expected to expire in %s, got %s", tt.expireIn, left)
+			}
+		})
+	}
+}
+
+func TestWatchHandler(t *testing.T) {
+	server := setupServer(t)
+	events := make(chan engine.Event, 3)
+	server.storage = MockStorage{data: make(map[string]engine.Record), events: events}
+	events <- engine.Event{Type: engine.EventSet, Record: engine.Record{Key: "key1", Value: []byte("value1"), Version: 1}}
+	events <- engine.Event{Type: engine.EventExpired, Record: engine.Record{Key: "key1", Version: 2}}
+	events <- engine.Event{Type: engine.EventOverflow}
+	close(events)
+
+	rr := httptest.NewRecorder()
+	req, err := http.NewRequest("GET", "/watch?prefix=key", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := http.HandlerFunc(server.WatchHandler)
+	handler.ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusOK {
+		t.Errorf("handler returned wrong status code: got %v want %v",
+			status, http.StatusOK)
+	}
+	if ct := rr.Header().Get("Content-Type"); ct != "text/event-stream" {
+		t.Errorf("handler returned wrong content type: %s", ct)
+	}
+	expected := "event: set\ndata: {\"key\":\"key1\",\"version\":1}\n\n" +
+		"event: expired\ndata: {\"key\":\"key1\",\"version\":2}\n\n" +
+		"event: overflow\ndata: {}\n\n"
+	if rr.Body.String() != expected {
+		t.Errorf("handler returned unexpected body: got %#v want %#v",
+			rr.Body.String(), expected)
+	}
+}
+
+func TestChangesHandler(t *testing.T) {
+	testData := []struct {
+		name           string
+		query          string
+		err            error
+		expectedStatus int
+		expectedBody   string
+	}{
+		{
+			name:           "changes",
+			query:          "since=4",
+			expectedStatus: http.StatusOK,
+			expectedBody: "id: 5\nevent: set\ndata: {\"value\":\"dmFsdWUx\",\"key\":\"key1\",\"version\":1}\n\n" +
+				"id: 6\nevent: delete\ndata: {\"key\":\"key1\",\"version\":2}\n\n",
+		},
+		{name: "compacted", query: "since=1", err: engine.ErrCompacted, expectedStatus: http.StatusGone},
+		{name: "wrong sequence number", query: "since=first", expectedStatus: http.StatusBadRequest},
+	}
+	for _, td := range testData {
+		t.Run(td.name, func(t *testing.T) {
+			server := setupServer(t)
+			events := make(chan engine.Event, 2)
+			server.storage = MockStorage{data: make(map[string]engine.Record), events: events, err: td.err}
+			events <- engine.Event{Type: engine.EventSet, Record: engine.Record{Key: "key1", Value: []byte("value1"), Version: 1}, Seq: 5}
+			events <- engine.Event{Type: engine.EventDelete, Record: engine.Record{Key: "key1", Version: 2}, Seq: 6}
+			close(events)
+
+			rr := httptest.NewRecorder()
+			req, err := http.NewRequest("GET", "/changes?"+td.query, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			handler := http.HandlerFunc(server.ChangesHandler)
+			handler.ServeHTTP(rr, req)
+
+			if status := rr.Code; status != td.expectedStatus {
+				t.Errorf("handler returned wrong status code: got %v want %v",
+					status, td.expectedStatus)
+			}
+			if td.expectedBody != "" && rr.Body.String() != td.expectedBody {
+				t.Errorf("handler returned unexpected body: got %#v want %#v",
+					rr.Body.String(), td.expectedBody)
+			}
+		})
+	}
+}
+
+func TestReplicationHandlers(t *testing.T) {
+	server := setupServer(t)
+	server.storage = MockStorage{data: map[string]engine.Record{
+		"key1": {Key: "key1", Value: []byte("value1"), Version: 3},
+	}}
+
+	rr := httptest.NewRecorder()
+	req, err := http.NewRequest("GET", "/replication/status", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	http.HandlerFunc(server.ReplicationStatusHandler).ServeHTTP(rr, req)
+	expected := "{\"role\":\"leader\",\"seq\":3,\"lag_seq\":0,\"lag_seconds\":0}\n"
+	if rr.Code != http.StatusOK || rr.Body.String() != expected {
+		t.Errorf("handler returned unexpected response: got %d %#v want %#v", rr.Code, rr.Body.String(), expected)
+	}
+
+	// only a follower can be promoted
+	rr = httptest.NewRecorder()
+	req, err = http.NewRequest("POST", "/replication/promote", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	http.HandlerFunc(server.PromoteHandler).ServeHTTP(rr, req)
+	if rr.Code != http.StatusConflict {
+		t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusConflict)
+	}
+
+	rr = httptest.NewRecorder()
+	req, err = http.NewRequest("GET", "/replication/dump", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	http.HandlerFunc(server.DumpHandler).ServeHTTP(rr, req)
+	var dump engine.Dump
+	if err := json.Unmarshal(rr.Body.Bytes(), &dump); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if dump.Seq != 3 || string(dump.Records["key1"].Value) != "value1" {
+		t.Errorf("unexpected dump: %v", dump)
+	}
+}
+
+func TestServerTimeouts(t *testing.T) {
+	log, err := zap.NewProduction()
+	if err != nil {
+		t.Errorf("error on logger init: %s", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events := make(chan engine.Event, 1)
+	storage := MockStorage{data: map[string]engine.Record{
+		"key1": {Key: "key1", Value: []byte("value1"), Version: 1},
+	}, events: events}
+	s := New(ctx, log.Sugar(), storage, config.Config{Replication: config.Replication{Token: "secret"}})
+	s.WriteTimeout = 100 * time.Millisecond
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(l)
+	defer s.Close()
+	url := "http://" + l.Addr().String()
+
+	// the stream outlives the write deadline of the server, events keep coming after it has passed
+	resp, err := http.Get(url + "/watch")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer resp.Body.Close()
+	stream := bufio.NewReader(resp.Body)
+	for version := uint64(2); version < 5; version++ {
+		time.Sleep(s.WriteTimeout)
+		events <- engine.Event{Type: engine.EventSet, Record: engine.Record{Key: "key1", Version: version}}
+		line, err := stream.ReadString('\n')
+		if err != nil || line != "event: set\n" {
+			t.Fatalf("unexpected stream: %#v, %v", line, err)
+		}
+		// data and the empty line
+		for i := 0; i < 2; i++ {
+			if _, err := stream.ReadString('\n'); err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+		}
+	}
+
+	tests := []struct {
+		name          string
+		path          string
+		authorization string
+		status        int
+	}{
+		{"dump without token", "/replication/dump", "", http.StatusUnauthorized},
+		{"dump with wrong token", "/replication/dump", "Bearer wrong", http.StatusUnauthorized},
+		{"dump with token", "/replication/dump", "Bearer secret", http.StatusOK},
+		{"changes without token", "/changes", "", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest("GET", url+tt.path, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.authorization != "" {
+				req.Header.Set("Authorization", tt.authorization)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != tt.status {
+				t.Errorf("unexpected status code: got %d want %d", resp.StatusCode, tt.status)
+			}
+		})
+	}
+}
+
+func TestConns(t *testing.T) {
+	c := newConns()
+	// both ends of pipes have the same address
+	conn1, peer1 := net.Pipe()
+	defer peer1.Close()
+	conn2, peer2 := net.Pipe()
+	defer peer2.Close()
+
+	c.track(conn1, http.StateNew)
+	c.track(conn2, http.StateNew)
+	c.track(conn1, http.StateActive)
+	c.track(conn1, http.StateClosed)
+	if _, ok := c.conns[conn2]; !ok || len(c.conns) != 1 {
+		t.Errorf("expected only the second connection to be kept, got %v", c.conns)
+	}
+	c.track(conn2, http.StateHijacked)
+	if len(c.conns) != 0 {
+		t.Errorf("expected no connections, got %v", c.conns)
+	}
+}
@@ -0,0 +1,61 @@
+package api
+
+import (
+	"crypto/subtle"
+	"net/http"
+
+	"github.com/go-chi/render"
+
+	"github.com/filatovw/ni-storage/replication"
+)
+
+// replicated is a storage of a follower
+type replicated interface {
+	Status() replication.Status
+	Promote() error
+}
+
+// authorized lets through requests with the replication token in Authorization header: "Bearer <token>".
+// 401 Unauthorized is returned otherwise, all requests are let through when there is no token.
+func (s *Server) authorized(next http.Handler) http.Handler {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		if s.token != "" && subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+s.token)) != 1 {
+			render.Status(r, http.StatusUnauthorized)
+			render.JSON(w, r, http.StatusText(http.StatusUnauthorized))
+			return
+		}
+		next.ServeHTTP(w, r)
+	}
+	return http.HandlerFunc(fn)
+}
+
+// DumpHandler returns all records along with the sequence number of the last change (GET /replication/dump)
+// A follower restores records from the dump when the changes it needs are compacted.
+func (s *Server) DumpHandler(w http.ResponseWriter, r *http.Request) {
+	render.JSON(w, r, s.storage.Dump())
+}
+
+// ReplicationStatusHandler returns role of the node and lag of a follower (GET /replication/status)
+func (s *Server) ReplicationStatusHandler(w http.ResponseWriter, r *http.Request) {
+	if follower, ok := s.storage.(replicated); ok {
+		render.JSON(w, r, follower.Status())
+		return
+	}
+	render.JSON(w, r, replication.Status{Role: replication.RoleLeader, Seq: s.storage.Seq()})
+}
+
+// PromoteHandler stops replication and makes a follower accept writes (POST /replication/promote)
+// 409 Conflict is returned when the node isn't a follower.
+func (s *Server) PromoteHandler(w http.ResponseWriter, r *http.Request) {
+	follower, ok := s.storage.(replicated)
+	if !ok {
+		render.Status(r, http.StatusConflict)
+		render.JSON(w, r, http.StatusText(http.StatusConflict))
+		return
+	}
+	if err := follower.Promote(); err != nil {
+		s.renderError(w, r, err)
+		return
+	}
+	render.JSON(w, r, follower.Status())
+}
@@ -15,6 +15,15 @@ import (
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
+const (
+	// requestTimeout limits processing of a request, except streaming ones
+	requestTimeout = 15 * time.Second
+	// writeTimeout limits writing of a response, except streaming ones
+	writeTimeout = 15 * time.Second
+	// dumpTimeout limits a dump of all records, it may take longer than other requests
+	dumpTimeout = 5 * time.Minute
+)
+
 func New(ctx context.Context, log logger.Logger, storage engine.Storage, cfg config.Config) *http.Server {
 	mux := chi.NewRouter()
 	mux.Use(render.SetContentType(render.ContentTypeJSON))
@@ -26,9 +35,28 @@ func New(ctx context.Context, log logger.Logger, storage engine.Storage, cfg con
 	mux.Handle("/health", HealthHandler(log))
 	mux.Handle("/metrics", promhttp.Handler())
 
-	server := Server{storage: storage, log: log}
+	server := Server{storage: storage, log: log, token: cfg.Replication.Token}
+	conns := newConns()
 
+	// responses of /watch and /changes are endless, so they have no write deadline
+	mux.With(conns.writeTimeout(0)).Get("/watch", server.WatchHandler)
+	mux.With(conns.writeTimeout(0), server.authorized).Get("/changes", server.ChangesHandler)
+	mux.Route("/replication", func(mux chi.Router) {
+		mux.With(middleware.Timeout(dumpTimeout), conns.writeTimeout(dumpTimeout), server.authorized).Get("/dump", server.DumpHandler)
+		mux.With(middleware.Timeout(requestTimeout)).Get("/status", server.ReplicationStatusHandler)
+		mux.With(middleware.Timeout(requestTimeout)).Post("/promote", server.PromoteHandler)
+	})
+	mux.Route("/cluster", func(mux chi.Router) {
+		mux.Use(middleware.Timeout(requestTimeout))
+		mux.Get("/members", server.MembersHandler)
+		mux.With(server.toLeader).Post("/members", server.JoinHandler)
+		mux.With(server.toLeader).Delete("/members/{id}", server.LeaveHandler)
+		mux.With(server.toLeader).Get("/read-index", server.ReadIndexHandler)
+	})
+	mux.With(middleware.Timeout(requestTimeout), server.consistent).Post("/batch", server.BatchHandler)
 	mux.Route("/keys", func(mux chi.Router) {
+		mux.Use(middleware.Timeout(requestTimeout))
+		mux.Use(server.consistent)
 		mux.Get("/", server.GetAllHandler)
 		mux.Delete("/", server.DeleteAllHandler)
 		mux.Put("/", server.SetMultipleHandler)
@@ -37,14 +65,18 @@ func New(ctx context.Context, log logger.Logger, storage engine.Storage, cfg con
 			mux.Put("/", server.SetHandler) // setting {id} in url seems more logical to me
 			mux.Head("/", server.CheckHandler)
 			mux.Delete("/", server.DeleteHandler)
+			mux.Get("/ttl", server.GetTTLHandler)
+			mux.Put("/ttl", server.SetTTLHandler)
+			mux.Delete("/ttl", server.PersistHandler)
 		})
 	})
 	s := &http.Server{
 		Addr:         cfg.HTTPServer.Address(),
 		ReadTimeout:  15 * time.Second,
-		WriteTimeout: 15 * time.Second,
+		WriteTimeout: writeTimeout,
 		IdleTimeout:  30 * time.Second,
 		Handler:      mux,
+		ConnState:    conns.track,
 	}
 	return s
 }
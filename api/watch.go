@@ -0,0 +1,150 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/filatovw/ni-storage/engine"
+	"github.com/filatovw/ni-storage/replication"
+	"github.com/go-chi/render"
+)
+
+const (
+	// keepAlivePeriod is a period between comments sent to idle watchers, so proxies don't close the connection
+	keepAlivePeriod = 15 * time.Second
+	// heartbeatPeriod is a period between heartbeats sent to readers of changes, followers measure their lag with them
+	heartbeatPeriod = time.Second
+)
+
+// watchEvent is data of a server-sent event
+type watchEvent struct {
+	Key            string     `json:"key,omitempty"`
+	Version        uint64     `json:"version,omitempty"`
+	ExpirationTime *time.Time `json:"expiration_time,omitempty"`
+}
+
+// writeEvent writes event in text/event-stream format
+func writeEvent(w http.ResponseWriter, e engine.Event) error {
+	data, err := json.Marshal(watchEvent{
+		Key:            e.Record.Key,
+		Version:        e.Record.Version,
+		ExpirationTime: e.Record.ExpirationTime,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.Type, data)
+	return err
+}
+
+// writeChange writes change with its sequence number as id and the whole record as data
+func writeChange(w http.ResponseWriter, e engine.Event) error {
+	if e.Type == engine.EventOverflow {
+		return writeEvent(w, e)
+	}
+	data, err := json.Marshal(e.Record)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", e.Seq, e.Type, data)
+	return err
+}
+
+// writeKeepAlive writes comment which is ignored by clients
+func writeKeepAlive(w http.ResponseWriter) error {
+	_, err := fmt.Fprint(w, ": keep-alive\n\n")
+	return err
+}
+
+// writeHeartbeat writes the last sequence number of the storage
+func (s *Server) writeHeartbeat(w http.ResponseWriter) error {
+	data, err := json.Marshal(replication.Heartbeat{Seq: s.storage.Seq()})
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", replication.EventHeartbeat, data)
+	return err
+}
+
+// stream sends events as server-sent events until the channel is closed or the client is gone.
+// Idle stream gets keepAlive every period.
+func (s *Server) stream(w http.ResponseWriter, r *http.Request, flusher http.Flusher, events <-chan engine.Event,
+	write func(http.ResponseWriter, engine.Event) error, keepAlive func(http.ResponseWriter) error, period time.Duration) {
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	t := time.NewTicker(period)
+	defer t.Stop()
+	for {
+		select {
+		case e, ok := <-events:
+			if !ok {
+				return
+			}
+			if err := write(w, e); err != nil {
+				s.log.Debugf("watcher is gone: %s", err)
+				return
+			}
+			flusher.Flush()
+		case <-t.C:
+			if err := keepAlive(w); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// WatchHandler streams changes of values as server-sent events (GET /watch?prefix=user:)
+// Event is one of: set, delete, expired. A watcher which falls behind gets overflow event and the stream is closed,
+// so it has to reload the values it's interested in and watch again.
+func (s *Server) WatchHandler(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		render.Status(r, http.StatusNotImplemented)
+		render.JSON(w, r, http.StatusText(http.StatusNotImplemented))
+		return
+	}
+	events := s.storage.Watch(r.Context(), r.URL.Query().Get("prefix"))
+	s.stream(w, r, flusher, events, writeEvent, writeKeepAlive, keepAlivePeriod)
+}
+
+// ChangesHandler streams stored changes after the given sequence number and then new ones (GET /changes?since=42)
+// Every change has its sequence number as id, so a reader resumes with since or Last-Event-ID header.
+// 410 Gone is returned when the requested changes are compacted, the reader has to reload values then.
+// Every second the stream gets heartbeat event with the last sequence number of the storage.
+func (s *Server) ChangesHandler(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		render.Status(r, http.StatusNotImplemented)
+		render.JSON(w, r, http.StatusText(http.StatusNotImplemented))
+		return
+	}
+	sinceParam := r.URL.Query().Get("since")
+	if sinceParam == "" {
+		sinceParam = r.Header.Get("Last-Event-ID")
+	}
+	var since uint64
+	if sinceParam != "" {
+		var err error
+		since, err = strconv.ParseUint(sinceParam, 10, 64)
+		if err != nil {
+			render.Status(r, http.StatusBadRequest)
+			render.JSON(w, r, http.StatusText(http.StatusBadRequest))
+			return
+		}
+	}
+	events, err := s.storage.Changes(r.Context(), since)
+	if err != nil {
+		s.renderError(w, r, err)
+		return
+	}
+	s.stream(w, r, flusher, events, writeChange, s.writeHeartbeat, heartbeatPeriod)
+}
@@ -0,0 +1,204 @@
+package client
+
+// Client of the HTTP API of the storage.
+// Reads and unconditional deletes (Get, Exists, List, Filter, TTL, Delete and Persist without conditions) which fail
+// with a network error, 502, 503 or 504 are retried with exponential backoff until the context is done. Other writes
+// are sent once, since a retry of a write which was applied could extend a lifetime or fail its own condition,
+// so the caller decides if such a write is sent again. Connections are kept alive and shared by requests of a client,
+// so a client is created once and used concurrently. Writes sent to a node of a cluster follow the redirect to the leader.
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultRetries      = 3
+	defaultMinBackoff   = 100 * time.Millisecond
+	defaultMaxBackoff   = 2 * time.Second
+	defaultMaxIdleConns = 64
+)
+
+// Client of a storage
+type Client struct {
+	url          string
+	http         *http.Client
+	retries      int
+	minBackoff   time.Duration
+	maxBackoff   time.Duration
+	maxIdleConns int
+}
+
+// Option configures a client
+type Option func(*Client)
+
+// WithHTTPClient makes the client send requests with the given HTTP client instead of its own pool of connections
+func WithHTTPClient(c *http.Client) Option {
+	return func(client *Client) {
+		client.http = c
+	}
+}
+
+// WithRetries sets a number of retries of a failed read or unconditional delete, 0 disables retries (default: 3)
+func WithRetries(n int) Option {
+	return func(client *Client) {
+		client.retries = n
+	}
+}
+
+// WithBackoff sets the delay before the first retry, it's doubled on every next retry up to max (default: 100ms, 2s)
+func WithBackoff(min, max time.Duration) Option {
+	return func(client *Client) {
+		client.minBackoff = min
+		client.maxBackoff = max
+	}
+}
+
+// WithMaxIdleConns sets a number of idle connections kept for reuse (default: 64)
+func WithMaxIdleConns(n int) Option {
+	return func(client *Client) {
+		client.maxIdleConns = n
+	}
+}
+
+// New creates a client of the API server with the given URL, e.g. http://127.0.0.1:8555
+func New(serverURL string, opts ...Option) *Client {
+	c := &Client{
+		url:          strings.TrimRight(serverURL, "/"),
+		retries:      defaultRetries,
+		minBackoff:   defaultMinBackoff,
+		maxBackoff:   defaultMaxBackoff,
+		maxIdleConns: defaultMaxIdleConns,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	if c.http == nil {
+		c.http = &http.Client{Transport: newTransport(c.maxIdleConns)}
+	}
+	return c
+}
+
+// newTransport is http.DefaultTransport which keeps more idle connections to a server
+func newTransport(maxIdleConns int) *http.Transport {
+	return &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		MaxIdleConns:          maxIdleConns,
+		MaxIdleConnsPerHost:   maxIdleConns,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: time.Second,
+	}
+}
+
+// request to the API, it's built anew for every attempt
+type request struct {
+	method string
+	// path is escaped
+	path   string
+	query  url.Values
+	header http.Header
+	body   []byte
+}
+
+// idempotent tells if the request may be sent again without changing its result
+func (r request) idempotent() bool {
+	switch r.method {
+	case http.MethodGet, http.MethodHead:
+		return true
+	case http.MethodDelete:
+		return r.header.Get("If-Match") == "" && r.header.Get("If-None-Match") == ""
+	}
+	return false
+}
+
+// retryable tells if a request may succeed when it's sent again
+func retryable(code int) bool {
+	return code == http.StatusBadGateway || code == http.StatusServiceUnavailable || code == http.StatusGatewayTimeout
+}
+
+// do sends a request until it succeeds or retries are used up, only idempotent requests are retried. Responses with status codes from 200 to 299 are returned
+// and the others are turned into errors
+func (c *Client) do(ctx context.Context, req request) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		resp, err := c.send(ctx, req)
+		if err == nil {
+			if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+				return resp, nil
+			}
+			discard(resp)
+			err = errorFromStatus(resp.StatusCode)
+			if !retryable(resp.StatusCode) {
+				return nil, err
+			}
+		}
+		if attempt >= c.retries || ctx.Err() != nil || !req.idempotent() {
+			return nil, err
+		}
+		if err := c.wait(ctx, attempt); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (c *Client) send(ctx context.Context, req request) (*http.Response, error) {
+	u := c.url + req.path
+	if len(req.query) > 0 {
+		u += "?" + req.query.Encode()
+	}
+	var body io.Reader
+	if req.body != nil {
+		body = bytes.NewReader(req.body)
+	}
+	r, err := http.NewRequest(req.method, u, body)
+	if err != nil {
+		return nil, errors.Wrap(err, "create request")
+	}
+	for k, v := range req.header {
+		r.Header[k] = v
+	}
+	resp, err := c.http.Do(r.WithContext(ctx))
+	if err != nil {
+		return nil, errors.Wrapf(err, "%s %s", req.method, req.path)
+	}
+	return resp, nil
+}
+
+// wait sleeps before a retry, the delay grows exponentially with jitter, so clients don't retry all at once
+func (c *Client) wait(ctx context.Context, attempt int) error {
+	delay := c.minBackoff << uint(attempt)
+	if delay > c.maxBackoff || delay <= 0 {
+		delay = c.maxBackoff
+	}
+	if delay > 0 {
+		delay = delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+	}
+	t := time.NewTimer(delay)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// discard reads the rest of a response, so its connection is reused
+func discard(resp *http.Response) {
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+}
@@ -0,0 +1,276 @@
+package client_test
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/filatovw/ni-storage/api"
+	"github.com/filatovw/ni-storage/client"
+	"github.com/filatovw/ni-storage/config"
+	"github.com/filatovw/ni-storage/internal/storagetest"
+)
+
+// startServer serves the storage with the API
+func startServer(t *testing.T, storage *storagetest.Storage) (*httptest.Server, func()) {
+	server := httptest.NewServer(api.New(storage.Ctx, storage.Log, storage.Service, config.Config{}).Handler)
+	return server, func() {
+		server.Close()
+		storage.Close()
+	}
+}
+
+func TestKeys(t *testing.T) {
+	server, stop := startServer(t, storagetest.New(t))
+	defer stop()
+	c := client.New(server.URL)
+	ctx := context.TODO()
+
+	if _, err := c.Get(ctx, "key1"); err != client.ErrNotFound {
+		t.Errorf("expected %s, got %v", client.ErrNotFound, err)
+	}
+	if ok, err := c.Exists(ctx, "key1"); ok || err != nil {
+		t.Errorf("expected missing key, got %t, %v", ok, err)
+	}
+	if err := c.Set(ctx, "key1", []byte("value1"), client.WithContentType("text/plain")); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	item, err := c.Get(ctx, "key1")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if item.Key != "key1" || string(item.Value) != "value1" || item.ContentType != "text/plain" || item.Version == 0 {
+		t.Errorf("unexpected item: %+v", item)
+	}
+	if ok, err := c.Exists(ctx, "key1"); !ok || err != nil {
+		t.Errorf("expected existing key, got %t, %v", ok, err)
+	}
+
+	tests := []struct {
+		name string
+		key  string
+		opts []client.WriteOption
+		err  error
+	}{
+		{name: "absent key is required", key: "key1", opts: []client.WriteOption{client.IfAbsent()}, err: client.ErrPreconditionFailed},
+		{name: "stale version", key: "key1", opts: []client.WriteOption{client.IfVersion(item.Version + 100)}, err: client.ErrPreconditionFailed},
+		{name: "current version", key: "key1", opts: []client.WriteOption{client.IfVersion(item.Version)}},
+		{name: "missing key", key: "key2", opts: []client.WriteOption{client.IfExists()}, err: client.ErrPreconditionFailed},
+		{name: "new key", key: "key2", opts: []client.WriteOption{client.IfAbsent(), client.WithTTL(90 * time.Second)}},
+		{name: "key with spaces", key: "key 3", opts: []client.WriteOption{client.WithSlidingTTL(time.Minute)}},
+	}
+	for _, tt := range tests {
+		if err := c.Set(ctx, tt.key, []byte("value"), tt.opts...); err != tt.err {
+			t.Errorf("%s: expected %v, got %v", tt.name, tt.err, err)
+		}
+	}
+	if item, err := c.Get(ctx, "key 3"); err != nil || string(item.Value) != "value" {
+		t.Errorf("unexpected item %+v, error %v", item, err)
+	}
+
+	if ttl, err := c.TTL(ctx, "key2"); err != nil || ttl != 90*time.Second {
+		t.Errorf("expected TTL 90s, got %s, %v", ttl, err)
+	}
+	if err := c.Expire(ctx, "key2", 10*time.Second); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	if ttl, err := c.TTL(ctx, "key2"); err != nil || ttl != 10*time.Second {
+		t.Errorf("expected TTL 10s, got %s, %v", ttl, err)
+	}
+	if err := c.Persist(ctx, "key2"); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	if ttl, err := c.TTL(ctx, "key2"); err != nil || ttl != 0 {
+		t.Errorf("expected permanent value, got %s, %v", ttl, err)
+	}
+	if err := c.Expire(ctx, "missing", time.Second); err != client.ErrNotFound {
+		t.Errorf("expected %s, got %v", client.ErrNotFound, err)
+	}
+
+	if err := c.Delete(ctx, "key2", client.IfVersion(1000)); err != client.ErrPreconditionFailed {
+		t.Errorf("expected %s, got %v", client.ErrPreconditionFailed, err)
+	}
+	if err := c.Delete(ctx, "key2"); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	if ok, _ := c.Exists(ctx, "key2"); ok {
+		t.Errorf("expected key2 to be deleted")
+	}
+}
+
+func TestList(t *testing.T) {
+	server, stop := startServer(t, storagetest.New(t))
+	defer stop()
+	c := client.New(server.URL)
+	ctx := context.TODO()
+
+	values := map[string]string{"user:1": "alice", "user:2": "bob", "user:10": "carol", "word": "polar", "world": "bear"}
+	if err := c.SetMany(ctx, values, client.WithTTL(time.Minute)); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if ttl, err := c.TTL(ctx, "word"); err != nil || ttl != time.Minute {
+		t.Errorf("expected TTL 1m, got %s, %v", ttl, err)
+	}
+
+	tests := []struct {
+		name string
+		opts client.ListOptions
+		keys []string
+	}{
+		{name: "all", keys: []string{"user:1", "user:10", "user:2", "word", "world"}},
+		{name: "prefix", opts: client.ListOptions{Prefix: "user:"}, keys: []string{"user:1", "user:10", "user:2"}},
+		{name: "range", opts: client.ListOptions{Start: "user:10", End: "word"}, keys: []string{"user:10", "user:2"}},
+	}
+	for _, tt := range tests {
+		keys, cursor, err := c.List(ctx, tt.opts)
+		if err != nil || cursor != "" || !reflect.DeepEqual(keys, tt.keys) {
+			t.Errorf("%s: expected %v, got %v, cursor %q, error %v", tt.name, tt.keys, keys, cursor, err)
+		}
+	}
+
+	// pages are followed by cursors
+	pages := [][]string{}
+	opts := client.ListOptions{Limit: 2}
+	for {
+		keys, cursor, err := c.List(ctx, opts)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		pages = append(pages, keys)
+		if cursor == "" {
+			break
+		}
+		opts.Cursor = cursor
+	}
+	expected := [][]string{{"user:1", "user:10"}, {"user:2", "word"}, {"world"}}
+	if !reflect.DeepEqual(pages, expected) {
+		t.Errorf("expected %v, got %v", expected, pages)
+	}
+
+	if keys, err := c.Filter(ctx, "wo$d", ""); err != nil || !reflect.DeepEqual(keys, []string{"word", "world"}) {
+		t.Errorf("unexpected keys %v, error %v", keys, err)
+	}
+	if keys, err := c.Filter(ctx, "user:$", "$o$"); err != nil || !reflect.DeepEqual(keys, []string{"user:10", "user:2"}) {
+		t.Errorf("unexpected keys %v, error %v", keys, err)
+	}
+}
+
+func TestRetries(t *testing.T) {
+	server, stop := startServer(t, storagetest.New(t))
+	defer stop()
+
+	// the first requests fail as if the storage restarts
+	var requests, failures int32
+	flaky := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		if atomic.AddInt32(&failures, -1) >= 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		r.URL.Scheme = "http"
+		r.URL.Host = server.Listener.Addr().String()
+		r.RequestURI = ""
+		resp, err := http.DefaultTransport.RoundTrip(r)
+		if err != nil {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		defer resp.Body.Close()
+		for k, v := range resp.Header {
+			w.Header()[k] = v
+		}
+		w.WriteHeader(resp.StatusCode)
+		io.Copy(w, resp.Body)
+	}))
+	defer flaky.Close()
+
+	if err := client.New(server.URL).Set(context.TODO(), "key1", []byte("value1")); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	get := func(c *client.Client) error {
+		_, err := c.Get(context.TODO(), "key1")
+		return err
+	}
+	tests := []struct {
+		name     string
+		call     func(c *client.Client) error
+		retries  int
+		failures int32
+		requests int32
+		err      error
+	}{
+		{name: "no failures", call: get, retries: 3, failures: 0, requests: 1},
+		{name: "recovered", call: get, retries: 3, failures: 2, requests: 3},
+		{name: "retries are used up", call: get, retries: 3, failures: 10, requests: 4, err: client.ErrUnavailable},
+		{name: "no retries", call: get, retries: 0, failures: 1, requests: 1, err: client.ErrUnavailable},
+		{
+			name: "set is sent once",
+			call: func(c *client.Client) error {
+				return c.Set(context.TODO(), "key1", []byte("value1"), client.WithTTL(time.Minute))
+			},
+			retries: 3, failures: 1, requests: 1, err: client.ErrUnavailable,
+		},
+		{
+			name: "conditional delete is sent once",
+			call: func(c *client.Client) error {
+				return c.Delete(context.TODO(), "key1", client.IfExists())
+			},
+			retries: 3, failures: 1, requests: 1, err: client.ErrUnavailable,
+		},
+		{
+			name: "unconditional delete is retried",
+			call: func(c *client.Client) error {
+				return c.Delete(context.TODO(), "key1")
+			},
+			retries: 3, failures: 2, requests: 3,
+		},
+	}
+	for _, tt := range tests {
+		atomic.StoreInt32(&requests, 0)
+		atomic.StoreInt32(&failures, tt.failures)
+		c := client.New(flaky.URL, client.WithRetries(tt.retries), client.WithBackoff(time.Millisecond, 5*time.Millisecond))
+		if err := tt.call(c); err != tt.err {
+			t.Errorf("%s: expected %v, got %v", tt.name, tt.err, err)
+		}
+		if n := atomic.LoadInt32(&requests); n != tt.requests {
+			t.Errorf("%s: expected %d requests, got %d", tt.name, tt.requests, n)
+		}
+	}
+
+	// retries stop when the context is done
+	atomic.StoreInt32(&failures, 1000)
+	c := client.New(flaky.URL, client.WithRetries(1000), client.WithBackoff(10*time.Millisecond, 10*time.Millisecond))
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	t1 := time.Now()
+	if _, err := c.Get(ctx, "key1"); err == nil {
+		t.Errorf("expected an error")
+	}
+	if d := time.Since(t1); d > time.Second {
+		t.Errorf("expected retries to stop with the context, they took %s", d)
+	}
+
+	// the server is unreachable
+	c = client.New("http://127.0.0.1:1", client.WithRetries(1), client.WithBackoff(time.Millisecond, time.Millisecond))
+	if _, err := c.Get(context.TODO(), "key1"); err == nil {
+		t.Errorf("expected an error")
+	}
+}
+
+func TestReadOnly(t *testing.T) {
+	server, stop := startServer(t, storagetest.NewReadOnly(t))
+	defer stop()
+	c := client.New(server.URL)
+
+	if item, err := c.Get(context.TODO(), "key1"); err != nil || string(item.Value) != "value1" || item.Version != 1 {
+		t.Errorf("unexpected item %+v, error %v", item, err)
+	}
+	if err := c.Set(context.TODO(), "key1", []byte("value2")); err != client.ErrReadOnly {
+		t.Errorf("expected %s, got %v", client.ErrReadOnly, err)
+	}
+}
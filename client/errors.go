@@ -0,0 +1,52 @@
+package client
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	// ErrBadRequest is returned on 400 Bad Request
+	ErrBadRequest = errors.New("bad request")
+	// ErrReadOnly is returned on 403 Forbidden, writes are sent to a follower which replicates a leader
+	ErrReadOnly = errors.New("storage is read-only")
+	// ErrNotFound is returned on 404 Not Found
+	ErrNotFound = errors.New("key not found")
+	// ErrPreconditionFailed is returned on 412 Precondition Failed, the condition of a write doesn't hold
+	ErrPreconditionFailed = errors.New("precondition failed")
+	// ErrTooLarge is returned on 413 Request Entity Too Large, a value exceeds the size limit of a record
+	ErrTooLarge = errors.New("value is too large")
+	// ErrUnavailable is returned on 503 Service Unavailable, the storage is shutting down or a cluster has no leader
+	ErrUnavailable = errors.New("storage is unavailable")
+	// ErrNoSpace is returned on 507 Insufficient Storage, the disk of the storage is full
+	ErrNoSpace = errors.New("no space left on the storage")
+)
+
+var statusErrors = map[int]error{
+	http.StatusBadRequest:            ErrBadRequest,
+	http.StatusForbidden:             ErrReadOnly,
+	http.StatusNotFound:              ErrNotFound,
+	http.StatusPreconditionFailed:    ErrPreconditionFailed,
+	http.StatusRequestEntityTooLarge: ErrTooLarge,
+	http.StatusServiceUnavailable:    ErrUnavailable,
+	http.StatusInsufficientStorage:   ErrNoSpace,
+}
+
+// StatusError is returned on a status code which has no error of its own
+type StatusError struct {
+	StatusCode int
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("unexpected status %d %s", e.StatusCode, http.StatusText(e.StatusCode))
+}
+
+// errorFromStatus maps an unsuccessful status code to an error
+func errorFromStatus(code int) error {
+	if err, ok := statusErrors[code]; ok {
+		return err
+	}
+	return &StatusError{StatusCode: code}
+}
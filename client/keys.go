@@ -0,0 +1,324 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// nextCursorHeader holds the cursor of the next page of keys
+const nextCursorHeader = "X-Next-Cursor"
+
+// Item is a stored value
+type Item struct {
+	Key   string
+	Value []byte
+	// ContentType of the value, it's application/octet-stream for values stored without it
+	ContentType string
+	// Version is changed on every write of the value
+	Version uint64
+}
+
+// WriteOption configures a write
+type WriteOption func(*writeOptions)
+
+type writeOptions struct {
+	ttl         time.Duration
+	sliding     bool
+	contentType string
+	ifMatch     string
+	ifNoneMatch string
+}
+
+// WithTTL makes a value expire after the period, it's rounded up to seconds
+func WithTTL(ttl time.Duration) WriteOption {
+	return func(o *writeOptions) {
+		o.ttl = ttl
+	}
+}
+
+// WithSlidingTTL makes a value expire after the period of inactivity, every read prolongs it
+func WithSlidingTTL(ttl time.Duration) WriteOption {
+	return func(o *writeOptions) {
+		o.ttl = ttl
+		o.sliding = true
+	}
+}
+
+// WithContentType stores a MIME type along with a value
+func WithContentType(contentType string) WriteOption {
+	return func(o *writeOptions) {
+		o.contentType = contentType
+	}
+}
+
+// IfVersion makes a write fail with ErrPreconditionFailed unless the value has the version
+func IfVersion(version uint64) WriteOption {
+	return func(o *writeOptions) {
+		o.ifMatch = strconv.Quote(strconv.FormatUint(version, 10))
+	}
+}
+
+// IfExists makes a write fail with ErrPreconditionFailed unless the key exists
+func IfExists() WriteOption {
+	return func(o *writeOptions) {
+		o.ifMatch = "*"
+	}
+}
+
+// IfAbsent makes a write fail with ErrPreconditionFailed when the key exists
+func IfAbsent() WriteOption {
+	return func(o *writeOptions) {
+		o.ifNoneMatch = "*"
+	}
+}
+
+func newWriteOptions(opts []WriteOption) writeOptions {
+	o := writeOptions{}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// header of conditions of a write
+func (o writeOptions) header() http.Header {
+	h := http.Header{}
+	if o.ifMatch != "" {
+		h.Set("If-Match", o.ifMatch)
+	}
+	if o.ifNoneMatch != "" {
+		h.Set("If-None-Match", o.ifNoneMatch)
+	}
+	if o.contentType != "" {
+		h.Set("Content-Type", o.contentType)
+	}
+	return h
+}
+
+// seconds rounds a period up to seconds
+func seconds(d time.Duration) int64 {
+	return int64(math.Ceil(d.Seconds()))
+}
+
+func keyPath(key string) string {
+	return "/keys/" + url.PathEscape(key)
+}
+
+// parseETag returns the version of a strong entity tag
+func parseETag(tag string) uint64 {
+	v, err := strconv.Unquote(tag)
+	if err != nil {
+		return 0
+	}
+	version, _ := strconv.ParseUint(v, 10, 64)
+	return version
+}
+
+// Get returns a value, ErrNotFound is returned for a missing key
+func (c *Client) Get(ctx context.Context, key string) (Item, error) {
+	resp, err := c.do(ctx, request{method: http.MethodGet, path: keyPath(key)})
+	if err != nil {
+		return Item{}, err
+	}
+	defer resp.Body.Close()
+	value, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return Item{}, errors.Wrap(err, "read value")
+	}
+	return Item{
+		Key:         key,
+		Value:       value,
+		ContentType: resp.Header.Get("Content-Type"),
+		Version:     parseETag(resp.Header.Get("ETag")),
+	}, nil
+}
+
+// Exists checks if a key exists
+func (c *Client) Exists(ctx context.Context, key string) (bool, error) {
+	resp, err := c.do(ctx, request{method: http.MethodHead, path: keyPath(key)})
+	if err == ErrNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	discard(resp)
+	return true, nil
+}
+
+// Set saves a value, options set its lifetime, content type and conditions
+func (c *Client) Set(ctx context.Context, key string, value []byte, opts ...WriteOption) error {
+	o := newWriteOptions(opts)
+	query := url.Values{}
+	if o.ttl > 0 {
+		query.Set("expire_in", strconv.FormatInt(seconds(o.ttl), 10))
+		if o.sliding {
+			query.Set("sliding", "true")
+		}
+	}
+	if value == nil {
+		value = []byte{}
+	}
+	resp, err := c.do(ctx, request{method: http.MethodPut, path: keyPath(key), query: query, header: o.header(), body: value})
+	if err != nil {
+		return err
+	}
+	discard(resp)
+	return nil
+}
+
+// SetMany saves text values at once, WithTTL is applied to all of them and other options are ignored
+func (c *Client) SetMany(ctx context.Context, values map[string]string, opts ...WriteOption) error {
+	o := newWriteOptions(opts)
+	type record struct {
+		Value    string `json:"value"`
+		ExpireIn *int64 `json:"expire_in,omitempty"`
+	}
+	records := make(map[string]record, len(values))
+	for k, v := range values {
+		r := record{Value: v}
+		if o.ttl > 0 {
+			expireIn := seconds(o.ttl)
+			r.ExpireIn = &expireIn
+		}
+		records[k] = r
+	}
+	body, err := json.Marshal(records)
+	if err != nil {
+		return errors.Wrap(err, "encode values")
+	}
+	header := http.Header{}
+	header.Set("Content-Type", "application/json")
+	resp, err := c.do(ctx, request{method: http.MethodPut, path: "/keys", header: header, body: body})
+	if err != nil {
+		return err
+	}
+	discard(resp)
+	return nil
+}
+
+// Delete removes a value, conditions of options are applied
+func (c *Client) Delete(ctx context.Context, key string, opts ...WriteOption) error {
+	o := newWriteOptions(opts)
+	o.contentType = ""
+	resp, err := c.do(ctx, request{method: http.MethodDelete, path: keyPath(key), header: o.header()})
+	if err != nil {
+		return err
+	}
+	discard(resp)
+	return nil
+}
+
+// ListOptions limits keys of a list, empty fields are not applied
+type ListOptions struct {
+	// Prefix all keys start with
+	Prefix string
+	// Start is the lowest key, inclusive
+	Start string
+	// End is the upper bound of keys, exclusive
+	End string
+	// Limit is the maximal number of keys of a page
+	Limit int
+	// Cursor of the page returned by the previous call
+	Cursor string
+}
+
+// List returns keys in ascending order. When there are more keys than the limit,
+// the cursor of the next page is returned, it's empty for the last page.
+func (c *Client) List(ctx context.Context, opts ListOptions) ([]string, string, error) {
+	query := url.Values{}
+	for k, v := range map[string]string{"prefix": opts.Prefix, "start": opts.Start, "end": opts.End, "cursor": opts.Cursor} {
+		if v != "" {
+			query.Set(k, v)
+		}
+	}
+	if opts.Limit > 0 {
+		query.Set("limit", strconv.Itoa(opts.Limit))
+	}
+	keys := []string{}
+	header, err := c.getJSON(ctx, "/keys", query, &keys)
+	if err != nil {
+		return nil, "", err
+	}
+	return keys, header.Get(nextCursorHeader), nil
+}
+
+// Filter returns sorted keys matching both patterns where $ matches any number of characters,
+// an empty pattern is not applied
+func (c *Client) Filter(ctx context.Context, keyPattern, valuePattern string) ([]string, error) {
+	if keyPattern == "" && valuePattern == "" {
+		return nil, errors.New("no pattern")
+	}
+	query := url.Values{}
+	if keyPattern != "" {
+		query.Set("filter", keyPattern)
+	}
+	if valuePattern != "" {
+		query.Set("value_filter", valuePattern)
+	}
+	keys := []string{}
+	if _, err := c.getJSON(ctx, "/keys", query, &keys); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// TTL returns the remaining lifetime of a value rounded up to seconds, it's 0 for permanent values
+func (c *Client) TTL(ctx context.Context, key string) (time.Duration, error) {
+	resp := struct {
+		ExpireIn *int64 `json:"expire_in"`
+	}{}
+	if _, err := c.getJSON(ctx, keyPath(key)+"/ttl", nil, &resp); err != nil {
+		return 0, err
+	}
+	if resp.ExpireIn == nil {
+		return 0, nil
+	}
+	return time.Duration(*resp.ExpireIn) * time.Second, nil
+}
+
+// Expire changes the lifetime of a value without rewriting it, the period is rounded up to seconds
+func (c *Client) Expire(ctx context.Context, key string, ttl time.Duration) error {
+	query := url.Values{"expire_in": []string{strconv.FormatInt(seconds(ttl), 10)}}
+	resp, err := c.do(ctx, request{method: http.MethodPut, path: keyPath(key) + "/ttl", query: query})
+	if err != nil {
+		return err
+	}
+	discard(resp)
+	return nil
+}
+
+// Persist makes a value permanent
+func (c *Client) Persist(ctx context.Context, key string) error {
+	resp, err := c.do(ctx, request{method: http.MethodDelete, path: keyPath(key) + "/ttl"})
+	if err != nil {
+		return err
+	}
+	discard(resp)
+	return nil
+}
+
+// getJSON decodes a response into v and returns its header
+func (c *Client) getJSON(ctx context.Context, path string, query url.Values, v interface{}) (http.Header, error) {
+	resp, err := c.do(ctx, request{method: http.MethodGet, path: path, query: query})
+	if err != nil {
+		return nil, err
+	}
+	defer discard(resp)
+	if ct := resp.Header.Get("Content-Type"); !strings.HasPrefix(ct, "application/json") {
+		return nil, errors.Errorf("unexpected content type %q", ct)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return nil, errors.Wrap(err, "decode response")
+	}
+	return resp.Header, nil
+}
@@ -0,0 +1,204 @@
+package cluster
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/filatovw/ni-storage/engine"
+	"github.com/hashicorp/raft"
+	"github.com/pkg/errors"
+)
+
+// op is a kind of command
+type op string
+
+const (
+	opSet       op = "set"
+	opDelete    op = "delete"
+	opDeleteAll op = "delete_all"
+	opBatch     op = "batch"
+	opExpire    op = "expire"
+	opPersist   op = "persist"
+	// opEvict removes keys expired by the time of the leader
+	opEvict op = "evict"
+	// opJoin and opLeave keep API URLs of members
+	opJoin  op = "join"
+	opLeave op = "leave"
+)
+
+// command is an entry of the raft log, it's applied by every node in the same order
+type command struct {
+	Op        op               `json:"op"`
+	Record    engine.Record    `json:"record,omitempty"`
+	Condition engine.Condition `json:"condition,omitempty"`
+	Ops       []engine.Op      `json:"ops,omitempty"`
+	Keys      []string         `json:"keys,omitempty"`
+	Time      time.Time        `json:"time,omitempty"`
+	Member    Member           `json:"member,omitempty"`
+	// Now is the time of the leader when the command was proposed, expiration is checked against it
+	Now time.Time `json:"now,omitempty"`
+}
+
+// fsm applies commands to the storage.
+// Nodes apply the same commands to the same state and check expiration against the time of the leader
+// stamped into commands rather than their own clocks, so a node applying a command late or replaying
+// the log after restart gets the same versions and sequence numbers of changes as the others.
+type fsm struct {
+	store Store
+
+	lock *sync.Mutex
+	// urls are API URLs of members by their IDs
+	urls map[string]string
+	// index is the raft index of the last applied command, it's the same on every node unlike sequence numbers
+	// of the storage which start anew when the log is replayed
+	index uint64
+	// applied is closed and replaced after every command
+	applied chan struct{}
+}
+
+func newFSM(store Store) *fsm {
+	return &fsm{
+		store:   store,
+		lock:    &sync.Mutex{},
+		urls:    make(map[string]string),
+		applied: make(chan struct{}),
+	}
+}
+
+// Apply command of the raft log, the result is an error of the command
+func (f *fsm) Apply(l *raft.Log) interface{} {
+	defer f.notify(l.Index)
+	var c command
+	if err := json.Unmarshal(l.Data, &c); err != nil {
+		return errors.Wrapf(err, "decode command %d", l.Index)
+	}
+	// the command is committed, so it's applied regardless of callers
+	ctx := engine.WithTime(context.Background(), c.Now)
+	switch c.Op {
+	case opSet:
+		return f.store.CompareAndSet(ctx, c.Record, c.Condition)
+	case opDelete:
+		return f.store.CompareAndDelete(ctx, c.Record.Key, c.Condition)
+	case opDeleteAll:
+		return f.store.DeleteAll(ctx)
+	case opBatch:
+		return f.store.Batch(ctx, c.Ops)
+	case opExpire:
+		return f.store.Expire(ctx, c.Record.Key, c.Time)
+	case opPersist:
+		return f.store.Persist(ctx, c.Record.Key)
+	case opEvict:
+		return f.store.RemoveExpired(ctx, c.Keys, c.Time)
+	case opJoin:
+		f.lock.Lock()
+		f.urls[c.Member.ID] = c.Member.URL
+		f.lock.Unlock()
+		return nil
+	case opLeave:
+		f.lock.Lock()
+		delete(f.urls, c.Member.ID)
+		f.lock.Unlock()
+		return nil
+	}
+	return errors.Errorf("unknown command %q", c.Op)
+}
+
+// notify wakes up readers waiting for changes
+func (f *fsm) notify(index uint64) {
+	f.lock.Lock()
+	f.index = index
+	close(f.applied)
+	f.applied = make(chan struct{})
+	f.lock.Unlock()
+}
+
+// appliedIndex returns the raft index of the last applied command
+func (f *fsm) appliedIndex() uint64 {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.index
+}
+
+// waitIndex waits until the command with the raft index is applied
+func (f *fsm) waitIndex(ctx context.Context, index uint64) error {
+	for {
+		f.lock.Lock()
+		applied := f.applied
+		current := f.index
+		f.lock.Unlock()
+		if current >= index {
+			return nil
+		}
+		select {
+		case <-applied:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// url returns API URL of a member
+func (f *fsm) url(id string) string {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.urls[id]
+}
+
+// state is a snapshot of the state machine
+type state struct {
+	Dump engine.Dump       `json:"dump"`
+	URLs map[string]string `json:"urls"`
+	// Index is the raft index of the last command included into the snapshot
+	Index uint64 `json:"index"`
+}
+
+// Snapshot takes a copy of records and members, it's written by raft in background
+func (f *fsm) Snapshot() (raft.FSMSnapshot, error) {
+	// raft doesn't apply commands while the snapshot is taken, so the dump is the state after the command with the index
+	s := &state{Dump: f.store.Dump(), URLs: make(map[string]string)}
+	f.lock.Lock()
+	s.Index = f.index
+	for id, url := range f.urls {
+		s.URLs[id] = url
+	}
+	f.lock.Unlock()
+	return s, nil
+}
+
+// Restore replaces records and members with a snapshot
+func (f *fsm) Restore(rc io.ReadCloser) error {
+	defer rc.Close()
+	var s state
+	if err := json.NewDecoder(rc).Decode(&s); err != nil {
+		return errors.Wrap(err, "decode snapshot")
+	}
+	if s.Dump.Records == nil {
+		s.Dump.Records = make(map[string]engine.Record)
+	}
+	if err := f.store.Restore(s.Dump); err != nil {
+		return err
+	}
+	f.lock.Lock()
+	f.urls = s.URLs
+	if f.urls == nil {
+		f.urls = make(map[string]string)
+	}
+	f.lock.Unlock()
+	f.notify(s.Index)
+	return nil
+}
+
+// Persist writes the snapshot
+func (s *state) Persist(sink raft.SnapshotSink) error {
+	if err := json.NewEncoder(sink).Encode(s); err != nil {
+		sink.Cancel()
+		return errors.Wrap(err, "write snapshot")
+	}
+	return sink.Close()
+}
+
+// Release is called when raft is done with the snapshot
+func (s *state) Release() {}
@@ -0,0 +1,543 @@
+package cluster
+
+// Raft cluster.
+// Nodes agree on mutations through raft: a mutation is a command of the raft log, and every node
+// applies committed commands to its Narwal storage in the same order. The raft log is the source of truth,
+// so the storage is rebuilt from the latest raft snapshot and the log on start.
+// Only the leader accepts mutations, the API redirects them from other nodes.
+// Reads are linearizable through read index: the leader confirms it's still the leader and tells
+// the raft index of the last command it has applied, the node serves the read once it has applied that command.
+// Expired records are removed by commands of the leader. Reads don't prolong sliding expiration in cluster mode,
+// since they aren't committed through raft.
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/raft"
+	raftboltdb "github.com/hashicorp/raft-boltdb"
+	"github.com/pkg/errors"
+
+	"github.com/filatovw/ni-storage/config"
+	"github.com/filatovw/ni-storage/engine"
+	"github.com/filatovw/ni-storage/logger"
+)
+
+var (
+	defaultRaftAddress  = "127.0.0.1:8600"
+	defaultExpirePeriod = 100 * time.Millisecond
+	defaultExpireBudget = 1000
+	defaultJoinPeriod   = time.Second
+	// applyTimeout limits waiting for a command to be queued by raft
+	applyTimeout = 10 * time.Second
+)
+
+const (
+	raftDirName       = "raft"
+	raftLogName       = "raft.db"
+	snapshotsRetain   = 2
+	transportPoolSize = 3
+	transportTimeout  = 10 * time.Second
+)
+
+// Store is a storage of records replicated by raft
+type Store interface {
+	engine.Storage
+	// Restore replaces all records with a dump
+	Restore(engine.Dump) error
+	// Expired takes keys which are expired by the time
+	Expired(time.Time, int) []string
+	// RemoveExpired deletes keys which are still expired by the time
+	RemoveExpired(context.Context, []string, time.Time) error
+	// Reindex puts keys taken by Expired back unless they are removed
+	Reindex([]string)
+}
+
+// Member of a cluster
+type Member struct {
+	ID string `json:"id"`
+	// Address is where the member gets raft messages
+	Address string `json:"address,omitempty"`
+	// URL of the API server of the member
+	URL    string `json:"url,omitempty"`
+	Leader bool   `json:"leader,omitempty"`
+	Voter  bool   `json:"voter,omitempty"`
+}
+
+// Options are parts of raft which are replaced in tests
+type Options struct {
+	// Raft config, LocalID and NotifyCh are set by the node
+	Raft      *raft.Config
+	Transport raft.Transport
+	Logs      raft.LogStore
+	Stable    raft.StableStore
+	Snapshots raft.SnapshotStore
+	// ExpirePeriod is a period between removals of expired records by the leader
+	ExpirePeriod time.Duration
+	// ExpireBudget is a number of expired records removed at once
+	ExpireBudget int
+}
+
+// Node is a storage replicated by raft
+type Node struct {
+	Store
+	log       logger.Logger
+	id        string
+	advertise string
+	raft      *raft.Raft
+	fsm       *fsm
+	client    *http.Client
+
+	expirePeriod time.Duration
+	expireBudget int
+
+	lock *sync.RWMutex
+	// ready is set when the leader has applied all commands of previous terms
+	ready bool
+}
+
+// logWriter passes logs of raft to the logger
+type logWriter struct {
+	log logger.Logger
+}
+
+func (w logWriter) Write(p []byte) (int, error) {
+	w.log.Debugf("%s", strings.TrimSpace(string(p)))
+	return len(p), nil
+}
+
+// Open starts a node which keeps the raft log and snapshots in the data directory and talks to other nodes over TCP
+func Open(ctx context.Context, log logger.Logger, store Store, cfg config.Config) (*Node, error) {
+	c := cfg.Cluster
+	if c.RaftAddress == "" {
+		c.RaftAddress = defaultRaftAddress
+	}
+	if c.Advertise == "" {
+		c.Advertise = fmt.Sprintf("http://%s", cfg.HTTPServer.Address())
+	}
+	output := logWriter{log}
+
+	dir := filepath.Join(cfg.NarWAL.DataDir, raftDirName)
+	snapshots, err := raft.NewFileSnapshotStore(dir, snapshotsRetain, output)
+	if err != nil {
+		return nil, errors.Wrap(err, "open raft snapshots")
+	}
+	logs, err := raftboltdb.NewBoltStore(filepath.Join(dir, raftLogName))
+	if err != nil {
+		return nil, errors.Wrap(err, "open raft log")
+	}
+	addr, err := net.ResolveTCPAddr("tcp", c.RaftAddress)
+	if err != nil {
+		return nil, errors.Wrap(err, "resolve raft address")
+	}
+	transport, err := raft.NewTCPTransport(c.RaftAddress, addr, transportPoolSize, transportTimeout, output)
+	if err != nil {
+		return nil, errors.Wrap(err, "open raft transport")
+	}
+	go func() {
+		<-ctx.Done()
+		transport.Close()
+		logs.Close()
+	}()
+
+	return NewNode(ctx, log, store, c, Options{
+		Transport:    transport,
+		Logs:         logs,
+		Stable:       logs,
+		Snapshots:    snapshots,
+		ExpirePeriod: cfg.NarWAL.ExpirePeriod,
+		ExpireBudget: cfg.NarWAL.ExpireBudget,
+	})
+}
+
+// NewNode starts raft on top of the storage until the context is done.
+// The storage is cleared, its records are restored from raft.
+func NewNode(ctx context.Context, log logger.Logger, store Store, cfg config.Cluster, opts Options) (*Node, error) {
+	if err := store.Restore(engine.Dump{Records: make(map[string]engine.Record)}); err != nil {
+		return nil, errors.Wrap(err, "clear storage")
+	}
+
+	conf := raft.DefaultConfig()
+	if opts.Raft != nil {
+		c := *opts.Raft
+		conf = &c
+	}
+	conf.LocalID = raft.ServerID(cfg.NodeID)
+	if conf.Logger == nil {
+		conf.LogOutput = logWriter{log}
+	}
+	leadership := make(chan bool, 1)
+	conf.NotifyCh = leadership
+
+	n := &Node{
+		Store:        store,
+		log:          log,
+		id:           cfg.NodeID,
+		advertise:    strings.TrimRight(cfg.Advertise, "/"),
+		fsm:          newFSM(store),
+		client:       &http.Client{},
+		expirePeriod: opts.ExpirePeriod,
+		expireBudget: opts.ExpireBudget,
+		lock:         &sync.RWMutex{},
+	}
+	if n.expirePeriod <= 0 {
+		n.expirePeriod = defaultExpirePeriod
+	}
+	if n.expireBudget <= 0 {
+		n.expireBudget = defaultExpireBudget
+	}
+
+	if cfg.Bootstrap {
+		exists, err := raft.HasExistingState(opts.Logs, opts.Stable, opts.Snapshots)
+		if err != nil {
+			return nil, errors.Wrap(err, "check raft state")
+		}
+		if !exists {
+			servers := raft.Configuration{Servers: []raft.Server{{ID: conf.LocalID, Address: opts.Transport.LocalAddr()}}}
+			if err := raft.BootstrapCluster(conf, opts.Logs, opts.Stable, opts.Snapshots, opts.Transport, servers); err != nil {
+				return nil, errors.Wrap(err, "bootstrap cluster")
+			}
+		}
+	}
+
+	r, err := raft.NewRaft(conf, n.fsm, opts.Logs, opts.Stable, opts.Snapshots, opts.Transport)
+	if err != nil {
+		return nil, errors.Wrap(err, "start raft")
+	}
+	n.raft = r
+
+	go n.lead(ctx, leadership)
+	go n.checkExpired(ctx, n.expirePeriod)
+	if cfg.Join != "" {
+		go n.join(ctx, cfg.Join, opts.Transport.LocalAddr())
+	}
+	go func() {
+		<-ctx.Done()
+		if err := r.Shutdown().Error(); err != nil {
+			log.Errorf("failed to shutdown raft: %s", err)
+		}
+	}()
+	return n, nil
+}
+
+// lead follows changes of leadership
+func (n *Node) lead(ctx context.Context, leadership <-chan bool) {
+	for {
+		select {
+		case leader := <-leadership:
+			n.setReady(false)
+			if !leader {
+				n.log.Infof("node %s is a follower", n.id)
+				continue
+			}
+			n.log.Infof("node %s is the leader", n.id)
+			// commands of previous terms are applied after the barrier
+			if err := n.raft.Barrier(applyTimeout).Error(); err != nil {
+				n.log.Errorf("failed to apply commands of previous terms: %s", err)
+				continue
+			}
+			n.setReady(true)
+			if n.fsm.url(n.id) != n.advertise {
+				err := n.apply(ctx, command{Op: opJoin, Member: Member{ID: n.id, URL: n.advertise}})
+				if err != nil {
+					n.log.Errorf("failed to register URL of the leader: %s", err)
+				}
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (n *Node) setReady(ready bool) {
+	n.lock.Lock()
+	n.ready = ready
+	n.lock.Unlock()
+}
+
+// isLeader checks if the node is the leader which has applied all commands of previous terms
+func (n *Node) isLeader() bool {
+	n.lock.RLock()
+	defer n.lock.RUnlock()
+	return n.ready && n.raft.State() == raft.Leader
+}
+
+// join asks a member to add the node to the cluster until it succeeds
+func (n *Node) join(ctx context.Context, url string, addr raft.ServerAddress) {
+	t := time.NewTicker(defaultJoinPeriod)
+	defer t.Stop()
+	for {
+		err := n.requestJoin(ctx, strings.TrimRight(url, "/"), Member{ID: n.id, Address: string(addr), URL: n.advertise})
+		if err == nil {
+			n.log.Infof("node %s joined the cluster via %s", n.id, url)
+			return
+		}
+		n.log.Errorf("failed to join the cluster via %s: %s", url, err)
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (n *Node) requestJoin(ctx context.Context, url string, m Member) error {
+	body, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, url+"/cluster/members", bytes.NewReader(body))
+	if err != nil {
+		return errors.Wrap(err, "build request")
+	}
+	// members redirect to the leader
+	resp, err := n.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return errors.Errorf("member responded with %s", resp.Status)
+	}
+	return nil
+}
+
+// checkExpired removes expired records while the node is the leader
+func (n *Node) checkExpired(ctx context.Context, period time.Duration) {
+	t := time.NewTicker(period)
+	for {
+		select {
+		case <-t.C:
+			if !n.isLeader() {
+				continue
+			}
+			now := time.Now()
+			keys := n.Store.Expired(now, n.expireBudget)
+			if len(keys) == 0 {
+				continue
+			}
+			if err := n.apply(ctx, command{Op: opEvict, Keys: keys, Time: now}); err != nil {
+				n.log.Errorf("failed to remove expired keys: %s", err)
+				n.Store.Reindex(keys)
+			}
+		case <-ctx.Done():
+			t.Stop()
+			return
+		}
+	}
+}
+
+// apply commits command through raft and returns its result.
+// When the context is done before that, the outcome of the command is unknown.
+func (n *Node) apply(ctx context.Context, c command) error {
+	if n.raft.State() != raft.Leader {
+		return engine.ErrNotLeader
+	}
+	c.Now = time.Now()
+	data, err := json.Marshal(c)
+	if err != nil {
+		return errors.Wrap(err, "encode command")
+	}
+	future := n.raft.Apply(data, applyTimeout)
+	done := make(chan error, 1)
+	go func() {
+		done <- future.Error()
+	}()
+	select {
+	case err := <-done:
+		if err == raft.ErrNotLeader || err == raft.ErrLeadershipLost {
+			return engine.ErrNotLeader
+		}
+		if err != nil {
+			return errors.Wrap(err, "commit command")
+		}
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	if err, ok := future.Response().(error); ok {
+		return err
+	}
+	return nil
+}
+
+// Leader returns API URL of the leader, it's empty when the leader is unknown.
+// isLeader tells if this node is the leader.
+func (n *Node) Leader() (url string, isLeader bool) {
+	if n.isLeader() {
+		return n.advertise, true
+	}
+	addr := n.raft.Leader()
+	if addr == "" {
+		return "", false
+	}
+	future := n.raft.GetConfiguration()
+	if err := future.Error(); err != nil {
+		return "", false
+	}
+	for _, s := range future.Configuration().Servers {
+		if s.Address == addr {
+			return n.fsm.url(string(s.ID)), false
+		}
+	}
+	return "", false
+}
+
+// CommitIndex confirms that the node is still the leader and returns the raft index of the last command it has applied.
+// The leader is ready once it has applied commands of previous terms, so the index covers all acknowledged mutations.
+// It's called by the leader only.
+func (n *Node) CommitIndex(ctx context.Context) (uint64, error) {
+	if !n.isLeader() {
+		return 0, engine.ErrNotLeader
+	}
+	// the index is taken first, so commands acknowledged before the confirmation are covered
+	index := n.fsm.appliedIndex()
+	if err := n.raft.VerifyLeader().Error(); err != nil {
+		return 0, engine.ErrNotLeader
+	}
+	return index, nil
+}
+
+// ReadIndexer is a storage which serves linearizable reads, listeners of other protocols check a storage for it
+type ReadIndexer interface {
+	ReadIndex(context.Context) error
+}
+
+// ReadIndex waits until the node has all changes committed before the call, so the following reads are linearizable
+func (n *Node) ReadIndex(ctx context.Context) error {
+	if n.isLeader() {
+		_, err := n.CommitIndex(ctx)
+		return err
+	}
+	url, _ := n.Leader()
+	if url == "" {
+		return engine.ErrNotLeader
+	}
+	req, err := http.NewRequest(http.MethodGet, url+"/cluster/read-index", nil)
+	if err != nil {
+		return errors.Wrap(err, "build request")
+	}
+	resp, err := n.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return errors.Wrap(err, "ask leader")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		// the leader is changing
+		return engine.ErrNotLeader
+	}
+	var index ReadIndex
+	if err := json.NewDecoder(resp.Body).Decode(&index); err != nil {
+		return errors.Wrap(err, "decode read index")
+	}
+	return n.fsm.waitIndex(ctx, index.Index)
+}
+
+// ReadIndex is the raft index of the last command applied by the leader
+type ReadIndex struct {
+	Index uint64 `json:"index"`
+}
+
+// Members returns members of the cluster
+func (n *Node) Members() ([]Member, error) {
+	future := n.raft.GetConfiguration()
+	if err := future.Error(); err != nil {
+		return nil, errors.Wrap(err, "get configuration")
+	}
+	leader := n.raft.Leader()
+	members := []Member{}
+	for _, s := range future.Configuration().Servers {
+		members = append(members, Member{
+			ID:      string(s.ID),
+			Address: string(s.Address),
+			URL:     n.fsm.url(string(s.ID)),
+			Leader:  s.Address == leader,
+			Voter:   s.Suffrage == raft.Voter,
+		})
+	}
+	return members, nil
+}
+
+// Join adds the member to the cluster as a voter, it's called on the leader
+func (n *Node) Join(ctx context.Context, m Member) error {
+	if !n.isLeader() {
+		return engine.ErrNotLeader
+	}
+	if err := n.raft.AddVoter(raft.ServerID(m.ID), raft.ServerAddress(m.Address), 0, 0).Error(); err != nil {
+		return errors.Wrapf(err, "add %s", m.ID)
+	}
+	return n.apply(ctx, command{Op: opJoin, Member: Member{ID: m.ID, URL: m.URL}})
+}
+
+// Leave removes the member from the cluster, it's called on the leader
+func (n *Node) Leave(ctx context.Context, id string) error {
+	if !n.isLeader() {
+		return engine.ErrNotLeader
+	}
+	// the URL is removed first, since the leader may remove itself
+	if err := n.apply(ctx, command{Op: opLeave, Member: Member{ID: id}}); err != nil {
+		return err
+	}
+	if err := n.raft.RemoveServer(raft.ServerID(id), 0, 0).Error(); err != nil {
+		return errors.Wrapf(err, "remove %s", id)
+	}
+	return nil
+}
+
+// Set save record in a storage
+func (n *Node) Set(ctx context.Context, record engine.Record) error {
+	return n.CompareAndSet(ctx, record, engine.Condition{})
+}
+
+// CompareAndSet save record if the current state of the record satisfies the condition
+func (n *Node) CompareAndSet(ctx context.Context, record engine.Record, cond engine.Condition) error {
+	// expiration is set by the leader, so it's the same on every node
+	if record.SlidingTTL > 0 && record.ExpirationTime == nil {
+		until := time.Now().Add(record.SlidingTTL)
+		record.ExpirationTime = &until
+	}
+	return n.apply(ctx, command{Op: opSet, Record: record, Condition: cond})
+}
+
+// Delete remove record with defined key
+func (n *Node) Delete(ctx context.Context, key string) error {
+	return n.CompareAndDelete(ctx, key, engine.Condition{})
+}
+
+// CompareAndDelete remove record if its current state satisfies the condition
+func (n *Node) CompareAndDelete(ctx context.Context, key string, cond engine.Condition) error {
+	return n.apply(ctx, command{Op: opDelete, Record: engine.Record{Key: key}, Condition: cond})
+}
+
+// DeleteAll remove all records
+func (n *Node) DeleteAll(ctx context.Context) error {
+	return n.apply(ctx, command{Op: opDeleteAll})
+}
+
+// Batch applies all operations atomically
+func (n *Node) Batch(ctx context.Context, ops []engine.Op) error {
+	for i, o := range ops {
+		if o.Record.SlidingTTL > 0 && o.Record.ExpirationTime == nil {
+			until := time.Now().Add(o.Record.SlidingTTL)
+			ops[i].Record.ExpirationTime = &until
+		}
+	}
+	return n.apply(ctx, command{Op: opBatch, Ops: ops})
+}
+
+// Expire changes expiration time of a record
+func (n *Node) Expire(ctx context.Context, key string, until time.Time) error {
+	return n.apply(ctx, command{Op: opExpire, Record: engine.Record{Key: key}, Time: until})
+}
+
+// Persist removes expiration time of a record
+func (n *Node) Persist(ctx context.Context, key string) error {
+	return n.apply(ctx, command{Op: opPersist, Record: engine.Record{Key: key}})
+}
@@ -0,0 +1,378 @@
+package cluster_test
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/raft"
+	"go.uber.org/zap"
+
+	"github.com/filatovw/ni-storage/api"
+	"github.com/filatovw/ni-storage/cluster"
+	"github.com/filatovw/ni-storage/config"
+	"github.com/filatovw/ni-storage/engine"
+	"github.com/filatovw/ni-storage/engine/narwal"
+)
+
+// member is a node of a test cluster
+type member struct {
+	node      *cluster.Node
+	storage   *narwal.Narwal
+	transport *raft.InmemTransport
+	snapshots *raft.InmemSnapshotStore
+	server    *httptest.Server
+	cancel    context.CancelFunc
+	dir       string
+	stopped   bool
+}
+
+// testCluster runs nodes in a single process over the in-memory transport
+type testCluster struct {
+	t       *testing.T
+	members []*member
+}
+
+func raftConfig() *raft.Config {
+	conf := raft.DefaultConfig()
+	conf.HeartbeatTimeout = 50 * time.Millisecond
+	conf.ElectionTimeout = 50 * time.Millisecond
+	conf.LeaderLeaseTimeout = 50 * time.Millisecond
+	conf.CommitTimeout = 5 * time.Millisecond
+	// logs are truncated often, so new members get records from snapshots
+	conf.SnapshotInterval = 20 * time.Millisecond
+	conf.SnapshotThreshold = 2
+	conf.TrailingLogs = 1
+	return conf
+}
+
+// start adds a node which asks a member with the URL to join the cluster, the node bootstraps the cluster without it
+func (c *testCluster) start(join string) *member {
+	t := c.t
+	t.Helper()
+	log, err := zap.NewProduction()
+	if err != nil {
+		t.Errorf("error on logger init: %s", err)
+	}
+	dir, err := ioutil.TempDir("", "cluster_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	storage, err := narwal.New(ctx, config.NarWAL{DataDir: dir, Follower: true}, log.Sugar())
+	if err != nil {
+		t.Fatalf("create engine: %s", err)
+	}
+
+	id := fmt.Sprintf("node%d", len(c.members))
+	addr, transport := raft.NewInmemTransport(raft.ServerAddress(id))
+	for _, m := range c.members {
+		m.transport.Connect(addr, transport)
+		transport.Connect(m.transport.LocalAddr(), m.transport)
+	}
+	m := &member{storage: storage, transport: transport, snapshots: raft.NewInmemSnapshotStore(), cancel: cancel, dir: dir}
+	handler := http.NewServeMux()
+	m.server = httptest.NewServer(handler)
+
+	store := raft.NewInmemStore()
+	cfg := config.Cluster{NodeID: id, Advertise: m.server.URL, Bootstrap: join == "", Join: join}
+	m.node, err = cluster.NewNode(ctx, log.Sugar(), storage, cfg, cluster.Options{
+		Raft:         raftConfig(),
+		Transport:    transport,
+		Logs:         store,
+		Stable:       store,
+		Snapshots:    m.snapshots,
+		ExpirePeriod: 10 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("create node: %s", err)
+	}
+	handler.Handle("/", api.New(ctx, log.Sugar(), m.node, config.Config{}).Handler)
+	c.members = append(c.members, m)
+
+	waitFor(t, "join of "+id, func() bool {
+		members, err := c.leader().node.Members()
+		if err != nil {
+			return false
+		}
+		for _, member := range members {
+			if member.ID == id && member.URL == m.server.URL {
+				return true
+			}
+		}
+		return false
+	})
+	return m
+}
+
+// stop the node, it's kept in the list of members
+func (c *testCluster) stop(m *member) {
+	m.stopped = true
+	m.cancel()
+	m.server.Close()
+	for _, other := range c.members {
+		other.transport.Disconnect(m.transport.LocalAddr())
+	}
+}
+
+func (c *testCluster) close() {
+	for _, m := range c.members {
+		m.cancel()
+		m.server.Close()
+		os.RemoveAll(m.dir)
+	}
+}
+
+// leader waits until one of running nodes leads
+func (c *testCluster) leader() *member {
+	c.t.Helper()
+	var leader *member
+	waitFor(c.t, "leader", func() bool {
+		for _, m := range c.members {
+			if _, isLeader := m.node.Leader(); isLeader && !m.stopped {
+				leader = m
+				return true
+			}
+		}
+		return false
+	})
+	return leader
+}
+
+// followers returns running nodes except the leader
+func (c *testCluster) followers() []*member {
+	leader := c.leader()
+	followers := []*member{}
+	for _, m := range c.members {
+		if m != leader && !m.stopped {
+			followers = append(followers, m)
+		}
+	}
+	return followers
+}
+
+func newCluster(t *testing.T, size int) *testCluster {
+	c := &testCluster{t: t}
+	first := c.start("")
+	for i := 1; i < size; i++ {
+		c.start(first.server.URL)
+	}
+	return c
+}
+
+// waitFor checks the condition until it holds or the time is out
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestClusterWrites(t *testing.T) {
+	c := newCluster(t, 3)
+	defer c.close()
+	leader := c.leader()
+
+	if err := leader.node.Set(context.TODO(), engine.Record{Key: "key1", Value: []byte("value1")}); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	err := leader.node.CompareAndSet(context.TODO(), engine.Record{Key: "key1", Value: []byte("value2")}, engine.Condition{Match: []uint64{42}})
+	if err != engine.ErrPreconditionFailed {
+		t.Errorf("expected: %s, got: %v", engine.ErrPreconditionFailed, err)
+	}
+	if err := leader.node.Batch(context.TODO(), []engine.Op{
+		{Type: engine.OpSet, Record: engine.Record{Key: "key2", Value: []byte("value2")}},
+		{Type: engine.OpDelete, Record: engine.Record{Key: "key1"}},
+	}); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	for _, m := range c.followers() {
+		// writes go through the leader only
+		if err := m.node.Set(context.TODO(), engine.Record{Key: "key3"}); err != engine.ErrNotLeader {
+			t.Errorf("expected: %s, got: %v", engine.ErrNotLeader, err)
+		}
+		if url, isLeader := m.node.Leader(); isLeader || url != leader.server.URL {
+			t.Errorf("expected leader %s, got %s", leader.server.URL, url)
+		}
+
+		// linearizable read sees all the writes acknowledged before
+		if err := m.node.ReadIndex(context.TODO()); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if m.node.Seq() != leader.node.Seq() {
+			t.Errorf("expected seq %d, got %d", leader.node.Seq(), m.node.Seq())
+		}
+		record, ok := m.node.Get("key2")
+		expected, _ := leader.node.Get("key2")
+		if !ok || string(record.Value) != "value2" || record.Version != expected.Version {
+			t.Errorf("expected: %v, got: %v", expected, record)
+		}
+		if m.node.Exists("key1") {
+			t.Errorf("expected key1 to be removed")
+		}
+	}
+}
+
+func TestClusterExpiration(t *testing.T) {
+	c := newCluster(t, 3)
+	defer c.close()
+	leader := c.leader()
+
+	until := time.Now().Add(50 * time.Millisecond)
+	leader.node.Set(context.TODO(), engine.Record{Key: "key1", Value: []byte("value1"), ExpirationTime: &until})
+	leader.node.Set(context.TODO(), engine.Record{Key: "key2", Value: []byte("value2")})
+
+	// the leader removes expired records through raft, so nodes stay the same
+	waitFor(t, "removal of expired record", func() bool {
+		return leader.node.Seq() == 3
+	})
+	for _, m := range c.followers() {
+		if err := m.node.ReadIndex(context.TODO()); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if records := m.storage.Dump().Records; len(records) != 1 {
+			t.Errorf("expected only key2, got %v", records)
+		}
+	}
+}
+
+func TestClusterFailover(t *testing.T) {
+	c := newCluster(t, 3)
+	defer c.close()
+	old := c.leader()
+	old.node.Set(context.TODO(), engine.Record{Key: "key1", Value: []byte("value1")})
+
+	c.stop(old)
+	leader := c.leader()
+	if leader == old {
+		t.Fatalf("expected a new leader")
+	}
+	if err := leader.node.Set(context.TODO(), engine.Record{Key: "key2", Value: []byte("value2")}); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	for _, m := range c.followers() {
+		if err := m.node.ReadIndex(context.TODO()); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if !m.node.Exists("key1") || !m.node.Exists("key2") {
+			t.Errorf("expected both keys, got %v", m.node.GetAll())
+		}
+	}
+}
+
+func TestClusterMembership(t *testing.T) {
+	c := newCluster(t, 3)
+	defer c.close()
+	leader := c.leader()
+	leader.node.Set(context.TODO(), engine.Record{Key: "key1", Value: []byte("value1")})
+
+	members, err := leader.node.Members()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(members) != 3 {
+		t.Fatalf("expected 3 members, got %v", members)
+	}
+	for _, m := range members {
+		if m.URL == "" || !m.Voter || m.Leader != (m.URL == leader.server.URL) {
+			t.Errorf("unexpected member: %+v", m)
+		}
+	}
+
+	removed := c.followers()[0]
+	id := ""
+	for _, m := range members {
+		if m.URL == removed.server.URL {
+			id = m.ID
+		}
+	}
+	if err := leader.node.Leave(context.TODO(), id); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	members, err = leader.node.Members()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(members) != 2 {
+		t.Errorf("expected 2 members, got %v", members)
+	}
+	// the removed node doesn't get heartbeats anymore and has to be stopped, otherwise it calls elections
+	c.stop(removed)
+
+	// a new member gets existing records from a snapshot
+	leader.node.Set(context.TODO(), engine.Record{Key: "key2", Value: []byte("value2")})
+	waitFor(t, "snapshot", func() bool {
+		snapshots, err := leader.snapshots.List()
+		return err == nil && len(snapshots) > 0
+	})
+	// the follower redirects the request to join to the leader
+	added := c.start(c.followers()[0].server.URL)
+	waitFor(t, "replication to the new member", func() bool {
+		return added.node.Exists("key1") && added.node.Exists("key2")
+	})
+	// the read index of the leader is reached by the member restored from the snapshot
+	leader.node.Set(context.TODO(), engine.Record{Key: "key3", Value: []byte("value3")})
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := added.node.ReadIndex(ctx); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !added.node.Exists("key3") {
+		t.Errorf("expected key3 after the read index")
+	}
+}
+
+func TestClusterHTTP(t *testing.T) {
+	c := newCluster(t, 3)
+	defer c.close()
+	leader := c.leader()
+	follower := c.followers()[0]
+
+	// the follower redirects writes, the client follows redirects with the body
+	req, err := http.NewRequest("PUT", follower.server.URL+"/keys/key1", strings.NewReader("value1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated || resp.Request.URL.Host != strings.TrimPrefix(leader.server.URL, "http://") {
+		t.Errorf("expected the write to be redirected to the leader, got %d from %s", resp.StatusCode, resp.Request.URL)
+	}
+
+	// reads of every node see the write
+	for _, m := range c.members {
+		resp, err := http.Get(m.server.URL + "/keys/key1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK || string(data) != "value1" {
+			t.Errorf("unexpected response: %d %s", resp.StatusCode, data)
+		}
+	}
+
+	resp, err = http.Get(follower.server.URL + "/cluster/members")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || strings.Count(string(data), `"voter":true`) != 3 {
+		t.Errorf("unexpected response: %d %s", resp.StatusCode, data)
+	}
+}
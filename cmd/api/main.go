@@ -3,16 +3,24 @@ package main
 import (
 	"context"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
 	"syscall"
 
 	"go.uber.org/zap"
+	"google.golang.org/grpc"
 
 	"github.com/filatovw/ni-storage/api"
+	"github.com/filatovw/ni-storage/cluster"
 	"github.com/filatovw/ni-storage/config"
+	"github.com/filatovw/ni-storage/engine"
 	"github.com/filatovw/ni-storage/engine/narwal"
+	"github.com/filatovw/ni-storage/memcache"
+	"github.com/filatovw/ni-storage/replication"
+	"github.com/filatovw/ni-storage/resp"
+	"github.com/filatovw/ni-storage/rpc"
 )
 
 func main() {
@@ -40,13 +48,68 @@ func main() {
 	ctx, cancel := context.WithCancel(ctx)
 
 	// init storage
-	storage, err := narwal.New(ctx, config.NarWAL.DataDir, slog)
+	storage, err := narwal.New(ctx, config.NarWAL, slog)
 	if err != nil {
 		log.Printf("failed to init storage: %s", err)
 		return
 	}
 
-	server := api.New(ctx, slog, storage, *config)
+	var service engine.Storage = storage
+	switch {
+	case config.Replication.Leader != "" && config.Cluster.NodeID != "":
+		log.Printf("a node of a cluster can't follow a leader")
+		return
+	case config.Replication.Leader != "":
+		// reads are served while the follower catches up with the leader
+		service = replication.NewFollower(ctx, slog, storage, config.Replication)
+	case config.Cluster.NodeID != "":
+		node, err := cluster.Open(ctx, slog, storage, *config)
+		if err != nil {
+			log.Printf("failed to start cluster node: %s", err)
+			return
+		}
+		service = node
+	}
+
+	server := api.New(ctx, slog, service, *config)
+
+	// the Redis protocol listener is optional
+	var respServer *resp.Server
+	if config.RESP.Address != "" {
+		respServer = resp.New(ctx, slog, service, config.RESP)
+		go func() {
+			if err := respServer.ListenAndServe(); err != resp.ErrServerClosed {
+				slog.Errorf("RESP server stopped with error: %s", err)
+			}
+		}()
+	}
+
+	// the memcached protocol listener is optional
+	var memcachedServer *memcache.Server
+	if config.Memcached.Address != "" {
+		memcachedServer = memcache.New(ctx, slog, service, config.Memcached)
+		go func() {
+			if err := memcachedServer.ListenAndServe(); err != memcache.ErrServerClosed {
+				slog.Errorf("memcached server stopped with error: %s", err)
+			}
+		}()
+	}
+
+	// the gRPC listener is optional
+	var grpcServer *grpc.Server
+	if config.GRPC.Address != "" {
+		l, err := net.Listen("tcp", config.GRPC.Address)
+		if err != nil {
+			log.Printf("failed to listen for gRPC: %s", err)
+			return
+		}
+		grpcServer = rpc.New(slog, service)
+		go func() {
+			if err := grpcServer.Serve(l); err != nil {
+				slog.Errorf("gRPC server stopped with error: %s", err)
+			}
+		}()
+	}
 
 	go func() {
 		sig := <-sigs
@@ -57,6 +120,17 @@ func main() {
 			slog.Errorf("server shutdowned with error: %s", err)
 		}
 
+		if respServer != nil {
+			respServer.Close()
+		}
+		if memcachedServer != nil {
+			memcachedServer.Close()
+		}
+		// watch streams are endless, so they are dropped instead of waiting for them
+		if grpcServer != nil {
+			grpcServer.Stop()
+		}
+
 		// stop storage goroutines
 		cancel()
 	}()
@@ -5,12 +5,20 @@ import (
 	"fmt"
 	"os"
 	"strconv"
+	"strings"
+	"time"
 )
 
 type Config struct {
-	HTTPServer HTTPServer `json:"api"`
-	NarWAL     NarWAL     `json:"narwal"`
-	Debug      bool       `json:"debug"`
+	HTTPServer  HTTPServer  `json:"api"`
+	NarWAL      NarWAL      `json:"narwal"`
+	Replication Replication `json:"replication"`
+	Cluster     Cluster     `json:"cluster"`
+	Proxy       Proxy       `json:"proxy"`
+	RESP        RESP        `json:"resp"`
+	Memcached   Memcached   `json:"memcached"`
+	GRPC        GRPC        `json:"grpc"`
+	Debug       bool        `json:"debug"`
 }
 
 type HTTPServer struct {
@@ -26,6 +34,75 @@ func (s HTTPServer) Address() string {
 // NarWAL keeps config of ni-storage
 type NarWAL struct {
 	DataDir string `json:"data-dir"`
+	// CompactMinSize is the size of the log in bytes, smaller logs are never compacted
+	CompactMinSize int64 `json:"compact-min-size"`
+	// CompactGarbageRatio is the share of stale entries in the log which triggers compaction
+	CompactGarbageRatio float64 `json:"compact-garbage-ratio"`
+	// SnapshotInterval is a period between snapshots of records
+	SnapshotInterval time.Duration `json:"snapshot-interval"`
+	// SnapshotRetain is a number of the newest snapshots kept on a disk
+	SnapshotRetain int `json:"snapshot-retain"`
+	// Durability is one of: always (fsync every write), interval (fsync every SyncInterval), none
+	Durability string `json:"durability"`
+	// SyncInterval is a period between flushes of the log in "interval" durability mode
+	SyncInterval time.Duration `json:"sync-interval"`
+	// ExpirePeriod is a period between sweeps of expired keys
+	ExpirePeriod time.Duration `json:"expire-period"`
+	// ExpireBudget is a number of expired keys removed at once, a sweep continues while the budget is used up
+	ExpireBudget int `json:"expire-budget"`
+	// Follower storage doesn't change records by itself, they are replicated from a leader
+	Follower bool `json:"follower"`
+}
+
+// Replication keeps config of a follower
+type Replication struct {
+	// Leader is URL of the API server to replicate, the node is a leader when it's empty
+	Leader string `json:"leader"`
+	// Token is required from followers to read changes and dumps of the node and sent by them to the leader,
+	// there is no access control when it's empty
+	Token string `json:"-"`
+}
+
+// Cluster keeps config of a node of a raft cluster
+type Cluster struct {
+	// NodeID identifies the node in the cluster, the node runs standalone when it's empty
+	NodeID string `json:"node-id"`
+	// RaftAddress is the address the node exchanges raft messages at, other nodes have to reach it
+	RaftAddress string `json:"raft-address"`
+	// Advertise is URL of the API server of the node, writes to other nodes are redirected to it when it leads
+	Advertise string `json:"advertise"`
+	// Bootstrap starts a new cluster with this node as the only member
+	Bootstrap bool `json:"bootstrap"`
+	// Join is URL of the API server of a member which is asked to add the node to the cluster
+	Join string `json:"join"`
+}
+
+// Proxy keeps config of a router of a sharded cluster
+type Proxy struct {
+	// Shards are URLs of API servers keys are spread across
+	Shards []string `json:"shards"`
+	// VirtualNodes is a number of points of a shard on the hash ring
+	VirtualNodes int `json:"virtual-nodes"`
+	// ReplicationToken is sent to shards to read their dumps while keys are moved, it's the token of replication
+	ReplicationToken string `json:"-"`
+}
+
+// RESP keeps config of the Redis protocol listener
+type RESP struct {
+	// Address is the TCP address of the listener, it's off when the address is empty
+	Address string `json:"address"`
+}
+
+// Memcached keeps config of the memcached text protocol listener
+type Memcached struct {
+	// Address is the TCP address of the listener, it's off when the address is empty
+	Address string `json:"address"`
+}
+
+// GRPC keeps config of the gRPC listener
+type GRPC struct {
+	// Address is the TCP address of the listener, it's off when the address is empty
+	Address string `json:"address"`
 }
 
 // Load config from environment and command line
@@ -39,6 +116,8 @@ func Load() *Config {
 	}
 	c.loadFromEnv()
 	c.loadFromCLI()
+	c.NarWAL.Follower = c.Replication.Leader != "" || c.Cluster.NodeID != ""
+	c.Proxy.ReplicationToken = c.Replication.Token
 	return c
 }
 
@@ -52,6 +131,82 @@ func (c *Config) loadFromEnv() {
 	if v := os.Getenv("NI_NARWAL_DATA_DIR"); v != "" {
 		c.NarWAL.DataDir = v
 	}
+	if v := os.Getenv("NI_NARWAL_COMPACT_MIN_SIZE"); v != "" {
+		if size, err := strconv.ParseInt(v, 10, 64); err == nil {
+			c.NarWAL.CompactMinSize = size
+		}
+	}
+	if v := os.Getenv("NI_NARWAL_COMPACT_GARBAGE_RATIO"); v != "" {
+		if ratio, err := strconv.ParseFloat(v, 64); err == nil {
+			c.NarWAL.CompactGarbageRatio = ratio
+		}
+	}
+	if v := os.Getenv("NI_NARWAL_SNAPSHOT_INTERVAL"); v != "" {
+		if interval, err := time.ParseDuration(v); err == nil {
+			c.NarWAL.SnapshotInterval = interval
+		}
+	}
+	if v := os.Getenv("NI_NARWAL_SNAPSHOT_RETAIN"); v != "" {
+		if retain, err := strconv.Atoi(v); err == nil {
+			c.NarWAL.SnapshotRetain = retain
+		}
+	}
+	if v := os.Getenv("NI_NARWAL_DURABILITY"); v != "" {
+		c.NarWAL.Durability = v
+	}
+	if v := os.Getenv("NI_NARWAL_SYNC_INTERVAL"); v != "" {
+		if interval, err := time.ParseDuration(v); err == nil {
+			c.NarWAL.SyncInterval = interval
+		}
+	}
+	if v := os.Getenv("NI_NARWAL_EXPIRE_PERIOD"); v != "" {
+		if period, err := time.ParseDuration(v); err == nil {
+			c.NarWAL.ExpirePeriod = period
+		}
+	}
+	if v := os.Getenv("NI_NARWAL_EXPIRE_BUDGET"); v != "" {
+		if budget, err := strconv.Atoi(v); err == nil {
+			c.NarWAL.ExpireBudget = budget
+		}
+	}
+	if v := os.Getenv("NI_REPLICATION_LEADER"); v != "" {
+		c.Replication.Leader = v
+	}
+	if v := os.Getenv("NI_REPLICATION_TOKEN"); v != "" {
+		c.Replication.Token = v
+	}
+	if v := os.Getenv("NI_CLUSTER_NODE_ID"); v != "" {
+		c.Cluster.NodeID = v
+	}
+	if v := os.Getenv("NI_CLUSTER_RAFT_ADDRESS"); v != "" {
+		c.Cluster.RaftAddress = v
+	}
+	if v := os.Getenv("NI_CLUSTER_ADVERTISE"); v != "" {
+		c.Cluster.Advertise = v
+	}
+	if v := os.Getenv("NI_CLUSTER_BOOTSTRAP"); v == "true" {
+		c.Cluster.Bootstrap = true
+	}
+	if v := os.Getenv("NI_CLUSTER_JOIN"); v != "" {
+		c.Cluster.Join = v
+	}
+	if v := os.Getenv("NI_PROXY_SHARDS"); v != "" {
+		c.Proxy.Shards = strings.Split(v, ",")
+	}
+	if v := os.Getenv("NI_PROXY_VIRTUAL_NODES"); v != "" {
+		if nodes, err := strconv.Atoi(v); err == nil {
+			c.Proxy.VirtualNodes = nodes
+		}
+	}
+	if v := os.Getenv("NI_RESP_ADDRESS"); v != "" {
+		c.RESP.Address = v
+	}
+	if v := os.Getenv("NI_MEMCACHED_ADDRESS"); v != "" {
+		c.Memcached.Address = v
+	}
+	if v := os.Getenv("NI_GRPC_ADDRESS"); v != "" {
+		c.GRPC.Address = v
+	}
 	if v := os.Getenv("NI_DEBUG"); v == "true" {
 		c.Debug = true
 	}
@@ -59,14 +214,54 @@ func (c *Config) loadFromEnv() {
 
 func (c *Config) loadFromCLI() {
 	var (
-		host    string
-		port    int
-		dataDir string
-		debug   bool
+		host                string
+		port                int
+		dataDir             string
+		compactMinSize      int64
+		compactGarbageRatio float64
+		snapshotInterval    time.Duration
+		snapshotRetain      int
+		durability          string
+		syncInterval        time.Duration
+		expirePeriod        time.Duration
+		expireBudget        int
+		leader              string
+		replicationToken    string
+		nodeID              string
+		raftAddress         string
+		advertise           string
+		bootstrap           bool
+		join                string
+		shards              string
+		virtualNodes        int
+		respAddress         string
+		memcachedAddress    string
+		grpcAddress         string
+		debug               bool
 	)
 	flag.StringVar(&host, "host", "", "api-server host (default: 0.0.0.0)")
 	flag.IntVar(&port, "port", 0, "api-server port (default: 8500)")
 	flag.StringVar(&dataDir, "data-dir", "./data", "path to folder with data")
+	flag.Int64Var(&compactMinSize, "compact-min-size", 0, "minimal size of the log in bytes to be compacted (default: 64MB)")
+	flag.Float64Var(&compactGarbageRatio, "compact-garbage-ratio", 0, "share of stale entries in the log that triggers compaction (default: 0.5)")
+	flag.DurationVar(&snapshotInterval, "snapshot-interval", 0, "period between snapshots of records (default: 5m)")
+	flag.IntVar(&snapshotRetain, "snapshot-retain", 0, "number of snapshots kept on a disk (default: 2)")
+	flag.StringVar(&durability, "durability", "", "when writes are flushed to a disk: always, interval or none (default: always)")
+	flag.DurationVar(&syncInterval, "sync-interval", 0, "period between flushes to a disk in interval durability mode (default: 100ms)")
+	flag.DurationVar(&expirePeriod, "expire-period", 0, "period between sweeps of expired keys (default: 100ms)")
+	flag.IntVar(&expireBudget, "expire-budget", 0, "number of expired keys removed at once (default: 1000)")
+	flag.StringVar(&leader, "leader", "", "URL of a leader to replicate, the node serves only reads until it's promoted (default: none)")
+	flag.StringVar(&replicationToken, "replication-token", "", "token followers and the proxy pass to read changes and dumps of the node, they are open without it (default: none)")
+	flag.StringVar(&nodeID, "node-id", "", "ID of the node in a raft cluster, the node runs standalone without it (default: none)")
+	flag.StringVar(&raftAddress, "raft-address", "", "address the node exchanges raft messages at (default: 127.0.0.1:8600)")
+	flag.StringVar(&advertise, "advertise", "", "URL of the api-server of the node known to other nodes (default: http://<host>:<port>)")
+	flag.BoolVar(&bootstrap, "bootstrap", false, "start a new cluster with this node as the only member")
+	flag.StringVar(&join, "join", "", "URL of the api-server of a member which adds the node to the cluster (default: none)")
+	flag.StringVar(&shards, "shards", "", "comma-separated URLs of api-servers the proxy spreads keys across (default: none)")
+	flag.IntVar(&virtualNodes, "virtual-nodes", 0, "number of points of a shard on the hash ring of the proxy (default: 100)")
+	flag.StringVar(&respAddress, "resp-address", "", "address of the Redis protocol listener, it's off without it (default: none)")
+	flag.StringVar(&memcachedAddress, "memcached-address", "", "address of the memcached protocol listener, it's off without it (default: none)")
+	flag.StringVar(&grpcAddress, "grpc-address", "", "address of the gRPC listener, it's off without it (default: none)")
 	flag.BoolVar(&debug, "debug", false, "debug mode with verbose logging")
 	flag.Parse()
 
@@ -79,6 +274,66 @@ func (c *Config) loadFromCLI() {
 	if dataDir != "" {
 		c.NarWAL.DataDir = dataDir
 	}
+	if compactMinSize > 0 {
+		c.NarWAL.CompactMinSize = compactMinSize
+	}
+	if compactGarbageRatio > 0 {
+		c.NarWAL.CompactGarbageRatio = compactGarbageRatio
+	}
+	if snapshotInterval > 0 {
+		c.NarWAL.SnapshotInterval = snapshotInterval
+	}
+	if snapshotRetain > 0 {
+		c.NarWAL.SnapshotRetain = snapshotRetain
+	}
+	if durability != "" {
+		c.NarWAL.Durability = durability
+	}
+	if syncInterval > 0 {
+		c.NarWAL.SyncInterval = syncInterval
+	}
+	if expirePeriod > 0 {
+		c.NarWAL.ExpirePeriod = expirePeriod
+	}
+	if expireBudget > 0 {
+		c.NarWAL.ExpireBudget = expireBudget
+	}
+	if leader != "" {
+		c.Replication.Leader = leader
+	}
+	if replicationToken != "" {
+		c.Replication.Token = replicationToken
+	}
+	if nodeID != "" {
+		c.Cluster.NodeID = nodeID
+	}
+	if raftAddress != "" {
+		c.Cluster.RaftAddress = raftAddress
+	}
+	if advertise != "" {
+		c.Cluster.Advertise = advertise
+	}
+	if bootstrap {
+		c.Cluster.Bootstrap = true
+	}
+	if join != "" {
+		c.Cluster.Join = join
+	}
+	if shards != "" {
+		c.Proxy.Shards = strings.Split(shards, ",")
+	}
+	if virtualNodes > 0 {
+		c.Proxy.VirtualNodes = virtualNodes
+	}
+	if respAddress != "" {
+		c.RESP.Address = respAddress
+	}
+	if memcachedAddress != "" {
+		c.Memcached.Address = memcachedAddress
+	}
+	if grpcAddress != "" {
+		c.GRPC.Address = grpcAddress
+	}
 	if debug {
 		c.Debug = true
 	}
@@ -1,16 +1,167 @@
 package engine
 
-import "time"
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
 
 // Null is the empty record
 var Null = Record{}
 
+// MaxRecordSize is the size limit of a value, larger ones are rejected with ErrTooLarge
+const MaxRecordSize = 2 << 24
+
+var (
+	// ErrTooLarge is returned when a record exceeds the size limit of a storage
+	ErrTooLarge = errors.New("record is too large")
+	// ErrNoSpace is returned when there is no space left on a device
+	ErrNoSpace = errors.New("no space left on device")
+	// ErrClosed is returned when a storage doesn't accept operations anymore
+	ErrClosed = errors.New("storage is closed")
+	// ErrPreconditionFailed is returned when a record doesn't satisfy the condition of a mutation
+	ErrPreconditionFailed = errors.New("precondition failed")
+	// ErrNotFound is returned when a mutation requires the record to exist
+	ErrNotFound = errors.New("record not found")
+	// ErrCompacted is returned when requested changes are not kept anymore
+	ErrCompacted = errors.New("changes are compacted")
+	// ErrReadOnly is returned on mutations of a follower which replicates a leader
+	ErrReadOnly = errors.New("storage is read-only")
+	// ErrNotLeader is returned on operations of a cluster node which have to be done by the leader
+	ErrNotLeader = errors.New("node is not the leader")
+)
+
 // Record entity in a Storage
 type Record struct {
 	// ExpirationTime can be empty for records with endless existance
 	ExpirationTime *time.Time `json:"expiration_time,omitempty"`
-	Value          string     `json:"value,omitempty"`
-	Key            string     `json:"key"`
+	Value          []byte     `json:"value,omitempty"`
+	// ContentType is a MIME type of the value, can be empty
+	ContentType string `json:"content_type,omitempty"`
+	Key         string `json:"key"`
+	// Version is assigned by a Storage on every change, it grows monotonically
+	Version uint64 `json:"version,omitempty"`
+	// SlidingTTL prolongs ExpirationTime on every read, so the record expires after this period of inactivity
+	SlidingTTL time.Duration `json:"sliding_ttl,omitempty"`
+}
+
+// Expired checks if the record has expired by the time
+func (r Record) Expired(t time.Time) bool {
+	return r.ExpirationTime != nil && r.ExpirationTime.Before(t)
+}
+
+// Condition is a precondition of a mutation. Zero value always holds.
+type Condition struct {
+	// Exists requires the record to be present when true and to be absent when false
+	Exists *bool
+	// Match lists versions one of which the record must have
+	Match []uint64
+	// NoneMatch lists versions the record must not have
+	NoneMatch []uint64
+}
+
+// Check if a record satisfies the condition, exists tells if the record is present in a storage
+func (c Condition) Check(record Record, exists bool) bool {
+	if c.Exists != nil && *c.Exists != exists {
+		return false
+	}
+	if len(c.Match) > 0 && (!exists || !containsVersion(c.Match, record.Version)) {
+		return false
+	}
+	if len(c.NoneMatch) > 0 && exists && containsVersion(c.NoneMatch, record.Version) {
+		return false
+	}
+	return true
+}
+
+func containsVersion(versions []uint64, version uint64) bool {
+	for _, v := range versions {
+		if v == version {
+			return true
+		}
+	}
+	return false
+}
+
+// OpType is a kind of operation in a batch
+type OpType int
+
+const (
+	// OpSet saves record
+	OpSet OpType = iota
+	// OpDelete removes record by key
+	OpDelete
+)
+
+// Op is a single operation of a batch
+type Op struct {
+	Type OpType
+	// Record to save, only Key is used for OpDelete
+	Record    Record
+	Condition Condition
+}
+
+// Range limits keys of a scan, empty fields are not applied
+type Range struct {
+	// Prefix all keys start with
+	Prefix string
+	// Start is the lowest key, inclusive
+	Start string
+	// End is the upper bound of keys, exclusive
+	End string
+}
+
+// From returns the lowest key which can be in the range
+func (r Range) From() string {
+	if r.Prefix > r.Start {
+		return r.Prefix
+	}
+	return r.Start
+}
+
+// Contains checks if the key is in the range
+func (r Range) Contains(key string) bool {
+	return key >= r.Start && (r.End == "" || key < r.End) && strings.HasPrefix(key, r.Prefix)
+}
+
+// Beyond checks if the key and all keys after it are out of the range
+func (r Range) Beyond(key string) bool {
+	return (r.End != "" && key >= r.End) || (key > r.Prefix && !strings.HasPrefix(key, r.Prefix))
+}
+
+// EventType is a kind of change of a record
+type EventType string
+
+const (
+	// EventSet is sent when a record is saved
+	EventSet EventType = "set"
+	// EventDelete is sent when a record is removed
+	EventDelete EventType = "delete"
+	// EventExpired is sent when a record is removed because of its expiration
+	EventExpired EventType = "expired"
+	// EventExpire is sent when expiration time of a record is changed, only Key and ExpirationTime of the record are set
+	EventExpire EventType = "expire"
+	// EventOverflow is the last event sent to a watcher which doesn't keep up with changes
+	EventOverflow EventType = "overflow"
+)
+
+// Event describes a change of a record, only Key and Version of the record are set for removals
+type Event struct {
+	Type   EventType
+	Record Record
+	// Seq is a sequence number of the change, it grows monotonically
+	Seq uint64
+}
+
+// Dump is a consistent copy of all records
+type Dump struct {
+	// Version is the last version assigned to a change
+	Version uint64 `json:"version"`
+	// Seq is the sequence number of the last change included into the dump
+	Seq     uint64            `json:"seq"`
+	Records map[string]Record `json:"records"`
 }
 
 // Storage simple KV-storage
@@ -21,12 +172,54 @@ type Storage interface {
 	Get(string) (Record, bool)
 	// GetAll get all records from storage
 	GetAll() map[string]Record
-	// Filter get all records passed filtering by passed pattern where "$"" means "any number of symbols"
+	// Scan calls fn for records in the range in ascending order of keys until fn returns false
+	Scan(Range, func(Record) bool)
+	// Filter get all records with keys matching the pattern where "$" means "any number of symbols"
 	Filter(string) (map[string]Record, error)
+	// FilterValues get all records with values matching the pattern where "$" means "any number of symbols"
+	FilterValues(string) (map[string]Record, error)
 	// Set save record in a storage
-	Set(Record)
+	Set(context.Context, Record) error
+	// CompareAndSet save record if the current state of the record satisfies the condition
+	CompareAndSet(context.Context, Record, Condition) error
 	// Delete remove record with defined key
-	Delete(string)
+	Delete(context.Context, string) error
+	// CompareAndDelete remove record if its current state satisfies the condition
+	CompareAndDelete(context.Context, string, Condition) error
 	// DeleteAll remove all records
-	DeleteAll()
+	DeleteAll(context.Context) error
+	// Batch applies all operations atomically: either all of them succeed or none is applied
+	Batch(context.Context, []Op) error
+	// TTL returns expiration time of a record, it's nil for permanent records
+	TTL(string) (*time.Time, bool)
+	// Expire changes expiration time of a record without rewriting its value
+	Expire(context.Context, string, time.Time) error
+	// Persist removes expiration time of a record
+	Persist(context.Context, string) error
+	// Watch sends changes of records with keys starting with the prefix until the context is done.
+	// The channel is closed after EventOverflow when the watcher falls behind.
+	Watch(context.Context, string) <-chan Event
+	// Changes sends stored changes with sequence numbers greater than the given one and then goes on with new changes.
+	// ErrCompacted is returned when some of the requested changes are not kept anymore.
+	Changes(context.Context, uint64) (<-chan Event, error)
+	// Seq returns the sequence number of the last change
+	Seq() uint64
+	// Dump returns a copy of all records along with the sequence number of the last change
+	Dump() Dump
+}
+
+type timeKey struct{}
+
+// WithTime makes mutations of a storage decide which records are expired by the given time instead of the clock,
+// so replicas applying the same mutations at different moments get the same result
+func WithTime(ctx context.Context, t time.Time) context.Context {
+	return context.WithValue(ctx, timeKey{}, t)
+}
+
+// TimeFrom returns the time set by WithTime, it's the current time when none is set
+func TimeFrom(ctx context.Context) time.Time {
+	if t, ok := ctx.Value(timeKey{}).(time.Time); ok && !t.IsZero() {
+		return t
+	}
+	return time.Now()
 }
@@ -0,0 +1,189 @@
+package narwal
+
+import (
+	"encoding/binary"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Binary encoding of entries:
+//
+//	| number of events: uvarint | event length: uvarint | event | ... |
+//
+// and events, values are stored as is:
+//
+//	| format: byte | action: byte | flags: byte |
+//	| expiration: int64, if flagExpiration is set | version: uint64, if flagVersion is set |
+//	| sliding TTL: int64, if flagSliding is set | sequence number: uint64, if flagSeq is set |
+//	| key length: uvarint | key | content type length: uvarint | content type | value length: uvarint | value |
+//
+// Expiration time is stored as unix time in nanoseconds, sliding TTL in nanoseconds.
+const (
+	eventFormat = 1
+
+	flagExpiration = 1 << 0
+	flagVersion    = 1 << 1
+	flagSliding    = 1 << 2
+	// flagExpired marks removal of a record because of its expiration
+	flagExpired = 1 << 3
+	flagSeq     = 1 << 4
+)
+
+var errShortEvent = errors.New("event is too short")
+
+// marshalEntry encodes events into bytes
+func marshalEntry(events []event) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(buf[:], uint64(len(events)))
+	b := append([]byte{}, buf[:n]...)
+	for _, e := range events {
+		b = appendBytes(b, marshalEvent(e))
+	}
+	return b
+}
+
+// unmarshalEntry decodes events from bytes
+func unmarshalEntry(b []byte) ([]event, error) {
+	count, n := binary.Uvarint(b)
+	if n <= 0 || count > uint64(len(b)) {
+		return nil, errShortEvent
+	}
+	b = b[n:]
+	events := make([]event, 0, count)
+	for i := uint64(0); i < count; i++ {
+		var (
+			raw []byte
+			err error
+		)
+		if raw, b, err = readBytes(b); err != nil {
+			return nil, err
+		}
+		e, err := unmarshalEvent(raw)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, e)
+	}
+	return events, nil
+}
+
+// marshalEvent encodes event into bytes
+func marshalEvent(e event) []byte {
+	r := e.Record
+	size := 3 + 4*8 + 3*binary.MaxVarintLen64 + len(r.Key) + len(r.ContentType) + len(r.Value)
+	b := make([]byte, 3, size)
+	b[0] = eventFormat
+	b[1] = byte(e.Action)
+	if r.ExpirationTime != nil {
+		b[2] |= flagExpiration
+		b = appendUint64(b, uint64(r.ExpirationTime.UnixNano()))
+	}
+	if r.Version != 0 {
+		b[2] |= flagVersion
+		b = appendUint64(b, r.Version)
+	}
+	if e.Expired {
+		b[2] |= flagExpired
+	}
+	if r.SlidingTTL != 0 {
+		b[2] |= flagSliding
+		b = appendUint64(b, uint64(r.SlidingTTL))
+	}
+	if e.Seq != 0 {
+		b[2] |= flagSeq
+		b = appendUint64(b, e.Seq)
+	}
+	b = appendBytes(b, []byte(r.Key))
+	b = appendBytes(b, []byte(r.ContentType))
+	b = appendBytes(b, r.Value)
+	return b
+}
+
+// unmarshalEvent decodes event from bytes
+func unmarshalEvent(b []byte) (event, error) {
+	e := event{}
+	if len(b) < 3 {
+		return e, errShortEvent
+	}
+	if b[0] != eventFormat {
+		return e, errors.Errorf("unknown event format: %d", b[0])
+	}
+	e.Action = action(b[1])
+	flags := b[2]
+	e.Expired = flags&flagExpired != 0
+	b = b[3:]
+
+	if flags&flagExpiration != 0 {
+		if len(b) < 8 {
+			return e, errShortEvent
+		}
+		ts := time.Unix(0, int64(binary.BigEndian.Uint64(b))).UTC()
+		e.Record.ExpirationTime = &ts
+		b = b[8:]
+	}
+	if flags&flagVersion != 0 {
+		if len(b) < 8 {
+			return e, errShortEvent
+		}
+		e.Record.Version = binary.BigEndian.Uint64(b)
+		b = b[8:]
+	}
+	if flags&flagSliding != 0 {
+		if len(b) < 8 {
+			return e, errShortEvent
+		}
+		e.Record.SlidingTTL = time.Duration(binary.BigEndian.Uint64(b))
+		b = b[8:]
+	}
+	if flags&flagSeq != 0 {
+		if len(b) < 8 {
+			return e, errShortEvent
+		}
+		e.Seq = binary.BigEndian.Uint64(b)
+		b = b[8:]
+	}
+
+	var (
+		key, contentType, value []byte
+		err                     error
+	)
+	if key, b, err = readBytes(b); err != nil {
+		return e, err
+	}
+	if contentType, b, err = readBytes(b); err != nil {
+		return e, err
+	}
+	if value, _, err = readBytes(b); err != nil {
+		return e, err
+	}
+	e.Record.Key = string(key)
+	e.Record.ContentType = string(contentType)
+	if len(value) > 0 {
+		e.Record.Value = value
+	}
+	return e, nil
+}
+
+func appendUint64(b []byte, v uint64) []byte {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], v)
+	return append(b, buf[:]...)
+}
+
+func appendBytes(b []byte, v []byte) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(buf[:], uint64(len(v)))
+	b = append(b, buf[:n]...)
+	return append(b, v...)
+}
+
+// readBytes reads length-prefixed bytes and returns the rest of the buffer
+func readBytes(b []byte) ([]byte, []byte, error) {
+	length, n := binary.Uvarint(b)
+	if n <= 0 || uint64(len(b)-n) < length {
+		return nil, nil, errShortEvent
+	}
+	b = b[n:]
+	return b[:length:length], b[length:], nil
+}
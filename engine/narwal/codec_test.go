@@ -0,0 +1,61 @@
+package narwal
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/filatovw/ni-storage/engine"
+)
+
+func TestCodec(t *testing.T) {
+	ts := time.Date(2059, 1, 1, 1, 1, 1, 5, time.UTC)
+	testData := []struct {
+		name  string
+		input event
+	}{
+		{
+			name:  "delete",
+			input: event{Record: engine.Record{Key: "key1"}, Action: actionDelete},
+		},
+		{
+			name:  "text value",
+			input: event{Record: engine.Record{Key: "key1", Value: []byte("value1"), ContentType: "text/plain"}, Action: actionSet},
+		},
+		{
+			name:  "binary value with expiration",
+			input: event{Record: engine.Record{Key: "ключ", Value: []byte{0x00, 0xff, '\n', '"'}, ExpirationTime: &ts}, Action: actionSet},
+		},
+		{
+			name:  "sliding expiration",
+			input: event{Record: engine.Record{Key: "key1", Value: []byte("value1"), ExpirationTime: &ts, SlidingTTL: time.Minute, Version: 7}, Action: actionSet},
+		},
+		{
+			name:  "expired",
+			input: event{Record: engine.Record{Key: "key1", Version: 3}, Action: actionDelete, Expired: true, Seq: 42},
+		},
+		{
+			name:  "expire",
+			input: event{Record: engine.Record{Key: "key1", ExpirationTime: &ts}, Action: actionExpire},
+		},
+	}
+	for _, td := range testData {
+		t.Run(td.name, func(t *testing.T) {
+			b := marshalEvent(td.input)
+			found, err := unmarshalEvent(b)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if !reflect.DeepEqual(found, td.input) {
+				t.Errorf("expected: %#v, got: %#v", td.input, found)
+			}
+
+			// every truncated encoding is rejected
+			for i := 0; i < len(b); i++ {
+				if _, err := unmarshalEvent(b[:i]); err == nil {
+					t.Errorf("expected error on %d bytes out of %d", i, len(b))
+				}
+			}
+		})
+	}
+}
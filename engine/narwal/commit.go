@@ -0,0 +1,320 @@
+package narwal
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"github.com/filatovw/ni-storage/engine"
+	"github.com/filatovw/ni-storage/engine/narwal/ttl"
+)
+
+// Group commit.
+// Mutations don't touch the log and records directly. They are queued as proposals
+// and a single goroutine collects all waiting proposals into a batch, writes them
+// into the log at once (so there is one fsync per batch), applies them to records
+// and then wakes up the waiting callers.
+// Since the committer is the only writer of records, it reads them without locking.
+
+const (
+	proposalsQueueSize = 1024
+	maxBatchSize       = 1024
+)
+
+// proposal is a mutation waiting to be committed
+type proposal struct {
+	// prepare builds events against the state left by previous proposals of the batch
+	// an error returned by prepare rejects only this proposal
+	prepare func(v *view) ([]event, error)
+	// now is the time expiration is checked against
+	now  time.Time
+	done chan error
+}
+
+// view shows records as they will be after pending events of a batch are applied
+type view struct {
+	// parent is set for nested views, data is used otherwise
+	parent  *view
+	data    map[string]engine.Record
+	pending map[string]*engine.Record
+	// version is the last version assigned within the batch
+	version uint64
+	// seq is the sequence number of the last event of the batch
+	seq uint64
+	// expiration tells when a record expires
+	expiration func(engine.Record) *time.Time
+	// now is the time of the proposal being prepared
+	now time.Time
+}
+
+// fork creates a nested view, its events and versions are visible to the parent
+// only after they are applied to it
+func (v *view) fork() *view {
+	return &view{parent: v, pending: make(map[string]*engine.Record), version: v.version, expiration: v.expiration, now: v.now}
+}
+
+// nextVersion assigns a version to a change
+func (v *view) nextVersion() uint64 {
+	v.version++
+	return v.version
+}
+
+// get record by key, nil in pending means the record is deleted
+func (v *view) get(key string) (engine.Record, bool) {
+	if r, ok := v.pending[key]; ok {
+		if r == nil {
+			return engine.Null, false
+		}
+		return *r, true
+	}
+	if v.parent != nil {
+		return v.parent.get(key)
+	}
+	r, ok := v.data[key]
+	return r, ok
+}
+
+// live gets record by key like readers do: expired records are treated as absent
+func (v *view) live(key string) (engine.Record, bool) {
+	r, ok := v.get(key)
+	if !ok {
+		return engine.Null, false
+	}
+	if until := v.expiration(r); until != nil && until.Before(v.now) {
+		return engine.Null, false
+	}
+	return r, true
+}
+
+// keys returns all existing keys in sorted order
+func (v *view) keys() []string {
+	var base []string
+	if v.parent != nil {
+		base = v.parent.keys()
+	} else {
+		base = make([]string, 0, len(v.data))
+		for k := range v.data {
+			base = append(base, k)
+		}
+	}
+	keys := make([]string, 0, len(base)+len(v.pending))
+	for _, k := range base {
+		if _, ok := v.pending[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	for k, r := range v.pending {
+		if r != nil {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// apply event on top of the view
+func (v *view) apply(e event) {
+	switch e.Action {
+	case actionSet:
+		r := e.Record
+		v.pending[e.Record.Key] = &r
+	case actionDelete:
+		v.pending[e.Record.Key] = nil
+	case actionExpire:
+		if r, ok := v.get(e.Record.Key); ok {
+			r.ExpirationTime = e.Record.ExpirationTime
+			if r.ExpirationTime == nil {
+				r.SlidingTTL = 0
+			}
+			if e.Record.Version != 0 {
+				r.Version = e.Record.Version
+			}
+			v.pending[e.Record.Key] = &r
+		}
+	}
+	if e.Record.Version > v.version {
+		v.version = e.Record.Version
+	}
+	if e.Seq > v.seq {
+		v.seq = e.Seq
+	}
+}
+
+// propose queues mutation and waits until it's written into the log and applied.
+// When the context is done before that, the outcome of the mutation is unknown.
+// Expiration is checked against the time of the context, see engine.WithTime.
+func (s *Narwal) propose(ctx context.Context, prepare func(v *view) ([]event, error)) error {
+	p := &proposal{prepare: prepare, now: engine.TimeFrom(ctx), done: make(chan error, 1)}
+	select {
+	case s.proposals <- p:
+	case <-s.closed:
+		return engine.ErrClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case err := <-p.done:
+		return err
+	case <-s.closed:
+		// the proposal is either committed or rejected by now
+		select {
+		case err := <-p.done:
+			return err
+		default:
+			return engine.ErrClosed
+		}
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// commitLoop collects proposals into batches until the context is done
+func (s *Narwal) commitLoop(ctx context.Context) {
+	for {
+		select {
+		case p := <-s.proposals:
+			batch := []*proposal{p}
+		collect:
+			for len(batch) < maxBatchSize {
+				select {
+				case p := <-s.proposals:
+					batch = append(batch, p)
+				default:
+					break collect
+				}
+			}
+			s.commit(batch)
+		case <-ctx.Done():
+			close(s.closed)
+			// proposals queued before closing still expect an answer
+			for {
+				select {
+				case p := <-s.proposals:
+					p.done <- engine.ErrClosed
+				default:
+					s.closeWAL()
+					return
+				}
+			}
+		}
+	}
+}
+
+// commit writes events of a batch into the log and applies them to records
+func (s *Narwal) commit(batch []*proposal) {
+	s.commitLock.Lock()
+	defer s.commitLock.Unlock()
+
+	v := &view{data: s.data, pending: make(map[string]*engine.Record), version: s.version, seq: s.seq, expiration: s.expiration}
+	// every proposal is written as a separate entry, so it's replayed entirely or not at all
+	entries := [][]event{}
+	errs := make([]error, len(batch))
+	for i, p := range batch {
+		v.now = p.now
+		proposed, err := p.prepare(v)
+		if err != nil {
+			errs[i] = err
+			continue
+		}
+		if len(proposed) == 0 {
+			continue
+		}
+		for i := range proposed {
+			// replicated events keep sequence numbers of the leader
+			if proposed[i].Seq == 0 {
+				proposed[i].Seq = v.seq + 1
+			}
+			v.apply(proposed[i])
+		}
+		entries = append(entries, proposed)
+	}
+
+	var err error
+	if len(entries) > 0 {
+		err = s.wal.WriteEntries(entries...)
+	}
+	if err == nil {
+		s.lock.Lock()
+		for _, entry := range entries {
+			for _, e := range entry {
+				s.apply(e)
+			}
+		}
+		s.version = v.version
+		s.seq = v.seq
+		s.lock.Unlock()
+		// the commit lock keeps changes in order
+		for _, entry := range entries {
+			for _, e := range entry {
+				s.publish(e)
+			}
+		}
+	}
+
+	for i, p := range batch {
+		if errs[i] != nil {
+			p.done <- errs[i]
+			continue
+		}
+		p.done <- err
+	}
+}
+
+// apply event to records
+func (s *Narwal) apply(e event) {
+	switch e.Action {
+	case actionSet:
+		if e.Record.ExpirationTime != nil {
+			s.ttl.Push(ttl.Record{Key: e.Record.Key, Until: *e.Record.ExpirationTime})
+		}
+		s.data[e.Record.Key] = e.Record
+		s.keys.Insert(e.Record.Key)
+	case actionDelete:
+		s.ttl.Delete(e.Record.Key)
+		delete(s.data, e.Record.Key)
+		s.keys.Delete(e.Record.Key)
+	case actionExpire:
+		r, ok := s.data[e.Record.Key]
+		if !ok {
+			return
+		}
+		r.ExpirationTime = e.Record.ExpirationTime
+		if r.ExpirationTime == nil {
+			r.SlidingTTL = 0
+		}
+		if e.Record.Version != 0 {
+			r.Version = e.Record.Version
+		}
+		s.data[e.Record.Key] = r
+		if r.ExpirationTime != nil {
+			s.ttl.Push(ttl.Record{Key: r.Key, Until: *r.ExpirationTime})
+		} else {
+			s.ttl.Delete(r.Key)
+		}
+	}
+}
+
+// publish event to watchers
+func (s *Narwal) publish(e event) {
+	if change, ok := changeEvent(e); ok {
+		s.hub.Publish(change)
+	}
+}
+
+// changeEvent describes event of the log as a change of a record
+func changeEvent(e event) (engine.Event, bool) {
+	change := engine.Event{Record: e.Record, Seq: e.Seq}
+	switch {
+	case e.Action == actionSet:
+		change.Type = engine.EventSet
+	case e.Action == actionDelete && e.Expired:
+		change.Type = engine.EventExpired
+	case e.Action == actionDelete:
+		change.Type = engine.EventDelete
+	case e.Action == actionExpire:
+		change.Type = engine.EventExpire
+	default:
+		return change, false
+	}
+	return change, true
+}
@@ -2,19 +2,40 @@ package narwal
 
 import (
 	"context"
-	"regexp"
-	"strings"
+	"path/filepath"
 	"sync"
 	"time"
 
+	"github.com/filatovw/ni-storage/config"
 	"github.com/filatovw/ni-storage/engine"
+	"github.com/filatovw/ni-storage/engine/narwal/index"
+	"github.com/filatovw/ni-storage/engine/narwal/pubsub"
 	"github.com/filatovw/ni-storage/engine/narwal/ttl"
 	"github.com/filatovw/ni-storage/logger"
 	"github.com/pkg/errors"
 )
 
 var (
-	defaultTTLCheckPeriod = 2 * time.Second
+	defaultExpirePeriod        = 100 * time.Millisecond
+	defaultExpireBudget        = 1000
+	defaultCompactCheckPeriod  = 30 * time.Second
+	defaultCompactMinSize      = int64(64 << 20) // 64 MB
+	defaultCompactGarbageRatio = 0.5
+	defaultSnapshotInterval    = 5 * time.Minute
+	defaultSnapshotRetain      = 2
+	defaultDurability          = DurabilityAlways
+	defaultSyncInterval        = 100 * time.Millisecond
+	defaultTouchFlushPeriod    = time.Second
+)
+
+// errStopped is returned when a reader of changes is gone
+var errStopped = errors.New("reading is stopped")
+
+const (
+	// expiredQueueSize is a number of keys found expired by readers waiting for the sweeper
+	expiredQueueSize = 1024
+	// watchBufferSize is a number of changes a watcher may fall behind
+	watchBufferSize = 1024
 )
 
 // Narwal engine stores data on a disk and keeps copy of data in memory.
@@ -22,46 +43,152 @@ type Narwal struct {
 	log  logger.Logger
 	lock *sync.RWMutex
 	data map[string]engine.Record
+	// keys of records in sorted order
+	keys *index.Index
 	wal  *WAL
 	ttl  *ttl.Index
+
+	// expirePeriod is a period between sweeps of expired keys
+	expirePeriod time.Duration
+	// expireBudget is a number of keys removed at once by the sweeper
+	expireBudget int
+	// expired receives keys found expired by readers
+	expired chan string
+	// touches keeps the time of the last read of records with sliding TTL until it's flushed into the log
+	touches   map[string]time.Time
+	touchLock *sync.Mutex
+	// hub delivers committed changes to watchers
+	hub *pubsub.Hub
+
+	compactMinSize      int64
+	compactGarbageRatio float64
+
+	snapshotInterval time.Duration
+	snapshotRetain   int
+	// maintenance serializes compaction and snapshotting
+	maintenance *sync.Mutex
+
+	proposals chan *proposal
+	// closed is closed when the storage stops accepting mutations
+	closed chan struct{}
+	// commitLock is held while a batch is written into the log and applied to records
+	commitLock *sync.Mutex
+	// version is the last version assigned to a change
+	version uint64
+	// seq is the sequence number of the last event written into the log
+	seq uint64
+	// follower is set while records are changed only by a leader, see Apply
+	follower bool
 }
 
 // event holds state container and performed action
 type event struct {
 	Record engine.Record `json:"record"`
 	Action action        `json:"action"`
+	// Expired is set for removals of expired records
+	Expired bool `json:"expired,omitempty"`
+	// Seq is a sequence number of the event in the log, it's empty for records rewritten by compaction
+	Seq uint64 `json:"seq,omitempty"`
 }
 
 // New creates engine object
-func New(ctx context.Context, path string, log logger.Logger) (*Narwal, error) {
-	wal, err := OpenWAL(log, path, defaultMaxRecordSize)
+func New(ctx context.Context, cfg config.NarWAL, log logger.Logger) (*Narwal, error) {
+	durability := defaultDurability
+	if cfg.Durability != "" {
+		d, err := ParseDurability(cfg.Durability)
+		if err != nil {
+			return nil, err
+		}
+		durability = d
+	}
+	syncInterval := cfg.SyncInterval
+	if syncInterval <= 0 {
+		syncInterval = defaultSyncInterval
+	}
+
+	wal, err := OpenWAL(log, cfg.DataDir, defaultMaxRecordSize)
 	if err != nil {
 		return nil, errors.Wrap(err, "open WAL")
 	}
-	snapshot, err := wal.Read()
+	wal.SetDurability(durability)
+	snap, err := loadSnapshot(log, wal.dir, wal.Size())
+	if err != nil {
+		return nil, errors.Wrap(err, "load snapshot")
+	}
+	snapshot, err := wal.ReadFrom(snap)
 	if err != nil {
 		return nil, err
 	}
 
 	ttlIndex := ttl.NewIndex()
+	keys := index.NewIndex()
+	for k, r := range snapshot {
+		keys.Insert(k)
+		if r.ExpirationTime != nil {
+			ttlIndex.Push(ttl.Record{Key: k, Until: *r.ExpirationTime})
+		}
+	}
 
 	storage := &Narwal{
-		log:  log,
-		wal:  wal,
-		lock: &sync.RWMutex{},
-		data: snapshot,
-		ttl:  &ttlIndex,
+		log:     log,
+		wal:     wal,
+		lock:    &sync.RWMutex{},
+		data:    snapshot,
+		keys:    keys,
+		version: snap.Version,
+		seq:     snap.Seq,
+		ttl:     &ttlIndex,
+
+		expirePeriod: cfg.ExpirePeriod,
+		expireBudget: cfg.ExpireBudget,
+		expired:      make(chan string, expiredQueueSize),
+		touches:      make(map[string]time.Time),
+		touchLock:    &sync.Mutex{},
+		hub:          pubsub.NewHub(watchBufferSize),
+
+		compactMinSize:      cfg.CompactMinSize,
+		compactGarbageRatio: cfg.CompactGarbageRatio,
+		snapshotInterval:    cfg.SnapshotInterval,
+		snapshotRetain:      cfg.SnapshotRetain,
+		maintenance:         &sync.Mutex{},
+		proposals:           make(chan *proposal, proposalsQueueSize),
+		closed:              make(chan struct{}),
+		commitLock:          &sync.Mutex{},
+		follower:            cfg.Follower,
+	}
+	if storage.expirePeriod <= 0 {
+		storage.expirePeriod = defaultExpirePeriod
+	}
+	if storage.expireBudget <= 0 {
+		storage.expireBudget = defaultExpireBudget
+	}
+	if storage.compactMinSize <= 0 {
+		storage.compactMinSize = defaultCompactMinSize
 	}
+	if storage.compactGarbageRatio <= 0 {
+		storage.compactGarbageRatio = defaultCompactGarbageRatio
+	}
+	if storage.snapshotInterval <= 0 {
+		storage.snapshotInterval = defaultSnapshotInterval
+	}
+	if storage.snapshotRetain <= 0 {
+		storage.snapshotRetain = defaultSnapshotRetain
+	}
+	go storage.commitLoop(ctx)
 	storage.deleteExpired(time.Now())
 
-	go storage.closeWAL(ctx)
-	go storage.checkExpired(ctx, defaultTTLCheckPeriod)
+	go storage.checkExpired(ctx, storage.expirePeriod)
+	go storage.checkTouches(ctx, defaultTouchFlushPeriod)
+	go storage.checkCompaction(ctx, defaultCompactCheckPeriod)
+	go storage.takeSnapshots(ctx, storage.snapshotInterval)
+	if durability == DurabilityInterval {
+		go storage.syncWAL(ctx, syncInterval)
+	}
 	return storage, nil
 }
 
 // closeWAL closes log-file
-func (s *Narwal) closeWAL(ctx context.Context) {
-	<-ctx.Done()
+func (s *Narwal) closeWAL() {
 	if err := s.wal.Close(); err != nil {
 		s.log.Errorf("failed to close WAL, possible data corruption: %s", err)
 	}
@@ -69,11 +196,106 @@ func (s *Narwal) closeWAL(ctx context.Context) {
 
 // deleteExpired delete all keys that are expired by the time
 func (s *Narwal) deleteExpired(t time.Time) {
+	if s.isFollower() {
+		return
+	}
+	s.lock.Lock()
 	keys := s.ttl.PopAfter(t)
+	s.lock.Unlock()
+	s.removeExpired(keys, t)
+}
+
+// removeExpired delete keys which are still expired by the time
+func (s *Narwal) removeExpired(keys []string, t time.Time) {
+	if len(keys) == 0 {
+		return
+	}
 	s.log.Debugf("keys: %s", keys)
+	if err := s.RemoveExpired(context.Background(), keys, t); err != nil {
+		s.log.Errorf("failed to remove expired keys: %s", err)
+	}
+}
+
+// RemoveExpired deletes keys which are still expired by the time, the rest of them are put back into the TTL index
+func (s *Narwal) RemoveExpired(ctx context.Context, keys []string, t time.Time) error {
+	defer s.Reindex(keys)
+	return s.propose(ctx, func(v *view) ([]event, error) {
+		events := []event{}
+		for _, key := range keys {
+			// the key could be updated after it was taken from the index
+			record, ok := v.get(key)
+			if !ok || !s.isExpired(record, t) {
+				continue
+			}
+			s.log.Debugf("Removed expired: %s", key)
+			e := deleteEvent(v, key)
+			e.Expired = true
+			events = append(events, e)
+		}
+		return events, nil
+	})
+}
+
+// expire schedules removal of a key found expired by a reader, the key is left to the sweeper when the queue is full
+func (s *Narwal) expire(key string) {
+	select {
+	case s.expired <- key:
+	default:
+	}
+}
+
+// sweepExpired removes expired keys in rounds of expireBudget keys.
+// It works like the active expiration of Redis, but the TTL index gives the oldest keys instead of random samples:
+// the next round starts only if the previous one used up the whole budget, and a sweep takes at most
+// a quarter of the period, so a mass expiry doesn't hold the committer and writers for long.
+func (s *Narwal) sweepExpired(period time.Duration) {
+	if s.isFollower() {
+		// expired records are removed by the leader
+		return
+	}
+	deadline := time.Now().Add(period / 4)
+	for {
+		now := time.Now()
+		keys := s.Expired(now, s.expireBudget)
+		s.removeExpired(keys, now)
+		if len(keys) < s.expireBudget || time.Now().After(deadline) {
+			return
+		}
+	}
+}
+
+// Expired takes at most n keys which are expired by the time, keys found by readers go first.
+// Taken keys have to be removed with RemoveExpired or put back with Reindex.
+func (s *Narwal) Expired(t time.Time, n int) []string {
+	keys := []string{}
+drain:
+	for len(keys) < n {
+		select {
+		case key := <-s.expired:
+			keys = append(keys, key)
+		default:
+			break drain
+		}
+	}
+	s.lock.Lock()
+	keys = append(keys, s.ttl.PopAfterN(t, n-len(keys))...)
+	s.lock.Unlock()
+	return keys
+}
+
+// Reindex puts keys taken by Expired back into the TTL index unless they are removed,
+// so keys prolonged by reads or left after a failed removal are swept later
+func (s *Narwal) Reindex(keys []string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
 	for _, key := range keys {
-		s.log.Debugf("Removed expired: %s", key)
-		s.Delete(key)
+		r, ok := s.data[key]
+		if !ok {
+			continue
+		}
+		if until := s.expiration(r); until != nil {
+			s.ttl.Push(ttl.Record{Key: key, Until: *until})
+		}
 	}
 }
 
@@ -83,7 +305,42 @@ func (s *Narwal) checkExpired(ctx context.Context, period time.Duration) {
 	for {
 		select {
 		case <-t.C:
-			s.deleteExpired(time.Now())
+			s.sweepExpired(period)
+		case <-ctx.Done():
+			t.Stop()
+			return
+		}
+	}
+}
+
+// syncWAL periodically flushes the log to a disk
+func (s *Narwal) syncWAL(ctx context.Context, period time.Duration) {
+	t := time.NewTicker(period)
+	for {
+		select {
+		case <-t.C:
+			if err := s.wal.Sync(); err != nil {
+				s.log.Errorf("failed to sync WAL: %s", err)
+			}
+		case <-ctx.Done():
+			t.Stop()
+			return
+		}
+	}
+}
+
+// checkCompaction compacts the log when it grows too large and holds too many stale entries
+func (s *Narwal) checkCompaction(ctx context.Context, period time.Duration) {
+	t := time.NewTicker(period)
+	for {
+		select {
+		case <-t.C:
+			if !s.needsCompaction() {
+				continue
+			}
+			if err := s.Compact(); err != nil {
+				s.log.Errorf("failed to compact WAL: %s", err)
+			}
 		case <-ctx.Done():
 			t.Stop()
 			return
@@ -91,96 +348,441 @@ func (s *Narwal) checkExpired(ctx context.Context, period time.Duration) {
 	}
 }
 
+// needsCompaction checks size of the log and share of stale entries in it
+func (s *Narwal) needsCompaction() bool {
+	if s.wal.Size() < s.compactMinSize {
+		return false
+	}
+	events := s.wal.Events()
+	if events == 0 {
+		return false
+	}
+	s.lock.RLock()
+	live := len(s.data)
+	s.lock.RUnlock()
+	garbage := float64(events-live) / float64(events)
+	return garbage >= s.compactGarbageRatio
+}
+
+// Compact rewrites the log so it keeps only actual state of records.
+// Readers are not blocked, writers are blocked only while records are copied and the new log replaces the old one.
+func (s *Narwal) Compact() error {
+	s.maintenance.Lock()
+	defer s.maintenance.Unlock()
+
+	// offsets of existing snapshots are meaningless for the compacted log
+	if err := purgeSnapshots(s.wal.dir, 0); err != nil {
+		return errors.Wrap(err, "remove snapshots")
+	}
+
+	s.commitLock.Lock()
+	snapshot := make(map[string]engine.Record, len(s.data))
+	for k, v := range s.data {
+		snapshot[k] = v
+	}
+	version, seq := s.version, s.seq
+	// the committer is waiting for the lock, so the copy and the log are consistent
+	err := s.wal.StartRewrite()
+	s.commitLock.Unlock()
+	if err != nil {
+		return err
+	}
+
+	before := s.wal.Size()
+	if err := s.wal.Rewrite(snapshot, version, seq); err != nil {
+		return errors.Wrap(err, "rewrite WAL")
+	}
+	s.log.Infof("WAL compacted: %d -> %d bytes", before, s.wal.Size())
+	return nil
+}
+
+// takeSnapshots periodically stores snapshot of records
+func (s *Narwal) takeSnapshots(ctx context.Context, period time.Duration) {
+	t := time.NewTicker(period)
+	for {
+		select {
+		case <-t.C:
+			if err := s.Snapshot(); err != nil {
+				s.log.Errorf("failed to take snapshot: %s", err)
+			}
+		case <-ctx.Done():
+			t.Stop()
+			return
+		}
+	}
+}
+
+// Snapshot stores a point-in-time copy of records tagged with the current offset of the log.
+// Only the newest snapshots are retained.
+func (s *Narwal) Snapshot() error {
+	s.maintenance.Lock()
+	defer s.maintenance.Unlock()
+
+	s.commitLock.Lock()
+	snap := snapshot{
+		Offset:  s.wal.Size(),
+		Events:  s.wal.Events(),
+		Version: s.version,
+		Seq:     s.seq,
+		Base:    s.wal.Base(),
+		Records: make(map[string]engine.Record, len(s.data)),
+	}
+	for k, v := range s.data {
+		snap.Records[k] = v
+	}
+	s.commitLock.Unlock()
+
+	paths, err := listSnapshots(s.wal.dir)
+	if err != nil {
+		return errors.Wrap(err, "list snapshots")
+	}
+	if len(paths) > 0 && filepath.Base(paths[0]) == snapshotName(snap.Offset) {
+		// nothing has changed since the last snapshot
+		return nil
+	}
+	if err := writeSnapshot(s.wal.dir, snap); err != nil {
+		return err
+	}
+	s.log.Debugf("snapshot taken at offset %d", snap.Offset)
+	return purgeSnapshots(s.wal.dir, s.snapshotRetain)
+}
+
 // Exists check if key exists in a storage
 func (s *Narwal) Exists(key string) bool {
-	s.lock.RLock()
-	defer s.lock.RUnlock()
-	_, ok := s.data[key]
+	_, ok := s.Get(key)
 	return ok
 }
 
-// Get find record by key
+// Get find record by key, expired records are treated as absent
 func (s *Narwal) Get(key string) (engine.Record, bool) {
 	s.lock.RLock()
-	defer s.lock.RUnlock()
 	record, ok := s.data[key]
+	follower := s.follower
+	s.lock.RUnlock()
 	if !ok {
 		return engine.Null, false
 	}
+	now := time.Now()
+	if s.isExpired(record, now) {
+		s.expire(key)
+		return engine.Null, false
+	}
+	// reads of a follower don't prolong records of the leader
+	if record.SlidingTTL > 0 && !follower {
+		s.touch(key, now)
+	}
 	return record, true
 }
 
 // Set save record in a storage
-func (s *Narwal) Set(record engine.Record) {
-	s.lock.Lock()
-	defer s.lock.Unlock()
-	s.set(record)
+func (s *Narwal) Set(ctx context.Context, record engine.Record) error {
+	return s.CompareAndSet(ctx, record, engine.Condition{})
+}
+
+// CompareAndSet save record if the current state of the record satisfies the condition
+func (s *Narwal) CompareAndSet(ctx context.Context, record engine.Record, cond engine.Condition) error {
+	// checked in advance, so a large record doesn't fail the whole batch
+	if len(record.Value) > s.wal.maxRecordSize {
+		return engine.ErrTooLarge
+	}
+	return s.propose(ctx, func(v *view) ([]event, error) {
+		return prepareSet(v, record, cond)
+	})
 }
 
 // Delete remove record with defined key
-func (s *Narwal) Delete(key string) {
-	s.lock.Lock()
-	defer s.lock.Unlock()
-	s.delete(key)
+func (s *Narwal) Delete(ctx context.Context, key string) error {
+	return s.CompareAndDelete(ctx, key, engine.Condition{})
+}
+
+// CompareAndDelete remove record if its current state satisfies the condition
+func (s *Narwal) CompareAndDelete(ctx context.Context, key string, cond engine.Condition) error {
+	return s.propose(ctx, func(v *view) ([]event, error) {
+		return prepareDelete(v, key, cond)
+	})
+}
+
+// Batch applies all operations atomically: either all of them succeed or none is applied
+func (s *Narwal) Batch(ctx context.Context, ops []engine.Op) error {
+	for _, op := range ops {
+		if len(op.Record.Value) > s.wal.maxRecordSize {
+			return errors.Wrapf(engine.ErrTooLarge, "key %s", op.Record.Key)
+		}
+	}
+	return s.propose(ctx, func(v *view) ([]event, error) {
+		tx := v.fork()
+		events := []event{}
+		for _, op := range ops {
+			var (
+				proposed []event
+				err      error
+			)
+			switch op.Type {
+			case engine.OpSet:
+				proposed, err = prepareSet(tx, op.Record, op.Condition)
+			case engine.OpDelete:
+				proposed, err = prepareDelete(tx, op.Record.Key, op.Condition)
+			default:
+				err = errors.Errorf("unknown operation: %d", op.Type)
+			}
+			if err != nil {
+				return nil, errors.Wrapf(err, "key %s", op.Record.Key)
+			}
+			for _, e := range proposed {
+				tx.apply(e)
+			}
+			events = append(events, proposed...)
+		}
+		return events, nil
+	})
+}
+
+// prepareSet builds event that saves record if the condition holds
+func prepareSet(v *view, record engine.Record, cond engine.Condition) ([]event, error) {
+	current, ok := v.live(record.Key)
+	if !cond.Check(current, ok) {
+		return nil, engine.ErrPreconditionFailed
+	}
+	if record.SlidingTTL > 0 && record.ExpirationTime == nil {
+		until := v.now.Add(record.SlidingTTL)
+		record.ExpirationTime = &until
+	}
+	//  check if record has already expired
+	if record.ExpirationTime != nil && record.ExpirationTime.Before(v.now) {
+		return nil, nil
+	}
+	record.Version = v.nextVersion()
+	return []event{{Record: record, Action: actionSet}}, nil
+}
+
+// prepareDelete builds event that removes record if the condition holds
+func prepareDelete(v *view, key string, cond engine.Condition) ([]event, error) {
+	current, ok := v.live(key)
+	if !cond.Check(current, ok) {
+		return nil, engine.ErrPreconditionFailed
+	}
+	return []event{deleteEvent(v, key)}, nil
+}
+
+// TTL returns expiration time of a record, it's nil for permanent records
+func (s *Narwal) TTL(key string) (*time.Time, bool) {
+	s.lock.RLock()
+	record, ok := s.data[key]
+	s.lock.RUnlock()
+	if !ok || s.isExpired(record, time.Now()) {
+		return nil, false
+	}
+	return s.expiration(record), true
 }
 
-// Filter get all records passed filtering by pattern where "$"" means "any number of symbols"
+// Expire changes expiration time of a record without rewriting its value, the record is removed if the time has passed
+func (s *Narwal) Expire(ctx context.Context, key string, until time.Time) error {
+	return s.propose(ctx, func(v *view) ([]event, error) {
+		if _, ok := v.live(key); !ok {
+			return nil, engine.ErrNotFound
+		}
+		if until.Before(v.now) {
+			return []event{deleteEvent(v, key)}, nil
+		}
+		return []event{{Record: engine.Record{Key: key, ExpirationTime: &until, Version: v.nextVersion()}, Action: actionExpire}}, nil
+	})
+}
+
+// Persist removes expiration time of a record, sliding TTL is removed as well
+func (s *Narwal) Persist(ctx context.Context, key string) error {
+	return s.propose(ctx, func(v *view) ([]event, error) {
+		current, ok := v.live(key)
+		if !ok {
+			return nil, engine.ErrNotFound
+		}
+		if current.ExpirationTime == nil && current.SlidingTTL == 0 {
+			return nil, nil
+		}
+		return []event{{Record: engine.Record{Key: key, Version: v.nextVersion()}, Action: actionExpire}}, nil
+	})
+}
+
+// Watch sends changes of records with keys starting with the prefix until the context is done.
+// The channel is closed after engine.EventOverflow when the watcher falls behind.
+func (s *Narwal) Watch(ctx context.Context, prefix string) <-chan engine.Event {
+	sub := s.hub.Subscribe(prefix)
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-s.closed:
+		}
+		s.hub.Unsubscribe(sub)
+	}()
+	return sub.C
+}
+
+// Changes sends stored changes with sequence numbers greater than since and then goes on with new changes
+// until the context is done. The channel is closed after engine.EventOverflow when the reader falls behind.
+func (s *Narwal) Changes(ctx context.Context, since uint64) (<-chan engine.Event, error) {
+	// subscribed in advance, so nothing is missed between reading the log and new changes
+	sub := s.hub.Subscribe("")
+	s.lock.RLock()
+	last := s.seq
+	s.lock.RUnlock()
+	if since < s.wal.Base() {
+		s.hub.Unsubscribe(sub)
+		return nil, engine.ErrCompacted
+	}
+
+	changes := make(chan engine.Event)
+	go func() {
+		defer close(changes)
+		defer s.hub.Unsubscribe(sub)
+		send := func(e engine.Event) bool {
+			select {
+			case changes <- e:
+				return true
+			case <-ctx.Done():
+				return false
+			case <-s.closed:
+				return false
+			}
+		}
+
+		if since < last {
+			err := s.wal.ReadSince(since, func(e event) error {
+				change, ok := changeEvent(e)
+				if !ok {
+					return nil
+				}
+				if !send(change) {
+					return errStopped
+				}
+				since = e.Seq
+				return nil
+			})
+			if err == errStopped {
+				return
+			}
+			if err != nil {
+				s.log.Errorf("failed to read changes from the log: %s", err)
+				// the reader has to start over
+				send(engine.Event{Type: engine.EventOverflow})
+				return
+			}
+		}
+		for {
+			select {
+			case e, ok := <-sub.C:
+				if !ok {
+					return
+				}
+				// the change is already read from the log
+				if e.Type != engine.EventOverflow && e.Seq <= since {
+					continue
+				}
+				if !send(e) {
+					return
+				}
+			case <-ctx.Done():
+				return
+			case <-s.closed:
+				return
+			}
+		}
+	}()
+	return changes, nil
+}
+
+// deleteEvent builds removal of a record.
+// It has own version, so the counter of versions doesn't go back after restart.
+func deleteEvent(v *view, key string) event {
+	return event{Record: engine.Record{Key: key, Version: v.nextVersion()}, Action: actionDelete}
+}
+
+// Scan calls fn for records in the range in ascending order of keys until fn returns false.
+// Mutations wait until the scan is over, so fn should be fast.
+func (s *Narwal) Scan(r engine.Range, fn func(engine.Record) bool) {
+	now := time.Now()
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	s.keys.Ascend(r.From(), func(key string) bool {
+		if r.Beyond(key) {
+			return false
+		}
+		if !r.Contains(key) {
+			return true
+		}
+		record := s.data[key]
+		if s.isExpired(record, now) {
+			s.expire(key)
+			return true
+		}
+		return fn(record)
+	})
+}
+
+// Filter get all records with keys matching the pattern where "$" means "any number of symbols".
+// Only keys starting with the literal prefix of the pattern are checked.
 func (s *Narwal) Filter(pattern string) (map[string]engine.Record, error) {
-	regPattern := strings.ReplaceAll(pattern, "$", ".*")
-	s.log.Debugf("pattern %s", regPattern)
-	exp, err := regexp.Compile(regPattern)
+	p, err := engine.CompilePattern(pattern)
 	if err != nil {
 		return nil, err
 	}
 
+	results := make(map[string]engine.Record)
+	s.Scan(engine.Range{Prefix: p.Prefix()}, func(r engine.Record) bool {
+		if p.MatchString(r.Key) {
+			results[r.Key] = r
+		}
+		return true
+	})
+	return results, nil
+}
+
+// FilterValues get all records with values matching the pattern where "$" means "any number of symbols"
+func (s *Narwal) FilterValues(pattern string) (map[string]engine.Record, error) {
+	p, err := engine.CompilePattern(pattern)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
 	s.lock.RLock()
 	defer s.lock.RUnlock()
 
 	results := make(map[string]engine.Record)
 	for _, v := range s.data {
-		if exp.MatchString(v.Value) {
+		if s.isExpired(v, now) {
+			s.expire(v.Key)
+			continue
+		}
+		if p.Match(v.Value) {
 			results[v.Key] = v
 		}
 	}
 	return results, nil
 }
 
-// GetAll get all records from storage
+// GetAll get all records from storage except expired ones
 func (s *Narwal) GetAll() map[string]engine.Record {
+	now := time.Now()
 	s.lock.RLock()
 	defer s.lock.RUnlock()
-	return s.data
-}
-
-// DeleteAll remove all records
-func (s *Narwal) DeleteAll() {
-	s.lock.Lock()
-	defer s.lock.Unlock()
-	for k := range s.data {
-		s.delete(k)
-	}
-}
-
-// set save record in a storage
-func (s *Narwal) set(record engine.Record) {
-	//  check if record has already expired
-	if record.ExpirationTime != nil && record.ExpirationTime.Before(time.Now()) {
-		return
-	}
-	if err := s.wal.Write(event{Record: record, Action: actionSet}); err != nil {
-		s.log.Error(err)
-	}
-	if record.ExpirationTime != nil {
-		s.ttl.Push(ttl.Record{Key: record.Key, Until: *record.ExpirationTime})
+	results := make(map[string]engine.Record, len(s.data))
+	for k, v := range s.data {
+		if s.isExpired(v, now) {
+			s.expire(k)
+			continue
+		}
+		results[k] = v
 	}
-	s.data[record.Key] = record
+	return results
 }
 
-// delete remove value from a storage by key
-func (s *Narwal) delete(key string) {
-	if err := s.wal.Write(event{Record: engine.Record{Key: key}, Action: actionDelete}); err != nil {
-		s.log.Error(err)
-	}
-	s.ttl.Delete(key)
-	delete(s.data, key)
+// DeleteAll remove all records
+func (s *Narwal) DeleteAll(ctx context.Context) error {
+	return s.propose(ctx, func(v *view) ([]event, error) {
+		keys := v.keys()
+		events := make([]event, len(keys))
+		for i, key := range keys {
+			events[i] = deleteEvent(v, key)
+		}
+		return events, nil
+	})
 }
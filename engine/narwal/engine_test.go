@@ -2,14 +2,20 @@ package narwal
 
 import (
 	"context"
+	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
 	"reflect"
+	"sort"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/filatovw/ni-storage/config"
 	"github.com/filatovw/ni-storage/engine"
+	"github.com/pkg/errors"
 	"go.uber.org/zap"
 )
 
@@ -24,7 +30,7 @@ func SetupEngineHelper(t *testing.T) (*Narwal, string) {
 		t.Errorf("error on logger init: %s", err)
 	}
 
-	s, err := New(context.TODO(), tmpdir, log.Sugar())
+	s, err := New(context.TODO(), config.NarWAL{DataDir: tmpdir}, log.Sugar())
 	if err != nil {
 		t.Errorf("create engine: %s", err)
 	}
@@ -35,8 +41,9 @@ func TestEngineSet(t *testing.T) {
 	s, tmpdir := SetupEngineHelper(t)
 	defer os.RemoveAll(tmpdir)
 
-	record := engine.Record{Key: "key1", Value: "value1"}
-	s.Set(record)
+	record := engine.Record{Key: "key1", Value: []byte("value1")}
+	s.Set(context.TODO(), record)
+	record.Version = 1
 	records := s.GetAll()
 	v, ok := records[record.Key]
 	if !ok {
@@ -54,21 +61,52 @@ func TestEngineSetExpiredTTL(t *testing.T) {
 
 	ts := time.Now()
 	ts = ts.Add(-time.Second * 5)
-	record := engine.Record{Key: "key1", Value: "value1", ExpirationTime: &ts}
-	s.Set(record)
+	record := engine.Record{Key: "key1", Value: []byte("value1"), ExpirationTime: &ts}
+	s.Set(context.TODO(), record)
 	expected := make(map[string]engine.Record)
 	if !reflect.DeepEqual(s.GetAll(), expected) {
 		t.Errorf("expected: %v, got: %v", expected, s.GetAll())
 	}
 }
 
+func TestEngineSetWithTime(t *testing.T) {
+	s, tmpdir := SetupEngineHelper(t)
+	defer os.RemoveAll(tmpdir)
+
+	// a mutation proposed before the record expired is applied late
+	proposed := time.Now().Add(-time.Minute)
+	ctx := engine.WithTime(context.TODO(), proposed)
+	until := proposed.Add(time.Second)
+	if err := s.Set(ctx, engine.Record{Key: "key1", Value: []byte("value1"), ExpirationTime: &until}); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if s.Seq() != 1 {
+		t.Errorf("expected the record to be saved, got seq %d", s.Seq())
+	}
+	// the record is live by the time of the mutation
+	cond := engine.Condition{Match: []uint64{1}}
+	if err := s.CompareAndSet(ctx, engine.Record{Key: "key1", Value: []byte("value2")}, cond); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	if err := s.Expire(ctx, "key1", proposed.Add(time.Second)); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	// readers use the clock
+	if _, ok := s.Get("key1"); ok {
+		t.Errorf("expected key1 to be expired")
+	}
+	if err := s.CompareAndSet(context.TODO(), engine.Record{Key: "key1", Value: []byte("value3")}, engine.Condition{Match: []uint64{2}}); err != engine.ErrPreconditionFailed {
+		t.Errorf("expected %s, got %v", engine.ErrPreconditionFailed, err)
+	}
+}
+
 func TestEngineSetExpiration(t *testing.T) {
 	s, tmpdir := SetupEngineHelper(t)
 	defer os.RemoveAll(tmpdir)
 
 	ts := time.Now()
-	record := engine.Record{Key: "key1", Value: "value1", ExpirationTime: &ts}
-	s.Set(record)
+	record := engine.Record{Key: "key1", Value: []byte("value1"), ExpirationTime: &ts}
+	s.Set(context.TODO(), record)
 	s.deleteExpired(ts.Add(-time.Second))
 	expected := make(map[string]engine.Record)
 	if !reflect.DeepEqual(s.GetAll(), expected) {
@@ -80,8 +118,9 @@ func TestEngineGet(t *testing.T) {
 	s, tmpdir := SetupEngineHelper(t)
 	defer os.RemoveAll(tmpdir)
 
-	record := engine.Record{Key: "key1", Value: "value1"}
-	s.Set(record)
+	record := engine.Record{Key: "key1", Value: []byte("value1")}
+	s.Set(context.TODO(), record)
+	record.Version = 1
 	found, ok := s.Get(record.Key)
 	if !ok {
 		t.Errorf("record with key %s not found", record.Key)
@@ -95,9 +134,9 @@ func TestEngineDelete(t *testing.T) {
 	s, tmpdir := SetupEngineHelper(t)
 	defer os.RemoveAll(tmpdir)
 
-	record := engine.Record{Key: "key1", Value: "value1"}
-	s.Set(record)
-	s.Delete(record.Key)
+	record := engine.Record{Key: "key1", Value: []byte("value1")}
+	s.Set(context.TODO(), record)
+	s.Delete(context.TODO(), record.Key)
 	expected := make(map[string]engine.Record)
 	if !reflect.DeepEqual(s.GetAll(), expected) {
 		t.Errorf("expected: %v, got: %v", expected, s.GetAll())
@@ -108,8 +147,8 @@ func TestEngineExists(t *testing.T) {
 	s, tmpdir := SetupEngineHelper(t)
 	defer os.RemoveAll(tmpdir)
 
-	record := engine.Record{Key: "key1", Value: "value1"}
-	s.Set(record)
+	record := engine.Record{Key: "key1", Value: []byte("value1")}
+	s.Set(context.TODO(), record)
 	ok := s.Exists(record.Key)
 	if !ok {
 		t.Errorf("record with key %s not found", record.Key)
@@ -121,17 +160,17 @@ func TestEngineDeleteAll(t *testing.T) {
 	defer os.RemoveAll(tmpdir)
 
 	records := []engine.Record{
-		engine.Record{Key: "key1", Value: "value1"},
-		engine.Record{Key: "key2", Value: "value2"},
-		engine.Record{Key: "key3", Value: "value3"},
+		engine.Record{Key: "key1", Value: []byte("value1")},
+		engine.Record{Key: "key2", Value: []byte("value2")},
+		engine.Record{Key: "key3", Value: []byte("value3")},
 	}
 	for _, r := range records {
-		s.Set(r)
+		s.Set(context.TODO(), r)
 	}
 	if len(s.GetAll()) != len(records) {
 		t.Errorf("unexpected number of records in a storage. Expected: %d, got: %d", len(records), len(s.GetAll()))
 	}
-	s.DeleteAll()
+	s.DeleteAll(context.TODO())
 	expected := make(map[string]engine.Record)
 	if !reflect.DeepEqual(s.GetAll(), expected) {
 		t.Errorf("expected: %v, got: %v", expected, s.GetAll())
@@ -143,14 +182,962 @@ func TestEngineGetAll(t *testing.T) {
 	defer os.RemoveAll(tmpdir)
 
 	records := map[string]engine.Record{
-		"key1": engine.Record{Key: "key1", Value: "value1"},
-		"key2": engine.Record{Key: "key2", Value: "value2"},
-		"key3": engine.Record{Key: "key3", Value: "value3"},
+		"key1": engine.Record{Key: "key1", Value: []byte("value1"), Version: 1},
+		"key2": engine.Record{Key: "key2", Value: []byte("value2"), Version: 2},
+		"key3": engine.Record{Key: "key3", Value: []byte("value3"), Version: 3},
 	}
-	for _, r := range records {
-		s.Set(r)
+	for _, key := range []string{"key1", "key2", "key3"} {
+		r := records[key]
+		r.Version = 0
+		s.Set(context.TODO(), r)
 	}
 	if !reflect.DeepEqual(s.GetAll(), records) {
 		t.Errorf("expected: %v, got: %v", records, s.GetAll())
 	}
 }
+
+func TestEngineCompact(t *testing.T) {
+	s, tmpdir := SetupEngineHelper(t)
+	defer os.RemoveAll(tmpdir)
+
+	for i := 0; i < 10; i++ {
+		s.Set(context.TODO(), engine.Record{Key: "key1", Value: []byte(fmt.Sprintf("value%d", i))})
+	}
+	s.Set(context.TODO(), engine.Record{Key: "key2", Value: []byte("value2")})
+	s.Delete(context.TODO(), "key2")
+	s.compactMinSize = 1
+	if !s.needsCompaction() {
+		t.Errorf("expected compaction to be needed")
+	}
+
+	before := s.wal.Size()
+	if err := s.Compact(); err != nil {
+		t.Fatalf("compact: %s", err)
+	}
+	if s.wal.Size() >= before {
+		t.Errorf("expected log to shrink, before: %d, after: %d", before, s.wal.Size())
+	}
+	s.Set(context.TODO(), engine.Record{Key: "key3", Value: []byte("value3")})
+
+	log, err := zap.NewProduction()
+	if err != nil {
+		t.Errorf("error on logger init: %s", err)
+	}
+	restored, err := New(context.TODO(), config.NarWAL{DataDir: tmpdir}, log.Sugar())
+	if err != nil {
+		t.Fatalf("reopen engine: %s", err)
+	}
+	if !reflect.DeepEqual(restored.GetAll(), s.GetAll()) {
+		t.Errorf("expected: %v, got: %v", s.GetAll(), restored.GetAll())
+	}
+}
+
+func TestEngineConcurrentSet(t *testing.T) {
+	s, tmpdir := SetupEngineHelper(t)
+	defer os.RemoveAll(tmpdir)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				s.Set(context.TODO(), engine.Record{Key: fmt.Sprintf("key%d-%d", i, j), Value: []byte("value")})
+			}
+		}(i)
+	}
+	wg.Wait()
+	if len(s.GetAll()) != 1000 {
+		t.Errorf("expected 1000 records, got: %d", len(s.GetAll()))
+	}
+	if s.wal.Events() != 1000 {
+		t.Errorf("expected 1000 events in WAL, got: %d", s.wal.Events())
+	}
+
+	log, err := zap.NewProduction()
+	if err != nil {
+		t.Errorf("error on logger init: %s", err)
+	}
+	restored, err := New(context.TODO(), config.NarWAL{DataDir: tmpdir}, log.Sugar())
+	if err != nil {
+		t.Fatalf("reopen engine: %s", err)
+	}
+	if !reflect.DeepEqual(restored.GetAll(), s.GetAll()) {
+		t.Errorf("restored records differ from written ones")
+	}
+}
+
+func BenchmarkEngineSetParallel(b *testing.B) {
+	tmpdir, err := ioutil.TempDir("", "engine_bench")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s, err := New(ctx, config.NarWAL{DataDir: tmpdir, Durability: string(DurabilityAlways)}, zap.NewNop().Sugar())
+	if err != nil {
+		b.Fatalf("create engine: %s", err)
+	}
+
+	var n int64
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			i := atomic.AddInt64(&n, 1)
+			s.Set(context.TODO(), engine.Record{Key: fmt.Sprintf("key%d", i), Value: []byte("value")})
+		}
+	})
+}
+
+func TestEngineSetTooLarge(t *testing.T) {
+	s, tmpdir := SetupEngineHelper(t)
+	defer os.RemoveAll(tmpdir)
+	s.wal.maxRecordSize = 4
+
+	err := s.Set(context.TODO(), engine.Record{Key: "key1", Value: []byte("value1")})
+	if errors.Cause(err) != engine.ErrTooLarge {
+		t.Errorf("expected: %s, got: %v", engine.ErrTooLarge, err)
+	}
+	if s.Exists("key1") {
+		t.Errorf("record should not be stored")
+	}
+}
+
+func TestEngineClosed(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "engine_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	s, err := New(ctx, config.NarWAL{DataDir: tmpdir}, zap.NewNop().Sugar())
+	if err != nil {
+		t.Fatalf("create engine: %s", err)
+	}
+	cancel()
+	<-s.closed
+
+	err = s.Set(context.TODO(), engine.Record{Key: "key1", Value: []byte("value1")})
+	if errors.Cause(err) != engine.ErrClosed {
+		t.Errorf("expected: %s, got: %v", engine.ErrClosed, err)
+	}
+	if err := s.Delete(context.TODO(), "key1"); errors.Cause(err) != engine.ErrClosed {
+		t.Errorf("expected: %s, got: %v", engine.ErrClosed, err)
+	}
+}
+
+func TestEngineCompareAndSet(t *testing.T) {
+	s, tmpdir := SetupEngineHelper(t)
+	defer os.RemoveAll(tmpdir)
+	exists := true
+	absent := false
+
+	testData := []struct {
+		name            string
+		cond            engine.Condition
+		expectedErr     error
+		expectedVersion uint64
+	}{
+		{name: "create absent", cond: engine.Condition{Exists: &absent}, expectedVersion: 1},
+		{name: "create existing", cond: engine.Condition{Exists: &absent}, expectedErr: engine.ErrPreconditionFailed, expectedVersion: 1},
+		{name: "update existing", cond: engine.Condition{Exists: &exists}, expectedVersion: 2},
+		{name: "match version", cond: engine.Condition{Match: []uint64{5, 2}}, expectedVersion: 3},
+		{name: "match stale version", cond: engine.Condition{Match: []uint64{2}}, expectedErr: engine.ErrPreconditionFailed, expectedVersion: 3},
+		{name: "none match current version", cond: engine.Condition{NoneMatch: []uint64{3}}, expectedErr: engine.ErrPreconditionFailed, expectedVersion: 3},
+		{name: "none match stale version", cond: engine.Condition{NoneMatch: []uint64{2}}, expectedVersion: 4},
+	}
+	for _, td := range testData {
+		err := s.CompareAndSet(context.TODO(), engine.Record{Key: "key1", Value: []byte(td.name)}, td.cond)
+		if errors.Cause(err) != td.expectedErr {
+			t.Errorf("%s: expected error: %v, got: %v", td.name, td.expectedErr, err)
+		}
+		record, _ := s.Get("key1")
+		if record.Version != td.expectedVersion {
+			t.Errorf("%s: expected version: %d, got: %d", td.name, td.expectedVersion, record.Version)
+		}
+	}
+
+	if err := s.CompareAndDelete(context.TODO(), "key1", engine.Condition{Match: []uint64{3}}); errors.Cause(err) != engine.ErrPreconditionFailed {
+		t.Errorf("expected error: %v, got: %v", engine.ErrPreconditionFailed, err)
+	}
+	if err := s.CompareAndDelete(context.TODO(), "key1", engine.Condition{Match: []uint64{4}}); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	if s.Exists("key1") {
+		t.Errorf("record should be deleted")
+	}
+}
+
+func TestEngineVersionAfterRestart(t *testing.T) {
+	s, tmpdir := SetupEngineHelper(t)
+	defer os.RemoveAll(tmpdir)
+
+	s.Set(context.TODO(), engine.Record{Key: "key1", Value: []byte("value1")})
+	s.Set(context.TODO(), engine.Record{Key: "key2", Value: []byte("value2")})
+	// the newest version belongs to the removal
+	s.Delete(context.TODO(), "key2")
+
+	restart := func() *Narwal {
+		log, err := zap.NewProduction()
+		if err != nil {
+			t.Errorf("error on logger init: %s", err)
+		}
+		restored, err := New(context.TODO(), config.NarWAL{DataDir: tmpdir}, log.Sugar())
+		if err != nil {
+			t.Fatalf("reopen engine: %s", err)
+		}
+		return restored
+	}
+
+	s = restart()
+	s.Set(context.TODO(), engine.Record{Key: "key2", Value: []byte("value2")})
+	if record, _ := s.Get("key2"); record.Version != 4 {
+		t.Errorf("expected version: 4, got: %d", record.Version)
+	}
+
+	s.Delete(context.TODO(), "key2")
+	if err := s.Compact(); err != nil {
+		t.Fatalf("compact: %s", err)
+	}
+	s = restart()
+	s.Set(context.TODO(), engine.Record{Key: "key2", Value: []byte("value2")})
+	if record, _ := s.Get("key2"); record.Version != 6 {
+		t.Errorf("expected version: 6, got: %d", record.Version)
+	}
+}
+
+func TestEngineBatch(t *testing.T) {
+	s, tmpdir := SetupEngineHelper(t)
+	defer os.RemoveAll(tmpdir)
+
+	s.Set(context.TODO(), engine.Record{Key: "key1", Value: []byte("value1")})
+	s.Set(context.TODO(), engine.Record{Key: "key2", Value: []byte("value2")})
+	before := s.GetAll()
+	absent := false
+
+	// the last operation fails, so nothing is applied
+	err := s.Batch(context.TODO(), []engine.Op{
+		{Type: engine.OpSet, Record: engine.Record{Key: "key3", Value: []byte("value3")}},
+		{Type: engine.OpDelete, Record: engine.Record{Key: "key1"}},
+		{Type: engine.OpSet, Record: engine.Record{Key: "key2", Value: []byte("new")}, Condition: engine.Condition{Exists: &absent}},
+	})
+	if errors.Cause(err) != engine.ErrPreconditionFailed {
+		t.Errorf("expected: %s, got: %v", engine.ErrPreconditionFailed, err)
+	}
+	if !reflect.DeepEqual(s.GetAll(), before) {
+		t.Errorf("expected: %v, got: %v", before, s.GetAll())
+	}
+
+	// operations see results of the previous ones
+	err = s.Batch(context.TODO(), []engine.Op{
+		{Type: engine.OpSet, Record: engine.Record{Key: "key3", Value: []byte("value3")}, Condition: engine.Condition{Exists: &absent}},
+		{Type: engine.OpDelete, Record: engine.Record{Key: "key1"}},
+		{Type: engine.OpSet, Record: engine.Record{Key: "key1", Value: []byte("new")}, Condition: engine.Condition{Exists: &absent}},
+		{Type: engine.OpDelete, Record: engine.Record{Key: "key3"}, Condition: engine.Condition{Match: []uint64{3}}},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	expected := map[string]engine.Record{
+		"key1": engine.Record{Key: "key1", Value: []byte("new"), Version: 5},
+		"key2": engine.Record{Key: "key2", Value: []byte("value2"), Version: 2},
+	}
+	if !reflect.DeepEqual(s.GetAll(), expected) {
+		t.Errorf("expected: %v, got: %v", expected, s.GetAll())
+	}
+
+	log, err := zap.NewProduction()
+	if err != nil {
+		t.Errorf("error on logger init: %s", err)
+	}
+	restored, err := New(context.TODO(), config.NarWAL{DataDir: tmpdir}, log.Sugar())
+	if err != nil {
+		t.Fatalf("reopen engine: %s", err)
+	}
+	if !reflect.DeepEqual(restored.GetAll(), expected) {
+		t.Errorf("expected: %v, got: %v", expected, restored.GetAll())
+	}
+}
+
+func TestEngineScan(t *testing.T) {
+	s, tmpdir := SetupEngineHelper(t)
+	defer os.RemoveAll(tmpdir)
+
+	for _, k := range []string{"b2", "a1", "c1", "a3", "b1", "a2", "ab"} {
+		s.Set(context.TODO(), engine.Record{Key: k, Value: []byte(k)})
+	}
+	s.Delete(context.TODO(), "a3")
+
+	testData := []struct {
+		name     string
+		rng      engine.Range
+		limit    int
+		expected []string
+	}{
+		{name: "all keys", expected: []string{"a1", "a2", "ab", "b1", "b2", "c1"}},
+		{name: "prefix", rng: engine.Range{Prefix: "a"}, expected: []string{"a1", "a2", "ab"}},
+		{name: "start and end", rng: engine.Range{Start: "a2", End: "b2"}, expected: []string{"a2", "ab", "b1"}},
+		{name: "prefix and start", rng: engine.Range{Prefix: "a", Start: "a15"}, expected: []string{"a2", "ab"}},
+		{name: "prefix and end", rng: engine.Range{Prefix: "b", End: "b2"}, expected: []string{"b1"}},
+		{name: "start before prefix", rng: engine.Range{Prefix: "b", Start: "a"}, expected: []string{"b1", "b2"}},
+		{name: "missing prefix", rng: engine.Range{Prefix: "a3"}, expected: []string{}},
+		{name: "limit", limit: 2, expected: []string{"a1", "a2"}},
+	}
+	for _, td := range testData {
+		t.Run(td.name, func(t *testing.T) {
+			keys := []string{}
+			s.Scan(td.rng, func(r engine.Record) bool {
+				keys = append(keys, r.Key)
+				return td.limit == 0 || len(keys) < td.limit
+			})
+			if !reflect.DeepEqual(keys, td.expected) {
+				t.Errorf("expected: %v, got: %v", td.expected, keys)
+			}
+		})
+	}
+
+	// index is restored on start
+	log, err := zap.NewProduction()
+	if err != nil {
+		t.Errorf("error on logger init: %s", err)
+	}
+	restored, err := New(context.TODO(), config.NarWAL{DataDir: tmpdir}, log.Sugar())
+	if err != nil {
+		t.Fatalf("reopen engine: %s", err)
+	}
+	keys := []string{}
+	restored.Scan(engine.Range{}, func(r engine.Record) bool {
+		keys = append(keys, r.Key)
+		return true
+	})
+	expected := []string{"a1", "a2", "ab", "b1", "b2", "c1"}
+	if !reflect.DeepEqual(keys, expected) {
+		t.Errorf("expected: %v, got: %v", expected, keys)
+	}
+}
+
+func TestEngineFilter(t *testing.T) {
+	s, tmpdir := SetupEngineHelper(t)
+	defer os.RemoveAll(tmpdir)
+
+	records := map[string]string{
+		"wod":     "polar bear",
+		"word":    "brown bear",
+		"world":   "bear",
+		"sword":   "polar fox",
+		"a.b":     "dot",
+		"axb":     "x",
+		"pri$e":   "dollar",
+		"line\nx": "multi\nline",
+	}
+	for k, v := range records {
+		s.Set(context.TODO(), engine.Record{Key: k, Value: []byte(v)})
+	}
+
+	testData := []struct {
+		name     string
+		filter   func(string) (map[string]engine.Record, error)
+		pattern  string
+		expected []string
+	}{
+		{name: "wildcard in the middle", filter: s.Filter, pattern: "wo$d", expected: []string{"wod", "word", "world"}},
+		{name: "anchored", filter: s.Filter, pattern: "word", expected: []string{"word"}},
+		{name: "wildcard at the start", filter: s.Filter, pattern: "$ord", expected: []string{"sword", "word"}},
+		{name: "escaped metacharacters", filter: s.Filter, pattern: "a.b", expected: []string{"a.b"}},
+		{name: "multiline", filter: s.Filter, pattern: "line$", expected: []string{"line\nx"}},
+		{name: "everything", filter: s.Filter, pattern: "$", expected: []string{"a.b", "axb", "line\nx", "pri$e", "sword", "wod", "word", "world"}},
+		{name: "no matches", filter: s.Filter, pattern: "wolf$", expected: []string{}},
+		{name: "values", filter: s.FilterValues, pattern: "polar$", expected: []string{"sword", "wod"}},
+		{name: "values anchored", filter: s.FilterValues, pattern: "bear", expected: []string{"world"}},
+		{name: "values multiline", filter: s.FilterValues, pattern: "multi$", expected: []string{"line\nx"}},
+	}
+	for _, td := range testData {
+		t.Run(td.name, func(t *testing.T) {
+			found, err := td.filter(td.pattern)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			keys := []string{}
+			for k := range found {
+				keys = append(keys, k)
+			}
+			sort.Strings(keys)
+			if !reflect.DeepEqual(keys, td.expected) {
+				t.Errorf("expected: %v, got: %v", td.expected, keys)
+			}
+		})
+	}
+}
+
+func TestEngineExpirationAfterRestart(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "engine_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+	log, err := zap.NewProduction()
+	if err != nil {
+		t.Errorf("error on logger init: %s", err)
+	}
+
+	// the sweeper doesn't run during the test, expiration is checked against the given time
+	cfg := config.NarWAL{DataDir: tmpdir, ExpirePeriod: time.Hour}
+	ctx, cancel := context.WithCancel(context.Background())
+	s, err := New(ctx, cfg, log.Sugar())
+	if err != nil {
+		t.Fatalf("create engine: %s", err)
+	}
+	now := time.Now()
+	soon := now.Add(time.Minute)
+	later := now.Add(time.Hour)
+	for _, record := range []engine.Record{
+		{Key: "soon", Value: []byte("value1"), ExpirationTime: &soon},
+		{Key: "later", Value: []byte("value2"), ExpirationTime: &later},
+		{Key: "forever", Value: []byte("value3")},
+	} {
+		if err := s.Set(engine.WithTime(context.TODO(), now), record); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+	cancel()
+	<-s.closed
+
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	restored, err := New(ctx, cfg, log.Sugar())
+	if err != nil {
+		t.Fatalf("reopen engine: %s", err)
+	}
+	// the TTL index is rebuilt from the log
+	for _, td := range []struct {
+		t        time.Time
+		expected []string
+	}{
+		{now, []string{}},
+		{soon.Add(time.Second), []string{"soon"}},
+		{later.Add(time.Second), []string{"later"}},
+	} {
+		keys := restored.Expired(td.t, 10)
+		if !reflect.DeepEqual(keys, td.expected) {
+			t.Errorf("expected expired keys %v by %s, got %v", td.expected, td.t, keys)
+		}
+		if err := restored.RemoveExpired(context.TODO(), keys, td.t); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		for _, key := range keys {
+			if _, ok := restored.data[key]; ok {
+				t.Errorf("expected key %s to be removed", key)
+			}
+		}
+	}
+	if !restored.Exists("forever") {
+		t.Errorf("expected key forever to exist")
+	}
+}
+
+func TestEngineLazyExpiration(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "engine_test")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+	log, err := zap.NewProduction()
+	if err != nil {
+		t.Errorf("error on logger init: %s", err)
+	}
+	// the sweeper doesn't run during the test
+	s, err := New(context.TODO(), config.NarWAL{DataDir: tmpdir, ExpirePeriod: time.Hour}, log.Sugar())
+	if err != nil {
+		t.Fatalf("create engine: %s", err)
+	}
+
+	ts := time.Now().Add(50 * time.Millisecond)
+	s.Set(context.TODO(), engine.Record{Key: "key1", Value: []byte("value1"), ExpirationTime: &ts})
+	s.Set(context.TODO(), engine.Record{Key: "key2", Value: []byte("value2")})
+	time.Sleep(100 * time.Millisecond)
+
+	if _, ok := s.Get("key1"); ok {
+		t.Errorf("expected expired key to be absent on get")
+	}
+	if s.Exists("key1") {
+		t.Errorf("expected expired key to be absent on exists")
+	}
+	if _, ok := s.GetAll()["key1"]; ok {
+		t.Errorf("expected expired key to be absent in all records")
+	}
+	if found, _ := s.Filter("key$"); len(found) != 1 {
+		t.Errorf("expected expired key to be filtered out, got: %v", found)
+	}
+	if found, _ := s.FilterValues("value$"); len(found) != 1 {
+		t.Errorf("expected expired key to be filtered out, got: %v", found)
+	}
+	s.lock.RLock()
+	_, ok := s.data["key1"]
+	s.lock.RUnlock()
+	if !ok {
+		t.Errorf("expected expired key to wait for the sweeper")
+	}
+
+	// expired record doesn't exist for conditions
+	absent := false
+	if err := s.CompareAndSet(context.TODO(), engine.Record{Key: "key1", Value: []byte("new")}, engine.Condition{Exists: &absent}); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	if r, ok := s.Get("key1"); !ok || string(r.Value) != "new" {
+		t.Errorf("expected key to be set again, got: %v", r)
+	}
+}
+
+func TestEngineSweepExpired(t *testing.T) {
+	testData := []struct {
+		name      string
+		budget    int
+		period    time.Duration
+		remaining int
+	}{
+		{name: "single round", budget: 10, period: time.Hour, remaining: 0},
+		{name: "several rounds", budget: 2, period: time.Hour, remaining: 0},
+		{name: "out of time", budget: 2, period: 0, remaining: 3},
+	}
+	for _, td := range testData {
+		t.Run(td.name, func(t *testing.T) {
+			tmpdir, err := ioutil.TempDir("", "engine_test")
+			if err != nil {
+				log.Fatal(err)
+			}
+			defer os.RemoveAll(tmpdir)
+			log, err := zap.NewProduction()
+			if err != nil {
+				t.Errorf("error on logger init: %s", err)
+			}
+			s, err := New(context.TODO(), config.NarWAL{DataDir: tmpdir, ExpirePeriod: time.Hour, ExpireBudget: td.budget}, log.Sugar())
+			if err != nil {
+				t.Fatalf("create engine: %s", err)
+			}
+
+			ts := time.Now().Add(50 * time.Millisecond)
+			for i := 0; i < 5; i++ {
+				s.Set(context.TODO(), engine.Record{Key: fmt.Sprintf("key%d", i), Value: []byte("value"), ExpirationTime: &ts})
+			}
+			time.Sleep(100 * time.Millisecond)
+
+			s.sweepExpired(td.period)
+			s.lock.RLock()
+			remaining := len(s.data)
+			s.lock.RUnlock()
+			if remaining != td.remaining {
+				t.Errorf("expected remaining: %d, got: %d", td.remaining, remaining)
+			}
+		})
+	}
+}
+
+func TestEngineTTL(t *testing.T) {
+	s, tmpdir := SetupEngineHelper(t)
+	defer os.RemoveAll(tmpdir)
+	log, err := zap.NewProduction()
+	if err != nil {
+		t.Errorf("error on logger init: %s", err)
+	}
+
+	s.Set(context.TODO(), engine.Record{Key: "key1", Value: []byte("value1")})
+	if until, ok := s.TTL("key1"); !ok || until != nil {
+		t.Errorf("expected permanent record, got: %v, %v", until, ok)
+	}
+
+	later := time.Now().Add(time.Hour).Round(0)
+	if err := s.Expire(context.TODO(), "key1", later); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if until, ok := s.TTL("key1"); !ok || until == nil || !until.Equal(later) {
+		t.Errorf("expected expiration: %s, got: %v", later, until)
+	}
+	found, _ := s.Get("key1")
+	if string(found.Value) != "value1" || found.Version != 2 {
+		t.Errorf("expected the same value and a new version, got: %v", found)
+	}
+
+	// expiration is restored from the log
+	restored, err := New(context.TODO(), config.NarWAL{DataDir: tmpdir}, log.Sugar())
+	if err != nil {
+		t.Fatalf("reopen engine: %s", err)
+	}
+	if until, ok := restored.TTL("key1"); !ok || until == nil || !until.Equal(later) {
+		t.Errorf("expected expiration after restart: %s, got: %v", later, until)
+	}
+	if restored.ttl.Len() != 1 {
+		t.Errorf("expected key in TTL index")
+	}
+	if found, _ := restored.Get("key1"); found.Version != 2 {
+		t.Errorf("expected version 2 after restart, got: %d", found.Version)
+	}
+
+	if err := restored.Persist(context.TODO(), "key1"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if restored.ttl.Len() != 0 {
+		t.Errorf("expected persisted key to leave TTL index")
+	}
+	if found, _ := restored.Get("key1"); found.Version != 3 {
+		t.Errorf("expected version 3 after persist, got: %d", found.Version)
+	}
+	restored.deleteExpired(later.Add(time.Second))
+	if until, ok := restored.TTL("key1"); !ok || until != nil {
+		t.Errorf("expected permanent record, got: %v, %v", until, ok)
+	}
+
+	restored, err = New(context.TODO(), config.NarWAL{DataDir: tmpdir}, log.Sugar())
+	if err != nil {
+		t.Fatalf("reopen engine: %s", err)
+	}
+	if until, ok := restored.TTL("key1"); !ok || until != nil {
+		t.Errorf("expected permanent record after restart, got: %v, %v", until, ok)
+	}
+
+	// the time has already passed
+	if err := restored.Expire(context.TODO(), "key1", time.Now().Add(-time.Second)); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if restored.Exists("key1") {
+		t.Errorf("expected record to be removed")
+	}
+	if err := restored.Expire(context.TODO(), "key1", later); err != engine.ErrNotFound {
+		t.Errorf("expected: %s, got: %v", engine.ErrNotFound, err)
+	}
+	if err := restored.Persist(context.TODO(), "key1"); err != engine.ErrNotFound {
+		t.Errorf("expected: %s, got: %v", engine.ErrNotFound, err)
+	}
+}
+
+func TestEngineSlidingTTL(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "engine_test")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+	log, err := zap.NewProduction()
+	if err != nil {
+		t.Errorf("error on logger init: %s", err)
+	}
+	// the sweeper doesn't run during the test
+	s, err := New(context.TODO(), config.NarWAL{DataDir: tmpdir, ExpirePeriod: time.Hour}, log.Sugar())
+	if err != nil {
+		t.Fatalf("create engine: %s", err)
+	}
+
+	ttl := 200 * time.Millisecond
+	s.Set(context.TODO(), engine.Record{Key: "session", Value: []byte("value1"), SlidingTTL: ttl})
+	s.Set(context.TODO(), engine.Record{Key: "fixed", Value: []byte("value2"), ExpirationTime: func() *time.Time { ts := time.Now().Add(ttl); return &ts }()})
+	events := s.wal.Events()
+
+	// reads keep the session alive longer than its TTL
+	for i := 0; i < 5; i++ {
+		time.Sleep(ttl / 2)
+		if _, ok := s.Get("session"); !ok {
+			t.Fatalf("expected session to be prolonged by reads")
+		}
+	}
+	if s.Exists("fixed") {
+		t.Errorf("expected record without sliding TTL to expire")
+	}
+	if s.wal.Events() != events {
+		t.Errorf("expected reads not to be written into the log")
+	}
+
+	s.flushTouches()
+	if s.wal.Events() != events+1 {
+		t.Errorf("expected one expire event, got: %d", s.wal.Events()-events)
+	}
+	until, _ := s.TTL("session")
+
+	// prolonged expiration is restored from the log
+	restored, err := New(context.TODO(), config.NarWAL{DataDir: tmpdir, ExpirePeriod: time.Hour}, log.Sugar())
+	if err != nil {
+		t.Fatalf("reopen engine: %s", err)
+	}
+	restoredUntil, ok := restored.TTL("session")
+	if !ok || restoredUntil == nil || !restoredUntil.Equal(*until) {
+		t.Errorf("expected expiration: %v, got: %v", until, restoredUntil)
+	}
+
+	time.Sleep(ttl + ttl/2)
+	if s.Exists("session") {
+		t.Errorf("expected session to expire without reads")
+	}
+}
+
+func TestEngineExpiredReindex(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "engine_test")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+	log, err := zap.NewProduction()
+	if err != nil {
+		t.Errorf("error on logger init: %s", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// the sweeper doesn't run during the test
+	s, err := New(ctx, config.NarWAL{DataDir: tmpdir, ExpirePeriod: time.Hour}, log.Sugar())
+	if err != nil {
+		t.Fatalf("create engine: %s", err)
+	}
+
+	now := time.Now()
+	at := func(d time.Duration) context.Context { return engine.WithTime(ctx, now.Add(d)) }
+	s.Set(at(0), engine.Record{Key: "session", Value: []byte("value1"), SlidingTTL: time.Minute})
+	until := now.Add(time.Minute)
+	s.Set(at(0), engine.Record{Key: "fixed", Value: []byte("value2"), ExpirationTime: &until})
+	s.Set(at(0), engine.Record{Key: "removed", Value: []byte("value3"), ExpirationTime: &until})
+
+	// the session is read before it expires, so the sweeper skips it
+	s.touch("session", now.Add(30*time.Second))
+	keys := s.Expired(now.Add(70*time.Second), 10)
+	sort.Strings(keys)
+	if !reflect.DeepEqual(keys, []string{"fixed", "removed", "session"}) {
+		t.Fatalf("unexpected expired keys: %v", keys)
+	}
+	if err := s.RemoveExpired(ctx, []string{"session"}, now.Add(70*time.Second)); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	// keys which aren't removed are put back
+	s.Delete(ctx, "removed")
+	s.Reindex([]string{"fixed", "removed"})
+
+	keys = s.Expired(now.Add(100*time.Second), 10)
+	sort.Strings(keys)
+	if !reflect.DeepEqual(keys, []string{"fixed", "session"}) {
+		t.Errorf("unexpected expired keys: %v", keys)
+	}
+}
+
+func TestEngineWatch(t *testing.T) {
+	s, tmpdir := SetupEngineHelper(t)
+	defer os.RemoveAll(tmpdir)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	events := s.Watch(ctx, "user:")
+
+	soon := time.Now().Add(time.Hour)
+	s.Set(context.TODO(), engine.Record{Key: "user:1", Value: []byte("value1")})
+	s.Set(context.TODO(), engine.Record{Key: "order:1", Value: []byte("value2")})
+	s.Delete(context.TODO(), "user:1")
+	s.Set(context.TODO(), engine.Record{Key: "user:2", Value: []byte("value3"), ExpirationTime: &soon})
+	s.deleteExpired(soon.Add(time.Second))
+
+	expected := []engine.EventType{engine.EventSet, engine.EventDelete, engine.EventSet, engine.EventExpired}
+	expectedKeys := []string{"user:1", "user:1", "user:2", "user:2"}
+	for i := range expected {
+		select {
+		case e := <-events:
+			if e.Type != expected[i] || e.Record.Key != expectedKeys[i] {
+				t.Errorf("expected: %s %s, got: %s %s", expected[i], expectedKeys[i], e.Type, e.Record.Key)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("expected event: %s %s", expected[i], expectedKeys[i])
+		}
+	}
+
+	cancel()
+	select {
+	case _, ok := <-events:
+		if ok {
+			t.Errorf("expected no more events")
+		}
+	case <-time.After(time.Second):
+		t.Errorf("expected channel to be closed")
+	}
+}
+
+func readChanges(t *testing.T, changes <-chan engine.Event, n int) []uint64 {
+	t.Helper()
+	seqs := []uint64{}
+	for i := 0; i < n; i++ {
+		select {
+		case e := <-changes:
+			seqs = append(seqs, e.Seq)
+		case <-time.After(time.Second):
+			t.Fatalf("expected %d changes, got: %v", n, seqs)
+		}
+	}
+	return seqs
+}
+
+func TestEngineChanges(t *testing.T) {
+	s, tmpdir := SetupEngineHelper(t)
+	defer os.RemoveAll(tmpdir)
+	log, err := zap.NewProduction()
+	if err != nil {
+		t.Errorf("error on logger init: %s", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	s.Set(context.TODO(), engine.Record{Key: "key1", Value: []byte("value1")})
+	s.Set(context.TODO(), engine.Record{Key: "key2", Value: []byte("value2")})
+	s.Delete(context.TODO(), "key1")
+
+	// stored changes go first, then new ones
+	changes, err := s.Changes(ctx, 1)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	first := <-changes
+	if first.Type != engine.EventSet || first.Record.Key != "key2" || string(first.Record.Value) != "value2" {
+		t.Errorf("unexpected change: %v", first)
+	}
+	s.Set(context.TODO(), engine.Record{Key: "key3", Value: []byte("value3")})
+	if seqs, expected := readChanges(t, changes, 2), []uint64{3, 4}; !reflect.DeepEqual(seqs, expected) {
+		t.Errorf("expected: %v, got: %v", expected, seqs)
+	}
+
+	// sequence numbers go on after restart
+	restored, err := New(ctx, config.NarWAL{DataDir: tmpdir}, log.Sugar())
+	if err != nil {
+		t.Fatalf("reopen engine: %s", err)
+	}
+	restored.Set(context.TODO(), engine.Record{Key: "key4", Value: []byte("value4")})
+	changes, err = restored.Changes(ctx, 0)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if seqs, expected := readChanges(t, changes, 5), []uint64{1, 2, 3, 4, 5}; !reflect.DeepEqual(seqs, expected) {
+		t.Errorf("expected: %v, got: %v", expected, seqs)
+	}
+
+	// compacted changes are not available anymore
+	if err := restored.Compact(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if err := restored.Snapshot(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	restored.Set(context.TODO(), engine.Record{Key: "key5", Value: []byte("value5")})
+	for _, storage := range []*Narwal{restored, func() *Narwal {
+		reopened, err := New(ctx, config.NarWAL{DataDir: tmpdir}, log.Sugar())
+		if err != nil {
+			t.Fatalf("reopen engine: %s", err)
+		}
+		return reopened
+	}()} {
+		if _, err := storage.Changes(ctx, 4); err != engine.ErrCompacted {
+			t.Errorf("expected: %s, got: %v", engine.ErrCompacted, err)
+		}
+		changes, err = storage.Changes(ctx, 5)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if seqs, expected := readChanges(t, changes, 1), []uint64{6}; !reflect.DeepEqual(seqs, expected) {
+			t.Errorf("expected: %v, got: %v", expected, seqs)
+		}
+	}
+}
+
+func TestEngineReplication(t *testing.T) {
+	leader, leaderDir := SetupEngineHelper(t)
+	defer os.RemoveAll(leaderDir)
+	followerDir, err := ioutil.TempDir("", "engine_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(followerDir)
+	log, err := zap.NewProduction()
+	if err != nil {
+		t.Errorf("error on logger init: %s", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	cfg := config.NarWAL{DataDir: followerDir, Follower: true}
+	follower, err := New(ctx, cfg, log.Sugar())
+	if err != nil {
+		t.Fatalf("create engine: %s", err)
+	}
+
+	until := time.Now().Add(time.Hour)
+	leader.Set(context.TODO(), engine.Record{Key: "key1", Value: []byte("value1")})
+	leader.Set(context.TODO(), engine.Record{Key: "key2", Value: []byte("value2"), ExpirationTime: &until})
+	leader.Delete(context.TODO(), "key1")
+	leader.Persist(context.TODO(), "key2")
+
+	changes, err := leader.Changes(ctx, 0)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	replicated := []engine.Event{}
+	for len(replicated) < 4 {
+		replicated = append(replicated, <-changes)
+	}
+	if err := follower.Apply(context.TODO(), replicated...); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	// applied changes are skipped
+	if err := follower.Apply(context.TODO(), replicated[:2]...); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !reflect.DeepEqual(follower.GetAll(), leader.GetAll()) {
+		t.Errorf("expected: %v, got: %v", leader.GetAll(), follower.GetAll())
+	}
+	if follower.Seq() != leader.Seq() || follower.Seq() != 4 {
+		t.Errorf("expected seq %d, got %d", leader.Seq(), follower.Seq())
+	}
+
+	// the follower resumes with the same sequence numbers after restart and promotion
+	reopened, err := New(ctx, cfg, log.Sugar())
+	if err != nil {
+		t.Fatalf("reopen engine: %s", err)
+	}
+	if reopened.Seq() != 4 {
+		t.Errorf("expected seq 4, got %d", reopened.Seq())
+	}
+	reopened.SetFollower(false)
+	reopened.Set(context.TODO(), engine.Record{Key: "key3", Value: []byte("value3")})
+	record, _ := reopened.Get("key3")
+	if reopened.Seq() != 5 || record.Version != 5 {
+		t.Errorf("expected seq 5 and version 5, got %d and %d", reopened.Seq(), record.Version)
+	}
+}
+
+func TestEngineRestore(t *testing.T) {
+	leader, leaderDir := SetupEngineHelper(t)
+	defer os.RemoveAll(leaderDir)
+	follower, followerDir := SetupEngineHelper(t)
+	defer os.RemoveAll(followerDir)
+	log, err := zap.NewProduction()
+	if err != nil {
+		t.Errorf("error on logger init: %s", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	follower.Set(context.TODO(), engine.Record{Key: "stale", Value: []byte("stale")})
+	watcher := follower.Watch(ctx, "")
+	for i := 0; i < 3; i++ {
+		leader.Set(context.TODO(), engine.Record{Key: fmt.Sprintf("key%d", i), Value: []byte("value")})
+	}
+
+	if err := follower.Restore(leader.Dump()); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !reflect.DeepEqual(follower.GetAll(), leader.GetAll()) {
+		t.Errorf("expected: %v, got: %v", leader.GetAll(), follower.GetAll())
+	}
+	if follower.Seq() != 3 {
+		t.Errorf("expected seq 3, got %d", follower.Seq())
+	}
+	if e := <-watcher; e.Type != engine.EventOverflow {
+		t.Errorf("expected overflow, got %v", e)
+	}
+	if _, err := follower.Changes(ctx, 2); err != engine.ErrCompacted {
+		t.Errorf("expected: %s, got: %v", engine.ErrCompacted, err)
+	}
+
+	reopened, err := New(ctx, config.NarWAL{DataDir: followerDir}, log.Sugar())
+	if err != nil {
+		t.Fatalf("reopen engine: %s", err)
+	}
+	if !reflect.DeepEqual(reopened.GetAll(), leader.GetAll()) || reopened.Seq() != 3 {
+		t.Errorf("expected: %v, got: %v", leader.GetAll(), reopened.GetAll())
+	}
+}
@@ -0,0 +1,73 @@
+package narwal
+
+import (
+	"bufio"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+
+	"github.com/filatovw/ni-storage/engine"
+	"github.com/pkg/errors"
+)
+
+// Every entry is stored in a frame:
+//
+//	| length: uint32 | checksum: uint32 | payload: length bytes |
+//
+// where checksum is CRC32C (Castagnoli) of the payload.
+// An entry holds one or more events which are replayed together.
+const (
+	frameHeaderSize = 8
+	maxFramePayload = 1<<32 - 1
+)
+
+var (
+	crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+	// errTornFrame means the frame is cut by the end of the log
+	errTornFrame = errors.New("torn frame")
+	// errCorruptedFrame means the frame is complete but its checksum doesn't match
+	errCorruptedFrame = errors.New("corrupted frame")
+)
+
+// encode entry of events into a frame
+func encode(events ...event) ([]byte, error) {
+	payload := marshalEntry(events)
+	if len(payload) > maxFramePayload {
+		return nil, engine.ErrTooLarge
+	}
+	frame := make([]byte, frameHeaderSize+len(payload))
+	binary.BigEndian.PutUint32(frame[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(frame[4:8], crc32.Checksum(payload, crcTable))
+	copy(frame[frameHeaderSize:], payload)
+	return frame, nil
+}
+
+// frameSize returns the size of a frame with the given payload
+func frameSize(payload []byte) int64 {
+	return int64(frameHeaderSize + len(payload))
+}
+
+// readFrame reads a single frame, remaining is the number of bytes left in the log.
+// Payload is returned along with errCorruptedFrame, so the caller knows where the frame ends.
+func readFrame(r *bufio.Reader, remaining int64) ([]byte, error) {
+	if remaining < frameHeaderSize {
+		return nil, errTornFrame
+	}
+	header := make([]byte, frameHeaderSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	length := int64(binary.BigEndian.Uint32(header[0:4]))
+	if length > remaining-frameHeaderSize {
+		return nil, errTornFrame
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+	if length == 0 || crc32.Checksum(payload, crcTable) != binary.BigEndian.Uint32(header[4:8]) {
+		return payload, errCorruptedFrame
+	}
+	return payload, nil
+}
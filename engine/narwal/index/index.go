@@ -0,0 +1,111 @@
+package index
+
+// Ordered index of keys.
+// The underlying struct is a skiplist: a sorted linked list with express lanes on top of it.
+// Insert, Delete and Seek take O(log n) on average, iteration over keys goes in lexicographical order.
+
+import (
+	"math/rand"
+)
+
+const (
+	maxLevel = 32
+	// probability of a node to be promoted to the next level is 1/branching
+	branching = 4
+)
+
+type node struct {
+	key  string
+	next []*node
+}
+
+// Index keeps keys in sorted order and provides Insert, Delete and Ascend operations.
+type Index struct {
+	head   *node
+	level  int
+	length int
+	rnd    *rand.Rand
+}
+
+// NewIndex creates ordered index
+func NewIndex() *Index {
+	return &Index{
+		head:  &node{next: make([]*node, maxLevel)},
+		level: 1,
+		rnd:   rand.New(rand.NewSource(1)),
+	}
+}
+
+// Len returns number of keys in index
+func (idx *Index) Len() int {
+	return idx.length
+}
+
+// randomLevel chooses the number of lanes for a new node
+func (idx *Index) randomLevel() int {
+	level := 1
+	for level < maxLevel && idx.rnd.Intn(branching) == 0 {
+		level++
+	}
+	return level
+}
+
+// findPrevious fills prev with the last nodes on each level with keys less than the key
+func (idx *Index) findPrevious(key string, prev []*node) *node {
+	x := idx.head
+	for i := idx.level - 1; i >= 0; i-- {
+		for x.next[i] != nil && x.next[i].key < key {
+			x = x.next[i]
+		}
+		if prev != nil {
+			prev[i] = x
+		}
+	}
+	return x.next[0]
+}
+
+// Insert key, nothing happens if the key is already indexed
+func (idx *Index) Insert(key string) {
+	prev := make([]*node, maxLevel)
+	if n := idx.findPrevious(key, prev); n != nil && n.key == key {
+		return
+	}
+	level := idx.randomLevel()
+	if level > idx.level {
+		for i := idx.level; i < level; i++ {
+			prev[i] = idx.head
+		}
+		idx.level = level
+	}
+	n := &node{key: key, next: make([]*node, level)}
+	for i := 0; i < level; i++ {
+		n.next[i] = prev[i].next[i]
+		prev[i].next[i] = n
+	}
+	idx.length++
+}
+
+// Delete key
+func (idx *Index) Delete(key string) {
+	prev := make([]*node, maxLevel)
+	n := idx.findPrevious(key, prev)
+	if n == nil || n.key != key {
+		return
+	}
+	for i := 0; i < len(n.next); i++ {
+		prev[i].next[i] = n.next[i]
+	}
+	for idx.level > 1 && idx.head.next[idx.level-1] == nil {
+		idx.level--
+	}
+	idx.length--
+}
+
+// Ascend calls fn for keys greater than or equal to from in ascending order until fn returns false
+func (idx *Index) Ascend(from string, fn func(key string) bool) {
+	for n := idx.findPrevious(from, nil); n != nil; n = n.next[0] {
+		if !fn(n.key) {
+			return
+		}
+	}
+}
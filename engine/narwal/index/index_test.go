@@ -0,0 +1,136 @@
+package index
+
+import (
+	"fmt"
+	"math/rand"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func collect(idx *Index, from string, limit int) []string {
+	keys := []string{}
+	idx.Ascend(from, func(key string) bool {
+		keys = append(keys, key)
+		return len(keys) < limit
+	})
+	return keys
+}
+
+func TestIndexAscend(t *testing.T) {
+	testData := []struct {
+		name     string
+		insert   []string
+		delete   []string
+		from     string
+		limit    int
+		expected []string
+	}{
+		{
+			name:     "no keys",
+			insert:   []string{},
+			limit:    10,
+			expected: []string{},
+		},
+		{
+			name:     "random inserting",
+			insert:   []string{"key3", "key1", "key4", "key2"},
+			limit:    10,
+			expected: []string{"key1", "key2", "key3", "key4"},
+		},
+		{
+			name:     "key inserted twice",
+			insert:   []string{"key1", "key2", "key1"},
+			limit:    10,
+			expected: []string{"key1", "key2"},
+		},
+		{
+			name:     "deleted keys",
+			insert:   []string{"key1", "key2", "key3"},
+			delete:   []string{"key2", "key5"},
+			limit:    10,
+			expected: []string{"key1", "key3"},
+		},
+		{
+			name:     "from existing key",
+			insert:   []string{"a", "b", "c", "d"},
+			from:     "b",
+			limit:    10,
+			expected: []string{"b", "c", "d"},
+		},
+		{
+			name:     "from missing key",
+			insert:   []string{"a", "b", "d"},
+			from:     "c",
+			limit:    10,
+			expected: []string{"d"},
+		},
+		{
+			name:     "from the end",
+			insert:   []string{"a", "b"},
+			from:     "z",
+			limit:    10,
+			expected: []string{},
+		},
+		{
+			name:     "stopped by callback",
+			insert:   []string{"a", "b", "c", "d"},
+			limit:    2,
+			expected: []string{"a", "b"},
+		},
+	}
+	for _, td := range testData {
+		t.Run(td.name, func(t *testing.T) {
+			idx := NewIndex()
+			for _, k := range td.insert {
+				idx.Insert(k)
+			}
+			for _, k := range td.delete {
+				idx.Delete(k)
+			}
+			found := collect(idx, td.from, td.limit)
+			if !reflect.DeepEqual(found, td.expected) {
+				t.Errorf("expected: %#v, got: %#v", td.expected, found)
+			}
+		})
+	}
+}
+
+func TestIndexRandomized(t *testing.T) {
+	idx := NewIndex()
+	expected := make(map[string]bool)
+	rnd := rand.New(rand.NewSource(42))
+	for i := 0; i < 10000; i++ {
+		key := fmt.Sprintf("key%d", rnd.Intn(2000))
+		if rnd.Intn(3) == 0 {
+			idx.Delete(key)
+			delete(expected, key)
+		} else {
+			idx.Insert(key)
+			expected[key] = true
+		}
+	}
+	keys := make([]string, 0, len(expected))
+	for k := range expected {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	if idx.Len() != len(keys) {
+		t.Errorf("expected length: %d, got: %d", len(keys), idx.Len())
+	}
+	if found := collect(idx, "", len(keys)+1); !reflect.DeepEqual(found, keys) {
+		t.Errorf("index is out of order")
+	}
+}
+
+func BenchmarkIndexInsert(b *testing.B) {
+	keys := make([]string, b.N)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("key%d", rand.Int())
+	}
+	idx := NewIndex()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		idx.Insert(keys[i])
+	}
+}
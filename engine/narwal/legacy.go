@@ -0,0 +1,157 @@
+package narwal
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/filatovw/ni-storage/engine"
+	"github.com/filatovw/ni-storage/logger"
+	"github.com/pkg/errors"
+)
+
+// Older versions wrote the log as JSON lines, one event per line, with values stored as strings.
+// Such a log is rewritten into frames on the first open, like a compacted log which holds only live records.
+
+// legacyEvent is an event of the log written as JSON lines
+type legacyEvent struct {
+	Record struct {
+		ExpirationTime *time.Time `json:"expiration_time,omitempty"`
+		Value          string     `json:"value,omitempty"`
+		Key            string     `json:"key"`
+	} `json:"record"`
+	Action action `json:"action"`
+}
+
+// isLegacy checks whether the log-file is written as JSON lines
+func isLegacy(path string) (bool, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, errors.Wrap(err, "open log")
+	}
+	defer f.Close()
+	b := make([]byte, 1)
+	if _, err := f.Read(b); err == io.EOF {
+		return false, nil
+	} else if err != nil {
+		return false, errors.Wrap(err, "read error")
+	}
+	return b[0] == '{', nil
+}
+
+// readLegacy replays a log of JSON lines, a line cut by the end of the log is dropped
+func readLegacy(log logger.Logger, path string) (map[string]engine.Record, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "open log")
+	}
+	defer f.Close()
+
+	records := make(map[string]engine.Record)
+	r := bufio.NewReader(f)
+	for line := 1; ; line++ {
+		b, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			if len(bytes.TrimSpace(b)) > 0 && log != nil {
+				log.Warnf("WAL has a torn tail: %d bytes of line %d are dropped", len(b), line)
+			}
+			return records, nil
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, "read error")
+		}
+		var e legacyEvent
+		if err := json.Unmarshal(b, &e); err != nil {
+			return nil, errors.Wrapf(err, "decode line %d", line)
+		}
+		switch e.Action {
+		case actionSet:
+			records[e.Record.Key] = engine.Record{
+				Key:            e.Record.Key,
+				Value:          []byte(e.Record.Value),
+				ExpirationTime: e.Record.ExpirationTime,
+			}
+		case actionDelete:
+			delete(records, e.Record.Key)
+		default:
+			return nil, errors.Errorf("unknown action at line %d", line)
+		}
+	}
+}
+
+// migrateLegacy rewrites the log of JSON lines in the directory into frames, records get versions in order of keys.
+// Snapshots are removed, since their offsets point into the old log.
+func migrateLegacy(log logger.Logger, dir string) error {
+	path := filepath.Join(dir, walFileName)
+	records, err := readLegacy(log, path)
+	if err != nil {
+		return errors.Wrap(err, "read legacy log")
+	}
+	keys := make([]string, 0, len(records))
+	for k := range records {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	tmpPath := filepath.Join(dir, compactFileName)
+	tmp, err := os.OpenFile(tmpPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0755)
+	if err != nil {
+		return errors.Wrap(err, "create migrated log")
+	}
+	defer os.Remove(tmpPath)
+	defer tmp.Close()
+
+	w := bufio.NewWriter(tmp)
+	checkpoint, err := encode(event{Record: engine.Record{Version: uint64(len(keys))}, Action: actionCheckpoint})
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(checkpoint); err != nil {
+		return writeError(err, "write migrated log")
+	}
+	for i, k := range keys {
+		record := records[k]
+		record.Version = uint64(i + 1)
+		frame, err := encode(event{Record: record, Action: actionSet})
+		if err != nil {
+			return err
+		}
+		if _, err := w.Write(frame); err != nil {
+			return writeError(err, "write migrated log")
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return writeError(err, "write migrated log")
+	}
+	if err := tmp.Sync(); err != nil {
+		return writeError(err, "sync migrated log")
+	}
+
+	snapshots, err := listSnapshots(dir)
+	if err != nil {
+		return errors.Wrap(err, "list snapshots")
+	}
+	for _, s := range snapshots {
+		if err := os.Remove(s); err != nil {
+			return errors.Wrap(err, "remove snapshot")
+		}
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		return errors.Wrap(err, "replace legacy log")
+	}
+	if err := syncDir(dir); err != nil {
+		return errors.Wrap(err, "sync directory")
+	}
+	if log != nil {
+		log.Infof("WAL is migrated from JSON lines: %d records", len(records))
+	}
+	return nil
+}
@@ -0,0 +1,99 @@
+package pubsub
+
+// Hub delivers changes of records to subscribers.
+// Publishing never blocks: every subscriber has a bounded buffer, and a subscriber
+// which lets the buffer fill up gets engine.EventOverflow and is unsubscribed.
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/filatovw/ni-storage/engine"
+)
+
+// Subscription receives events of records with keys starting with its prefix
+type Subscription struct {
+	// C is closed when the subscription is over
+	C      <-chan engine.Event
+	c      chan engine.Event
+	prefix string
+	size   int
+}
+
+// Hub keeps subscriptions and provides Subscribe, Unsubscribe and Publish operations.
+type Hub struct {
+	lock          *sync.Mutex
+	subscriptions map[*Subscription]struct{}
+	bufferSize    int
+}
+
+// NewHub creates hub, bufferSize is a number of events a subscriber may fall behind
+func NewHub(bufferSize int) *Hub {
+	return &Hub{
+		lock:          &sync.Mutex{},
+		subscriptions: make(map[*Subscription]struct{}),
+		bufferSize:    bufferSize,
+	}
+}
+
+// Subscribe to events of records with keys starting with the prefix
+func (h *Hub) Subscribe(prefix string) *Subscription {
+	// one more slot is reserved for the overflow event
+	c := make(chan engine.Event, h.bufferSize+1)
+	sub := &Subscription{C: c, c: c, prefix: prefix, size: h.bufferSize}
+	h.lock.Lock()
+	h.subscriptions[sub] = struct{}{}
+	h.lock.Unlock()
+	return sub
+}
+
+// Unsubscribe stops delivery of events and closes the channel of the subscription
+func (h *Hub) Unsubscribe(sub *Subscription) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.remove(sub)
+}
+
+func (h *Hub) remove(sub *Subscription) {
+	if _, ok := h.subscriptions[sub]; !ok {
+		return
+	}
+	delete(h.subscriptions, sub)
+	close(sub.c)
+}
+
+// Publish event to subscribers
+func (h *Hub) Publish(e engine.Event) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	for sub := range h.subscriptions {
+		if !strings.HasPrefix(e.Record.Key, sub.prefix) {
+			continue
+		}
+		if len(sub.c) >= sub.size {
+			sub.c <- engine.Event{Type: engine.EventOverflow}
+			h.remove(sub)
+			continue
+		}
+		sub.c <- e
+	}
+}
+
+// Reset sends engine.EventOverflow to all subscribers and unsubscribes them,
+// it's used when records are replaced at once and changes can't describe it
+func (h *Hub) Reset() {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	for sub := range h.subscriptions {
+		// the slot for the overflow event is always free
+		sub.c <- engine.Event{Type: engine.EventOverflow}
+		h.remove(sub)
+	}
+}
+
+// Len returns number of subscriptions
+func (h *Hub) Len() int {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return len(h.subscriptions)
+}
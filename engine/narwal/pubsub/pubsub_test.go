@@ -0,0 +1,106 @@
+package pubsub
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/filatovw/ni-storage/engine"
+)
+
+func event(t engine.EventType, key string) engine.Event {
+	return engine.Event{Type: t, Record: engine.Record{Key: key}}
+}
+
+func drain(sub *Subscription) []engine.Event {
+	events := []engine.Event{}
+	for {
+		select {
+		case e, ok := <-sub.C:
+			if !ok {
+				return events
+			}
+			events = append(events, e)
+		default:
+			return events
+		}
+	}
+}
+
+func TestHubPublish(t *testing.T) {
+	hub := NewHub(10)
+	all := hub.Subscribe("")
+	users := hub.Subscribe("user:")
+
+	hub.Publish(event(engine.EventSet, "user:1"))
+	hub.Publish(event(engine.EventSet, "order:1"))
+	hub.Publish(event(engine.EventExpired, "user:2"))
+
+	expected := []engine.Event{event(engine.EventSet, "user:1"), event(engine.EventSet, "order:1"), event(engine.EventExpired, "user:2")}
+	if found := drain(all); !reflect.DeepEqual(found, expected) {
+		t.Errorf("expected: %v, got: %v", expected, found)
+	}
+	expected = []engine.Event{event(engine.EventSet, "user:1"), event(engine.EventExpired, "user:2")}
+	if found := drain(users); !reflect.DeepEqual(found, expected) {
+		t.Errorf("expected: %v, got: %v", expected, found)
+	}
+
+	hub.Unsubscribe(users)
+	hub.Unsubscribe(users)
+	if _, ok := <-users.C; ok {
+		t.Errorf("expected channel to be closed")
+	}
+	if hub.Len() != 1 {
+		t.Errorf("expected 1 subscription, got: %d", hub.Len())
+	}
+}
+
+func TestHubOverflow(t *testing.T) {
+	hub := NewHub(3)
+	slow := hub.Subscribe("")
+	fast := hub.Subscribe("")
+
+	for i := 0; i < 5; i++ {
+		hub.Publish(event(engine.EventSet, fmt.Sprintf("key%d", i)))
+		drain(fast)
+	}
+
+	expected := []engine.Event{
+		event(engine.EventSet, "key0"),
+		event(engine.EventSet, "key1"),
+		event(engine.EventSet, "key2"),
+		{Type: engine.EventOverflow},
+	}
+	found := []engine.Event{}
+	for e := range slow.C {
+		found = append(found, e)
+	}
+	if !reflect.DeepEqual(found, expected) {
+		t.Errorf("expected: %v, got: %v", expected, found)
+	}
+	if hub.Len() != 1 {
+		t.Errorf("expected fast subscriber to stay, got %d subscriptions", hub.Len())
+	}
+}
+
+func TestHubReset(t *testing.T) {
+	hub := NewHub(3)
+	subs := []*Subscription{hub.Subscribe(""), hub.Subscribe("key")}
+	for i := 0; i < 3; i++ {
+		hub.Publish(event(engine.EventSet, fmt.Sprintf("key%d", i)))
+	}
+	hub.Reset()
+
+	for _, sub := range subs {
+		var last engine.Event
+		for e := range sub.C {
+			last = e
+		}
+		if last.Type != engine.EventOverflow {
+			t.Errorf("expected overflow as the last event, got %v", last)
+		}
+	}
+	if hub.Len() != 0 {
+		t.Errorf("expected no subscriptions, got %d", hub.Len())
+	}
+}
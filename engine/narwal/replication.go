@@ -0,0 +1,149 @@
+package narwal
+
+import (
+	"context"
+	"time"
+
+	"github.com/filatovw/ni-storage/engine"
+	"github.com/filatovw/ni-storage/engine/narwal/index"
+	"github.com/filatovw/ni-storage/engine/narwal/ttl"
+	"github.com/pkg/errors"
+)
+
+// Replication.
+// A follower writes changes of a leader into its own log with the sequence numbers and versions
+// assigned by the leader, so it resumes replication from its last sequence number after restart
+// and goes on with the same numbering when it's promoted.
+// While the storage is a follower it doesn't remove expired records and doesn't prolong records
+// with sliding TTL, the leader does it and these changes are replicated as well.
+
+// isFollower tells if records are changed only by a leader
+func (s *Narwal) isFollower() bool {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.follower
+}
+
+// SetFollower switches the storage into follower mode and back
+func (s *Narwal) SetFollower(follower bool) {
+	s.lock.Lock()
+	s.follower = follower
+	s.lock.Unlock()
+}
+
+// Seq returns the sequence number of the last change
+func (s *Narwal) Seq() uint64 {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.seq
+}
+
+// Dump returns a copy of all records along with the sequence number of the last change.
+// Expired records are included, their removal is a change which goes after the dump.
+func (s *Narwal) Dump() engine.Dump {
+	// the committer is the only writer, so the copy is consistent with the counters
+	s.commitLock.Lock()
+	defer s.commitLock.Unlock()
+	dump := engine.Dump{
+		Version: s.version,
+		Seq:     s.seq,
+		Records: make(map[string]engine.Record, len(s.data)),
+	}
+	for k, v := range s.data {
+		dump.Records[k] = v
+	}
+	return dump
+}
+
+// Apply writes changes replicated from a leader keeping their sequence numbers and versions.
+// Changes which are already applied are skipped.
+func (s *Narwal) Apply(ctx context.Context, changes ...engine.Event) error {
+	events := make([]event, 0, len(changes))
+	for _, change := range changes {
+		e, err := replicatedEvent(change)
+		if err != nil {
+			return err
+		}
+		events = append(events, e)
+	}
+	return s.propose(ctx, func(v *view) ([]event, error) {
+		proposed := []event{}
+		for _, e := range events {
+			if e.Seq <= v.seq {
+				continue
+			}
+			proposed = append(proposed, e)
+		}
+		return proposed, nil
+	})
+}
+
+// replicatedEvent builds event of the log from a change of a leader
+func replicatedEvent(change engine.Event) (event, error) {
+	e := event{Seq: change.Seq}
+	switch change.Type {
+	case engine.EventSet:
+		e.Record = change.Record
+		e.Action = actionSet
+	case engine.EventDelete, engine.EventExpired:
+		e.Record = engine.Record{Key: change.Record.Key, Version: change.Record.Version}
+		e.Action = actionDelete
+		e.Expired = change.Type == engine.EventExpired
+	case engine.EventExpire:
+		e.Record = engine.Record{Key: change.Record.Key, ExpirationTime: change.Record.ExpirationTime, Version: change.Record.Version}
+		e.Action = actionExpire
+	default:
+		return e, errors.Errorf("unexpected change: %s", change.Type)
+	}
+	if e.Seq == 0 {
+		return e, errors.Errorf("change of %s has no sequence number", change.Record.Key)
+	}
+	return e, nil
+}
+
+// Restore replaces all records with the dump of a leader, it's used when the changes
+// a follower needs are compacted by the leader. Watchers get engine.EventOverflow.
+func (s *Narwal) Restore(dump engine.Dump) error {
+	s.maintenance.Lock()
+	defer s.maintenance.Unlock()
+
+	// snapshots don't match the new log
+	if err := purgeSnapshots(s.wal.dir, 0); err != nil {
+		return errors.Wrap(err, "remove snapshots")
+	}
+
+	// writers wait until the log is replaced
+	s.commitLock.Lock()
+	defer s.commitLock.Unlock()
+	if err := s.wal.StartRewrite(); err != nil {
+		return err
+	}
+	if err := s.wal.Rewrite(dump.Records, dump.Version, dump.Seq); err != nil {
+		return errors.Wrap(err, "rewrite WAL")
+	}
+
+	data := make(map[string]engine.Record, len(dump.Records))
+	keys := index.NewIndex()
+	ttlIndex := ttl.NewIndex()
+	for k, r := range dump.Records {
+		data[k] = r
+		keys.Insert(k)
+		if r.ExpirationTime != nil {
+			ttlIndex.Push(ttl.Record{Key: k, Until: *r.ExpirationTime})
+		}
+	}
+	s.lock.Lock()
+	s.data = data
+	s.keys = keys
+	s.ttl = &ttlIndex
+	s.version = dump.Version
+	s.seq = dump.Seq
+	s.lock.Unlock()
+
+	s.touchLock.Lock()
+	s.touches = make(map[string]time.Time)
+	s.touchLock.Unlock()
+
+	s.hub.Reset()
+	return nil
+}
@@ -0,0 +1,106 @@
+package narwal
+
+import (
+	"context"
+	"time"
+
+	"github.com/filatovw/ni-storage/engine"
+)
+
+// Sliding expiration.
+// Reads of records with sliding TTL don't write into the log. They only remember the time of the last access,
+// so the record is treated as alive until that time plus the TTL. Accesses are written periodically
+// as expire events, one entry for all records read since the previous flush.
+// Accesses which are not flushed yet are lost on crash, so such records may expire earlier after restart.
+
+// touch remembers the time of the last read of a record with sliding TTL
+func (s *Narwal) touch(key string, t time.Time) {
+	s.touchLock.Lock()
+	if last, ok := s.touches[key]; !ok || t.After(last) {
+		s.touches[key] = t
+	}
+	s.touchLock.Unlock()
+}
+
+// expiration returns the time the record expires at, reads which are not flushed yet are taken into account
+func (s *Narwal) expiration(r engine.Record) *time.Time {
+	if r.ExpirationTime == nil || r.SlidingTTL == 0 {
+		return r.ExpirationTime
+	}
+	s.touchLock.Lock()
+	last, ok := s.touches[r.Key]
+	s.touchLock.Unlock()
+	if !ok {
+		return r.ExpirationTime
+	}
+	if until := last.Add(r.SlidingTTL); until.After(*r.ExpirationTime) {
+		return &until
+	}
+	return r.ExpirationTime
+}
+
+// isExpired checks if the record has expired by the time
+func (s *Narwal) isExpired(r engine.Record, t time.Time) bool {
+	until := s.expiration(r)
+	return until != nil && until.Before(t)
+}
+
+// flushTouches writes prolonged expiration of records read since the last flush into the log
+func (s *Narwal) flushTouches() {
+	if s.isFollower() {
+		return
+	}
+	s.touchLock.Lock()
+	touches := make(map[string]time.Time, len(s.touches))
+	for k, t := range s.touches {
+		touches[k] = t
+	}
+	s.touchLock.Unlock()
+	if len(touches) == 0 {
+		return
+	}
+
+	err := s.propose(context.Background(), func(v *view) ([]event, error) {
+		events := []event{}
+		for key, t := range touches {
+			// the record could be removed or replaced after it was read
+			r, ok := v.get(key)
+			if !ok || r.SlidingTTL == 0 || r.ExpirationTime == nil {
+				continue
+			}
+			until := t.Add(r.SlidingTTL)
+			if !until.After(*r.ExpirationTime) {
+				continue
+			}
+			events = append(events, event{Record: engine.Record{Key: key, ExpirationTime: &until}, Action: actionExpire})
+		}
+		return events, nil
+	})
+	if err != nil {
+		s.log.Errorf("failed to prolong expiration of keys: %s", err)
+		return
+	}
+
+	s.touchLock.Lock()
+	for k, t := range touches {
+		// the key could be read again during the flush
+		if s.touches[k].Equal(t) {
+			delete(s.touches, k)
+		}
+	}
+	s.touchLock.Unlock()
+}
+
+// checkTouches periodically flushes reads of records with sliding TTL
+func (s *Narwal) checkTouches(ctx context.Context, period time.Duration) {
+	t := time.NewTicker(period)
+	for {
+		select {
+		case <-t.C:
+			s.flushTouches()
+		case <-ctx.Done():
+			t.Stop()
+			return
+		}
+	}
+}
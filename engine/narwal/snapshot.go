@@ -0,0 +1,154 @@
+package narwal
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/filatovw/ni-storage/engine"
+	"github.com/filatovw/ni-storage/logger"
+	"github.com/pkg/errors"
+)
+
+const (
+	snapshotPrefix = "snapshot-"
+	snapshotSuffix = ".snap"
+	snapshotTmp    = ".tmp"
+)
+
+// snapshot is a point-in-time copy of all records.
+// It covers the log up to Offset, so only the tail of the log has to be replayed on start.
+type snapshot struct {
+	// Offset in the log-file the snapshot was taken at
+	Offset int64 `json:"offset"`
+	// Events is a number of events in the log-file before Offset
+	Events int `json:"events"`
+	// Version is the last version assigned to a change
+	Version uint64 `json:"version"`
+	// Seq is the sequence number of the last event before Offset
+	Seq uint64 `json:"seq"`
+	// Base is the sequence number of the last event removed from the log by compaction
+	Base    uint64                   `json:"base"`
+	Records map[string]engine.Record `json:"records"`
+}
+
+// snapshotName is built from the offset, so names sort in order of creation
+func snapshotName(offset int64) string {
+	return fmt.Sprintf("%s%020d%s", snapshotPrefix, offset, snapshotSuffix)
+}
+
+// listSnapshots returns paths of snapshot files, the newest go first
+func listSnapshots(dir string) ([]string, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	paths := []string{}
+	for _, f := range files {
+		name := f.Name()
+		if strings.HasPrefix(name, snapshotPrefix) && strings.HasSuffix(name, snapshotSuffix) {
+			paths = append(paths, filepath.Join(dir, name))
+		}
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(paths)))
+	return paths, nil
+}
+
+// writeSnapshot stores snapshot into a temporary file and atomically renames it
+func writeSnapshot(dir string, snap snapshot) error {
+	path := filepath.Join(dir, snapshotName(snap.Offset))
+	tmpPath := path + snapshotTmp
+	f, err := os.OpenFile(tmpPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0755)
+	if err != nil {
+		return errors.Wrap(err, "create snapshot")
+	}
+	w := bufio.NewWriter(f)
+	if err := json.NewEncoder(w).Encode(snap); err != nil {
+		f.Close()
+		os.Remove(tmpPath)
+		return errors.Wrap(err, "write snapshot")
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		os.Remove(tmpPath)
+		return errors.Wrap(err, "write snapshot")
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(tmpPath)
+		return errors.Wrap(err, "sync snapshot")
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmpPath)
+		return errors.Wrap(err, "close snapshot")
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		os.Remove(tmpPath)
+		return errors.Wrap(err, "rename snapshot")
+	}
+	return syncDir(dir)
+}
+
+// readSnapshot loads snapshot from a file
+func readSnapshot(path string) (*snapshot, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	snap := &snapshot{}
+	if err := json.NewDecoder(bufio.NewReader(f)).Decode(snap); err != nil {
+		return nil, err
+	}
+	if snap.Records == nil {
+		return nil, errors.New("snapshot has no records")
+	}
+	return snap, nil
+}
+
+// loadSnapshot finds the newest valid snapshot which fits into the log of a given size.
+// Empty snapshot is returned when there is nothing to load.
+func loadSnapshot(log logger.Logger, dir string, walSize int64) (*snapshot, error) {
+	paths, err := listSnapshots(dir)
+	if err != nil {
+		return nil, errors.Wrap(err, "list snapshots")
+	}
+	for _, path := range paths {
+		snap, err := readSnapshot(path)
+		if err != nil {
+			log.Warnf("skip broken snapshot %s: %s", path, err)
+			continue
+		}
+		if snap.Offset > walSize {
+			log.Warnf("skip snapshot %s: offset %d is beyond the end of WAL", path, snap.Offset)
+			continue
+		}
+		return snap, nil
+	}
+	return &snapshot{Records: make(map[string]engine.Record)}, nil
+}
+
+// purgeSnapshots removes all snapshots except the newest ones
+func purgeSnapshots(dir string, retain int) error {
+	paths, err := listSnapshots(dir)
+	if err != nil {
+		return err
+	}
+	if retain < 0 {
+		retain = 0
+	}
+	if len(paths) <= retain {
+		return nil
+	}
+	for _, path := range paths[retain:] {
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,106 @@
+package narwal
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/filatovw/ni-storage/config"
+	"github.com/filatovw/ni-storage/engine"
+	"go.uber.org/zap"
+)
+
+func TestSnapshotRecovery(t *testing.T) {
+	s, tmpdir := SetupEngineHelper(t)
+	defer os.RemoveAll(tmpdir)
+
+	s.Set(context.TODO(), engine.Record{Key: "key1", Value: []byte("value1")})
+	s.Set(context.TODO(), engine.Record{Key: "key2", Value: []byte("value2")})
+	if err := s.Snapshot(); err != nil {
+		t.Fatalf("snapshot: %s", err)
+	}
+	// the tail of the log
+	s.Set(context.TODO(), engine.Record{Key: "key3", Value: []byte("value3")})
+	s.Delete(context.TODO(), "key1")
+
+	log, err := zap.NewProduction()
+	if err != nil {
+		t.Errorf("error on logger init: %s", err)
+	}
+	restored, err := New(context.TODO(), config.NarWAL{DataDir: tmpdir}, log.Sugar())
+	if err != nil {
+		t.Fatalf("reopen engine: %s", err)
+	}
+	if !reflect.DeepEqual(restored.GetAll(), s.GetAll()) {
+		t.Errorf("expected: %v, got: %v", s.GetAll(), restored.GetAll())
+	}
+	if restored.wal.Events() != s.wal.Events() {
+		t.Errorf("expected %d events, got: %d", s.wal.Events(), restored.wal.Events())
+	}
+}
+
+func TestSnapshotSkipBroken(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "snapshot_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+	log, err := zap.NewProduction()
+	if err != nil {
+		t.Errorf("error on logger init: %s", err)
+	}
+
+	valid := snapshot{Offset: 10, Records: map[string]engine.Record{"key1": engine.Record{Key: "key1", Value: []byte("value1")}}}
+	if err := writeSnapshot(tmpdir, valid); err != nil {
+		t.Fatalf("write snapshot: %s", err)
+	}
+	beyond := snapshot{Offset: 200, Records: map[string]engine.Record{}}
+	if err := writeSnapshot(tmpdir, beyond); err != nil {
+		t.Fatalf("write snapshot: %s", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(tmpdir, snapshotName(100)), []byte(`{"offset":100,"reco`), 0755); err != nil {
+		t.Fatalf("write broken snapshot: %s", err)
+	}
+
+	snap, err := loadSnapshot(log.Sugar(), tmpdir, 150)
+	if err != nil {
+		t.Fatalf("load snapshot: %s", err)
+	}
+	if !reflect.DeepEqual(*snap, valid) {
+		t.Errorf("expected: %v, got: %v", valid, *snap)
+	}
+}
+
+func TestSnapshotRetain(t *testing.T) {
+	s, tmpdir := SetupEngineHelper(t)
+	defer os.RemoveAll(tmpdir)
+	s.snapshotRetain = 2
+
+	for _, key := range []string{"key1", "key2", "key3"} {
+		s.Set(context.TODO(), engine.Record{Key: key, Value: []byte("value")})
+		if err := s.Snapshot(); err != nil {
+			t.Fatalf("snapshot: %s", err)
+		}
+	}
+	paths, err := listSnapshots(tmpdir)
+	if err != nil {
+		t.Fatalf("list snapshots: %s", err)
+	}
+	if len(paths) != 2 {
+		t.Errorf("expected 2 snapshots, got: %v", paths)
+	}
+
+	if err := s.Compact(); err != nil {
+		t.Fatalf("compact: %s", err)
+	}
+	paths, err = listSnapshots(tmpdir)
+	if err != nil {
+		t.Fatalf("list snapshots: %s", err)
+	}
+	if len(paths) != 0 {
+		t.Errorf("expected snapshots to be removed by compaction, got: %v", paths)
+	}
+}
@@ -1,24 +1,26 @@
 package ttl
 
 // TTL index serves for storing of <time:key> pair.
-// The underlying struct is a stack. Older values lie on top which makes it easier to check just a few of them regularely.
-// Downside of this approach is the complexity of adding of a new value or deletion by key
-// but in context of KV database with in-memory cache Reads happens way more often than Writes.
+// The underlying struct is a binary min-heap. The oldest value lies on top which makes it easy to check just a few of them regularely.
+// Position of every key in the heap is tracked, so adding, updating and deletion by key take O(log n).
 
 import (
-	"sort"
+	"container/heap"
 	"time"
 )
 
-// Index stores data in a stack-like structure and provides Push, PopAfter and Delete operations.
+// Index stores data in a heap and provides Push, PopAfter and Delete operations.
 type Index struct {
-	stack []Record
+	heap *records
 }
 
 // NewIndex creates TTL index
 func NewIndex() Index {
 	return Index{
-		stack: []Record{},
+		heap: &records{
+			items:     []Record{},
+			positions: make(map[string]int),
+		},
 	}
 }
 
@@ -28,41 +30,69 @@ type Record struct {
 	Key   string
 }
 
-// Push record on stack
+// records implements heap.Interface and keeps positions of keys up to date
+type records struct {
+	items     []Record
+	positions map[string]int
+}
+
+func (h *records) Len() int { return len(h.items) }
+
+func (h *records) Less(i, j int) bool { return h.items[i].Until.Before(h.items[j].Until) }
+
+func (h *records) Swap(i, j int) {
+	h.items[i], h.items[j] = h.items[j], h.items[i]
+	h.positions[h.items[i].Key] = i
+	h.positions[h.items[j].Key] = j
+}
+
+func (h *records) Push(x interface{}) {
+	r := x.(Record)
+	h.positions[r.Key] = len(h.items)
+	h.items = append(h.items, r)
+}
+
+func (h *records) Pop() interface{} {
+	n := len(h.items) - 1
+	r := h.items[n]
+	h.items = h.items[:n]
+	delete(h.positions, r.Key)
+	return r
+}
+
+// Len returns number of keys in index
+func (idx *Index) Len() int {
+	return idx.heap.Len()
+}
+
+// Push record into index, expiration time of a key which is already indexed is updated
 func (idx *Index) Push(r Record) {
-	idx.Delete(r.Key)
-	idx.stack = append(idx.stack, r)
-	sort.Slice(idx.stack, func(i, j int) bool { return idx.stack[i].Until.Before(idx.stack[j].Until) })
+	if i, ok := idx.heap.positions[r.Key]; ok {
+		idx.heap.items[i] = r
+		heap.Fix(idx.heap, i)
+		return
+	}
+	heap.Push(idx.heap, r)
 }
 
 // Delete record by key
 func (idx *Index) Delete(k string) {
-	i := -1
-	for j, e := range idx.stack {
-		if e.Key == k {
-			i = j
-			break
-		}
-	}
-	if i >= 0 {
-		idx.stack = append(idx.stack[:i], idx.stack[i+1:]...)
+	if i, ok := idx.heap.positions[k]; ok {
+		heap.Remove(idx.heap, i)
 	}
 }
 
-// PopAfter returns all the keys with expiration time older than given time
+// PopAfter returns all the keys with expiration time older than given time, the oldest go first
 func (idx *Index) PopAfter(t time.Time) []string {
+	return idx.PopAfterN(t, idx.heap.Len())
+}
+
+// PopAfterN returns at most n keys with expiration time older than given time, the oldest go first
+func (idx *Index) PopAfterN(t time.Time, n int) []string {
 	results := []string{}
-	i := -1
-	for j, e := range idx.stack {
-		if e.Until.Before(t) {
-			results = append(results, e.Key)
-			i = j
-		} else {
-			break
-		}
-	}
-	if i >= 0 {
-		idx.stack = idx.stack[i+1:]
+	for len(results) < n && idx.heap.Len() > 0 && idx.heap.items[0].Until.Before(t) {
+		r := heap.Pop(idx.heap).(Record)
+		results = append(results, r.Key)
 	}
 	return results
 }
@@ -1,11 +1,21 @@
 package ttl
 
 import (
+	"fmt"
+	"math/rand"
 	"reflect"
+	"sort"
 	"testing"
 	"time"
 )
 
+// sorted returns records of index in order of expiration
+func sorted(idx Index) []Record {
+	records := append([]Record{}, idx.heap.items...)
+	sort.Slice(records, func(i, j int) bool { return records[i].Until.Before(records[j].Until) })
+	return records
+}
+
 func TestTTLIndexPopAfter(t *testing.T) {
 	ts1 := Record{Until: time.Date(2019, 2, 20, 16, 0, 0, 0, time.UTC), Key: "key1"}
 	ts2 := Record{Until: time.Date(2019, 2, 20, 17, 0, 0, 0, time.UTC), Key: "key2"}
@@ -68,8 +78,8 @@ func TestTTLIndexPopAfter(t *testing.T) {
 				t.Errorf("expected found: %#v, got: %#v", td.expectedPop, found)
 			}
 
-			if !reflect.DeepEqual(idx.stack, td.expectedIndex) {
-				t.Errorf("expected remains in index: %#v, got: %#v", td.expectedIndex, idx.stack)
+			if remains := sorted(idx); !reflect.DeepEqual(remains, td.expectedIndex) {
+				t.Errorf("expected remains in index: %#v, got: %#v", td.expectedIndex, remains)
 			}
 		})
 	}
@@ -132,9 +142,126 @@ func TestTTLIndexDelete(t *testing.T) {
 				idx.Delete(k)
 			}
 
-			if !reflect.DeepEqual(idx.stack, td.expectedIndex) {
-				t.Errorf("expected remains in index: %#v, got: %#v", td.expectedIndex, idx.stack)
+			if remains := sorted(idx); !reflect.DeepEqual(remains, td.expectedIndex) {
+				t.Errorf("expected remains in index: %#v, got: %#v", td.expectedIndex, remains)
 			}
 		})
 	}
 }
+
+func TestTTLIndexPopAfterN(t *testing.T) {
+	idx := NewIndex()
+	base := time.Date(2019, 2, 20, 16, 0, 0, 0, time.UTC)
+	for i := 0; i < 5; i++ {
+		idx.Push(Record{Key: fmt.Sprintf("key%d", i), Until: base.Add(time.Duration(5-i) * time.Second)})
+	}
+	deadline := base.Add(4500 * time.Millisecond)
+	if found, expected := idx.PopAfterN(deadline, 2), []string{"key4", "key3"}; !reflect.DeepEqual(found, expected) {
+		t.Errorf("expected found: %#v, got: %#v", expected, found)
+	}
+	if found, expected := idx.PopAfterN(deadline, 5), []string{"key2", "key1"}; !reflect.DeepEqual(found, expected) {
+		t.Errorf("expected found: %#v, got: %#v", expected, found)
+	}
+	if idx.Len() != 1 {
+		t.Errorf("expected 1 key in index, got: %d", idx.Len())
+	}
+}
+
+func TestTTLIndexRandomized(t *testing.T) {
+	idx := NewIndex()
+	expected := make(map[string]time.Time)
+	base := time.Date(2019, 2, 20, 16, 0, 0, 0, time.UTC)
+	rnd := rand.New(rand.NewSource(42))
+	for i := 0; i < 10000; i++ {
+		key := fmt.Sprintf("key%d", rnd.Intn(1000))
+		if rnd.Intn(3) == 0 {
+			idx.Delete(key)
+			delete(expected, key)
+			continue
+		}
+		until := base.Add(time.Duration(rnd.Intn(1000)) * time.Second)
+		idx.Push(Record{Key: key, Until: until})
+		expected[key] = until
+	}
+	if idx.Len() != len(expected) {
+		t.Fatalf("expected length: %d, got: %d", len(expected), idx.Len())
+	}
+
+	deadline := base.Add(500 * time.Second)
+	found := idx.PopAfter(deadline)
+	for i, k := range found {
+		if !expected[k].Before(deadline) {
+			t.Errorf("key %s is not expired: %s", k, expected[k])
+		}
+		if i > 0 && expected[k].Before(expected[found[i-1]]) {
+			t.Errorf("keys are out of order: %s, %s", found[i-1], k)
+		}
+		delete(expected, k)
+	}
+	for k, until := range expected {
+		if until.Before(deadline) {
+			t.Errorf("expired key %s remains in index", k)
+		}
+	}
+	if idx.Len() != len(expected) {
+		t.Errorf("expected length: %d, got: %d", len(expected), idx.Len())
+	}
+}
+
+func benchmarkRecords(n int) []Record {
+	base := time.Date(2019, 2, 20, 16, 0, 0, 0, time.UTC)
+	records := make([]Record, n)
+	for i := range records {
+		records[i] = Record{Key: fmt.Sprintf("key%d", i), Until: base.Add(time.Duration(rand.Intn(n)) * time.Second)}
+	}
+	return records
+}
+
+func BenchmarkTTLIndexPush(b *testing.B) {
+	records := benchmarkRecords(b.N)
+	idx := NewIndex()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		idx.Push(records[i])
+	}
+}
+
+func BenchmarkTTLIndexUpdate(b *testing.B) {
+	records := benchmarkRecords(100000)
+	idx := NewIndex()
+	for _, r := range records {
+		idx.Push(r)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		r := records[i%len(records)]
+		r.Until = r.Until.Add(time.Second)
+		idx.Push(r)
+	}
+}
+
+func BenchmarkTTLIndexDelete(b *testing.B) {
+	records := benchmarkRecords(b.N)
+	idx := NewIndex()
+	for _, r := range records {
+		idx.Push(r)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		idx.Delete(records[i].Key)
+	}
+}
+
+func BenchmarkTTLIndexPopAfter(b *testing.B) {
+	records := benchmarkRecords(b.N)
+	idx := NewIndex()
+	for _, r := range records {
+		idx.Push(r)
+	}
+	deadline := time.Date(2019, 2, 20, 16, 0, 0, 0, time.UTC)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		deadline = deadline.Add(time.Second)
+		idx.PopAfter(deadline)
+	}
+}
@@ -2,11 +2,14 @@ package narwal
 
 import (
 	"bufio"
-	"encoding/json"
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
 	"io"
 	"os"
 	"path/filepath"
 	"sync"
+	"syscall"
 
 	"github.com/filatovw/ni-storage/engine"
 	"github.com/filatovw/ni-storage/logger"
@@ -20,17 +23,78 @@ type action int
 const (
 	actionSet    action = 0
 	actionDelete action = 1
+	// actionCheckpoint keeps the last assigned version when older events are compacted
+	actionCheckpoint action = 2
+	// actionExpire changes expiration time of a record, empty expiration time makes the record permanent.
+	// Changes made by clients carry a new version of the record, prolongation by reads keeps the version.
+	actionExpire action = 3
 
-	defaultMaxRecordSize = 2 << 24 // 16 MB
+	defaultMaxRecordSize = engine.MaxRecordSize
+
+	walFileName     = "narwal.wal"
+	compactFileName = "narwal.wal.compact"
+)
+
+// Durability defines when written events are flushed to a disk
+type Durability string
+
+const (
+	// DurabilityAlways flushes every write before it is acknowledged
+	DurabilityAlways Durability = "always"
+	// DurabilityInterval flushes the log periodically, last writes may be lost on crash
+	DurabilityInterval Durability = "interval"
+	// DurabilityNone leaves flushing to the operating system
+	DurabilityNone Durability = "none"
 )
 
+// ParseDurability validates durability mode
+func ParseDurability(v string) (Durability, error) {
+	switch d := Durability(v); d {
+	case DurabilityAlways, DurabilityInterval, DurabilityNone:
+		return d, nil
+	default:
+		return "", errors.Errorf("unknown durability mode: %q", v)
+	}
+}
+
+// logFile is the open log-file, tests replace it to fail I/O
+type logFile interface {
+	io.ReadWriteCloser
+	io.ReaderAt
+	io.Seeker
+	Truncate(size int64) error
+	Sync() error
+}
+
 // WAL log-file in append mode
 type WAL struct {
 	maxRecordSize int
+	dir           string
 	path          string
-	rw            io.ReadWriteCloser
+	rw            logFile
 	lock          *sync.Mutex
 	log           logger.Logger
+
+	// size of the log-file in bytes
+	size int64
+	// events is a number of events stored in the log-file
+	events int
+	// base is the sequence number of the last event removed by compaction, later events are kept in the log-file
+	base uint64
+	// rewrite collects events written while compaction is in progress
+	rewrite *rewriteBuffer
+
+	durability Durability
+	// dirty is set when there are writes which are not flushed to a disk
+	dirty bool
+	// broken is set when a failed write can't be removed from the log-file, later writes are refused
+	broken error
+}
+
+// rewriteBuffer keeps events that were written into the old log-file during compaction
+type rewriteBuffer struct {
+	buf    bytes.Buffer
+	events int
 }
 
 // OpenWAL open log or create it if it doesn't exist
@@ -42,17 +106,38 @@ func OpenWAL(log logger.Logger, path string, maxRecordSize int) (*WAL, error) {
 	if err := os.MkdirAll(path, 0755); err != nil {
 		return nil, errors.Wrap(err, "create directory")
 	}
-	dataPath := filepath.Join(path, "narwal.wal")
+	// leftover of interrupted compaction, the original log is still in place
+	if err := os.Remove(filepath.Join(path, compactFileName)); err != nil && !os.IsNotExist(err) {
+		return nil, errors.Wrap(err, "remove compacted log")
+	}
+	dataPath := filepath.Join(path, walFileName)
+	legacy, err := isLegacy(dataPath)
+	if err != nil {
+		return nil, err
+	}
+	if legacy {
+		if err := migrateLegacy(log, path); err != nil {
+			return nil, errors.Wrap(err, "migrate legacy log")
+		}
+	}
 	rw, err := os.OpenFile(dataPath, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0755)
 	if err != nil {
 		return nil, errors.Wrap(err, "init storage")
 	}
+	stat, err := rw.Stat()
+	if err != nil {
+		rw.Close()
+		return nil, errors.Wrap(err, "stat storage")
+	}
 	return &WAL{
 		maxRecordSize: maxRecordSize,
+		dir:           path,
 		path:          dataPath,
 		rw:            rw,
 		lock:          &sync.Mutex{},
 		log:           log,
+		size:          stat.Size(),
+		durability:    DurabilityNone,
 	}, nil
 }
 
@@ -60,55 +145,419 @@ func OpenWAL(log logger.Logger, path string, maxRecordSize int) (*WAL, error) {
 func (l *WAL) Close() error {
 	l.lock.Lock()
 	defer l.lock.Unlock()
+	if err := l.sync(); err != nil {
+		l.rw.Close()
+		return err
+	}
 	return l.rw.Close()
 }
 
+// SetDurability changes the moment when writes are flushed to a disk
+func (l *WAL) SetDurability(d Durability) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.durability = d
+}
+
+// Sync flushes written events to a disk
+func (l *WAL) Sync() error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.sync()
+}
+
+func (l *WAL) sync() error {
+	if !l.dirty {
+		return nil
+	}
+	if err := l.rw.Sync(); err != nil {
+		return writeError(err, "sync log")
+	}
+	l.dirty = false
+	return nil
+}
+
+// Size of the log-file in bytes
+func (l *WAL) Size() int64 {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.size
+}
+
+// Events returns a number of events stored in the log-file
+func (l *WAL) Events() int {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.events
+}
+
+// Base returns the sequence number of the last event removed by compaction
+func (l *WAL) Base() uint64 {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.base
+}
+
+// ReadSince calls fn for events with sequence numbers greater than since, which were written before the call.
+// engine.ErrCompacted is returned when some of these events are removed by compaction.
+func (l *WAL) ReadSince(since uint64, fn func(e event) error) error {
+	l.lock.Lock()
+	if since < l.base {
+		l.lock.Unlock()
+		return engine.ErrCompacted
+	}
+	// the file stays readable even if compaction replaces it in the meantime
+	f, err := os.Open(l.path)
+	size := l.size
+	l.lock.Unlock()
+	if err != nil {
+		return errors.Wrap(err, "open log")
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	var offset int64
+	for offset < size {
+		payload, err := readFrame(r, size-offset)
+		if err != nil {
+			return errors.Wrapf(err, "read entry at offset %d", offset)
+		}
+		events, err := unmarshalEntry(payload)
+		if err != nil {
+			return errors.Wrapf(err, "decode entry at offset %d", offset)
+		}
+		offset += frameSize(payload)
+		for _, e := range events {
+			if e.Seq <= since {
+				continue
+			}
+			if err := fn(e); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
 // Read snapshot from log-file
 func (l *WAL) Read() (map[string]engine.Record, error) {
-	result := make(map[string]engine.Record)
-	scan := bufio.NewScanner(l.rw)
-	var e event
+	return l.ReadFrom(&snapshot{Records: make(map[string]engine.Record)})
+}
 
-	scan.Split(bufio.ScanLines)
-	for scan.Scan() {
-		r := scan.Bytes()
-		if err := json.Unmarshal(r, &e); err != nil {
-			return nil, err
+// ReadFrom replays the tail of log-file written after the snapshot was taken.
+// Records and version of the snapshot are updated in place.
+// A torn or corrupted frame at the end of the log is truncated,
+// corruption in the middle of the log is reported as an error.
+func (l *WAL) ReadFrom(snap *snapshot) (map[string]engine.Record, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if _, err := l.rw.Seek(snap.Offset, io.SeekStart); err != nil {
+		return nil, errors.Wrap(err, "seek snapshot offset")
+	}
+	result := snap.Records
+	r := bufio.NewReader(l.rw)
+	l.events = snap.Events
+	l.base = snap.Base
+	offset := snap.Offset
+	for offset < l.size {
+		payload, err := readFrame(r, l.size-offset)
+		if err != nil {
+			if (err == errCorruptedFrame && !l.isTail(offset, payload)) || (err == errTornFrame && !l.isTornTail(offset)) {
+				return nil, errors.Errorf("WAL is corrupted at offset %d", offset)
+			}
+			if err != errCorruptedFrame && err != errTornFrame {
+				return nil, errors.Wrap(err, "read error")
+			}
+			if err := l.truncate(offset); err != nil {
+				return nil, err
+			}
+			break
 		}
+		events, err := unmarshalEntry(payload)
+		if err != nil {
+			return nil, errors.Wrapf(err, "decode entry at offset %d", offset)
+		}
+		offset += frameSize(payload)
 
-		switch e.Action {
-		case actionSet:
-			result[e.Record.Key] = e.Record
-		case actionDelete:
-			delete(result, e.Record.Key)
-		default:
-			return nil, errors.New("unknown action")
+		for _, e := range events {
+			switch e.Action {
+			case actionSet:
+				result[e.Record.Key] = e.Record
+			case actionDelete:
+				delete(result, e.Record.Key)
+			case actionExpire:
+				if r, ok := result[e.Record.Key]; ok {
+					r.ExpirationTime = e.Record.ExpirationTime
+					if r.ExpirationTime == nil {
+						r.SlidingTTL = 0
+					}
+					if e.Record.Version != 0 {
+						r.Version = e.Record.Version
+					}
+					result[e.Record.Key] = r
+				}
+			case actionCheckpoint:
+				l.base = e.Seq
+			default:
+				return nil, errors.New("unknown action")
+			}
+			if e.Record.Version > snap.Version {
+				snap.Version = e.Record.Version
+			}
+			if e.Seq > snap.Seq {
+				snap.Seq = e.Seq
+			}
 		}
+		l.events += len(events)
 	}
+	return result, nil
+}
 
-	if err := scan.Err(); err != nil {
-		return nil, errors.Wrap(err, "read error")
+// isTail checks whether a corrupted frame at offset is the last thing in the log.
+// Zeroes after the frame are treated as preallocated space, not as data.
+func (l *WAL) isTail(offset int64, payload []byte) bool {
+	end := offset + frameSize(payload)
+	if end >= l.size {
+		return true
 	}
-	return result, nil
+	rest := make([]byte, l.size-end)
+	if _, err := l.rw.ReadAt(rest, end); err != nil {
+		return false
+	}
+	for _, b := range rest {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// isTornTail checks whether a frame at offset which goes beyond the end of the log is really cut by it.
+// A write is cut only at the end of the log, so a complete frame found after the offset means that
+// the length of the frame is corrupted.
+func (l *WAL) isTornTail(offset int64) bool {
+	if l.size-offset <= frameHeaderSize {
+		return true
+	}
+	rest := make([]byte, l.size-offset-1)
+	if _, err := l.rw.ReadAt(rest, offset+1); err != nil {
+		return false
+	}
+	for i := 0; i+frameHeaderSize < len(rest); i++ {
+		length := int(binary.BigEndian.Uint32(rest[i : i+4]))
+		end := i + frameHeaderSize + length
+		if length == 0 || end > len(rest) {
+			continue
+		}
+		if crc32.Checksum(rest[i+frameHeaderSize:end], crcTable) == binary.BigEndian.Uint32(rest[i+4:i+8]) {
+			return false
+		}
+	}
+	return true
+}
+
+// truncate drops the broken tail of the log
+func (l *WAL) truncate(offset int64) error {
+	lost := l.size - offset
+	if err := l.rw.Truncate(offset); err != nil {
+		return errors.Wrap(err, "truncate corrupted tail")
+	}
+	if err := l.rw.Sync(); err != nil {
+		return errors.Wrap(err, "sync truncated log")
+	}
+	l.size = offset
+	if l.log != nil {
+		l.log.Warnf("WAL has a torn tail: %d bytes after offset %d are truncated", lost, offset)
+	}
+	return nil
 }
 
-// Write event into log-file
-func (l *WAL) Write(e event) error {
+// Write events into log-file as a single entry, the entry is replayed entirely or not at all
+func (l *WAL) Write(events ...event) error {
+	return l.WriteEntries(events)
+}
+
+// WriteEntries writes several entries into log-file at once
+func (l *WAL) WriteEntries(entries ...[]event) error {
 	l.lock.Lock()
 	defer l.lock.Unlock()
-	if len(e.Record.Value) > l.maxRecordSize {
-		return errors.New("entity is too large")
+
+	if l.broken != nil {
+		return l.broken
+	}
+	var (
+		buf    bytes.Buffer
+		events int
+	)
+	for _, entry := range entries {
+		for _, e := range entry {
+			if len(e.Record.Value) > l.maxRecordSize {
+				return engine.ErrTooLarge
+			}
+		}
+		r, err := encode(entry...)
+		if err != nil {
+			return err
+		}
+		buf.Write(r)
+		events += len(entry)
 	}
 
-	r, err := json.Marshal(e)
+	size := l.size
+	n, err := l.rw.Write(buf.Bytes())
+	l.size += int64(n)
+	l.dirty = true
 	if err != nil {
-		return err
+		l.discard(size)
+		return writeError(err, "write log")
+	}
+	if l.durability == DurabilityAlways {
+		// the caller gets an error, so the entries must not reappear after restart
+		if err := l.sync(); err != nil {
+			l.discard(size)
+			return err
+		}
+	}
+	l.events += events
+
+	if l.rewrite != nil {
+		l.rewrite.buf.Write(buf.Bytes())
+		l.rewrite.events += events
+	}
+	return nil
+}
+
+// discard removes a failed write from the end of the log-file, so the next write doesn't land after a partial frame
+func (l *WAL) discard(size int64) {
+	if err := l.rw.Truncate(size); err != nil {
+		l.broken = errors.Wrap(err, "log has a partial write")
+		if l.log != nil {
+			l.log.Errorf("failed to truncate WAL after a failed write: %s", err)
+		}
+		return
 	}
+	l.size = size
+}
 
-	r = append(r, []byte("\n")...)
-	if _, err = l.rw.Write(r); err != nil {
+// StartRewrite begins compaction. Events written after this call are kept aside
+// and appended to the compacted log by Rewrite.
+// Caller must guarantee that no writes are in progress while StartRewrite is called.
+func (l *WAL) StartRewrite() error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.rewrite != nil {
+		return errors.New("compaction is already in progress")
+	}
+	l.rewrite = &rewriteBuffer{}
+	return nil
+}
+
+// Rewrite replaces log-file with a compacted one that holds only given records
+// and events written since StartRewrite was called.
+// Version and seq are the last version and sequence number assigned by the moment the records were taken.
+func (l *WAL) Rewrite(records map[string]engine.Record, version, seq uint64) (err error) {
+	defer func() {
+		if err != nil {
+			l.lock.Lock()
+			l.rewrite = nil
+			l.lock.Unlock()
+		}
+	}()
+
+	tmpPath := filepath.Join(l.dir, compactFileName)
+	tmp, err := os.OpenFile(tmpPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0755)
+	if err != nil {
+		return errors.Wrap(err, "create compacted log")
+	}
+	defer func() {
+		if err != nil {
+			tmp.Close()
+			os.Remove(tmpPath)
+		}
+	}()
+
+	// the bulk of the work is done without holding the lock, so writers are not blocked
+	w := bufio.NewWriter(tmp)
+	var size int64
+	checkpoint, err := encode(event{Record: engine.Record{Version: version}, Action: actionCheckpoint, Seq: seq})
+	if err != nil {
 		return err
 	}
+	n, err := w.Write(checkpoint)
+	size += int64(n)
+	if err != nil {
+		return errors.Wrap(err, "write compacted log")
+	}
+	for _, record := range records {
+		r, err := encode(event{Record: record, Action: actionSet})
+		if err != nil {
+			return err
+		}
+		n, err := w.Write(r)
+		size += int64(n)
+		if err != nil {
+			return errors.Wrap(err, "write compacted log")
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return errors.Wrap(err, "write compacted log")
+	}
 
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	n, err = tmp.Write(l.rewrite.buf.Bytes())
+	size += int64(n)
+	if err != nil {
+		return errors.Wrap(err, "write compacted log")
+	}
+	if err := tmp.Sync(); err != nil {
+		return errors.Wrap(err, "sync compacted log")
+	}
+	if err := os.Rename(tmpPath, l.path); err != nil {
+		return errors.Wrap(err, "replace log")
+	}
+	if err := syncDir(l.dir); err != nil {
+		l.log.Errorf("failed to sync data directory: %s", err)
+	}
+	if err := l.rw.Close(); err != nil {
+		l.log.Errorf("failed to close old log: %s", err)
+	}
+	// reopen in append mode
+	if err := tmp.Close(); err != nil {
+		l.log.Errorf("failed to close compacted log: %s", err)
+	}
+	rw, err := os.OpenFile(l.path, os.O_RDWR|os.O_APPEND, 0755)
+	if err != nil {
+		return errors.Wrap(err, "reopen log")
+	}
+
+	l.rw = rw
+	l.dirty = false
+	// the compacted log has no partial writes
+	l.broken = nil
+	l.size = size
+	l.events = 1 + len(records) + l.rewrite.events
+	l.base = seq
+	l.rewrite = nil
 	return nil
 }
+
+// writeError keeps the cause of an error recognizable when the disk is full
+func writeError(err error, message string) error {
+	if pathErr, ok := err.(*os.PathError); ok && pathErr.Err == syscall.ENOSPC {
+		return errors.WithMessage(engine.ErrNoSpace, message)
+	}
+	return errors.Wrap(err, message)
+}
+
+// syncDir flushes directory entries, so renamed files survive a crash
+func syncDir(path string) error {
+	d, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
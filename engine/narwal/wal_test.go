@@ -4,11 +4,14 @@ import (
 	"io/ioutil"
 	"log"
 	"os"
+	"path/filepath"
 	"reflect"
 	"testing"
 	"time"
 
 	"github.com/filatovw/ni-storage/engine"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
 )
 
 func TestWAL(t *testing.T) {
@@ -25,10 +28,10 @@ func TestWAL(t *testing.T) {
 		t.Errorf("error on open: %s", err)
 		return
 	}
-	record1 := engine.Record{Key: "key1", Value: "value1"}
-	record2 := engine.Record{Key: "key2", Value: "value2"}
+	record1 := engine.Record{Key: "key1", Value: []byte("value1")}
+	record2 := engine.Record{Key: "key2", Value: []byte("value2")}
 	ts := time.Date(2059, 1, 1, 1, 1, 1, 0, time.UTC)
-	record3 := engine.Record{Key: "key3", Value: "value3", ExpirationTime: &ts}
+	record3 := engine.Record{Key: "key3", Value: []byte("value3"), ExpirationTime: &ts}
 	record4 := engine.Record{Key: "key1"}
 
 	input := []event{
@@ -76,7 +79,7 @@ func TestWAL(t *testing.T) {
 		t.Errorf("error on reading WAL: %s", err)
 	}
 	if !reflect.DeepEqual(snapshot, expected) {
-		t.Errorf("expected: %s, got: %s", expected, snapshot)
+		t.Errorf("expected: %v, got: %v", expected, snapshot)
 	}
 }
 
@@ -113,9 +116,420 @@ func TestWALValueTooLarge(t *testing.T) {
 		t.Errorf("error on open: %s", err)
 		return
 	}
-	err = wal.Write(event{Action: actionSet, Record: engine.Record{Key: "some key", Value: "123"}})
+	err = wal.Write(event{Action: actionSet, Record: engine.Record{Key: "some key", Value: []byte("123")}})
 	if err == nil {
 		t.Errorf("expected error: too large value, got nothing")
 		return
 	}
 }
+
+func TestWALRewrite(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "wal_rewrite_test")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	defer os.RemoveAll(tmpdir) // clean up
+
+	wal, err := OpenWAL(nil, tmpdir, 2<<10)
+	if err != nil {
+		t.Errorf("error on open: %s", err)
+		return
+	}
+	record1 := engine.Record{Key: "key1", Value: []byte("value1")}
+	record2 := engine.Record{Key: "key2", Value: []byte("value2")}
+	record3 := engine.Record{Key: "key3", Value: []byte("value3")}
+	for _, e := range []event{
+		{Record: engine.Record{Key: "key1", Value: []byte("old")}, Action: actionSet},
+		{Record: record1, Action: actionSet},
+		{Record: record2, Action: actionSet},
+	} {
+		if err := wal.Write(e); err != nil {
+			t.Errorf("error on writing: %s", err)
+			return
+		}
+	}
+
+	if err := wal.StartRewrite(); err != nil {
+		t.Errorf("error on starting rewrite: %s", err)
+		return
+	}
+	// written while compaction is in progress
+	if err := wal.Write(event{Record: record3, Action: actionSet}); err != nil {
+		t.Errorf("error on writing: %s", err)
+		return
+	}
+	if err := wal.Write(event{Record: engine.Record{Key: "key2"}, Action: actionDelete}); err != nil {
+		t.Errorf("error on writing: %s", err)
+		return
+	}
+	if err := wal.Rewrite(map[string]engine.Record{"key1": record1, "key2": record2}, 0, 0); err != nil {
+		t.Errorf("error on rewrite: %s", err)
+		return
+	}
+	if wal.Events() != 5 {
+		t.Errorf("expected 5 events, got: %d", wal.Events())
+	}
+	if err := wal.Close(); err != nil {
+		t.Errorf("error on closing: %s", err)
+		return
+	}
+
+	wal, err = OpenWAL(nil, tmpdir, 2<<10)
+	if err != nil {
+		t.Errorf("error on open: %s", err)
+		return
+	}
+	snapshot, err := wal.Read()
+	if err != nil {
+		t.Errorf("error on reading WAL: %s", err)
+	}
+	expected := map[string]engine.Record{
+		"key1": record1,
+		"key3": record3,
+	}
+	if !reflect.DeepEqual(snapshot, expected) {
+		t.Errorf("expected: %v, got: %v", expected, snapshot)
+	}
+}
+
+// writeWALHelper writes events into a new log and returns path to the log-file and offsets of frames
+func writeWALHelper(t *testing.T, dir string, events []event) (string, []int64) {
+	t.Helper()
+	wal, err := OpenWAL(nil, dir, 2<<10)
+	if err != nil {
+		t.Fatalf("error on open: %s", err)
+	}
+	offsets := []int64{}
+	for _, e := range events {
+		offsets = append(offsets, wal.Size())
+		if err := wal.Write(e); err != nil {
+			t.Fatalf("error on writing: %s", err)
+		}
+	}
+	if err := wal.Close(); err != nil {
+		t.Fatalf("error on closing: %s", err)
+	}
+	return wal.path, offsets
+}
+
+func TestWALCorruption(t *testing.T) {
+	record1 := engine.Record{Key: "key1", Value: []byte("value1")}
+	record2 := engine.Record{Key: "key2", Value: []byte("value2")}
+	record3 := engine.Record{Key: "key3", Value: []byte("value3")}
+	events := []event{
+		{Record: record1, Action: actionSet},
+		{Record: record2, Action: actionSet},
+		{Record: record3, Action: actionSet},
+	}
+
+	testData := []struct {
+		name     string
+		corrupt  func(data []byte, offsets []int64) []byte
+		expected map[string]engine.Record
+		fails    bool
+	}{
+		{
+			name: "torn header of the last frame",
+			corrupt: func(data []byte, offsets []int64) []byte {
+				return data[:offsets[2]+3]
+			},
+			expected: map[string]engine.Record{"key1": record1, "key2": record2},
+		},
+		{
+			name: "torn payload of the last frame",
+			corrupt: func(data []byte, offsets []int64) []byte {
+				return data[:len(data)-2]
+			},
+			expected: map[string]engine.Record{"key1": record1, "key2": record2},
+		},
+		{
+			name: "wrong checksum of the last frame",
+			corrupt: func(data []byte, offsets []int64) []byte {
+				data[len(data)-1] ^= 0xff
+				return data
+			},
+			expected: map[string]engine.Record{"key1": record1, "key2": record2},
+		},
+		{
+			name: "zeroes after the last frame",
+			corrupt: func(data []byte, offsets []int64) []byte {
+				return append(data, make([]byte, 64)...)
+			},
+			expected: map[string]engine.Record{"key1": record1, "key2": record2, "key3": record3},
+		},
+		{
+			name: "wrong checksum in the middle",
+			corrupt: func(data []byte, offsets []int64) []byte {
+				data[offsets[2]-1] ^= 0xff
+				return data
+			},
+			fails: true,
+		},
+		{
+			name: "length beyond the end in the middle",
+			corrupt: func(data []byte, offsets []int64) []byte {
+				data[offsets[1]] = 0xff
+				return data
+			},
+			fails: true,
+		},
+	}
+	for _, td := range testData {
+		t.Run(td.name, func(t *testing.T) {
+			tmpdir, err := ioutil.TempDir("", "wal_corruption_test")
+			if err != nil {
+				log.Fatal(err)
+			}
+			defer os.RemoveAll(tmpdir) // clean up
+
+			path, offsets := writeWALHelper(t, tmpdir, events)
+			data, err := ioutil.ReadFile(path)
+			if err != nil {
+				t.Fatalf("read log: %s", err)
+			}
+			if err := ioutil.WriteFile(path, td.corrupt(data, offsets), 0755); err != nil {
+				t.Fatalf("write log: %s", err)
+			}
+
+			logger, err := zap.NewProduction()
+			if err != nil {
+				t.Errorf("error on logger init: %s", err)
+			}
+			wal, err := OpenWAL(logger.Sugar(), tmpdir, 2<<10)
+			if err != nil {
+				t.Fatalf("error on open: %s", err)
+			}
+			snapshot, err := wal.Read()
+			if td.fails {
+				if err == nil {
+					t.Errorf("expected corruption error, got nothing")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("error on reading WAL: %s", err)
+			}
+			if !reflect.DeepEqual(snapshot, td.expected) {
+				t.Errorf("expected: %v, got: %v", td.expected, snapshot)
+			}
+
+			// the log is writable after truncation
+			if err := wal.Write(events[2]); err != nil {
+				t.Fatalf("error on writing: %s", err)
+			}
+			if err := wal.Close(); err != nil {
+				t.Fatalf("error on closing: %s", err)
+			}
+			wal, err = OpenWAL(nil, tmpdir, 2<<10)
+			if err != nil {
+				t.Fatalf("error on open: %s", err)
+			}
+			snapshot, err = wal.Read()
+			if err != nil {
+				t.Fatalf("error on reading WAL: %s", err)
+			}
+			if !reflect.DeepEqual(snapshot, map[string]engine.Record{"key1": record1, "key2": record2, "key3": record3}) {
+				t.Errorf("unexpected records after recovery: %v", snapshot)
+			}
+		})
+	}
+}
+
+func TestWALDurability(t *testing.T) {
+	testData := []struct {
+		name          string
+		durability    Durability
+		expectedDirty bool
+	}{
+		{name: "always", durability: DurabilityAlways, expectedDirty: false},
+		{name: "interval", durability: DurabilityInterval, expectedDirty: true},
+		{name: "none", durability: DurabilityNone, expectedDirty: true},
+	}
+	for _, td := range testData {
+		t.Run(td.name, func(t *testing.T) {
+			tmpdir, err := ioutil.TempDir("", "wal_durability_test")
+			if err != nil {
+				log.Fatal(err)
+			}
+			defer os.RemoveAll(tmpdir) // clean up
+
+			wal, err := OpenWAL(nil, tmpdir, 2<<10)
+			if err != nil {
+				t.Fatalf("error on open: %s", err)
+			}
+			wal.SetDurability(td.durability)
+			if err := wal.Write(event{Action: actionSet, Record: engine.Record{Key: "key1", Value: []byte("value1")}}); err != nil {
+				t.Fatalf("error on writing: %s", err)
+			}
+			if wal.dirty != td.expectedDirty {
+				t.Errorf("expected dirty: %v, got: %v", td.expectedDirty, wal.dirty)
+			}
+			if err := wal.Sync(); err != nil {
+				t.Fatalf("error on sync: %s", err)
+			}
+			if wal.dirty {
+				t.Errorf("expected log to be flushed")
+			}
+		})
+	}
+
+	if _, err := ParseDurability("sometimes"); err == nil {
+		t.Errorf("expected error on unknown durability mode")
+	}
+}
+
+func TestWALTornEntry(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "wal_torn_entry_test")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir) // clean up
+
+	record1 := engine.Record{Key: "key1", Value: []byte("value1")}
+	record2 := engine.Record{Key: "key2", Value: []byte("value2")}
+	path, _ := writeWALHelper(t, tmpdir, []event{{Record: record1, Action: actionSet}})
+
+	wal, err := OpenWAL(nil, tmpdir, 2<<10)
+	if err != nil {
+		t.Fatalf("error on open: %s", err)
+	}
+	// both events belong to the same entry
+	if err := wal.Write(event{Record: record2, Action: actionSet}, event{Record: engine.Record{Key: "key1"}, Action: actionDelete}); err != nil {
+		t.Fatalf("error on writing: %s", err)
+	}
+	if err := wal.Close(); err != nil {
+		t.Fatalf("error on closing: %s", err)
+	}
+	if err := os.Truncate(path, wal.size-1); err != nil {
+		t.Fatalf("truncate log: %s", err)
+	}
+
+	logger, err := zap.NewProduction()
+	if err != nil {
+		t.Errorf("error on logger init: %s", err)
+	}
+	wal, err = OpenWAL(logger.Sugar(), tmpdir, 2<<10)
+	if err != nil {
+		t.Fatalf("error on open: %s", err)
+	}
+	snapshot, err := wal.Read()
+	if err != nil {
+		t.Fatalf("error on reading WAL: %s", err)
+	}
+	expected := map[string]engine.Record{"key1": record1}
+	if !reflect.DeepEqual(snapshot, expected) {
+		t.Errorf("expected: %v, got: %v", expected, snapshot)
+	}
+}
+
+func TestWALLegacyMigration(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "wal_legacy_test")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir) // clean up
+
+	legacy := `{"record":{"key":"key1","value":"value1"},"action":0}
+{"record":{"key":"key2","value":"value2","expiration_time":"2030-01-01T00:00:00Z"},"action":0}
+{"record":{"key":"key3","value":"value3"},"action":0}
+{"record":{"key":"key3"},"action":1}
+{"record":{"key":"key4","val`
+	if err := ioutil.WriteFile(filepath.Join(tmpdir, walFileName), []byte(legacy), 0755); err != nil {
+		t.Fatalf("write log: %s", err)
+	}
+	// snapshots point into the legacy log
+	if err := ioutil.WriteFile(filepath.Join(tmpdir, snapshotName(10)), []byte("{}"), 0755); err != nil {
+		t.Fatalf("write snapshot: %s", err)
+	}
+
+	until := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+	expected := map[string]engine.Record{
+		"key1": {Key: "key1", Value: []byte("value1"), Version: 1},
+		"key2": {Key: "key2", Value: []byte("value2"), ExpirationTime: &until, Version: 2},
+	}
+	for i := 0; i < 2; i++ {
+		wal, err := OpenWAL(nil, tmpdir, 2<<10)
+		if err != nil {
+			t.Fatalf("error on open: %s", err)
+		}
+		snap := &snapshot{Records: make(map[string]engine.Record)}
+		records, err := wal.ReadFrom(snap)
+		if err != nil {
+			t.Fatalf("error on reading WAL: %s", err)
+		}
+		if !reflect.DeepEqual(records, expected) {
+			t.Errorf("expected: %v, got: %v", expected, records)
+		}
+		if snap.Version != 2 {
+			t.Errorf("expected version 2, got %d", snap.Version)
+		}
+		if err := wal.Close(); err != nil {
+			t.Fatalf("error on closing: %s", err)
+		}
+	}
+	if snapshots, _ := listSnapshots(tmpdir); len(snapshots) != 0 {
+		t.Errorf("expected snapshots to be removed, got %v", snapshots)
+	}
+}
+
+// shortFile writes a half of the data and fails
+type shortFile struct {
+	logFile
+}
+
+func (f shortFile) Write(p []byte) (int, error) {
+	n, _ := f.logFile.Write(p[:len(p)/2])
+	return n, errors.New("no space left on device")
+}
+
+func TestWALFailedWrite(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "wal_failed_write_test")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir) // clean up
+
+	record1 := engine.Record{Key: "key1", Value: []byte("value1")}
+	record2 := engine.Record{Key: "key2", Value: make([]byte, 1<<10)}
+	record3 := engine.Record{Key: "key3", Value: []byte("value3")}
+	wal, err := OpenWAL(nil, tmpdir, 2<<10)
+	if err != nil {
+		t.Fatalf("error on open: %s", err)
+	}
+	if err := wal.Write(event{Record: record1, Action: actionSet}); err != nil {
+		t.Fatalf("error on writing: %s", err)
+	}
+	size := wal.Size()
+
+	// the disk is full in the middle of the frame
+	file := wal.rw
+	wal.rw = shortFile{file}
+	err = wal.Write(event{Record: record2, Action: actionSet})
+	wal.rw = file
+	if err == nil {
+		t.Fatalf("expected write error")
+	}
+	if wal.Size() != size {
+		t.Errorf("expected size %d after the failed write, got %d", size, wal.Size())
+	}
+
+	if err := wal.Write(event{Record: record3, Action: actionSet}); err != nil {
+		t.Fatalf("error on writing: %s", err)
+	}
+	if err := wal.Close(); err != nil {
+		t.Fatalf("error on closing: %s", err)
+	}
+	wal, err = OpenWAL(nil, tmpdir, 2<<10)
+	if err != nil {
+		t.Fatalf("error on open: %s", err)
+	}
+	snapshot, err := wal.Read()
+	if err != nil {
+		t.Fatalf("error on reading WAL: %s", err)
+	}
+	expected := map[string]engine.Record{"key1": record1, "key3": record3}
+	if !reflect.DeepEqual(snapshot, expected) {
+		t.Errorf("expected: %v, got: %v", expected, snapshot)
+	}
+}
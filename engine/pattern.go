@@ -0,0 +1,79 @@
+package engine
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Wildcard matches any number of symbols in a pattern
+const Wildcard = "$"
+
+// Pattern matches whole strings, "$" means "any number of symbols", other symbols match literally
+type Pattern struct {
+	prefix string
+	exp    *regexp.Regexp
+}
+
+// CompilePattern translates pattern into an anchored regular expression
+func CompilePattern(pattern string) (*Pattern, error) {
+	parts := strings.Split(pattern, Wildcard)
+	prefix := parts[0]
+	for i, part := range parts {
+		parts[i] = regexp.QuoteMeta(part)
+	}
+	exp, err := regexp.Compile(`^(?s:` + strings.Join(parts, ".*") + `)$`)
+	if err != nil {
+		return nil, err
+	}
+	return &Pattern{prefix: prefix, exp: exp}, nil
+}
+
+// Prefix returns literal part of the pattern before the first wildcard, all matching strings start with it
+func (p *Pattern) Prefix() string {
+	return p.prefix
+}
+
+// MatchString checks if the string matches the pattern
+func (p *Pattern) MatchString(s string) bool {
+	return p.exp.MatchString(s)
+}
+
+// Match checks if the bytes match the pattern
+func (p *Pattern) Match(b []byte) bool {
+	return p.exp.Match(b)
+}
+
+// FilterKeys returns sorted keys of records of the storage matching both patterns, empty pattern is not applied
+func FilterKeys(storage Storage, keyPattern, valuePattern string) ([]string, error) {
+	var (
+		records map[string]Record
+		err     error
+	)
+	if keyPattern != "" {
+		records, err = storage.Filter(keyPattern)
+	} else {
+		records, err = storage.FilterValues(valuePattern)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if keyPattern != "" && valuePattern != "" {
+		p, err := CompilePattern(valuePattern)
+		if err != nil {
+			return nil, err
+		}
+		for k, v := range records {
+			if !p.Match(v.Value) {
+				delete(records, k)
+			}
+		}
+	}
+
+	keys := make([]string, 0, len(records))
+	for k := range records {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
@@ -0,0 +1,79 @@
+package storagetest
+
+// Fixture of tests of front-ends: a storage in a temporary directory served either as is or as a follower of a leader.
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"go.uber.org/zap"
+
+	"github.com/filatovw/ni-storage/config"
+	"github.com/filatovw/ni-storage/engine"
+	"github.com/filatovw/ni-storage/engine/narwal"
+	"github.com/filatovw/ni-storage/replication"
+)
+
+// unavailableLeader is an address nobody listens at, so a follower of it keeps its records
+const unavailableLeader = "http://127.0.0.1:1"
+
+// Storage of a test, records are put into the engine directly
+type Storage struct {
+	*narwal.Narwal
+	Ctx context.Context
+	Log *zap.SugaredLogger
+	// Service is served by a front-end, it's the engine or its follower
+	Service engine.Storage
+
+	cancel context.CancelFunc
+	dir    string
+}
+
+// New creates a storage in a temporary directory
+func New(t *testing.T) *Storage {
+	t.Helper()
+	return newStorage(t, "")
+}
+
+// newStorage creates a storage in a temporary directory, it's a follower of the leader when its URL is set
+func newStorage(t *testing.T, leader string) *Storage {
+	t.Helper()
+	log, err := zap.NewProduction()
+	if err != nil {
+		t.Errorf("error on logger init: %s", err)
+	}
+	dir, err := ioutil.TempDir("", "storage_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	storage, err := narwal.New(ctx, config.NarWAL{DataDir: dir}, log.Sugar())
+	if err != nil {
+		t.Fatalf("create engine: %s", err)
+	}
+	s := &Storage{Narwal: storage, Ctx: ctx, Log: log.Sugar(), Service: storage, cancel: cancel, dir: dir}
+	if leader != "" {
+		s.Service = replication.NewFollower(ctx, s.Log, storage, config.Replication{Leader: leader})
+	}
+	return s
+}
+
+// NewReadOnly creates a follower of an unavailable leader which has key1 set to value1 of version 1.
+// Front-ends serve reads of the record and refuse writes.
+func NewReadOnly(t *testing.T) *Storage {
+	t.Helper()
+	s := newStorage(t, unavailableLeader)
+	record := engine.Record{Key: "key1", Value: []byte("value1"), Version: 1}
+	if err := s.Apply(context.TODO(), engine.Event{Type: engine.EventSet, Record: record, Seq: 1}); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	return s
+}
+
+// Close stops the storage and removes its directory
+func (s *Storage) Close() {
+	s.cancel()
+	os.RemoveAll(s.dir)
+}
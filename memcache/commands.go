@@ -0,0 +1,445 @@
+package memcache
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"io/ioutil"
+	"mime"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/filatovw/ni-storage/cluster"
+	"github.com/filatovw/ni-storage/engine"
+)
+
+const (
+	// maxLineLength limits a command line
+	maxLineLength = 64 << 10
+	// maxKeyLength is the limit of memcached
+	maxKeyLength = 250
+	// maxValueLength limits a data block read from a client, a storage may have a lower limit
+	maxValueLength = 64 << 20
+	// maxRelativeExptime is 30 days, larger exptime is unix time
+	maxRelativeExptime = 60 * 60 * 24 * 30
+	// flagsContentType keeps flags of a value in its flags parameter
+	flagsContentType = "application/vnd.memcached"
+
+	replyError      = "ERROR"
+	replyBadFormat  = "CLIENT_ERROR bad command line format"
+	replyBadChunk   = "CLIENT_ERROR bad data chunk"
+	replyNonNumeric = "CLIENT_ERROR cannot increment or decrement non-numeric value"
+	replyTooLarge   = "SERVER_ERROR object too large for cache"
+	replyStored     = "STORED"
+	replyNotStored  = "NOT_STORED"
+	replyExists     = "EXISTS"
+	replyNotFound   = "NOT_FOUND"
+	replyDeleted    = "DELETED"
+	replyTouched    = "TOUCHED"
+	replyOK         = "OK"
+	replyEnd        = "END"
+	replyVersion    = "VERSION ni-storage"
+	noReply         = "noreply"
+)
+
+var (
+	errLineTooLong = errors.New("line is too long")
+	errBadChunk    = errors.New("data chunk isn't terminated")
+)
+
+// run reads a command and writes its reply, it tells if the client quits.
+// An error means the connection can't be used anymore.
+func (s *Server) run(r *bufio.Reader, w *bufio.Writer) (bool, error) {
+	line, err := readLine(r)
+	if err != nil {
+		if err == errLineTooLong {
+			writeLine(w, "CLIENT_ERROR "+err.Error())
+			w.Flush()
+		}
+		return false, err
+	}
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		writeLine(w, replyError)
+		return false, nil
+	}
+	t1 := time.Now()
+	ctx, cancel := context.WithTimeout(s.ctx, commandTimeout)
+	defer cancel()
+	name, args := fields[0], fields[1:]
+	switch name {
+	case "get", "gets":
+		s.get(ctx, w, args, name == "gets")
+	case "set", "add", "replace", "cas":
+		err = s.store(ctx, r, w, name, args)
+	case "delete":
+		s.delete(ctx, w, args)
+	case "touch":
+		s.touch(ctx, w, args)
+	case "incr", "decr":
+		s.incr(ctx, w, args, name == "decr")
+	case "flush_all":
+		s.flushAll(ctx, w, args)
+	case "version":
+		writeLine(w, replyVersion)
+	case "verbosity":
+		reply(w, args, replyOK)
+	case "quit":
+		return true, nil
+	default:
+		writeLine(w, replyError)
+		return false, nil
+	}
+	s.log.Debugf("served command %s in %s", name, time.Since(t1))
+	return false, err
+}
+
+// readLine reads a command line terminated by CRLF or LF
+func readLine(r *bufio.Reader) (string, error) {
+	line := []byte{}
+	for {
+		chunk, isPrefix, err := r.ReadLine()
+		if err != nil {
+			return "", err
+		}
+		line = append(line, chunk...)
+		if len(line) > maxLineLength {
+			return "", errLineTooLong
+		}
+		if !isPrefix {
+			return string(line), nil
+		}
+	}
+}
+
+func writeLine(w *bufio.Writer, line string) {
+	w.WriteString(line)
+	w.WriteString("\r\n")
+}
+
+// reply writes the line unless the client asked for no reply with the last argument
+func reply(w *bufio.Writer, args []string, line string) {
+	if len(args) > 0 && args[len(args)-1] == noReply {
+		return
+	}
+	writeLine(w, line)
+}
+
+// serverError maps errors of a storage to replies
+func (s *Server) serverError(err error) string {
+	switch errors.Cause(err) {
+	case engine.ErrTooLarge:
+		return replyTooLarge
+	case engine.ErrReadOnly, engine.ErrNotLeader, engine.ErrNoSpace, engine.ErrClosed:
+	default:
+		s.log.Errorf("storage error: %s", err)
+	}
+	return "SERVER_ERROR " + errors.Cause(err).Error()
+}
+
+// validKey checks the limits of memcached keys, spaces are impossible in keys split by them
+func validKey(key string) bool {
+	if len(key) == 0 || len(key) > maxKeyLength {
+		return false
+	}
+	for i := 0; i < len(key); i++ {
+		if key[i] < ' ' || key[i] == 0x7f {
+			return false
+		}
+	}
+	return true
+}
+
+// expiration turns exptime of memcached into expiration time: 0 never expires, negative exptime expires at once,
+// up to 30 days it's a number of seconds from now, otherwise it's unix time
+func expiration(exptime int64, now time.Time) *time.Time {
+	var until time.Time
+	switch {
+	case exptime == 0:
+		return nil
+	case exptime < 0:
+		until = now.Add(-time.Second)
+	case exptime <= maxRelativeExptime:
+		until = now.Add(time.Duration(exptime) * time.Second)
+	default:
+		until = time.Unix(exptime, 0)
+	}
+	return &until
+}
+
+// contentType keeps flags of a value, zero flags are not kept
+func contentType(flags uint32) string {
+	if flags == 0 {
+		return ""
+	}
+	return mime.FormatMediaType(flagsContentType, map[string]string{"flags": strconv.FormatUint(uint64(flags), 10)})
+}
+
+// flagsOf returns flags of a value, values which weren't set over memcached have zero flags
+func flagsOf(record engine.Record) uint32 {
+	mediaType, params, err := mime.ParseMediaType(record.ContentType)
+	if err != nil || mediaType != flagsContentType {
+		return 0
+	}
+	flags, _ := strconv.ParseUint(params["flags"], 10, 32)
+	return uint32(flags)
+}
+
+// get writes values of found keys, with gets their CAS tokens are written too (get|gets <key>*)
+func (s *Server) get(ctx context.Context, w *bufio.Writer, keys []string, cas bool) {
+	if len(keys) == 0 {
+		writeLine(w, replyError)
+		return
+	}
+	for _, key := range keys {
+		if !validKey(key) {
+			writeLine(w, replyBadFormat)
+			return
+		}
+	}
+	if node, ok := s.storage.(cluster.ReadIndexer); ok {
+		if err := node.ReadIndex(ctx); err != nil {
+			writeLine(w, s.serverError(err))
+			return
+		}
+	}
+	for _, key := range keys {
+		record, ok := s.storage.Get(key)
+		if !ok {
+			continue
+		}
+		header := "VALUE " + key + " " + strconv.FormatUint(uint64(flagsOf(record)), 10) + " " + strconv.Itoa(len(record.Value))
+		if cas {
+			header += " " + strconv.FormatUint(record.Version, 10)
+		}
+		writeLine(w, header)
+		w.Write(record.Value)
+		w.WriteString("\r\n")
+	}
+	writeLine(w, replyEnd)
+}
+
+// store saves a value (set|add|replace <key> <flags> <exptime> <bytes> [noreply], cas <key> <flags> <exptime> <bytes> <cas unique> [noreply]).
+// add requires the key to be absent, replace requires it to exist and cas requires it to have the version.
+func (s *Server) store(ctx context.Context, r *bufio.Reader, w *bufio.Writer, name string, args []string) error {
+	fields := 4
+	if name == "cas" {
+		fields = 5
+	}
+	if len(args) < fields || len(args) > fields+1 || len(args) == fields+1 && args[fields] != noReply {
+		writeLine(w, replyBadFormat)
+		return nil
+	}
+	size, err := strconv.Atoi(args[3])
+	if err != nil || size < 0 {
+		writeLine(w, replyBadFormat)
+		return nil
+	}
+	if size > maxValueLength {
+		// the data block is skipped, so the next command can be read
+		if _, err := io.CopyN(ioutil.Discard, r, int64(size)+2); err != nil {
+			return err
+		}
+		writeLine(w, replyTooLarge)
+		return nil
+	}
+	data := make([]byte, size+2)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return err
+	}
+	if data[size] != '\r' || data[size+1] != '\n' {
+		writeLine(w, replyBadChunk)
+		w.Flush()
+		return errBadChunk
+	}
+
+	key := args[0]
+	flags, flagsErr := strconv.ParseUint(args[1], 10, 32)
+	exptime, exptimeErr := strconv.ParseInt(args[2], 10, 64)
+	if !validKey(key) || flagsErr != nil || exptimeErr != nil {
+		writeLine(w, replyBadFormat)
+		return nil
+	}
+	record := engine.Record{
+		Key:            key,
+		Value:          data[:size],
+		ContentType:    contentType(uint32(flags)),
+		ExpirationTime: expiration(exptime, time.Now()),
+	}
+	cond := engine.Condition{}
+	switch name {
+	case "add", "replace":
+		exists := name == "replace"
+		cond.Exists = &exists
+	case "cas":
+		version, err := strconv.ParseUint(args[4], 10, 64)
+		if err != nil {
+			writeLine(w, replyBadFormat)
+			return nil
+		}
+		cond.Match = []uint64{version}
+	}
+
+	// a value which has expired already replaces the current one and disappears at once
+	if record.Expired(time.Now()) {
+		err = s.storage.CompareAndDelete(ctx, key, cond)
+	} else {
+		err = s.storage.CompareAndSet(ctx, record, cond)
+	}
+	switch {
+	case errors.Cause(err) == engine.ErrPreconditionFailed && name == "cas":
+		if s.storage.Exists(key) {
+			reply(w, args, replyExists)
+		} else {
+			reply(w, args, replyNotFound)
+		}
+	case errors.Cause(err) == engine.ErrPreconditionFailed:
+		reply(w, args, replyNotStored)
+	case err != nil:
+		reply(w, args, s.serverError(err))
+	default:
+		reply(w, args, replyStored)
+	}
+	return nil
+}
+
+// delete removes a value (delete <key> [noreply])
+func (s *Server) delete(ctx context.Context, w *bufio.Writer, args []string) {
+	// old clients send zero time before noreply
+	if len(args) > 1 && args[1] == "0" {
+		args = append(args[:1], args[2:]...)
+	}
+	if len(args) < 1 || len(args) > 2 || len(args) == 2 && args[1] != noReply || !validKey(args[0]) {
+		writeLine(w, replyBadFormat)
+		return
+	}
+	exists := true
+	err := s.storage.CompareAndDelete(ctx, args[0], engine.Condition{Exists: &exists})
+	switch {
+	case errors.Cause(err) == engine.ErrPreconditionFailed:
+		reply(w, args, replyNotFound)
+	case err != nil:
+		reply(w, args, s.serverError(err))
+	default:
+		reply(w, args, replyDeleted)
+	}
+}
+
+// touch changes expiration of a value without rewriting it (touch <key> <exptime> [noreply])
+func (s *Server) touch(ctx context.Context, w *bufio.Writer, args []string) {
+	if len(args) < 2 || len(args) > 3 || len(args) == 3 && args[2] != noReply || !validKey(args[0]) {
+		writeLine(w, replyBadFormat)
+		return
+	}
+	exptime, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil {
+		writeLine(w, replyBadFormat)
+		return
+	}
+	if until := expiration(exptime, time.Now()); until != nil {
+		err = s.storage.Expire(ctx, args[0], *until)
+	} else {
+		err = s.storage.Persist(ctx, args[0])
+	}
+	switch {
+	case errors.Cause(err) == engine.ErrNotFound:
+		reply(w, args, replyNotFound)
+	case err != nil:
+		reply(w, args, s.serverError(err))
+	default:
+		reply(w, args, replyTouched)
+	}
+}
+
+// incr changes a decimal value by the delta (incr|decr <key> <delta> [noreply]).
+// Increments wrap around at 64 bits and decrements stop at zero, flags and expiration of the value are kept,
+// sliding expiration is renewed like by any other write.
+func (s *Server) incr(ctx context.Context, w *bufio.Writer, args []string, decr bool) {
+	if len(args) < 2 || len(args) > 3 || len(args) == 3 && args[2] != noReply || !validKey(args[0]) {
+		writeLine(w, replyBadFormat)
+		return
+	}
+	delta, err := strconv.ParseUint(args[1], 10, 64)
+	if err != nil {
+		writeLine(w, "CLIENT_ERROR invalid numeric delta argument")
+		return
+	}
+	// the value is changed only if nobody has changed it since it's read
+	for {
+		now := time.Now()
+		record, ok := s.storage.Get(args[0])
+		// expiration time of a record read recently is behind its sliding TTL, the write renews it instead
+		if record.SlidingTTL > 0 {
+			record.ExpirationTime = nil
+		}
+		if !ok || record.Expired(now) {
+			reply(w, args, replyNotFound)
+			return
+		}
+		current, err := strconv.ParseUint(strings.TrimRight(string(record.Value), " "), 10, 64)
+		if err != nil {
+			reply(w, args, replyNonNumeric)
+			return
+		}
+		next := current + delta
+		if decr {
+			next = 0
+			if current > delta {
+				next = current - delta
+			}
+		}
+		record.Value = []byte(strconv.FormatUint(next, 10))
+		// the storage checks expiration at the same time, so a record which isn't stored fails the condition
+		// instead of disappearing silently, and the client gets NOT_FOUND
+		err = s.storage.CompareAndSet(engine.WithTime(ctx, now), record, engine.Condition{Match: []uint64{record.Version}})
+		if errors.Cause(err) == engine.ErrPreconditionFailed && ctx.Err() == nil {
+			continue
+		}
+		if err != nil {
+			reply(w, args, s.serverError(err))
+			return
+		}
+		reply(w, args, string(record.Value))
+		return
+	}
+}
+
+// flushAll removes all values now or after the delay in seconds (flush_all [delay] [noreply])
+func (s *Server) flushAll(ctx context.Context, w *bufio.Writer, args []string) {
+	rest := args
+	if len(rest) > 0 && rest[len(rest)-1] == noReply {
+		rest = rest[:len(rest)-1]
+	}
+	delay := int64(0)
+	if len(rest) > 1 {
+		writeLine(w, replyBadFormat)
+		return
+	}
+	if len(rest) == 1 {
+		var err error
+		if delay, err = strconv.ParseInt(rest[0], 10, 64); err != nil || delay < 0 {
+			writeLine(w, replyBadFormat)
+			return
+		}
+	}
+	if delay > 0 {
+		time.AfterFunc(time.Duration(delay)*time.Second, func() {
+			if s.ctx.Err() != nil {
+				return
+			}
+			if err := s.storage.DeleteAll(s.ctx); err != nil {
+				s.log.Errorf("delayed flush_all failed: %s", err)
+			}
+		})
+		reply(w, args, replyOK)
+		return
+	}
+	if err := s.storage.DeleteAll(ctx); err != nil {
+		reply(w, args, s.serverError(err))
+		return
+	}
+	reply(w, args, replyOK)
+}
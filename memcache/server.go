@@ -0,0 +1,71 @@
+package memcache
+
+// Memcached text protocol listener.
+// The server supports storage and retrieval commands of memcached on top of engine.Storage.
+// CAS tokens are versions of records, exptime is turned into expiration time of a record,
+// and flags of a value are kept in its content type, so values set over HTTP have zero flags.
+// Commands get and gets of a cluster node wait for the read index before looking up the keys, failures of a node
+// which is not the leader are SERVER_ERROR replies.
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/filatovw/ni-storage/config"
+	"github.com/filatovw/ni-storage/engine"
+	"github.com/filatovw/ni-storage/logger"
+	"github.com/filatovw/ni-storage/tcpserver"
+)
+
+// commandTimeout limits processing of a command
+const commandTimeout = 15 * time.Second
+
+// ErrServerClosed is returned by Serve after the server is closed
+var ErrServerClosed = errors.New("memcache: server closed")
+
+// Server serves memcached clients
+type Server struct {
+	*tcpserver.Server
+	ctx     context.Context
+	log     logger.Logger
+	storage engine.Storage
+}
+
+// New creates a server of the storage, commands are done until the context is done
+func New(ctx context.Context, log logger.Logger, storage engine.Storage, cfg config.Memcached) *Server {
+	s := &Server{
+		ctx:     ctx,
+		log:     log,
+		storage: storage,
+	}
+	s.Server = tcpserver.New(log, cfg.Address, ErrServerClosed, s.serveConn)
+	return s
+}
+
+// serveConn runs commands of a client until it quits or the connection breaks.
+// Replies are flushed once all commands sent so far are done, so pipelined commands are answered at once.
+func (s *Server) serveConn(conn net.Conn) {
+	s.log.Debugf("client %s connected", conn.RemoteAddr())
+	r := bufio.NewReader(conn)
+	w := bufio.NewWriter(conn)
+	for {
+		quit, err := s.run(r, w)
+		if err != nil {
+			s.log.Debugf("client %s disconnected: %s", conn.RemoteAddr(), err)
+			return
+		}
+		if r.Buffered() == 0 || quit {
+			if err := w.Flush(); err != nil {
+				s.log.Debugf("client %s disconnected: %s", conn.RemoteAddr(), err)
+				return
+			}
+		}
+		if quit {
+			return
+		}
+	}
+}
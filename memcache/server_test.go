@@ -0,0 +1,265 @@
+package memcache_test
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/filatovw/ni-storage/config"
+	"github.com/filatovw/ni-storage/engine"
+	"github.com/filatovw/ni-storage/internal/storagetest"
+	"github.com/filatovw/ni-storage/memcache"
+)
+
+// client speaks the protocol over a raw connection
+type client struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func (c *client) send(request string) {
+	c.t.Helper()
+	if _, err := c.conn.Write([]byte(request)); err != nil {
+		c.t.Fatalf("unexpected error: %s", err)
+	}
+}
+
+// read reads as many bytes as the expected reply has
+func (c *client) read(expected string) string {
+	c.t.Helper()
+	c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	reply := make([]byte, len(expected))
+	if _, err := io.ReadFull(c.r, reply); err != nil {
+		c.t.Fatalf("unexpected error: %s, read %q", err, reply)
+	}
+	return string(reply)
+}
+
+func (c *client) readLine() string {
+	c.t.Helper()
+	c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		c.t.Fatalf("unexpected error: %s", err)
+	}
+	return strings.TrimSuffix(line, "\r\n")
+}
+
+// startServer serves the storage at a random port
+func startServer(t *testing.T, storage *storagetest.Storage) (string, func()) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := memcache.New(storage.Ctx, storage.Log, storage.Service, config.Memcached{})
+	done := make(chan error)
+	go func() {
+		done <- server.Serve(l)
+	}()
+	return l.Addr().String(), func() {
+		server.Close()
+		if err := <-done; err != memcache.ErrServerClosed {
+			t.Errorf("expected %s, got %v", memcache.ErrServerClosed, err)
+		}
+		storage.Close()
+	}
+}
+
+func connect(t *testing.T, addr string) *client {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &client{t: t, conn: conn, r: bufio.NewReader(conn)}
+}
+
+func TestCommands(t *testing.T) {
+	storage := storagetest.New(t)
+	addr, stop := startServer(t, storage)
+	defer stop()
+	c := connect(t, addr)
+	defer c.conn.Close()
+
+	tests := []struct {
+		request string
+		reply   string
+	}{
+		{request: "version\r\n", reply: "VERSION ni-storage\r\n"},
+		{request: "verbosity 1\r\n", reply: "OK\r\n"},
+		{request: "unknown\r\n", reply: "ERROR\r\n"},
+		{request: "\r\n", reply: "ERROR\r\n"},
+		{request: "get\r\n", reply: "ERROR\r\n"},
+
+		{request: "get key1\r\n", reply: "END\r\n"},
+		{request: "set key1 0 0 6\r\nvalue1\r\n", reply: "STORED\r\n"},
+		{request: "get key1\r\n", reply: "VALUE key1 0 6\r\nvalue1\r\nEND\r\n"},
+		{request: "set key2 42 0 12\r\nbin\x00\r\nary\r\nx\r\n", reply: "STORED\r\n"},
+		{request: "get key1 missing key2\r\n", reply: "VALUE key1 0 6\r\nvalue1\r\nVALUE key2 42 12\r\nbin\x00\r\nary\r\nx\r\nEND\r\n"},
+		{request: "set key3 0 0 0\r\n\r\n", reply: "STORED\r\n"},
+		{request: "get key3\r\n", reply: "VALUE key3 0 0\r\n\r\nEND\r\n"},
+		{request: "set key1 0 0\r\n", reply: "CLIENT_ERROR bad command line format\r\n"},
+		{request: "set key1 x 0 1\r\na\r\n", reply: "CLIENT_ERROR bad command line format\r\n"},
+		{request: "set " + strings.Repeat("k", 251) + " 0 0 1\r\na\r\n", reply: "CLIENT_ERROR bad command line format\r\n"},
+		{request: "set key1 0 0 1 noreply\r\na\r\nget key1\r\n", reply: "VALUE key1 0 1\r\na\r\nEND\r\n"},
+
+		{request: "add key1 0 0 1\r\nb\r\n", reply: "NOT_STORED\r\n"},
+		{request: "add key4 0 0 1\r\nb\r\n", reply: "STORED\r\n"},
+		{request: "replace key5 0 0 1\r\nc\r\n", reply: "NOT_STORED\r\n"},
+		{request: "replace key4 0 0 1\r\nc\r\n", reply: "STORED\r\n"},
+		{request: "get key4\r\n", reply: "VALUE key4 0 1\r\nc\r\nEND\r\n"},
+		{request: "cas key5 0 0 1 1\r\nd\r\n", reply: "NOT_FOUND\r\n"},
+		{request: "cas key4 0 0 1 1000\r\nd\r\n", reply: "EXISTS\r\n"},
+
+		{request: "incr key1 1\r\n", reply: "CLIENT_ERROR cannot increment or decrement non-numeric value\r\n"},
+		{request: "incr missing 1\r\n", reply: "NOT_FOUND\r\n"},
+		{request: "set counter 0 0 2\r\n10\r\n", reply: "STORED\r\n"},
+		{request: "incr counter 5\r\n", reply: "15\r\n"},
+		{request: "decr counter 3\r\n", reply: "12\r\n"},
+		{request: "decr counter 100\r\n", reply: "0\r\n"},
+		{request: "incr counter -1\r\n", reply: "CLIENT_ERROR invalid numeric delta argument\r\n"},
+		{request: "set counter 0 0 20\r\n18446744073709551615\r\n", reply: "STORED\r\n"},
+		{request: "incr counter 2\r\n", reply: "1\r\n"},
+
+		{request: "touch key1 100\r\n", reply: "TOUCHED\r\n"},
+		{request: "touch missing 100\r\n", reply: "NOT_FOUND\r\n"},
+		{request: "touch key1 0\r\n", reply: "TOUCHED\r\n"},
+		{request: "set key6 0 -1 1\r\na\r\n", reply: "STORED\r\n"},
+		{request: "get key6\r\n", reply: "END\r\n"},
+		{request: "set key1 0 1 1\r\na\r\n", reply: "STORED\r\n"},
+		{request: "touch key1 -1\r\n", reply: "TOUCHED\r\n"},
+		{request: "get key1\r\n", reply: "END\r\n"},
+
+		{request: "delete key2\r\n", reply: "DELETED\r\n"},
+		{request: "delete key2\r\n", reply: "NOT_FOUND\r\n"},
+		{request: "delete key3 0\r\n", reply: "DELETED\r\n"},
+		{request: "delete key4 noreply\r\nget key4\r\n", reply: "END\r\n"},
+		{request: "flush_all later\r\n", reply: "CLIENT_ERROR bad command line format\r\n"},
+		{request: "flush_all\r\n", reply: "OK\r\n"},
+		{request: "get counter\r\n", reply: "END\r\n"},
+	}
+	for _, tt := range tests {
+		c.send(tt.request)
+		if reply := c.read(tt.reply); reply != tt.reply {
+			t.Errorf("%q: expected %q, got %q", tt.request, tt.reply, reply)
+		}
+	}
+	if n := len(storage.GetAll()); n != 0 {
+		t.Errorf("expected no keys, got %d", n)
+	}
+
+	c.send("quit\r\n")
+	if _, err := c.r.ReadByte(); err == nil {
+		t.Errorf("expected the connection to be closed")
+	}
+}
+
+func TestCAS(t *testing.T) {
+	storage := storagetest.New(t)
+	addr, stop := startServer(t, storage)
+	defer stop()
+	c := connect(t, addr)
+	defer c.conn.Close()
+
+	c.send("set key1 7 0 6\r\nvalue1\r\n")
+	c.read("STORED\r\n")
+	record, _ := storage.Get("key1")
+	c.send("gets key1\r\n")
+	expected := fmt.Sprintf("VALUE key1 7 6 %d", record.Version)
+	if line := c.readLine(); line != expected {
+		t.Fatalf("expected %q, got %q", expected, line)
+	}
+	c.read("value1\r\nEND\r\n")
+
+	c.send(fmt.Sprintf("cas key1 8 0 6 %d\r\nvalue2\r\n", record.Version))
+	if reply := c.readLine(); reply != "STORED" {
+		t.Errorf("unexpected reply: %q", reply)
+	}
+	// the token is stale after the value is changed
+	c.send(fmt.Sprintf("cas key1 9 0 6 %d\r\nvalue3\r\n", record.Version))
+	if reply := c.readLine(); reply != "EXISTS" {
+		t.Errorf("unexpected reply: %q", reply)
+	}
+	c.send("get key1\r\n")
+	c.read("VALUE key1 8 6\r\nvalue2\r\nEND\r\n")
+}
+
+func TestIncrSliding(t *testing.T) {
+	storage := storagetest.New(t)
+	addr, stop := startServer(t, storage)
+	defer stop()
+	c := connect(t, addr)
+	defer c.conn.Close()
+
+	// the counter is read before its expiration time, so it's still alive after that time
+	record := engine.Record{Key: "counter", Value: []byte("1"), SlidingTTL: 300 * time.Millisecond}
+	if err := storage.Set(storage.Ctx, record); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	time.Sleep(200 * time.Millisecond)
+	storage.Get("counter")
+	time.Sleep(200 * time.Millisecond)
+
+	c.send("incr counter 1\r\n")
+	if reply := c.readLine(); reply != "2" {
+		t.Errorf("unexpected reply: %q", reply)
+	}
+	c.send("get counter\r\n")
+	if reply := c.read("VALUE counter 0 1\r\n2\r\nEND\r\n"); reply != "VALUE counter 0 1\r\n2\r\nEND\r\n" {
+		t.Errorf("unexpected reply: %q", reply)
+	}
+}
+
+func TestTooLarge(t *testing.T) {
+	addr, stop := startServer(t, storagetest.New(t))
+	defer stop()
+	c := connect(t, addr)
+	defer c.conn.Close()
+
+	// the data block of a value larger than the limit is skipped, so the connection can be used further
+	size := 64<<20 + 1
+	c.send(fmt.Sprintf("set key1 0 0 %d\r\n", size))
+	c.send(strings.Repeat("a", size) + "\r\n")
+	if reply := c.readLine(); reply != "SERVER_ERROR object too large for cache" {
+		t.Errorf("unexpected reply: %q", reply)
+	}
+	c.send("get key1\r\n")
+	if reply := c.readLine(); reply != "END" {
+		t.Errorf("unexpected reply: %q", reply)
+	}
+}
+
+func TestBadDataChunk(t *testing.T) {
+	addr, stop := startServer(t, storagetest.New(t))
+	defer stop()
+	c := connect(t, addr)
+	defer c.conn.Close()
+
+	c.send("set key1 0 0 2\r\nvalue1\r\n")
+	if reply := c.readLine(); reply != "CLIENT_ERROR bad data chunk" {
+		t.Errorf("unexpected reply: %q", reply)
+	}
+	if _, err := c.r.ReadByte(); err == nil {
+		t.Errorf("expected the connection to be closed")
+	}
+}
+
+func TestReadOnly(t *testing.T) {
+	addr, stop := startServer(t, storagetest.NewReadOnly(t))
+	defer stop()
+	c := connect(t, addr)
+	defer c.conn.Close()
+
+	c.send("get key1\r\n")
+	if reply := c.read("VALUE key1 0 6\r\nvalue1\r\nEND\r\n"); reply != "VALUE key1 0 6\r\nvalue1\r\nEND\r\n" {
+		t.Errorf("unexpected reply: %q", reply)
+	}
+	c.send("set key1 0 0 6\r\nvalue2\r\n")
+	if reply := c.readLine(); reply != "SERVER_ERROR storage is read-only" {
+		t.Errorf("unexpected reply: %q", reply)
+	}
+}
@@ -0,0 +1,417 @@
+package proxy
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/go-chi/chi/middleware"
+	"github.com/go-chi/render"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"github.com/filatovw/ni-storage/api"
+	"github.com/filatovw/ni-storage/config"
+	"github.com/filatovw/ni-storage/logger"
+)
+
+const (
+	// requestTimeout limits processing of a request including requests to shards
+	requestTimeout = 15 * time.Second
+	// nextCursorHeader holds the cursor of the next page of keys, it's the same cursor shards return
+	nextCursorHeader = "X-Next-Cursor"
+)
+
+// hopHeaders are meaningful for a single connection only, so they aren't passed between a client and shards
+var hopHeaders = []string{
+	"Connection",
+	"Content-Length",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// New creates a server routing requests for keys to shards of the config
+func New(ctx context.Context, log logger.Logger, cfg config.Config) *http.Server {
+	p := NewProxy(ctx, log, cfg.Proxy)
+
+	mux := chi.NewRouter()
+	mux.Use(render.SetContentType(render.ContentTypeJSON))
+	mux.Use(middleware.RequestID)
+	mux.Use(api.LevelLogger(log))
+
+	mux.Handle("/health", api.HealthHandler(log))
+	mux.Handle("/metrics", promhttp.Handler())
+
+	mux.Route("/shards", func(mux chi.Router) {
+		mux.Use(middleware.Timeout(requestTimeout))
+		mux.Get("/", p.ShardsHandler)
+		mux.Post("/", p.JoinHandler)
+		mux.Delete("/", p.LeaveHandler)
+	})
+	mux.With(middleware.Timeout(requestTimeout)).Post("/batch", p.BatchHandler)
+	mux.Route("/keys", func(mux chi.Router) {
+		mux.Use(middleware.Timeout(requestTimeout))
+		mux.Get("/", p.GetAllHandler)
+		mux.Delete("/", p.DeleteAllHandler)
+		mux.Put("/", p.SetMultipleHandler)
+		mux.Route("/{id}", func(mux chi.Router) {
+			mux.Get("/", p.KeyHandler)
+			mux.Put("/", p.KeyHandler)
+			mux.Head("/", p.KeyHandler)
+			mux.Delete("/", p.KeyHandler)
+			mux.Get("/ttl", p.TTLHandler)
+			mux.Put("/ttl", p.TTLHandler)
+			mux.Delete("/ttl", p.TTLHandler)
+		})
+	})
+	return &http.Server{
+		Addr:         cfg.HTTPServer.Address(),
+		ReadTimeout:  15 * time.Second,
+		WriteTimeout: 30 * time.Second,
+		IdleTimeout:  30 * time.Second,
+		Handler:      mux,
+	}
+}
+
+// renderStatus renders the text of the status code
+func renderStatus(w http.ResponseWriter, r *http.Request, status int) {
+	render.Status(r, status)
+	render.JSON(w, r, http.StatusText(status))
+}
+
+// renderError maps errors of the proxy to HTTP status codes, failed requests to shards are 502 Bad Gateway
+func (p *Proxy) renderError(w http.ResponseWriter, r *http.Request, err error) {
+	status := http.StatusBadGateway
+	switch errors.Cause(err) {
+	case ErrRebalancing, ErrShardExists, ErrLastShard:
+		status = http.StatusConflict
+	case ErrUnknownShard:
+		status = http.StatusNotFound
+	default:
+		p.log.Errorf("proxy error: %s", err)
+	}
+	renderStatus(w, r, status)
+}
+
+// requestHeader copies headers of a client request which are passed to shards
+func requestHeader(r *http.Request) http.Header {
+	header := http.Header{}
+	for k, v := range r.Header {
+		header[k] = v
+	}
+	for _, h := range hopHeaders {
+		header.Del(h)
+	}
+	// responses are passed to a client as is, so they aren't compressed by the transport
+	header.Del("Accept-Encoding")
+	return header
+}
+
+// writeResponse passes a response of a shard to a client
+func writeResponse(w http.ResponseWriter, resp response) {
+	for k, v := range resp.header {
+		w.Header()[k] = v
+	}
+	for _, h := range hopHeaders {
+		w.Header().Del(h)
+	}
+	w.WriteHeader(resp.status)
+	w.Write(resp.body)
+}
+
+// ShardsHandler lists shards of the ring (GET /shards)
+func (p *Proxy) ShardsHandler(w http.ResponseWriter, r *http.Request) {
+	render.JSON(w, r, p.Status())
+}
+
+// shardRequest names a shard by URL of its API server
+type shardRequest struct {
+	URL string `json:"url"`
+}
+
+// JoinHandler adds a shard to the ring (POST /shards), keys are moved to it in background
+// 409 Conflict is returned while keys of the previous change are moved.
+func (p *Proxy) JoinHandler(w http.ResponseWriter, r *http.Request) {
+	var req shardRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.URL == "" {
+		renderStatus(w, r, http.StatusBadRequest)
+		return
+	}
+	if err := p.Join(r.Context(), req.URL); err != nil {
+		p.renderError(w, r, err)
+		return
+	}
+	renderStatus(w, r, http.StatusAccepted)
+}
+
+// LeaveHandler removes a shard from the ring (DELETE /shards?url=http://...), its keys are moved to other shards in background
+func (p *Proxy) LeaveHandler(w http.ResponseWriter, r *http.Request) {
+	shard := r.URL.Query().Get("url")
+	if shard == "" {
+		renderStatus(w, r, http.StatusBadRequest)
+		return
+	}
+	if err := p.Leave(shard); err != nil {
+		p.renderError(w, r, err)
+		return
+	}
+	renderStatus(w, r, http.StatusAccepted)
+}
+
+// KeyHandler forwards a request for a value (/keys/{id}) to the shard of the key.
+// While the key is moved, a read missing on the new shard falls back to the old one
+// and a removal is sent to both of them.
+func (p *Proxy) KeyHandler(w http.ResponseWriter, r *http.Request) {
+	p.forward(w, r, r.Method == http.MethodDelete)
+}
+
+// TTLHandler forwards a request for expiration of a value (/keys/{id}/ttl) to the shard of the key.
+// While the key is moved, a read missing on the new shard falls back to the old one. A change missing on the new shard
+// is refused with 409 Conflict when the old shard has the key, since the key would be moved with its old expiration.
+func (p *Proxy) TTLHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet {
+		p.forward(w, r, false)
+		return
+	}
+	body, err := requestBody(r)
+	if err != nil {
+		renderStatus(w, r, http.StatusBadRequest)
+		return
+	}
+	key := chi.URLParam(r, "id")
+	owner, previous := p.route(key)
+	if previous != "" {
+		defer p.lockKey(key)()
+	}
+	resp, err := p.send(r.Context(), r.Method, owner+r.URL.RequestURI(), requestHeader(r), body)
+	if err != nil {
+		p.renderError(w, r, err)
+		return
+	}
+	if previous != "" && resp.status == http.StatusNotFound {
+		old, err := p.send(r.Context(), http.MethodHead, previous+strings.TrimSuffix(r.URL.EscapedPath(), "/ttl"), nil, nil)
+		if err != nil {
+			p.renderError(w, r, err)
+			return
+		}
+		if old.status == http.StatusOK {
+			p.renderError(w, r, ErrRebalancing)
+			return
+		}
+	}
+	writeResponse(w, resp)
+}
+
+// requestBody reads the body of a client request, it's nil when the body is empty
+func requestBody(r *http.Request) ([]byte, error) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil || len(body) == 0 {
+		return nil, err
+	}
+	return body, nil
+}
+
+// forward sends a request for a key to its shard. While the key is moved, a read missing on the new shard
+// is repeated on the old one, and so is a mutation when it's set. Mutations of the key wait for its move.
+func (p *Proxy) forward(w http.ResponseWriter, r *http.Request, mutation bool) {
+	body, err := requestBody(r)
+	if err != nil {
+		renderStatus(w, r, http.StatusBadRequest)
+		return
+	}
+	header := requestHeader(r)
+	key := chi.URLParam(r, "id")
+	owner, previous := p.route(key)
+	read := r.Method == http.MethodGet || r.Method == http.MethodHead
+	if previous != "" && !read {
+		defer p.lockKey(key)()
+	}
+	resp, err := p.send(r.Context(), r.Method, owner+r.URL.RequestURI(), header, body)
+	if err != nil {
+		p.renderError(w, r, err)
+		return
+	}
+	if previous != "" && (read && resp.status == http.StatusNotFound || mutation) {
+		old, err := p.send(r.Context(), r.Method, previous+r.URL.RequestURI(), header, body)
+		if err != nil {
+			p.renderError(w, r, err)
+			return
+		}
+		if resp.status == http.StatusNotFound {
+			resp = old
+		}
+	}
+	writeResponse(w, resp)
+}
+
+// failed returns the first failure of requests to shards, or false when all of them have the expected status
+func failed(results []result, status int) (result, bool) {
+	for _, res := range results {
+		if res.err != nil || res.resp.status != status {
+			return res, true
+		}
+	}
+	return result{}, false
+}
+
+// renderFailure renders an error of a shard or passes its response to a client
+func (p *Proxy) renderFailure(w http.ResponseWriter, r *http.Request, res result) {
+	if res.err != nil {
+		p.renderError(w, r, errors.Wrap(res.err, res.shard))
+		return
+	}
+	writeResponse(w, res.resp)
+}
+
+// GetAllHandler lists keys of all shards in ascending order (GET /keys), it takes the same parameters as a shard.
+// A page has the smallest keys of all shards, so shards with more keys limit the page by their last keys.
+func (p *Proxy) GetAllHandler(w http.ResponseWriter, r *http.Request) {
+	shards := p.shards()
+	results := p.broadcast(r.Context(), http.MethodGet, r.URL.RequestURI(), requestHeader(r), only(shards))
+	if res, ok := failed(results, http.StatusOK); ok {
+		p.renderFailure(w, r, res)
+		return
+	}
+
+	seen := make(map[string]bool)
+	keys := []string{}
+	// bound is the smallest last key of shards which have more keys
+	bound, more := "", false
+	for _, res := range results {
+		var page []string
+		if err := json.Unmarshal(res.resp.body, &page); err != nil {
+			p.renderError(w, r, errors.Wrapf(err, "decode keys of %s", res.shard))
+			return
+		}
+		if res.resp.header.Get(nextCursorHeader) != "" && len(page) > 0 {
+			if last := page[len(page)-1]; !more || last < bound {
+				bound = last
+			}
+			more = true
+		}
+		for _, key := range page {
+			// a key is kept by two shards while it's moved
+			if !seen[key] {
+				seen[key] = true
+				keys = append(keys, key)
+			}
+		}
+	}
+	sort.Strings(keys)
+
+	if more {
+		// keys after the bound may be missing from the page
+		keys = keys[:sort.SearchStrings(keys, bound)+1]
+	}
+	// the limit is checked by shards already
+	if limit, _ := strconv.Atoi(r.URL.Query().Get("limit")); limit > 0 && len(keys) > limit {
+		keys = keys[:limit]
+		bound, more = keys[limit-1], true
+	}
+	if more {
+		w.Header().Set(nextCursorHeader, base64.RawURLEncoding.EncodeToString([]byte(bound)))
+	}
+	render.JSON(w, r, keys)
+}
+
+// DeleteAllHandler deletes values of all shards (DELETE /keys)
+func (p *Proxy) DeleteAllHandler(w http.ResponseWriter, r *http.Request) {
+	results := p.broadcast(r.Context(), http.MethodDelete, r.URL.RequestURI(), requestHeader(r), only(p.shards()))
+	if res, ok := failed(results, http.StatusAccepted); ok {
+		p.renderFailure(w, r, res)
+		return
+	}
+	renderStatus(w, r, http.StatusAccepted)
+}
+
+// SetMultipleHandler sets multiple values at once (PUT /keys), values are split by shards.
+// Values of a shard are set atomically, but a failure of one shard doesn't revert others.
+func (p *Proxy) SetMultipleHandler(w http.ResponseWriter, r *http.Request) {
+	var req map[string]json.RawMessage
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		renderStatus(w, r, http.StatusBadRequest)
+		return
+	}
+	parts := make(map[string]map[string]json.RawMessage)
+	for key, value := range req {
+		owner, _ := p.route(key)
+		if parts[owner] == nil {
+			parts[owner] = make(map[string]json.RawMessage)
+		}
+		parts[owner][key] = value
+	}
+	bodies := make(map[string][]byte, len(parts))
+	for shard, part := range parts {
+		body, err := json.Marshal(part)
+		if err != nil {
+			p.renderError(w, r, err)
+			return
+		}
+		bodies[shard] = body
+	}
+	results := p.broadcast(r.Context(), http.MethodPut, r.URL.RequestURI(), requestHeader(r), bodies)
+	if res, ok := failed(results, http.StatusCreated); ok {
+		p.renderFailure(w, r, res)
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+	render.JSON(w, r, http.StatusText(http.StatusOK))
+}
+
+// BatchHandler forwards an atomic batch (POST /batch) to the shard of its keys.
+// Atomicity can't be kept across shards, so all keys of a batch must belong to the same shard (400 Bad Request otherwise),
+// and batches with keys being moved are refused with 409 Conflict.
+func (p *Proxy) BatchHandler(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		renderStatus(w, r, http.StatusBadRequest)
+		return
+	}
+	var ops []struct {
+		Key string `json:"key"`
+	}
+	if err := json.Unmarshal(body, &ops); err != nil {
+		renderStatus(w, r, http.StatusBadRequest)
+		return
+	}
+	shard := ""
+	for _, op := range ops {
+		owner, previous := p.route(op.Key)
+		if shard != "" && owner != shard {
+			renderStatus(w, r, http.StatusBadRequest)
+			return
+		}
+		if previous != "" {
+			p.renderError(w, r, ErrRebalancing)
+			return
+		}
+		shard = owner
+	}
+	if shard == "" {
+		// an empty batch is checked by any shard
+		shards := p.shards()
+		if len(shards) == 0 {
+			renderStatus(w, r, http.StatusServiceUnavailable)
+			return
+		}
+		shard = shards[0]
+	}
+	resp, err := p.send(r.Context(), r.Method, shard+r.URL.RequestURI(), requestHeader(r), body)
+	if err != nil {
+		p.renderError(w, r, err)
+		return
+	}
+	writeResponse(w, resp)
+}
@@ -0,0 +1,111 @@
+package proxy
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"go.uber.org/zap"
+
+	"github.com/filatovw/ni-storage/api"
+	"github.com/filatovw/ni-storage/config"
+	"github.com/filatovw/ni-storage/engine"
+	"github.com/filatovw/ni-storage/engine/narwal"
+)
+
+// startStorage starts an API server with its own storage
+func startStorage(t *testing.T, ctx context.Context) (*narwal.Narwal, string, func()) {
+	t.Helper()
+	log, err := zap.NewProduction()
+	if err != nil {
+		t.Errorf("error on logger init: %s", err)
+	}
+	dir, err := ioutil.TempDir("", "proxy_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	storage, err := narwal.New(ctx, config.NarWAL{DataDir: dir}, log.Sugar())
+	if err != nil {
+		t.Fatalf("create engine: %s", err)
+	}
+	server := httptest.NewServer(api.New(ctx, log.Sugar(), storage, config.Config{}).Handler)
+	return storage, server.URL, func() {
+		server.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestMove(t *testing.T) {
+	tests := []struct {
+		name string
+		// change is made after the dump is taken
+		change    func(ctx context.Context, from, to *narwal.Narwal) error
+		fails     bool
+		fromValue string
+		toValue   string
+	}{
+		{
+			name:    "moved",
+			change:  func(ctx context.Context, from, to *narwal.Narwal) error { return nil },
+			toValue: "value1",
+		},
+		{
+			name: "removed from both shards",
+			change: func(ctx context.Context, from, to *narwal.Narwal) error {
+				return from.Delete(ctx, "key1")
+			},
+		},
+		{
+			name: "changed on the old shard",
+			change: func(ctx context.Context, from, to *narwal.Narwal) error {
+				return from.Set(ctx, engine.Record{Key: "key1", Value: []byte("value2")})
+			},
+			fails:     true,
+			fromValue: "value2",
+		},
+		{
+			name: "written to the new shard",
+			change: func(ctx context.Context, from, to *narwal.Narwal) error {
+				return to.Set(ctx, engine.Record{Key: "key1", Value: []byte("value3")})
+			},
+			toValue: "value3",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			from, fromURL, stopFrom := startStorage(t, ctx)
+			defer stopFrom()
+			to, toURL, stopTo := startStorage(t, ctx)
+			defer stopTo()
+			log, err := zap.NewProduction()
+			if err != nil {
+				t.Errorf("error on logger init: %s", err)
+			}
+			p := NewProxy(ctx, log.Sugar(), config.Proxy{})
+
+			if err := from.Set(ctx, engine.Record{Key: "key1", Value: []byte("value1")}); err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			record := from.Dump().Records["key1"]
+			if err := tt.change(ctx, from, to); err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if err := p.move(record, fromURL, toURL); (err != nil) != tt.fails {
+				t.Errorf("unexpected error: %v", err)
+			}
+			for _, check := range []struct {
+				storage *narwal.Narwal
+				value   string
+			}{{from, tt.fromValue}, {to, tt.toValue}} {
+				record, ok := check.storage.Get("key1")
+				if ok != (check.value != "") || ok && string(record.Value) != check.value {
+					t.Errorf("expected %q, got %q", check.value, record.Value)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,420 @@
+package proxy
+
+// Sharding proxy.
+// The proxy spreads keys across ni-storage nodes (shards) with a consistent-hash ring. Requests for a key
+// are forwarded to the shard the key belongs to, GET /keys and DELETE /keys are sent to all shards
+// and their results are merged.
+// When a shard joins or leaves, the ring is replaced at once and keys which belong to other shards now
+// are moved in background: a record still kept by the old shard is copied to its new shard unless the key has been
+// written there already, and then it's removed from the old shard unless it has changed; the copy is removed then,
+// so deleted keys don't come back. Until all keys are moved, reads missing on the new shard fall back to the old one,
+// removals are sent to both of them, and mutations of a key wait while the key is copied.
+// The ring is kept in memory of the proxy, so shards joined through the API have to be passed on restart.
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/filatovw/ni-storage/config"
+	"github.com/filatovw/ni-storage/engine"
+	"github.com/filatovw/ni-storage/logger"
+)
+
+// keyLockCount is a number of locks keys are spread across
+const keyLockCount = 64
+
+var (
+	// ErrRebalancing is returned when shards are changed before keys of the previous change are moved
+	ErrRebalancing = errors.New("keys are being moved between shards")
+	// ErrShardExists is returned when a shard joins the ring twice
+	ErrShardExists = errors.New("shard is already on the ring")
+	// ErrUnknownShard is returned when a shard which isn't on the ring leaves it
+	ErrUnknownShard = errors.New("shard is not on the ring")
+	// ErrLastShard is returned when the only shard leaves the ring
+	ErrLastShard = errors.New("the last shard can't leave the ring")
+)
+
+// Status of the ring
+type Status struct {
+	Shards []string `json:"shards"`
+	// Rebalancing tells if keys are being moved after the last change of shards
+	Rebalancing bool `json:"rebalancing"`
+}
+
+// Proxy routes requests to shards
+type Proxy struct {
+	ctx          context.Context
+	log          logger.Logger
+	client       *http.Client
+	virtualNodes int
+	// token of replication is passed to shards to read their dumps
+	token string
+
+	lock *sync.RWMutex
+	ring *Ring
+	// previous is the ring keys are being moved from, it's nil when all keys are in place
+	previous *Ring
+	// keyLocks serialize moves of keys with mutations of them forwarded by the proxy
+	keyLocks [keyLockCount]sync.Mutex
+}
+
+// NewProxy creates a proxy for shards of the config, keys are moved until the context is done
+func NewProxy(ctx context.Context, log logger.Logger, cfg config.Proxy) *Proxy {
+	return &Proxy{
+		ctx:          ctx,
+		log:          log,
+		client:       &http.Client{},
+		virtualNodes: cfg.VirtualNodes,
+		token:        cfg.ReplicationToken,
+		lock:         &sync.RWMutex{},
+		ring:         NewRing(cfg.VirtualNodes, Shards(cfg)...),
+	}
+}
+
+// Shards returns normalized URLs of shards of the config, blank ones are dropped
+func Shards(cfg config.Proxy) []string {
+	shards := make([]string, 0, len(cfg.Shards))
+	for _, shard := range cfg.Shards {
+		if shard = normalize(shard); shard != "" {
+			shards = append(shards, shard)
+		}
+	}
+	return shards
+}
+
+// normalize trims the trailing slash of a shard URL, so it's joined with paths as is
+func normalize(shard string) string {
+	return strings.TrimRight(strings.TrimSpace(shard), "/")
+}
+
+// Status returns shards of the ring
+func (p *Proxy) Status() Status {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	return Status{Shards: p.ring.Shards(), Rebalancing: p.previous != nil}
+}
+
+// route returns the shard of the key and the shard the key is being moved from, the latter is empty when the key is in place
+func (p *Proxy) route(key string) (string, string) {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	owner := p.ring.Owner(key)
+	if p.previous == nil {
+		return owner, ""
+	}
+	if previous := p.previous.Owner(key); previous != owner {
+		return owner, previous
+	}
+	return owner, ""
+}
+
+// shards returns all shards which may keep keys
+func (p *Proxy) shards() []string {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	shards := p.ring.Shards()
+	if p.previous != nil {
+		for _, shard := range p.previous.Shards() {
+			if !p.ring.Has(shard) {
+				shards = append(shards, shard)
+			}
+		}
+	}
+	return shards
+}
+
+// Join adds a shard to the ring and starts moving keys which belong to it
+func (p *Proxy) Join(ctx context.Context, shard string) error {
+	shard = normalize(shard)
+	// a shard which doesn't respond would lose keys moved to it
+	resp, err := p.send(ctx, http.MethodGet, shard+"/health", nil, nil)
+	if err != nil {
+		return err
+	}
+	if resp.status != http.StatusOK {
+		return errors.Errorf("shard %s responded with %d", shard, resp.status)
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.previous != nil {
+		return ErrRebalancing
+	}
+	if p.ring.Has(shard) {
+		return ErrShardExists
+	}
+	// keys of all shards may move to the new one
+	sources := p.ring.Shards()
+	p.previous = p.ring
+	p.ring = NewRing(p.virtualNodes, append(p.ring.Shards(), shard)...)
+	go p.rebalance(sources)
+	p.log.Infof("shard %s joined, moving keys from %d shards", shard, len(sources))
+	return nil
+}
+
+// Leave removes a shard from the ring and starts moving its keys to other shards.
+// The shard has to be kept running until all keys are moved.
+func (p *Proxy) Leave(shard string) error {
+	shard = normalize(shard)
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.previous != nil {
+		return ErrRebalancing
+	}
+	if !p.ring.Has(shard) {
+		return ErrUnknownShard
+	}
+	shards := []string{}
+	for _, s := range p.ring.Shards() {
+		if s != shard {
+			shards = append(shards, s)
+		}
+	}
+	if len(shards) == 0 {
+		return ErrLastShard
+	}
+	p.previous = p.ring
+	p.ring = NewRing(p.virtualNodes, shards...)
+	go p.rebalance([]string{shard})
+	p.log.Infof("shard %s leaves, moving its keys", shard)
+	return nil
+}
+
+// rebalance moves keys of the shards which belong to other shards now, failed shards are retried
+func (p *Proxy) rebalance(sources []string) {
+	for len(sources) > 0 {
+		failed := []string{}
+		for _, shard := range sources {
+			if err := p.drain(shard); err != nil {
+				p.log.Errorf("failed to move keys of %s: %s", shard, err)
+				failed = append(failed, shard)
+			}
+		}
+		sources = failed
+		if len(sources) == 0 {
+			break
+		}
+		select {
+		case <-time.After(time.Second):
+		case <-p.ctx.Done():
+			return
+		}
+	}
+	p.lock.Lock()
+	p.previous = nil
+	p.lock.Unlock()
+	p.log.Infof("keys are moved")
+}
+
+// drain moves records of the shard which belong to other shards
+func (p *Proxy) drain(shard string) error {
+	header := http.Header{}
+	if p.token != "" {
+		header.Set("Authorization", "Bearer "+p.token)
+	}
+	resp, err := p.send(p.ctx, http.MethodGet, shard+"/replication/dump", header, nil)
+	if err != nil {
+		return err
+	}
+	if resp.status != http.StatusOK {
+		return errors.Errorf("shard responded with %d", resp.status)
+	}
+	var dump engine.Dump
+	if err := json.Unmarshal(resp.body, &dump); err != nil {
+		return errors.Wrap(err, "decode dump")
+	}
+	p.lock.RLock()
+	ring := p.ring
+	p.lock.RUnlock()
+
+	moved := 0
+	for key, record := range dump.Records {
+		owner := ring.Owner(key)
+		if owner == shard {
+			continue
+		}
+		if err := p.move(record, shard, owner); err != nil {
+			return errors.Wrapf(err, "move %s to %s", key, owner)
+		}
+		moved++
+	}
+	p.log.Infof("moved %d of %d keys of %s", moved, len(dump.Records), shard)
+	return nil
+}
+
+// lockKey locks the key against a move or a mutation, the returned function unlocks it
+func (p *Proxy) lockKey(key string) func() {
+	l := &p.keyLocks[hash(key)%keyLockCount]
+	l.Lock()
+	return l.Unlock
+}
+
+// move copies the record to its new shard and removes it from the old one.
+// The record is copied only while it's current on the old shard, and the copy is removed when the record is deleted
+// or changed on the old shard before it's removed there, so a deleted key doesn't come back. A changed record is moved
+// with the next dump. A newer record written to the new shard is kept.
+func (p *Proxy) move(record engine.Record, from, to string) error {
+	defer p.lockKey(record.Key)()
+	path := "/keys/" + url.PathEscape(record.Key)
+	version := strconv.Quote(strconv.FormatUint(record.Version, 10))
+
+	resp, err := p.send(p.ctx, http.MethodHead, from+path, nil, nil)
+	if err != nil {
+		return err
+	}
+	switch {
+	case resp.status == http.StatusNotFound:
+		return nil
+	case resp.status != http.StatusOK:
+		return errors.Errorf("shard %s responded with %d", from, resp.status)
+	case resp.header.Get("ETag") != version:
+		return errors.Errorf("key has changed on %s since the dump", from)
+	}
+
+	// copied is the version of the record on the new shard, it's empty when nothing is copied
+	copied := ""
+	now := time.Now()
+	if !record.Expired(now) {
+		// the copy keeps the remaining lifetime, and a sliding one keeps its prolongation
+		query := url.Values{}
+		if record.ExpirationTime != nil {
+			query.Set("expire_in", strconv.FormatInt(int64(math.Ceil(record.ExpirationTime.Sub(now).Seconds())), 10))
+			if record.SlidingTTL > 0 {
+				query.Set("sliding", strconv.FormatInt(int64(math.Ceil(record.SlidingTTL.Seconds())), 10))
+			}
+		}
+		header := http.Header{}
+		header.Set("If-None-Match", "*")
+		if record.ContentType != "" {
+			header.Set("Content-Type", record.ContentType)
+		}
+		target := to + path
+		if len(query) > 0 {
+			target += "?" + query.Encode()
+		}
+		resp, err := p.send(p.ctx, http.MethodPut, target, header, record.Value)
+		if err != nil {
+			return err
+		}
+		switch resp.status {
+		case http.StatusCreated:
+			// mutations of the key wait for the move, so the record on the new shard is the copy
+			resp, err := p.send(p.ctx, http.MethodHead, to+path, nil, nil)
+			if err != nil {
+				return err
+			}
+			if resp.status != http.StatusOK {
+				return errors.Errorf("shard %s responded with %d", to, resp.status)
+			}
+			copied = resp.header.Get("ETag")
+		case http.StatusPreconditionFailed:
+		default:
+			return errors.Errorf("shard %s responded with %d", to, resp.status)
+		}
+	}
+
+	header := http.Header{}
+	header.Set("If-Match", version)
+	resp, err = p.send(p.ctx, http.MethodDelete, from+path, header, nil)
+	if err != nil {
+		return err
+	}
+	switch {
+	case resp.status == http.StatusAccepted:
+		return nil
+	case resp.status == http.StatusNotFound && copied == "":
+		return nil
+	case resp.status != http.StatusNotFound && resp.status != http.StatusPreconditionFailed:
+		return errors.Errorf("shard %s responded with %d", from, resp.status)
+	}
+	if copied != "" {
+		header := http.Header{}
+		header.Set("If-Match", copied)
+		resp, err := p.send(p.ctx, http.MethodDelete, to+path, header, nil)
+		if err != nil {
+			return err
+		}
+		switch resp.status {
+		case http.StatusAccepted, http.StatusNotFound, http.StatusPreconditionFailed:
+		default:
+			return errors.Errorf("shard %s responded with %d", to, resp.status)
+		}
+	}
+	return errors.Errorf("key has been removed or changed on %s while it's moved", from)
+}
+
+// response of a shard
+type response struct {
+	status int
+	header http.Header
+	body   []byte
+}
+
+// send makes a request to a shard and reads the whole response
+func (p *Proxy) send(ctx context.Context, method, target string, header http.Header, body []byte) (response, error) {
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+	req, err := http.NewRequest(method, target, reader)
+	if err != nil {
+		return response{}, errors.Wrap(err, "build request")
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	resp, err := p.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return response{}, errors.Wrap(err, "request shard")
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return response{}, errors.Wrap(err, "read response of shard")
+	}
+	return response{status: resp.StatusCode, header: resp.Header, body: data}, nil
+}
+
+// result of a request sent to one of many shards
+type result struct {
+	shard string
+	resp  response
+	err   error
+}
+
+// broadcast sends requests to shards at once, bodies are kept by shards
+func (p *Proxy) broadcast(ctx context.Context, method, uri string, header http.Header, bodies map[string][]byte) []result {
+	results := make(chan result, len(bodies))
+	for shard, body := range bodies {
+		go func(shard string, body []byte) {
+			resp, err := p.send(ctx, method, shard+uri, header, body)
+			results <- result{shard: shard, resp: resp, err: err}
+		}(shard, body)
+	}
+	all := make([]result, 0, len(bodies))
+	for range bodies {
+		all = append(all, <-results)
+	}
+	return all
+}
+
+// only makes requests without bodies to shards
+func only(shards []string) map[string][]byte {
+	bodies := make(map[string][]byte, len(shards))
+	for _, shard := range shards {
+		bodies[shard] = nil
+	}
+	return bodies
+}
@@ -0,0 +1,444 @@
+package proxy_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/filatovw/ni-storage/api"
+	"github.com/filatovw/ni-storage/config"
+	"github.com/filatovw/ni-storage/engine/narwal"
+	"github.com/filatovw/ni-storage/proxy"
+)
+
+// shard is an API server with its own storage
+type shard struct {
+	storage *narwal.Narwal
+	server  *httptest.Server
+	dir     string
+}
+
+// testProxy routes requests to shards started in the same process
+type testProxy struct {
+	t      *testing.T
+	ctx    context.Context
+	cancel context.CancelFunc
+	shards []*shard
+	server *httptest.Server
+	// token of replication of shards started next, the proxy doesn't know it, so their keys can't be moved
+	token string
+}
+
+func newProxy(t *testing.T, shards int) *testProxy {
+	ctx, cancel := context.WithCancel(context.Background())
+	p := &testProxy{t: t, ctx: ctx, cancel: cancel}
+	urls := []string{}
+	for i := 0; i < shards; i++ {
+		urls = append(urls, p.startShard().server.URL)
+	}
+	log, err := zap.NewProduction()
+	if err != nil {
+		t.Errorf("error on logger init: %s", err)
+	}
+	cfg := config.Config{Proxy: config.Proxy{Shards: urls, VirtualNodes: 50}}
+	p.server = httptest.NewServer(proxy.New(ctx, log.Sugar(), cfg).Handler)
+	return p
+}
+
+// startShard starts a shard which isn't on the ring yet
+func (p *testProxy) startShard() *shard {
+	t := p.t
+	t.Helper()
+	log, err := zap.NewProduction()
+	if err != nil {
+		t.Errorf("error on logger init: %s", err)
+	}
+	dir, err := ioutil.TempDir("", "proxy_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	storage, err := narwal.New(p.ctx, config.NarWAL{DataDir: dir}, log.Sugar())
+	if err != nil {
+		t.Fatalf("create engine: %s", err)
+	}
+	s := &shard{storage: storage, dir: dir}
+	cfg := config.Config{Replication: config.Replication{Token: p.token}}
+	s.server = httptest.NewServer(api.New(p.ctx, log.Sugar(), storage, cfg).Handler)
+	p.shards = append(p.shards, s)
+	return s
+}
+
+func (p *testProxy) close() {
+	p.cancel()
+	p.server.Close()
+	for _, s := range p.shards {
+		s.server.Close()
+		os.RemoveAll(s.dir)
+	}
+}
+
+func (p *testProxy) request(method, path, body string, header map[string]string) (*http.Response, string) {
+	t := p.t
+	t.Helper()
+	req, err := http.NewRequest(method, p.server.URL+path, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp, string(data)
+}
+
+func (p *testProxy) status() proxy.Status {
+	p.t.Helper()
+	resp, body := p.request("GET", "/shards", "", nil)
+	if resp.StatusCode != http.StatusOK {
+		p.t.Fatalf("unexpected status code: %d", resp.StatusCode)
+	}
+	var s proxy.Status
+	if err := json.Unmarshal([]byte(body), &s); err != nil {
+		p.t.Fatalf("unexpected error: %s", err)
+	}
+	return s
+}
+
+// waitRebalanced waits until keys are moved after a change of shards
+func (p *testProxy) waitRebalanced() {
+	p.t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for p.status().Rebalancing {
+		if time.Now().After(deadline) {
+			p.t.Fatalf("timed out waiting for keys to move")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// checkPlacement checks that every key is kept only by the shard it belongs to
+func (p *testProxy) checkPlacement(expected int) {
+	t := p.t
+	t.Helper()
+	status := p.status()
+	ring := proxy.NewRing(50, status.Shards...)
+	total := 0
+	for _, s := range p.shards {
+		onRing := ring.Has(s.server.URL)
+		for key := range s.storage.GetAll() {
+			if !onRing || ring.Owner(key) != s.server.URL {
+				t.Errorf("key %s is kept by %s, expected %s", key, s.server.URL, ring.Owner(key))
+			}
+			total++
+		}
+		if onRing && expected > 0 && len(s.storage.GetAll()) == 0 {
+			t.Errorf("shard %s has no keys", s.server.URL)
+		}
+	}
+	if total != expected {
+		t.Errorf("expected %d keys, got %d", expected, total)
+	}
+}
+
+func keys(t *testing.T, body string) []string {
+	t.Helper()
+	var keys []string
+	if err := json.Unmarshal([]byte(body), &keys); err != nil {
+		t.Fatalf("unexpected response %s: %s", body, err)
+	}
+	return keys
+}
+
+func TestProxyKeys(t *testing.T) {
+	p := newProxy(t, 3)
+	defer p.close()
+
+	expected := []string{}
+	for i := 0; i < 50; i++ {
+		key := fmt.Sprintf("key%02d", i)
+		expected = append(expected, key)
+		if resp, _ := p.request("PUT", "/keys/"+key, "value"+key, map[string]string{"Content-Type": "text/plain"}); resp.StatusCode != http.StatusCreated {
+			t.Fatalf("unexpected status code: %d", resp.StatusCode)
+		}
+	}
+	resp, _ := p.request("PUT", "/keys", `{"multi1":{"value":"m1"},"multi2":{"value":"m2"}}`, nil)
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("unexpected status code: %d", resp.StatusCode)
+	}
+	expected = append(expected, "multi1", "multi2")
+	p.checkPlacement(len(expected))
+
+	// values and headers of shards are passed as is
+	resp, body := p.request("GET", "/keys/key07", "", nil)
+	if resp.StatusCode != http.StatusOK || body != "valuekey07" || resp.Header.Get("Content-Type") != "text/plain" || resp.Header.Get("ETag") == "" {
+		t.Errorf("unexpected response: %d %s %v", resp.StatusCode, body, resp.Header)
+	}
+	resp, _ = p.request("PUT", "/keys/key07", "changed", map[string]string{"If-Match": `"0"`})
+	if resp.StatusCode != http.StatusPreconditionFailed {
+		t.Errorf("expected status %d, got %d", http.StatusPreconditionFailed, resp.StatusCode)
+	}
+	if resp, _ := p.request("GET", "/keys/missing", "", nil); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("expected status %d, got %d", http.StatusNotFound, resp.StatusCode)
+	}
+
+	// keys of all shards are merged
+	resp, body = p.request("GET", "/keys", "", nil)
+	if got := keys(t, body); resp.StatusCode != http.StatusOK || strings.Join(got, ",") != strings.Join(expected, ",") {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+	resp, body = p.request("GET", "/keys?filter=multi$", "", nil)
+	if got := keys(t, body); strings.Join(got, ",") != "multi1,multi2" {
+		t.Errorf("unexpected keys: %v", got)
+	}
+
+	// pages of merged keys follow each other
+	for _, limit := range []int{1, 7, 100} {
+		paged := []string{}
+		cursor := ""
+		for pages := 0; ; pages++ {
+			if pages > len(expected) {
+				t.Fatalf("too many pages")
+			}
+			resp, body := p.request("GET", fmt.Sprintf("/keys?limit=%d&cursor=%s", limit, cursor), "", nil)
+			page := keys(t, body)
+			if len(page) > limit {
+				t.Fatalf("expected at most %d keys, got %v", limit, page)
+			}
+			paged = append(paged, page...)
+			if cursor = resp.Header.Get("X-Next-Cursor"); cursor == "" {
+				break
+			}
+		}
+		if strings.Join(paged, ",") != strings.Join(expected, ",") {
+			t.Errorf("limit %d: expected %v, got %v", limit, expected, paged)
+		}
+	}
+	if resp, _ := p.request("GET", "/keys?limit=-1", "", nil); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected status %d, got %d", http.StatusBadRequest, resp.StatusCode)
+	}
+
+	// a batch is atomic only within a shard
+	ring := proxy.NewRing(50, p.status().Shards...)
+	other := ""
+	for _, key := range expected {
+		if ring.Owner(key) != ring.Owner("key00") {
+			other = key
+			break
+		}
+	}
+	resp, _ = p.request("POST", "/batch", fmt.Sprintf(`[{"op":"delete","key":"key00"},{"op":"delete","key":"%s"}]`, other), nil)
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected status %d, got %d", http.StatusBadRequest, resp.StatusCode)
+	}
+	resp, _ = p.request("POST", "/batch", `[{"op":"set","key":"key00","value":"batch"}]`, nil)
+	if resp.StatusCode != http.StatusCreated {
+		t.Errorf("expected status %d, got %d", http.StatusCreated, resp.StatusCode)
+	}
+
+	resp, _ = p.request("DELETE", "/keys", "", nil)
+	if resp.StatusCode != http.StatusAccepted {
+		t.Errorf("expected status %d, got %d", http.StatusAccepted, resp.StatusCode)
+	}
+	p.checkPlacement(0)
+}
+
+func TestProxyRebalance(t *testing.T) {
+	p := newProxy(t, 2)
+	defer p.close()
+
+	for i := 0; i < 200; i++ {
+		p.request("PUT", fmt.Sprintf("/keys/key%03d", i), "value", nil)
+	}
+	p.request("PUT", "/keys/ttl?expire_in=60", "value", map[string]string{"Content-Type": "text/plain"})
+	p.request("PUT", "/keys/sliding?expire_in=60&sliding=600", "value", nil)
+
+	// keys which belong to the new shard are moved to it
+	added := p.startShard()
+	resp, _ := p.request("POST", "/shards", fmt.Sprintf(`{"url":"%s/"}`, added.server.URL), nil)
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("unexpected status code: %d", resp.StatusCode)
+	}
+	p.waitRebalanced()
+	if s := p.status(); len(s.Shards) != 3 {
+		t.Fatalf("unexpected shards: %v", s.Shards)
+	}
+	p.checkPlacement(202)
+
+	resp, body := p.request("GET", "/keys", "", nil)
+	if got := keys(t, body); resp.StatusCode != http.StatusOK || len(got) != 202 {
+		t.Errorf("expected 202 keys, got %d", len(got))
+	}
+	for _, key := range []string{"ttl", "sliding"} {
+		resp, body := p.request("GET", "/keys/"+key+"/ttl", "", nil)
+		if resp.StatusCode != http.StatusOK || !strings.Contains(body, `"expire_in":60`) && !strings.Contains(body, `"expire_in":59`) {
+			t.Errorf("expected expiration of %s to be kept, got %d %s", key, resp.StatusCode, body)
+		}
+	}
+	if resp, _ := p.request("GET", "/keys/ttl", "", nil); resp.Header.Get("Content-Type") != "text/plain" {
+		t.Errorf("expected content type to be kept, got %v", resp.Header)
+	}
+
+	// keys of the leaving shard are moved to others
+	leaving := p.shards[0].server.URL
+	resp, _ = p.request("DELETE", "/shards?url="+url.QueryEscape(leaving), "", nil)
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("unexpected status code: %d", resp.StatusCode)
+	}
+	p.waitRebalanced()
+	s := p.status()
+	sort.Strings(s.Shards)
+	if len(s.Shards) != 2 || s.Shards[0] == leaving || s.Shards[1] == leaving {
+		t.Fatalf("unexpected shards: %v", s.Shards)
+	}
+	p.checkPlacement(202)
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		body   string
+		status int
+	}{
+		{name: "join twice", method: "POST", path: "/shards", body: fmt.Sprintf(`{"url":"%s"}`, added.server.URL), status: http.StatusConflict},
+		{name: "join unavailable", method: "POST", path: "/shards", body: `{"url":"http://127.0.0.1:1"}`, status: http.StatusBadGateway},
+		{name: "join without url", method: "POST", path: "/shards", body: `{}`, status: http.StatusBadRequest},
+		{name: "leave unknown", method: "DELETE", path: "/shards?url=" + url.QueryEscape(leaving), status: http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if resp, body := p.request(tt.method, tt.path, tt.body, nil); resp.StatusCode != tt.status {
+				t.Errorf("expected status %d, got %d %s", tt.status, resp.StatusCode, body)
+			}
+		})
+	}
+}
+
+func TestProxyMoveExpiration(t *testing.T) {
+	p := newProxy(t, 1)
+	defer p.close()
+	p.request("PUT", "/keys/ttl?expire_in=60", "value", nil)
+	p.request("PUT", "/keys/sliding?expire_in=60&sliding=600", "value", nil)
+
+	// all keys are moved from the first shard to the added one
+	first := p.shards[0]
+	added := p.startShard()
+	if resp, _ := p.request("POST", "/shards", fmt.Sprintf(`{"url":"%s"}`, added.server.URL), nil); resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("unexpected status code: %d", resp.StatusCode)
+	}
+	p.waitRebalanced()
+	if resp, _ := p.request("DELETE", "/shards?url="+url.QueryEscape(first.server.URL), "", nil); resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("unexpected status code: %d", resp.StatusCode)
+	}
+	p.waitRebalanced()
+
+	for _, key := range []string{"ttl", "sliding"} {
+		record, ok := added.storage.Get(key)
+		if !ok || record.ExpirationTime == nil {
+			t.Fatalf("expected %s to be moved with expiration, got %v", key, record)
+		}
+		if left := time.Until(*record.ExpirationTime); left > time.Minute || left < 58*time.Second {
+			t.Errorf("expected remaining lifetime of %s to be kept, got %s", key, left)
+		}
+	}
+	if record, _ := added.storage.Get("sliding"); record.SlidingTTL != 10*time.Minute {
+		t.Errorf("expected sliding expiration to be kept, got %s", record.SlidingTTL)
+	}
+	if record, _ := added.storage.Get("ttl"); record.SlidingTTL != 0 {
+		t.Errorf("expected fixed expiration to be kept, got sliding %s", record.SlidingTTL)
+	}
+}
+
+func TestProxyTTLWhileMoving(t *testing.T) {
+	p := newProxy(t, 1)
+	defer p.close()
+	p.token = "secret"
+	leaving := p.startShard().server.URL
+	if resp, _ := p.request("POST", "/shards", fmt.Sprintf(`{"url":"%s"}`, leaving), nil); resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("unexpected status code: %d", resp.StatusCode)
+	}
+	p.waitRebalanced()
+	for i := 0; i < 20; i++ {
+		p.request("PUT", fmt.Sprintf("/keys/key%03d", i), "value", nil)
+	}
+	ring := proxy.NewRing(50, p.status().Shards...)
+	key := ""
+	for i := 0; i < 20 && key == ""; i++ {
+		if k := fmt.Sprintf("key%03d", i); ring.Owner(k) == leaving {
+			key = k
+		}
+	}
+	if key == "" {
+		t.Fatalf("no keys of %s", leaving)
+	}
+
+	// keys of the leaving shard stay on it, since the proxy can't read its dump
+	if resp, _ := p.request("DELETE", "/shards?url="+url.QueryEscape(leaving), "", nil); resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("unexpected status code: %d", resp.StatusCode)
+	}
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		status int
+	}{
+		{name: "read of a moved key", method: "GET", path: "/keys/" + key + "/ttl", status: http.StatusOK},
+		{name: "change of a moved key", method: "PUT", path: "/keys/" + key + "/ttl?expire_in=60", status: http.StatusConflict},
+		{name: "removal of a moved key", method: "DELETE", path: "/keys/" + key + "/ttl", status: http.StatusConflict},
+		{name: "change of a missing key", method: "PUT", path: "/keys/missing/ttl?expire_in=60", status: http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if resp, body := p.request(tt.method, tt.path, "", nil); resp.StatusCode != tt.status {
+				t.Errorf("expected status %d, got %d %s", tt.status, resp.StatusCode, body)
+			}
+		})
+	}
+	if !p.status().Rebalancing {
+		t.Errorf("expected keys to be moved yet")
+	}
+}
+
+func TestProxyWithoutShards(t *testing.T) {
+	cfg := config.Config{Proxy: config.Proxy{Shards: []string{"", " / "}}}
+	if shards := proxy.Shards(cfg.Proxy); len(shards) != 0 {
+		t.Errorf("expected blank shards to be dropped, got %v", shards)
+	}
+	log, err := zap.NewProduction()
+	if err != nil {
+		t.Errorf("error on logger init: %s", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	server := httptest.NewServer(proxy.New(ctx, log.Sugar(), cfg).Handler)
+	defer server.Close()
+
+	for _, body := range []string{`[]`, `[{"op":"delete","key":"key1"}]`} {
+		resp, err := http.Post(server.URL+"/batch", "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusServiceUnavailable {
+			t.Errorf("expected status %d for %s, got %d", http.StatusServiceUnavailable, body, resp.StatusCode)
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package proxy
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"sort"
+	"strconv"
+)
+
+// defaultVirtualNodes is a number of points of a shard on the ring
+const defaultVirtualNodes = 100
+
+// point is a position of a shard on the ring
+type point struct {
+	hash  uint32
+	shard string
+}
+
+// Ring is a consistent-hash ring of shards, it's never changed after it's built.
+// Every shard takes several points on the ring (virtual nodes), a key belongs to the shard
+// of the first point following the hash of the key. So keys are spread evenly,
+// and only keys of the points taken or freed by a shard move when the shard joins or leaves.
+type Ring struct {
+	points []point
+	shards []string
+}
+
+// NewRing builds a ring of shards with the given number of virtual nodes per shard
+func NewRing(virtualNodes int, shards ...string) *Ring {
+	if virtualNodes <= 0 {
+		virtualNodes = defaultVirtualNodes
+	}
+	r := &Ring{shards: make([]string, 0, len(shards))}
+	seen := make(map[string]bool, len(shards))
+	for _, shard := range shards {
+		if seen[shard] {
+			continue
+		}
+		seen[shard] = true
+		r.shards = append(r.shards, shard)
+		for i := 0; i < virtualNodes; i++ {
+			r.points = append(r.points, point{hash: hash(shard + "#" + strconv.Itoa(i)), shard: shard})
+		}
+	}
+	sort.Strings(r.shards)
+	// shards are compared on equal hashes, so the ring doesn't depend on the order of shards
+	sort.Slice(r.points, func(i, j int) bool {
+		if r.points[i].hash != r.points[j].hash {
+			return r.points[i].hash < r.points[j].hash
+		}
+		return r.points[i].shard < r.points[j].shard
+	})
+	return r
+}
+
+// Owner returns the shard the key belongs to, it's empty for an empty ring
+func (r *Ring) Owner(key string) string {
+	if len(r.points) == 0 {
+		return ""
+	}
+	h := hash(key)
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i].hash >= h })
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.points[i].shard
+}
+
+// Shards returns sorted shards of the ring
+func (r *Ring) Shards() []string {
+	shards := make([]string, len(r.shards))
+	copy(shards, r.shards)
+	return shards
+}
+
+// Has checks if the shard is on the ring
+func (r *Ring) Has(shard string) bool {
+	i := sort.SearchStrings(r.shards, shard)
+	return i < len(r.shards) && r.shards[i] == shard
+}
+
+// hash is the first 4 bytes of MD5, it's spread well even for similar keys
+func hash(s string) uint32 {
+	sum := md5.Sum([]byte(s))
+	return binary.BigEndian.Uint32(sum[:4])
+}
@@ -0,0 +1,80 @@
+package proxy
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestRingOwner(t *testing.T) {
+	shards := []string{"http://a", "http://b", "http://c"}
+	ring := NewRing(100, shards...)
+	// the ring doesn't depend on the order of shards
+	reversed := NewRing(100, "http://c", "http://b", "http://a", "http://a")
+
+	counts := make(map[string]int)
+	for i := 0; i < 10000; i++ {
+		key := fmt.Sprintf("key%d", i)
+		owner := ring.Owner(key)
+		if owner != reversed.Owner(key) {
+			t.Fatalf("owner of %s depends on the order of shards", key)
+		}
+		counts[owner]++
+	}
+	for _, shard := range shards {
+		// every shard gets about a third of keys
+		if counts[shard] < 2500 || counts[shard] > 4200 {
+			t.Errorf("unexpected share of %s: %d of 10000", shard, counts[shard])
+		}
+	}
+
+	if owner := NewRing(100).Owner("key"); owner != "" {
+		t.Errorf("expected no owner on an empty ring, got %s", owner)
+	}
+	if !ring.Has("http://b") || ring.Has("http://d") {
+		t.Errorf("unexpected shards: %v", ring.Shards())
+	}
+}
+
+func TestRingMovement(t *testing.T) {
+	tests := []struct {
+		name   string
+		before []string
+		after  []string
+		// moved keys are only those which go to the new shard or leave the removed one
+		shard string
+	}{
+		{
+			name:   "join",
+			before: []string{"http://a", "http://b", "http://c"},
+			after:  []string{"http://a", "http://b", "http://c", "http://d"},
+			shard:  "http://d",
+		},
+		{
+			name:   "leave",
+			before: []string{"http://a", "http://b", "http://c"},
+			after:  []string{"http://a", "http://c"},
+			shard:  "http://b",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before, after := NewRing(100, tt.before...), NewRing(100, tt.after...)
+			moved := 0
+			for i := 0; i < 10000; i++ {
+				key := fmt.Sprintf("key%d", i)
+				from, to := before.Owner(key), after.Owner(key)
+				if from == to {
+					continue
+				}
+				moved++
+				if from != tt.shard && to != tt.shard {
+					t.Fatalf("key %s moved from %s to %s", key, from, to)
+				}
+			}
+			// about a quarter of keys go to the fourth shard and a third leaves one of three shards
+			if moved < 1500 || moved > 4200 {
+				t.Errorf("unexpected number of moved keys: %d of 10000", moved)
+			}
+		})
+	}
+}
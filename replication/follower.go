@@ -0,0 +1,428 @@
+package replication
+
+// Follower replicates a leader by WAL shipping.
+// It reads changes of the leader from GET /changes starting after the last sequence number it has,
+// writes them into its own log with the same sequence numbers and serves only reads.
+// When the changes it needs are compacted by the leader, it restores all records from
+// GET /replication/dump and goes on from there. Lag is tracked with heartbeats of the leader
+// which carry its last sequence number.
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/filatovw/ni-storage/config"
+	"github.com/filatovw/ni-storage/engine"
+	"github.com/filatovw/ni-storage/logger"
+	"github.com/pkg/errors"
+)
+
+const (
+	// RoleLeader accepts writes
+	RoleLeader = "leader"
+	// RoleFollower replicates a leader and serves only reads
+	RoleFollower = "follower"
+
+	// EventHeartbeat is sent by a leader to followers, its data is Heartbeat
+	EventHeartbeat = "heartbeat"
+)
+
+var (
+	defaultRetryPeriod = time.Second
+	// maxApplyBatch is a number of changes applied at once when a follower catches up
+	maxApplyBatch = 1024
+)
+
+// Heartbeat tells followers the last sequence number of a leader
+type Heartbeat struct {
+	Seq uint64 `json:"seq"`
+}
+
+// Status of replication
+type Status struct {
+	Role string `json:"role"`
+	// Leader is URL of the leader, it's set for followers
+	Leader string `json:"leader,omitempty"`
+	// Connected tells if a follower receives changes of the leader
+	Connected bool `json:"connected,omitempty"`
+	// Seq is the sequence number of the last change of the node
+	Seq uint64 `json:"seq"`
+	// LeaderSeq is the last sequence number of the leader known to a follower
+	LeaderSeq uint64 `json:"leader_seq,omitempty"`
+	// LagSeq is a number of changes a follower falls behind
+	LagSeq uint64 `json:"lag_seq"`
+	// LagSeconds is the time passed since a follower was in sync with the leader
+	LagSeconds float64 `json:"lag_seconds"`
+}
+
+// Replica is a storage which applies changes of a leader
+type Replica interface {
+	engine.Storage
+	// Apply writes changes of a leader keeping their sequence numbers
+	Apply(context.Context, ...engine.Event) error
+	// Restore replaces all records with a dump of a leader
+	Restore(engine.Dump) error
+	// SetFollower switches the storage into follower mode and back
+	SetFollower(bool)
+}
+
+// Follower is a read-only storage which replicates a leader until it's promoted
+type Follower struct {
+	Replica
+	log         logger.Logger
+	leader      string
+	token       string
+	client      *http.Client
+	retryPeriod time.Duration
+
+	lock *sync.Mutex
+	// leaderSeq is the last sequence number of the leader known so far
+	leaderSeq uint64
+	// synced is the last time the follower was in sync with the leader
+	synced    time.Time
+	connected bool
+	promoted  bool
+	// cancel stops replication, done is closed when it's stopped
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// NewFollower starts replication of the leader of the config until the context is done or the follower is promoted
+func NewFollower(ctx context.Context, log logger.Logger, replica Replica, cfg config.Replication) *Follower {
+	ctx, cancel := context.WithCancel(ctx)
+	replica.SetFollower(true)
+	f := &Follower{
+		Replica:     replica,
+		log:         log,
+		leader:      strings.TrimRight(cfg.Leader, "/"),
+		token:       cfg.Token,
+		client:      &http.Client{},
+		retryPeriod: defaultRetryPeriod,
+		lock:        &sync.Mutex{},
+		synced:      time.Now(),
+		cancel:      cancel,
+		done:        make(chan struct{}),
+	}
+	go f.run(ctx)
+	return f
+}
+
+// run replicates the leader, reconnecting after failures
+func (f *Follower) run(ctx context.Context) {
+	defer close(f.done)
+	for {
+		err := f.follow(ctx)
+		f.setConnected(false)
+		if ctx.Err() != nil {
+			return
+		}
+		if errors.Cause(err) == engine.ErrCompacted {
+			f.log.Infof("changes after %d are compacted by the leader, restoring records", f.Seq())
+			if err = f.restore(ctx); err == nil {
+				continue
+			}
+		}
+		f.log.Errorf("replication failed: %s", err)
+		select {
+		case <-time.After(f.retryPeriod):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// follow applies changes of the leader until the stream breaks
+func (f *Follower) follow(ctx context.Context) error {
+	url := fmt.Sprintf("%s/changes?since=%d", f.leader, f.Seq())
+	resp, err := f.get(ctx, url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusGone:
+		return engine.ErrCompacted
+	default:
+		return errors.Errorf("leader responded with %s", resp.Status)
+	}
+	f.setConnected(true)
+	f.log.Infof("following %s since %d", f.leader, f.Seq())
+
+	r := bufio.NewReader(resp.Body)
+	batch := []engine.Event{}
+	for {
+		msg, err := readMessage(r)
+		if err != nil {
+			return errors.Wrap(err, "read changes")
+		}
+		switch msg.event {
+		case "":
+			// keep-alive comment
+			continue
+		case EventHeartbeat:
+			var hb Heartbeat
+			if err := json.Unmarshal([]byte(msg.data), &hb); err != nil {
+				return errors.Wrap(err, "decode heartbeat")
+			}
+			f.observe(hb.Seq)
+		case string(engine.EventOverflow):
+			return errors.New("follower falls behind the leader")
+		default:
+			change, err := msg.change()
+			if err != nil {
+				return err
+			}
+			batch = append(batch, change)
+			f.observe(change.Seq)
+		}
+		// changes which have already arrived are applied at once
+		if len(batch) > 0 && (r.Buffered() == 0 || len(batch) >= maxApplyBatch) {
+			if err := f.Apply(ctx, batch...); err != nil {
+				return errors.Wrap(err, "apply changes")
+			}
+			batch = batch[:0]
+		}
+		f.checkSync()
+	}
+}
+
+// restore replaces records with a dump of the leader
+func (f *Follower) restore(ctx context.Context) error {
+	resp, err := f.get(ctx, f.leader+"/replication/dump")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return errors.Errorf("leader responded with %s", resp.Status)
+	}
+	var dump engine.Dump
+	if err := json.NewDecoder(resp.Body).Decode(&dump); err != nil {
+		return errors.Wrap(err, "decode dump")
+	}
+	if err := f.Restore(dump); err != nil {
+		return errors.Wrap(err, "restore dump")
+	}
+	f.observe(dump.Seq)
+	f.checkSync()
+	f.log.Infof("restored %d records at %d", len(dump.Records), dump.Seq)
+	return nil
+}
+
+// get requests the leader with the replication token
+func (f *Follower) get(ctx context.Context, url string) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "build request")
+	}
+	if f.token != "" {
+		req.Header.Set("Authorization", "Bearer "+f.token)
+	}
+	resp, err := f.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, errors.Wrap(err, "connect to leader")
+	}
+	return resp, nil
+}
+
+func (f *Follower) setConnected(connected bool) {
+	f.lock.Lock()
+	f.connected = connected
+	f.lock.Unlock()
+}
+
+// observe remembers the sequence number of the leader
+func (f *Follower) observe(seq uint64) {
+	f.lock.Lock()
+	if seq > f.leaderSeq {
+		f.leaderSeq = seq
+	}
+	f.lock.Unlock()
+}
+
+// checkSync remembers the time when all known changes of the leader are applied
+func (f *Follower) checkSync() {
+	seq := f.Seq()
+	f.lock.Lock()
+	if seq >= f.leaderSeq {
+		f.synced = time.Now()
+	}
+	f.lock.Unlock()
+}
+
+// Status returns role of the node and lag of replication
+func (f *Follower) Status() Status {
+	seq := f.Seq()
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.promoted {
+		return Status{Role: RoleLeader, Seq: seq}
+	}
+	status := Status{
+		Role:      RoleFollower,
+		Leader:    f.leader,
+		Connected: f.connected,
+		Seq:       seq,
+		LeaderSeq: f.leaderSeq,
+	}
+	if f.leaderSeq > seq {
+		status.LagSeq = f.leaderSeq - seq
+		status.LagSeconds = time.Since(f.synced).Seconds()
+	}
+	return status
+}
+
+// Promote stops replication and makes the follower accept writes.
+// The old leader is not stopped, it's up to an operator to make sure it doesn't accept writes anymore.
+func (f *Follower) Promote() error {
+	f.cancel()
+	<-f.done
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if !f.promoted {
+		f.Replica.SetFollower(false)
+		f.promoted = true
+		f.log.Infof("promoted to leader at %d", f.Replica.Seq())
+	}
+	return nil
+}
+
+// writable checks if the follower is promoted
+func (f *Follower) writable() error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if !f.promoted {
+		return engine.ErrReadOnly
+	}
+	return nil
+}
+
+// Set save record in a storage
+func (f *Follower) Set(ctx context.Context, record engine.Record) error {
+	if err := f.writable(); err != nil {
+		return err
+	}
+	return f.Replica.Set(ctx, record)
+}
+
+// CompareAndSet save record if the current state of the record satisfies the condition
+func (f *Follower) CompareAndSet(ctx context.Context, record engine.Record, cond engine.Condition) error {
+	if err := f.writable(); err != nil {
+		return err
+	}
+	return f.Replica.CompareAndSet(ctx, record, cond)
+}
+
+// Delete remove record with defined key
+func (f *Follower) Delete(ctx context.Context, key string) error {
+	if err := f.writable(); err != nil {
+		return err
+	}
+	return f.Replica.Delete(ctx, key)
+}
+
+// CompareAndDelete remove record if its current state satisfies the condition
+func (f *Follower) CompareAndDelete(ctx context.Context, key string, cond engine.Condition) error {
+	if err := f.writable(); err != nil {
+		return err
+	}
+	return f.Replica.CompareAndDelete(ctx, key, cond)
+}
+
+// DeleteAll remove all records
+func (f *Follower) DeleteAll(ctx context.Context) error {
+	if err := f.writable(); err != nil {
+		return err
+	}
+	return f.Replica.DeleteAll(ctx)
+}
+
+// Batch applies all operations atomically
+func (f *Follower) Batch(ctx context.Context, ops []engine.Op) error {
+	if err := f.writable(); err != nil {
+		return err
+	}
+	return f.Replica.Batch(ctx, ops)
+}
+
+// Expire changes expiration time of a record
+func (f *Follower) Expire(ctx context.Context, key string, until time.Time) error {
+	if err := f.writable(); err != nil {
+		return err
+	}
+	return f.Replica.Expire(ctx, key, until)
+}
+
+// Persist removes expiration time of a record
+func (f *Follower) Persist(ctx context.Context, key string) error {
+	if err := f.writable(); err != nil {
+		return err
+	}
+	return f.Replica.Persist(ctx, key)
+}
+
+// message is a server-sent event
+type message struct {
+	id    string
+	event string
+	data  string
+}
+
+// change decodes change of a record sent by GET /changes
+func (m message) change() (engine.Event, error) {
+	seq, err := strconv.ParseUint(m.id, 10, 64)
+	if err != nil {
+		return engine.Event{}, errors.Wrapf(err, "parse id of %s change", m.event)
+	}
+	change := engine.Event{Type: engine.EventType(m.event), Seq: seq}
+	if err := json.Unmarshal([]byte(m.data), &change.Record); err != nil {
+		return change, errors.Wrapf(err, "decode %s change", m.event)
+	}
+	return change, nil
+}
+
+// readMessage reads lines of a server-sent event until an empty line, comments give a message without event
+func readMessage(r *bufio.Reader) (message, error) {
+	var msg message
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return msg, err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if line == "" {
+			return msg, nil
+		}
+		if strings.HasPrefix(line, ":") {
+			continue
+		}
+		field, value := line, ""
+		if i := strings.Index(line, ":"); i >= 0 {
+			field, value = line[:i], strings.TrimPrefix(line[i+1:], " ")
+		}
+		switch field {
+		case "id":
+			msg.id = value
+		case "event":
+			msg.event = value
+		case "data":
+			if msg.data != "" {
+				msg.data += "\n"
+			}
+			msg.data += value
+		}
+	}
+}
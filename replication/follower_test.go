@@ -0,0 +1,258 @@
+package replication_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/filatovw/ni-storage/api"
+	"github.com/filatovw/ni-storage/config"
+	"github.com/filatovw/ni-storage/engine"
+	"github.com/filatovw/ni-storage/engine/narwal"
+	"github.com/filatovw/ni-storage/replication"
+)
+
+// node is an API server with its own storage
+type node struct {
+	storage *narwal.Narwal
+	server  *httptest.Server
+	cancel  context.CancelFunc
+}
+
+func (n *node) stop() {
+	// streams of changes are over when the context is done, so the server doesn't wait for them
+	n.cancel()
+	n.server.Close()
+}
+
+// startNode starts a leader or a follower of the leader when its URL is set
+func startNode(t *testing.T, dir, leader string) *node {
+	t.Helper()
+	return startReplica(t, dir, config.Replication{Leader: leader})
+}
+
+// startReplica starts a node with the replication config
+func startReplica(t *testing.T, dir string, cfg config.Replication) *node {
+	t.Helper()
+	log, err := zap.NewProduction()
+	if err != nil {
+		t.Errorf("error on logger init: %s", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	storage, err := narwal.New(ctx, config.NarWAL{DataDir: dir, Follower: cfg.Leader != ""}, log.Sugar())
+	if err != nil {
+		t.Fatalf("create engine: %s", err)
+	}
+	var service engine.Storage = storage
+	if cfg.Leader != "" {
+		service = replication.NewFollower(ctx, log.Sugar(), storage, cfg)
+	}
+	server := httptest.NewServer(api.New(ctx, log.Sugar(), service, config.Config{Replication: cfg}).Handler)
+	return &node{storage: storage, server: server, cancel: cancel}
+}
+
+func tempDir(t *testing.T) string {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "replication_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func request(t *testing.T, method, url, body string) (int, string) {
+	t.Helper()
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, string(data)
+}
+
+func status(t *testing.T, n *node) replication.Status {
+	t.Helper()
+	code, body := request(t, "GET", n.server.URL+"/replication/status", "")
+	if code != http.StatusOK {
+		t.Fatalf("unexpected status code: %d", code)
+	}
+	var s replication.Status
+	if err := json.Unmarshal([]byte(body), &s); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	return s
+}
+
+// waitFor checks the condition until it holds or the time is out
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// hasValue checks if the node returns the value of the key, empty value means the key is absent
+func hasValue(t *testing.T, n *node, key, value string) func() bool {
+	return func() bool {
+		code, body := request(t, "GET", n.server.URL+"/keys/"+key, "")
+		if value == "" {
+			return code == http.StatusNotFound
+		}
+		return code == http.StatusOK && body == value
+	}
+}
+
+func TestFollower(t *testing.T) {
+	leaderDir, followerDir := tempDir(t), tempDir(t)
+	defer os.RemoveAll(leaderDir)
+	defer os.RemoveAll(followerDir)
+	leader := startNode(t, leaderDir, "")
+	defer leader.stop()
+
+	request(t, "PUT", leader.server.URL+"/keys/key1", "value1")
+	request(t, "PUT", leader.server.URL+"/keys/key2", "value2")
+	request(t, "DELETE", leader.server.URL+"/keys/key1", "")
+
+	follower := startNode(t, followerDir, leader.server.URL)
+	waitFor(t, "replication of stored changes", hasValue(t, follower, "key2", "value2"))
+	waitFor(t, "replication of removal", hasValue(t, follower, "key1", ""))
+
+	// new changes are streamed
+	request(t, "PUT", leader.server.URL+"/keys/key3", "value3")
+	waitFor(t, "replication of new changes", hasValue(t, follower, "key3", "value3"))
+	waitFor(t, "follower to catch up", func() bool {
+		s := status(t, follower)
+		return s.Connected && s.LagSeq == 0 && s.Seq == leader.storage.Seq()
+	})
+	if s := status(t, follower); s.Role != replication.RoleFollower || s.Leader != leader.server.URL || s.LagSeconds != 0 {
+		t.Errorf("unexpected status: %+v", s)
+	}
+	if s := status(t, leader); s.Role != replication.RoleLeader || s.Seq != 4 {
+		t.Errorf("unexpected status: %+v", s)
+	}
+
+	// writes are refused
+	if code, _ := request(t, "PUT", follower.server.URL+"/keys/key4", "value4"); code != http.StatusForbidden {
+		t.Errorf("expected status %d, got %d", http.StatusForbidden, code)
+	}
+
+	// a restarted follower resumes from its last change
+	follower.stop()
+	request(t, "PUT", leader.server.URL+"/keys/key5", "value5")
+	follower = startNode(t, followerDir, leader.server.URL)
+	defer follower.stop()
+	waitFor(t, "replication after restart", hasValue(t, follower, "key5", "value5"))
+	if !hasValue(t, follower, "key3", "value3")() {
+		t.Errorf("expected key3 to survive restart")
+	}
+
+	// a promoted follower accepts writes and doesn't follow the old leader anymore
+	code, body := request(t, "POST", follower.server.URL+"/replication/promote", "")
+	if code != http.StatusOK || !strings.Contains(body, `"role":"leader"`) {
+		t.Errorf("unexpected response: %d %s", code, body)
+	}
+	if code, _ := request(t, "PUT", follower.server.URL+"/keys/key6", "value6"); code != http.StatusCreated {
+		t.Errorf("expected status %d, got %d", http.StatusCreated, code)
+	}
+	request(t, "PUT", leader.server.URL+"/keys/key7", "value7")
+	time.Sleep(100 * time.Millisecond)
+	if !hasValue(t, follower, "key7", "")() {
+		t.Errorf("expected key7 not to be replicated after promotion")
+	}
+	if s := status(t, follower); s.Role != replication.RoleLeader || s.Seq != 6 {
+		t.Errorf("unexpected status: %+v", s)
+	}
+}
+
+func TestFollowerToken(t *testing.T) {
+	leaderDir, followerDir, strangerDir := tempDir(t), tempDir(t), tempDir(t)
+	defer os.RemoveAll(leaderDir)
+	defer os.RemoveAll(followerDir)
+	defer os.RemoveAll(strangerDir)
+	leader := startReplica(t, leaderDir, config.Replication{Token: "secret"})
+	defer leader.stop()
+	request(t, "PUT", leader.server.URL+"/keys/key1", "value1")
+
+	follower := startReplica(t, followerDir, config.Replication{Leader: leader.server.URL, Token: "secret"})
+	defer follower.stop()
+	waitFor(t, "replication with the token", hasValue(t, follower, "key1", "value1"))
+
+	// changes aren't given away without the token
+	stranger := startReplica(t, strangerDir, config.Replication{Leader: leader.server.URL, Token: "wrong"})
+	defer stranger.stop()
+	time.Sleep(100 * time.Millisecond)
+	if !hasValue(t, stranger, "key1", "")() || status(t, stranger).Connected {
+		t.Errorf("expected changes not to be replicated with a wrong token")
+	}
+}
+
+func TestFollowerRestore(t *testing.T) {
+	leaderDir, followerDir := tempDir(t), tempDir(t)
+	defer os.RemoveAll(leaderDir)
+	defer os.RemoveAll(followerDir)
+	leader := startNode(t, leaderDir, "")
+	defer leader.stop()
+
+	for i := 0; i < 10; i++ {
+		request(t, "PUT", leader.server.URL+fmt.Sprintf("/keys/key%d", i), "value")
+	}
+	request(t, "DELETE", leader.server.URL+"/keys/key0", "")
+	if err := leader.storage.Compact(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	request(t, "PUT", leader.server.URL+"/keys/key10", "value")
+
+	// changes the follower needs are compacted, so it starts with a dump
+	follower := startNode(t, followerDir, leader.server.URL)
+	defer follower.stop()
+	waitFor(t, "follower to catch up", func() bool {
+		return follower.storage.Seq() == leader.storage.Seq()
+	})
+	if len(follower.storage.GetAll()) != 10 || !hasValue(t, follower, "key0", "")() || !hasValue(t, follower, "key10", "value")() {
+		t.Errorf("unexpected records: %v", follower.storage.GetAll())
+	}
+}
+
+func TestFollowerLag(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	// the leader has changes it doesn't send
+	leader := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprintf(w, "event: %s\ndata: {\"seq\":10}\n\n", replication.EventHeartbeat)
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	}))
+	follower := startNode(t, dir, leader.URL)
+	defer leader.Close()
+	defer follower.stop()
+
+	waitFor(t, "heartbeat", func() bool {
+		return status(t, follower).LeaderSeq == 10
+	})
+	time.Sleep(50 * time.Millisecond)
+	if s := status(t, follower); !s.Connected || s.LagSeq != 10 || s.LagSeconds < 0.05 {
+		t.Errorf("unexpected status: %+v", s)
+	}
+}
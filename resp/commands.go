@@ -0,0 +1,332 @@
+package resp
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/filatovw/ni-storage/engine"
+)
+
+const (
+	errSyntax     = "ERR syntax error"
+	errNotInteger = "ERR value is not an integer or out of range"
+)
+
+// command of the protocol
+type command struct {
+	// arity is a number of arguments including the name of the command, -n means n or more arguments
+	arity int
+	// read commands of a cluster node see all writes committed before them
+	read bool
+	run  func(ctx context.Context, s *Server, w *writer, args [][]byte)
+}
+
+// commands by their names in lower case
+var commands map[string]command
+
+func init() {
+	commands = map[string]command{
+		"ping":     {arity: -1, run: ping},
+		"echo":     {arity: 2, run: echo},
+		"hello":    {arity: -1, run: hello},
+		"client":   {arity: -2, run: client},
+		"select":   {arity: 2, run: selectDB},
+		"command":  {arity: -1, run: commandInfo},
+		"quit":     {arity: 1, run: quit},
+		"get":      {arity: 2, read: true, run: get},
+		"set":      {arity: -3, run: set},
+		"del":      {arity: -2, run: del},
+		"exists":   {arity: -2, read: true, run: exists},
+		"keys":     {arity: 2, read: true, run: keys},
+		"expire":   {arity: 3, run: expire},
+		"ttl":      {arity: 2, read: true, run: ttl},
+		"persist":  {arity: 2, run: persist},
+		"mget":     {arity: -2, read: true, run: mget},
+		"mset":     {arity: -3, run: mset},
+		"flushall": {arity: -1, run: flushAll},
+	}
+}
+
+func commandName(arg []byte) string {
+	return strings.ToLower(string(arg))
+}
+
+// ping replies PONG or the message (PING [message])
+func ping(ctx context.Context, s *Server, w *writer, args [][]byte) {
+	switch len(args) {
+	case 0:
+		w.status("PONG")
+	case 1:
+		w.bulk(args[0])
+	default:
+		w.error("ERR wrong number of arguments for 'ping' command")
+	}
+}
+
+// echo replies the message (ECHO message)
+func echo(ctx context.Context, s *Server, w *writer, args [][]byte) {
+	w.bulk(args[0])
+}
+
+// hello switches the protocol version and describes the server (HELLO [protover [AUTH username password] [SETNAME clientname]]).
+// Authentication isn't supported, so credentials are ignored.
+func hello(ctx context.Context, s *Server, w *writer, args [][]byte) {
+	if len(args) > 0 {
+		proto, err := strconv.Atoi(string(args[0]))
+		if err != nil {
+			w.error("ERR Protocol version is not an integer or out of range")
+			return
+		}
+		if proto != 2 && proto != 3 {
+			w.error("NOPROTO unsupported protocol version")
+			return
+		}
+		w.proto = proto
+	}
+	w.dict(5)
+	w.bulk([]byte("server"))
+	w.bulk([]byte("ni-storage"))
+	w.bulk([]byte("proto"))
+	w.integer(int64(w.proto))
+	w.bulk([]byte("mode"))
+	w.bulk([]byte("standalone"))
+	w.bulk([]byte("role"))
+	w.bulk([]byte("master"))
+	w.bulk([]byte("modules"))
+	w.array(0)
+}
+
+// client accepts names and info clients send about themselves (CLIENT SETNAME name, CLIENT SETINFO attr value)
+func client(ctx context.Context, s *Server, w *writer, args [][]byte) {
+	switch commandName(args[0]) {
+	case "setname", "setinfo":
+		w.status("OK")
+	default:
+		w.error("ERR unknown subcommand '" + string(args[0]) + "'")
+	}
+}
+
+// selectDB accepts only the default database, the storage has no others (SELECT index)
+func selectDB(ctx context.Context, s *Server, w *writer, args [][]byte) {
+	if string(args[0]) != "0" {
+		w.error("ERR DB index is out of range")
+		return
+	}
+	w.status("OK")
+}
+
+// commandInfo describes no commands, so clients don't rely on details of Redis commands (COMMAND [subcommand])
+func commandInfo(ctx context.Context, s *Server, w *writer, args [][]byte) {
+	w.array(0)
+}
+
+// quit replies OK before the connection is closed (QUIT)
+func quit(ctx context.Context, s *Server, w *writer, args [][]byte) {
+	w.status("OK")
+}
+
+// get replies the value of the key or null (GET key)
+func get(ctx context.Context, s *Server, w *writer, args [][]byte) {
+	record, ok := s.storage.Get(string(args[0]))
+	if !ok {
+		w.null()
+		return
+	}
+	w.bulk(record.Value)
+}
+
+// set saves the value (SET key value [EX seconds|PX milliseconds] [NX|XX]).
+// With NX the key must be absent and with XX it must exist, null is replied when the condition doesn't hold.
+func set(ctx context.Context, s *Server, w *writer, args [][]byte) {
+	record := engine.Record{Key: string(args[0]), Value: args[1]}
+	cond := engine.Condition{}
+	for i := 2; i < len(args); i++ {
+		switch opt := commandName(args[i]); opt {
+		case "nx", "xx":
+			if cond.Exists != nil {
+				w.error(errSyntax)
+				return
+			}
+			exists := opt == "xx"
+			cond.Exists = &exists
+		case "ex", "px":
+			if record.ExpirationTime != nil || i+1 == len(args) {
+				w.error(errSyntax)
+				return
+			}
+			i++
+			n, err := strconv.ParseInt(string(args[i]), 10, 64)
+			if err != nil {
+				w.error(errNotInteger)
+				return
+			}
+			if n <= 0 {
+				w.error("ERR invalid expire time in 'set' command")
+				return
+			}
+			unit := time.Second
+			if opt == "px" {
+				unit = time.Millisecond
+			}
+			until := time.Now().Add(time.Duration(n) * unit)
+			record.ExpirationTime = &until
+		default:
+			w.error(errSyntax)
+			return
+		}
+	}
+	err := s.storage.CompareAndSet(ctx, record, cond)
+	switch {
+	case errors.Cause(err) == engine.ErrPreconditionFailed:
+		w.null()
+	case err != nil:
+		s.renderError(w, err)
+	default:
+		w.status("OK")
+	}
+}
+
+// del removes keys and replies a number of removed ones (DEL key [key ...])
+func del(ctx context.Context, s *Server, w *writer, args [][]byte) {
+	exists := true
+	removed := int64(0)
+	for _, key := range args {
+		err := s.storage.CompareAndDelete(ctx, string(key), engine.Condition{Exists: &exists})
+		if errors.Cause(err) == engine.ErrPreconditionFailed {
+			continue
+		}
+		if err != nil {
+			s.renderError(w, err)
+			return
+		}
+		removed++
+	}
+	w.integer(removed)
+}
+
+// exists replies a number of existing keys, a key is counted as many times as it's repeated (EXISTS key [key ...])
+func exists(ctx context.Context, s *Server, w *writer, args [][]byte) {
+	n := int64(0)
+	for _, key := range args {
+		if s.storage.Exists(string(key)) {
+			n++
+		}
+	}
+	w.integer(n)
+}
+
+// keys replies keys matching the glob-style pattern in ascending order (KEYS pattern)
+func keys(ctx context.Context, s *Server, w *writer, args [][]byte) {
+	pattern := string(args[0])
+	matched := []string{}
+	s.storage.Scan(engine.Range{Prefix: literalPrefix(pattern)}, func(record engine.Record) bool {
+		if match(pattern, record.Key) {
+			matched = append(matched, record.Key)
+		}
+		return true
+	})
+	w.array(len(matched))
+	for _, key := range matched {
+		w.bulk([]byte(key))
+	}
+}
+
+// expire sets lifetime of the key in seconds, it replies 1 or 0 when the key doesn't exist (EXPIRE key seconds)
+func expire(ctx context.Context, s *Server, w *writer, args [][]byte) {
+	seconds, err := strconv.ParseInt(string(args[1]), 10, 64)
+	if err != nil {
+		w.error(errNotInteger)
+		return
+	}
+	err = s.storage.Expire(ctx, string(args[0]), time.Now().Add(time.Duration(seconds)*time.Second))
+	switch {
+	case errors.Cause(err) == engine.ErrNotFound:
+		w.integer(0)
+	case err != nil:
+		s.renderError(w, err)
+	default:
+		w.integer(1)
+	}
+}
+
+// ttl replies remaining lifetime of the key in seconds, -1 for a permanent key and -2 for a missing one (TTL key)
+func ttl(ctx context.Context, s *Server, w *writer, args [][]byte) {
+	until, ok := s.storage.TTL(string(args[0]))
+	switch {
+	case !ok:
+		w.integer(-2)
+	case until == nil:
+		w.integer(-1)
+	default:
+		left := time.Until(*until)
+		if left < 0 {
+			left = 0
+		}
+		w.integer(int64((left + time.Second/2) / time.Second))
+	}
+}
+
+// persist removes lifetime of the key, it replies 0 when the key doesn't exist or is permanent already (PERSIST key)
+func persist(ctx context.Context, s *Server, w *writer, args [][]byte) {
+	key := string(args[0])
+	if until, ok := s.storage.TTL(key); !ok || until == nil {
+		w.integer(0)
+		return
+	}
+	err := s.storage.Persist(ctx, key)
+	switch {
+	case errors.Cause(err) == engine.ErrNotFound:
+		w.integer(0)
+	case err != nil:
+		s.renderError(w, err)
+	default:
+		w.integer(1)
+	}
+}
+
+// mget replies values of the keys, null for missing ones (MGET key [key ...])
+func mget(ctx context.Context, s *Server, w *writer, args [][]byte) {
+	w.array(len(args))
+	for _, key := range args {
+		record, ok := s.storage.Get(string(key))
+		if !ok {
+			w.null()
+			continue
+		}
+		w.bulk(record.Value)
+	}
+}
+
+// mset saves values of all keys atomically (MSET key value [key value ...])
+func mset(ctx context.Context, s *Server, w *writer, args [][]byte) {
+	if len(args)%2 != 0 {
+		w.error("ERR wrong number of arguments for 'mset' command")
+		return
+	}
+	ops := make([]engine.Op, 0, len(args)/2)
+	for i := 0; i < len(args); i += 2 {
+		ops = append(ops, engine.Op{Type: engine.OpSet, Record: engine.Record{Key: string(args[i]), Value: args[i+1]}})
+	}
+	if err := s.storage.Batch(ctx, ops); err != nil {
+		s.renderError(w, err)
+		return
+	}
+	w.status("OK")
+}
+
+// flushAll removes all keys (FLUSHALL [ASYNC|SYNC])
+func flushAll(ctx context.Context, s *Server, w *writer, args [][]byte) {
+	if len(args) > 1 || len(args) == 1 && commandName(args[0]) != "async" && commandName(args[0]) != "sync" {
+		w.error(errSyntax)
+		return
+	}
+	if err := s.storage.DeleteAll(ctx); err != nil {
+		s.renderError(w, err)
+		return
+	}
+	w.status("OK")
+}
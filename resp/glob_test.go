@@ -0,0 +1,52 @@
+package resp
+
+import "testing"
+
+func TestMatch(t *testing.T) {
+	tests := []struct {
+		pattern string
+		s       string
+		match   bool
+	}{
+		{pattern: "*", s: "", match: true},
+		{pattern: "*", s: "anything", match: true},
+		{pattern: "h?llo", s: "hello", match: true},
+		{pattern: "h?llo", s: "hllo", match: false},
+		{pattern: "h*llo", s: "heeeello", match: true},
+		{pattern: "h*llo", s: "hello world", match: false},
+		{pattern: "h[ae]llo", s: "hallo", match: true},
+		{pattern: "h[ae]llo", s: "hillo", match: false},
+		{pattern: "h[^e]llo", s: "hallo", match: true},
+		{pattern: "h[^e]llo", s: "hello", match: false},
+		{pattern: "h[a-b]llo", s: "hbllo", match: true},
+		{pattern: "h[b-a]llo", s: "hallo", match: true},
+		{pattern: "h[a-b]llo", s: "hcllo", match: false},
+		{pattern: `h\*llo`, s: "h*llo", match: true},
+		{pattern: `h\*llo`, s: "hello", match: false},
+		{pattern: "user:*:name", s: "user:42:name", match: true},
+		{pattern: "user:**", s: "user:", match: true},
+		{pattern: "key", s: "key1", match: false},
+	}
+	for _, tt := range tests {
+		if got := match(tt.pattern, tt.s); got != tt.match {
+			t.Errorf("match(%q, %q): expected %t, got %t", tt.pattern, tt.s, tt.match, got)
+		}
+	}
+}
+
+func TestLiteralPrefix(t *testing.T) {
+	tests := map[string]string{
+		"*":         "",
+		"user:*":    "user:",
+		"user:?":    "user:",
+		"a[bc]":     "a",
+		`a\*b*`:     "a*b",
+		"plain":     "plain",
+		`trailing\`: `trailing\`,
+	}
+	for pattern, expected := range tests {
+		if got := literalPrefix(pattern); got != expected {
+			t.Errorf("literalPrefix(%q): expected %q, got %q", pattern, expected, got)
+		}
+	}
+}
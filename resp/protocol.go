@@ -0,0 +1,159 @@
+package resp
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"strconv"
+
+	"github.com/filatovw/ni-storage/engine"
+)
+
+const (
+	// maxBulkLength limits a single argument of a command, values larger than a record aren't stored anyway
+	maxBulkLength = engine.MaxRecordSize
+	// maxArgs limits a number of arguments of a command
+	maxArgs = 1 << 20
+	// maxInlineLength limits a command sent as a line of text
+	maxInlineLength = 64 << 10
+)
+
+// protocolError is returned when a client breaks the protocol, the connection is closed after it
+type protocolError string
+
+func (e protocolError) Error() string {
+	return "Protocol error: " + string(e)
+}
+
+// readCommand reads a command sent as an array of bulk strings (the way clients do)
+// or as a line of text separated by spaces (the way a user types it in telnet)
+func readCommand(r *bufio.Reader) ([][]byte, error) {
+	line, err := readLine(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 || line[0] != '*' {
+		return bytes.Fields(line), nil
+	}
+	n, err := strconv.Atoi(string(line[1:]))
+	if err != nil || n > maxArgs {
+		return nil, protocolError("invalid multibulk length")
+	}
+	if n <= 0 {
+		return nil, nil
+	}
+	// memory is taken as arguments arrive rather than by lengths announced in headers
+	args := [][]byte{}
+	for i := 0; i < n; i++ {
+		line, err := readLine(r)
+		if err != nil {
+			return nil, err
+		}
+		if len(line) == 0 {
+			return nil, protocolError("expected '$', got an empty line")
+		}
+		if line[0] != '$' {
+			return nil, protocolError(fmt.Sprintf("expected '$', got '%c'", line[0]))
+		}
+		size, err := strconv.Atoi(string(line[1:]))
+		if err != nil || size < 0 || size > maxBulkLength {
+			return nil, protocolError("invalid bulk length")
+		}
+		var buf bytes.Buffer
+		if _, err := io.CopyN(&buf, r, int64(size)+2); err != nil {
+			return nil, err
+		}
+		arg := buf.Bytes()
+		if arg[size] != '\r' || arg[size+1] != '\n' {
+			return nil, protocolError("bulk string isn't terminated")
+		}
+		args = append(args, arg[:size])
+	}
+	return args, nil
+}
+
+// readLine reads a line terminated by CRLF (or LF in inline commands) without the terminator
+func readLine(r *bufio.Reader) ([]byte, error) {
+	line := []byte{}
+	for {
+		chunk, isPrefix, err := r.ReadLine()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, chunk...)
+		if len(line) > maxInlineLength {
+			return nil, protocolError("too big inline request")
+		}
+		if !isPrefix {
+			return line, nil
+		}
+	}
+}
+
+// writer encodes replies in the protocol version chosen by a client, RESP2 unless it's switched with HELLO 3
+type writer struct {
+	*bufio.Writer
+	proto int
+}
+
+func newWriter(w io.Writer) *writer {
+	return &writer{Writer: bufio.NewWriter(w), proto: 2}
+}
+
+// status writes a simple string
+func (w *writer) status(s string) {
+	w.WriteByte('+')
+	w.WriteString(s)
+	w.WriteString("\r\n")
+}
+
+// error writes an error, its message starts with a code like ERR or WRONGTYPE
+func (w *writer) error(msg string) {
+	w.WriteByte('-')
+	w.WriteString(msg)
+	w.WriteString("\r\n")
+}
+
+// integer writes a number
+func (w *writer) integer(n int64) {
+	w.WriteByte(':')
+	w.WriteString(strconv.FormatInt(n, 10))
+	w.WriteString("\r\n")
+}
+
+// bulk writes a binary safe string
+func (w *writer) bulk(b []byte) {
+	w.WriteByte('$')
+	w.WriteString(strconv.Itoa(len(b)))
+	w.WriteString("\r\n")
+	w.Write(b)
+	w.WriteString("\r\n")
+}
+
+// null writes a missing value
+func (w *writer) null() {
+	if w.proto == 3 {
+		w.WriteString("_\r\n")
+		return
+	}
+	w.WriteString("$-1\r\n")
+}
+
+// array writes the header of an array, n elements follow it
+func (w *writer) array(n int) {
+	w.WriteByte('*')
+	w.WriteString(strconv.Itoa(n))
+	w.WriteString("\r\n")
+}
+
+// dict writes the header of a map, n pairs of keys and values follow it. It's a flat array in RESP2.
+func (w *writer) dict(n int) {
+	if w.proto == 3 {
+		w.WriteByte('%')
+		w.WriteString(strconv.Itoa(n))
+		w.WriteString("\r\n")
+		return
+	}
+	w.array(2 * n)
+}
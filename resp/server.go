@@ -0,0 +1,122 @@
+package resp
+
+// Redis protocol listener.
+// The server speaks RESP2, and RESP3 once a client switches to it with HELLO 3, so redis-cli and Redis clients
+// can be used with the storage. It supports commands which map onto engine.Storage, values are stored
+// without a content type. On a cluster node read commands wait for the read index first; writes of a node
+// which is not the leader reply TRYAGAIN, so a client retries them against the leader.
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/filatovw/ni-storage/cluster"
+	"github.com/filatovw/ni-storage/config"
+	"github.com/filatovw/ni-storage/engine"
+	"github.com/filatovw/ni-storage/logger"
+	"github.com/filatovw/ni-storage/tcpserver"
+)
+
+// commandTimeout limits processing of a command
+const commandTimeout = 15 * time.Second
+
+// ErrServerClosed is returned by Serve after the server is closed
+var ErrServerClosed = errors.New("resp: server closed")
+
+// Server serves RESP clients
+type Server struct {
+	*tcpserver.Server
+	ctx     context.Context
+	log     logger.Logger
+	storage engine.Storage
+}
+
+// New creates a server of the storage, commands are done until the context is done
+func New(ctx context.Context, log logger.Logger, storage engine.Storage, cfg config.RESP) *Server {
+	s := &Server{
+		ctx:     ctx,
+		log:     log,
+		storage: storage,
+	}
+	s.Server = tcpserver.New(log, cfg.Address, ErrServerClosed, s.serveConn)
+	return s
+}
+
+// serveConn runs commands of a client until it quits or breaks the protocol.
+// Replies are flushed once all commands sent so far are done, so pipelined commands are answered at once.
+func (s *Server) serveConn(conn net.Conn) {
+	s.log.Debugf("client %s connected", conn.RemoteAddr())
+	r := bufio.NewReader(conn)
+	w := newWriter(conn)
+	for {
+		args, err := readCommand(r)
+		if err != nil {
+			if _, ok := err.(protocolError); ok {
+				w.error("ERR " + err.Error())
+				w.Flush()
+			}
+			s.log.Debugf("client %s disconnected: %s", conn.RemoteAddr(), err)
+			return
+		}
+		if len(args) == 0 {
+			continue
+		}
+		quit := s.run(w, args)
+		if r.Buffered() == 0 || quit {
+			if err := w.Flush(); err != nil {
+				s.log.Debugf("client %s disconnected: %s", conn.RemoteAddr(), err)
+				return
+			}
+		}
+		if quit {
+			return
+		}
+	}
+}
+
+// run does a command and writes its reply, it tells if the client quits
+func (s *Server) run(w *writer, args [][]byte) bool {
+	name := commandName(args[0])
+	cmd, ok := commands[name]
+	if !ok {
+		w.error("ERR unknown command '" + string(args[0]) + "'")
+		return false
+	}
+	if cmd.arity > 0 && len(args) != cmd.arity || cmd.arity < 0 && len(args) < -cmd.arity {
+		w.error("ERR wrong number of arguments for '" + name + "' command")
+		return false
+	}
+	t1 := time.Now()
+	ctx, cancel := context.WithTimeout(s.ctx, commandTimeout)
+	defer cancel()
+	if cmd.read {
+		if node, ok := s.storage.(cluster.ReadIndexer); ok {
+			if err := node.ReadIndex(ctx); err != nil {
+				s.renderError(w, err)
+				return false
+			}
+		}
+	}
+	cmd.run(ctx, s, w, args[1:])
+	s.log.Debugf("served command %s in %s", name, time.Since(t1))
+	return name == "quit"
+}
+
+// renderError maps errors of a storage to error codes of Redis
+func (s *Server) renderError(w *writer, err error) {
+	switch errors.Cause(err) {
+	case engine.ErrReadOnly:
+		w.error("READONLY You can't write against a read only replica.")
+	case engine.ErrNotLeader:
+		w.error("TRYAGAIN " + err.Error())
+	case engine.ErrTooLarge, engine.ErrNoSpace, engine.ErrClosed:
+		w.error("ERR " + err.Error())
+	default:
+		s.log.Errorf("storage error: %s", err)
+		w.error("ERR " + err.Error())
+	}
+}
@@ -0,0 +1,323 @@
+package resp_test
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/filatovw/ni-storage/config"
+	"github.com/filatovw/ni-storage/engine"
+	"github.com/filatovw/ni-storage/internal/storagetest"
+	"github.com/filatovw/ni-storage/resp"
+)
+
+// status is a simple string reply
+type status string
+
+// replyError is an error reply
+type replyError string
+
+// client speaks the protocol over a raw connection
+type client struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// send writes a command as an array of bulk strings
+func (c *client) send(args ...string) {
+	c.t.Helper()
+	cmd := fmt.Sprintf("*%d\r\n", len(args))
+	for _, arg := range args {
+		cmd += fmt.Sprintf("$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if _, err := c.conn.Write([]byte(cmd)); err != nil {
+		c.t.Fatalf("unexpected error: %s", err)
+	}
+}
+
+// read decodes a reply of RESP2 or RESP3
+func (c *client) read() interface{} {
+	c.t.Helper()
+	c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		c.t.Fatalf("unexpected error: %s", err)
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	switch line[0] {
+	case '+':
+		return status(line[1:])
+	case '-':
+		return replyError(line[1:])
+	case ':':
+		n, err := strconv.ParseInt(line[1:], 10, 64)
+		if err != nil {
+			c.t.Fatalf("unexpected integer %q", line)
+		}
+		return n
+	case '_':
+		return nil
+	case '$':
+		size, _ := strconv.Atoi(line[1:])
+		if size < 0 {
+			return nil
+		}
+		data := make([]byte, size+2)
+		if _, err := io.ReadFull(c.r, data); err != nil {
+			c.t.Fatalf("unexpected error: %s", err)
+		}
+		return string(data[:size])
+	case '*':
+		n, _ := strconv.Atoi(line[1:])
+		if n < 0 {
+			return nil
+		}
+		items := []interface{}{}
+		for i := 0; i < n; i++ {
+			items = append(items, c.read())
+		}
+		return items
+	case '%':
+		n, _ := strconv.Atoi(line[1:])
+		items := map[interface{}]interface{}{}
+		for i := 0; i < n; i++ {
+			k := c.read()
+			items[k] = c.read()
+		}
+		return items
+	}
+	c.t.Fatalf("unexpected reply %q", line)
+	return nil
+}
+
+// do sends a command and reads its reply
+func (c *client) do(args ...string) interface{} {
+	c.t.Helper()
+	c.send(args...)
+	return c.read()
+}
+
+// startServer serves the storage at a random port
+func startServer(t *testing.T, storage *storagetest.Storage) (string, func()) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := resp.New(storage.Ctx, storage.Log, storage.Service, config.RESP{})
+	done := make(chan error)
+	go func() {
+		done <- server.Serve(l)
+	}()
+	return l.Addr().String(), func() {
+		server.Close()
+		if err := <-done; err != resp.ErrServerClosed {
+			t.Errorf("expected %s, got %v", resp.ErrServerClosed, err)
+		}
+		storage.Close()
+	}
+}
+
+func connect(t *testing.T, addr string) *client {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &client{t: t, conn: conn, r: bufio.NewReader(conn)}
+}
+
+func TestCommands(t *testing.T) {
+	addr, stop := startServer(t, storagetest.New(t))
+	defer stop()
+	c := connect(t, addr)
+	defer c.conn.Close()
+
+	tests := []struct {
+		args  []string
+		reply interface{}
+	}{
+		{args: []string{"PING"}, reply: status("PONG")},
+		{args: []string{"ping", "hello"}, reply: "hello"},
+		{args: []string{"ECHO", "hello"}, reply: "hello"},
+		{args: []string{"SELECT", "0"}, reply: status("OK")},
+		{args: []string{"SELECT", "1"}, reply: replyError("ERR DB index is out of range")},
+		{args: []string{"UNKNOWN"}, reply: replyError("ERR unknown command 'UNKNOWN'")},
+		{args: []string{"GET"}, reply: replyError("ERR wrong number of arguments for 'get' command")},
+
+		{args: []string{"GET", "key1"}, reply: nil},
+		{args: []string{"SET", "key1", "value1"}, reply: status("OK")},
+		{args: []string{"GET", "key1"}, reply: "value1"},
+		{args: []string{"SET", "key1", "value2", "NX"}, reply: nil},
+		{args: []string{"SET", "key1", "value2", "XX"}, reply: status("OK")},
+		{args: []string{"SET", "key2", "value2", "XX"}, reply: nil},
+		{args: []string{"SET", "key2", "value2", "nx"}, reply: status("OK")},
+		{args: []string{"SET", "key3", "bin\x00\r\nary"}, reply: status("OK")},
+		{args: []string{"GET", "key3"}, reply: "bin\x00\r\nary"},
+		{args: []string{"SET", "key1", "value", "NX", "XX"}, reply: replyError("ERR syntax error")},
+		{args: []string{"SET", "key1", "value", "EX"}, reply: replyError("ERR syntax error")},
+		{args: []string{"SET", "key1", "value", "EX", "ten"}, reply: replyError("ERR value is not an integer or out of range")},
+		{args: []string{"SET", "key1", "value", "EX", "0"}, reply: replyError("ERR invalid expire time in 'set' command")},
+		{args: []string{"SET", "key1", "value", "KEEPTTL"}, reply: replyError("ERR syntax error")},
+
+		{args: []string{"MGET", "key1", "missing", "key2"}, reply: []interface{}{"value2", nil, "value2"}},
+		{args: []string{"MSET", "user:1", "a", "user:2", "b", "user:10", "c"}, reply: status("OK")},
+		{args: []string{"MSET", "user:1", "a", "user:2"}, reply: replyError("ERR wrong number of arguments for 'mset' command")},
+		{args: []string{"EXISTS", "key1", "key1", "missing"}, reply: int64(2)},
+		{args: []string{"KEYS", "user:?"}, reply: []interface{}{"user:1", "user:2"}},
+		{args: []string{"KEYS", "user:*"}, reply: []interface{}{"user:1", "user:10", "user:2"}},
+		{args: []string{"KEYS", "*[23]"}, reply: []interface{}{"key2", "key3", "user:2"}},
+
+		{args: []string{"TTL", "key1"}, reply: int64(-1)},
+		{args: []string{"TTL", "missing"}, reply: int64(-2)},
+		{args: []string{"EXPIRE", "key1", "100"}, reply: int64(1)},
+		{args: []string{"EXPIRE", "missing", "100"}, reply: int64(0)},
+		{args: []string{"EXPIRE", "key1", "soon"}, reply: replyError("ERR value is not an integer or out of range")},
+		{args: []string{"TTL", "key1"}, reply: int64(100)},
+		{args: []string{"PERSIST", "key1"}, reply: int64(1)},
+		{args: []string{"PERSIST", "key1"}, reply: int64(0)},
+		{args: []string{"PERSIST", "missing"}, reply: int64(0)},
+		{args: []string{"TTL", "key1"}, reply: int64(-1)},
+		{args: []string{"SET", "key4", "value4", "EX", "60"}, reply: status("OK")},
+		{args: []string{"TTL", "key4"}, reply: int64(60)},
+		{args: []string{"SET", "key4", "value4", "PX", "2400"}, reply: status("OK")},
+		{args: []string{"TTL", "key4"}, reply: int64(2)},
+		{args: []string{"SET", "key4", "value4"}, reply: status("OK")},
+		{args: []string{"TTL", "key4"}, reply: int64(-1)},
+		{args: []string{"EXPIRE", "key4", "-1"}, reply: int64(1)},
+		{args: []string{"EXISTS", "key4"}, reply: int64(0)},
+
+		{args: []string{"DEL", "key1", "key2", "missing"}, reply: int64(2)},
+		{args: []string{"GET", "key1"}, reply: nil},
+		{args: []string{"FLUSHALL", "LATER"}, reply: replyError("ERR syntax error")},
+		{args: []string{"FLUSHALL", "ASYNC"}, reply: status("OK")},
+		{args: []string{"KEYS", "*"}, reply: []interface{}{}},
+		{args: []string{"QUIT"}, reply: status("OK")},
+	}
+	for _, tt := range tests {
+		if reply := c.do(tt.args...); !reflect.DeepEqual(reply, tt.reply) {
+			t.Errorf("%v: expected %#v, got %#v", tt.args, tt.reply, reply)
+		}
+	}
+	// the connection is closed after QUIT
+	if _, err := c.r.ReadByte(); err == nil {
+		t.Errorf("expected the connection to be closed")
+	}
+}
+
+func TestRESP3(t *testing.T) {
+	addr, stop := startServer(t, storagetest.New(t))
+	defer stop()
+	c := connect(t, addr)
+	defer c.conn.Close()
+
+	if reply := c.do("GET", "missing"); reply != nil {
+		t.Errorf("expected null, got %#v", reply)
+	}
+	if _, err := c.conn.Write([]byte("*2\r\n$3\r\nGET\r\n$7\r\nmissing\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	if line, _ := c.r.ReadString('\n'); line != "$-1\r\n" {
+		t.Errorf("expected RESP2 null, got %q", line)
+	}
+
+	if reply := c.do("HELLO", "4"); reply != replyError("NOPROTO unsupported protocol version") {
+		t.Errorf("unexpected reply: %#v", reply)
+	}
+	expected := map[interface{}]interface{}{
+		"server":  "ni-storage",
+		"proto":   int64(3),
+		"mode":    "standalone",
+		"role":    "master",
+		"modules": []interface{}{},
+	}
+	if reply := c.do("HELLO", "3", "AUTH", "default", "secret", "SETNAME", "test"); !reflect.DeepEqual(reply, expected) {
+		t.Errorf("expected %#v, got %#v", expected, reply)
+	}
+	c.send("GET", "missing")
+	if line, _ := c.r.ReadString('\n'); line != "_\r\n" {
+		t.Errorf("expected RESP3 null, got %q", line)
+	}
+	if reply := c.do("CLIENT", "SETINFO", "lib-name", "test"); reply != status("OK") {
+		t.Errorf("unexpected reply: %#v", reply)
+	}
+}
+
+func TestPipeline(t *testing.T) {
+	storage := storagetest.New(t)
+	addr, stop := startServer(t, storage)
+	defer stop()
+	c := connect(t, addr)
+	defer c.conn.Close()
+
+	// all commands are sent before replies are read
+	for i := 0; i < 100; i++ {
+		c.send("SET", fmt.Sprintf("key%d", i), strconv.Itoa(i))
+	}
+	for i := 0; i < 100; i++ {
+		if reply := c.read(); reply != status("OK") {
+			t.Fatalf("unexpected reply: %#v", reply)
+		}
+	}
+	if n := len(storage.GetAll()); n != 100 {
+		t.Errorf("expected 100 keys, got %d", n)
+	}
+
+	// inline commands are typed in telnet
+	if _, err := c.conn.Write([]byte("GET key42\r\nEXISTS key1 key2\n")); err != nil {
+		t.Fatal(err)
+	}
+	if reply := c.read(); reply != "42" {
+		t.Errorf("unexpected reply: %#v", reply)
+	}
+	if reply := c.read(); reply != int64(2) {
+		t.Errorf("unexpected reply: %#v", reply)
+	}
+}
+
+func TestProtocolError(t *testing.T) {
+	addr, stop := startServer(t, storagetest.New(t))
+	defer stop()
+
+	tests := []struct {
+		name  string
+		input string
+		reply replyError
+	}{
+		{name: "not a bulk string", input: "*1\r\n+GET\r\n", reply: "ERR Protocol error: expected '$', got '+'"},
+		{name: "bulk string over the record size", input: fmt.Sprintf("*1\r\n$%d\r\n", engine.MaxRecordSize+1), reply: "ERR Protocol error: invalid bulk length"},
+		{name: "too many arguments", input: "*2000000\r\n", reply: "ERR Protocol error: invalid multibulk length"},
+	}
+	for _, tt := range tests {
+		c := connect(t, addr)
+		if _, err := c.conn.Write([]byte(tt.input)); err != nil {
+			t.Fatal(err)
+		}
+		if reply := c.read(); reply != tt.reply {
+			t.Errorf("%s: unexpected reply: %#v", tt.name, reply)
+		}
+		if _, err := c.r.ReadByte(); err == nil {
+			t.Errorf("%s: expected the connection to be closed", tt.name)
+		}
+		c.conn.Close()
+	}
+}
+
+func TestReadOnly(t *testing.T) {
+	addr, stop := startServer(t, storagetest.NewReadOnly(t))
+	defer stop()
+	c := connect(t, addr)
+	defer c.conn.Close()
+
+	if reply := c.do("GET", "key1"); reply != "value1" {
+		t.Errorf("unexpected reply: %#v", reply)
+	}
+	if reply := c.do("SET", "key1", "value2"); reply != replyError("READONLY You can't write against a read only replica.") {
+		t.Errorf("unexpected reply: %#v", reply)
+	}
+}
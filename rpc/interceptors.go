@@ -0,0 +1,66 @@
+package rpc
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+
+	"github.com/filatovw/ni-storage/logger"
+)
+
+// requestTimeout limits processing of a unary request, streams last until the client is gone
+const requestTimeout = 15 * time.Second
+
+var (
+	requestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "ni_grpc_requests_total",
+		Help: "Number of served gRPC requests by method and status code.",
+	}, []string{"method", "code"})
+	requestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "ni_grpc_request_duration_seconds",
+		Help:    "Latency of served gRPC requests by method.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"method"})
+)
+
+func init() {
+	// metrics are exposed by /metrics of the HTTP API
+	prometheus.MustRegister(requestsTotal, requestDuration)
+}
+
+// observe logs a served request and updates its metrics
+func observe(l logger.Logger, method string, t1 time.Time, err error) {
+	latency := time.Since(t1)
+	code := status.Code(err)
+	requestsTotal.WithLabelValues(method, code.String()).Inc()
+	requestDuration.WithLabelValues(method).Observe(latency.Seconds())
+	l.Info("Served ",
+		"proto: grpc; ",
+		fmt.Sprintf("method: %s; ", method),
+		fmt.Sprintf("latency: %d; ", latency),
+		fmt.Sprintf("code: %s", code))
+}
+
+func unaryInterceptor(l logger.Logger) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		t1 := time.Now()
+		ctx, cancel := context.WithTimeout(ctx, requestTimeout)
+		defer cancel()
+		resp, err := handler(ctx, req)
+		observe(l, info.FullMethod, t1, err)
+		return resp, err
+	}
+}
+
+func streamInterceptor(l logger.Logger) grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		t1 := time.Now()
+		err := handler(srv, ss)
+		observe(l, info.FullMethod, t1, err)
+		return err
+	}
+}
@@ -0,0 +1,253 @@
+package rpc
+
+// gRPC listener.
+// The service is generated from storage.proto with `make proto`, it mirrors /keys routes of the HTTP API
+// on top of the same engine.Storage. Get, Exists and List of a cluster node confirm the read index unless
+// the request sets stale, and writes of a node which is not the leader fail with UNAVAILABLE.
+
+import (
+	"context"
+	"time"
+
+	"github.com/pkg/errors"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"github.com/filatovw/ni-storage/cluster"
+	"github.com/filatovw/ni-storage/engine"
+	"github.com/filatovw/ni-storage/logger"
+)
+
+// Server implements StorageServer
+type Server struct {
+	storage engine.Storage
+	log     logger.Logger
+}
+
+// New creates a gRPC server of the storage, requests are logged and measured like requests of the HTTP API
+func New(log logger.Logger, storage engine.Storage) *grpc.Server {
+	server := grpc.NewServer(
+		grpc.UnaryInterceptor(unaryInterceptor(log)),
+		grpc.StreamInterceptor(streamInterceptor(log)),
+	)
+	RegisterStorageServer(server, &Server{storage: storage, log: log})
+	return server
+}
+
+// statusError maps errors of a storage to gRPC status codes
+func (s *Server) statusError(err error) error {
+	code := codes.Internal
+	switch errors.Cause(err) {
+	case engine.ErrTooLarge, engine.ErrNoSpace:
+		code = codes.ResourceExhausted
+	case engine.ErrClosed, engine.ErrNotLeader:
+		code = codes.Unavailable
+	case engine.ErrPreconditionFailed:
+		code = codes.FailedPrecondition
+	case engine.ErrNotFound:
+		code = codes.NotFound
+	case engine.ErrReadOnly:
+		code = codes.PermissionDenied
+	default:
+		s.log.Errorf("storage error: %s", err)
+	}
+	return status.Error(code, errors.Cause(err).Error())
+}
+
+// consistent makes a cluster node serve a read after all writes committed before it, unless stale reads are allowed
+func (s *Server) consistent(ctx context.Context, stale bool) error {
+	node, ok := s.storage.(cluster.ReadIndexer)
+	if !ok || stale {
+		return nil
+	}
+	if err := node.ReadIndex(ctx); err != nil {
+		return s.statusError(err)
+	}
+	return nil
+}
+
+// expiration turns a lifetime in seconds into expiration time, zero lifetime means a permanent value
+func expiration(expireIn int64, sliding bool, now time.Time) (*time.Time, time.Duration) {
+	if expireIn == 0 {
+		return nil, 0
+	}
+	ts := now.Add(time.Duration(expireIn) * time.Second)
+	if sliding {
+		return &ts, time.Duration(expireIn) * time.Second
+	}
+	return &ts, 0
+}
+
+// unixNano returns expiration time in nanoseconds, it's 0 for permanent values
+func unixNano(t *time.Time) int64 {
+	if t == nil {
+		return 0
+	}
+	return t.UnixNano()
+}
+
+func toCondition(c *Condition) engine.Condition {
+	cond := engine.Condition{}
+	if c == nil {
+		return cond
+	}
+	switch c.Presence {
+	case Condition_PRESENT, Condition_ABSENT:
+		exists := c.Presence == Condition_PRESENT
+		cond.Exists = &exists
+	}
+	cond.Match = c.Match
+	cond.NoneMatch = c.NoneMatch
+	return cond
+}
+
+// Get returns a value with its content type and version
+func (s *Server) Get(ctx context.Context, req *GetRequest) (*Record, error) {
+	if err := s.consistent(ctx, req.Stale); err != nil {
+		return nil, err
+	}
+	record, ok := s.storage.Get(req.Key)
+	if !ok {
+		return nil, status.Error(codes.NotFound, engine.ErrNotFound.Error())
+	}
+	return &Record{
+		Key:            record.Key,
+		Value:          record.Value,
+		ContentType:    record.ContentType,
+		Version:        record.Version,
+		ExpirationTime: unixNano(record.ExpirationTime),
+	}, nil
+}
+
+// Set saves a value, expire_in sets its lifetime and the condition makes the update conditional
+func (s *Server) Set(ctx context.Context, req *SetRequest) (*SetResponse, error) {
+	if req.Key == "" {
+		return nil, status.Error(codes.InvalidArgument, "key is empty")
+	}
+	record := engine.Record{
+		Key:         req.Key,
+		Value:       req.Value,
+		ContentType: req.ContentType,
+	}
+	record.ExpirationTime, record.SlidingTTL = expiration(req.ExpireIn, req.Sliding, time.Now())
+	if err := s.storage.CompareAndSet(ctx, record, toCondition(req.Condition)); err != nil {
+		return nil, s.statusError(err)
+	}
+	return &SetResponse{}, nil
+}
+
+// Delete removes a value, the condition makes the removal conditional
+func (s *Server) Delete(ctx context.Context, req *DeleteRequest) (*DeleteResponse, error) {
+	if err := s.storage.CompareAndDelete(ctx, req.Key, toCondition(req.Condition)); err != nil {
+		return nil, s.statusError(err)
+	}
+	return &DeleteResponse{}, nil
+}
+
+// Exists checks if a value exists and returns its version
+func (s *Server) Exists(ctx context.Context, req *ExistsRequest) (*ExistsResponse, error) {
+	if err := s.consistent(ctx, req.Stale); err != nil {
+		return nil, err
+	}
+	record, ok := s.storage.Get(req.Key)
+	if !ok {
+		return &ExistsResponse{}, nil
+	}
+	return &ExistsResponse{Exists: true, Version: record.Version}, nil
+}
+
+// List streams keys in ascending order. Keys are collected before they are sent,
+// so a slow client doesn't hold the storage.
+func (s *Server) List(req *ListRequest, stream Storage_ListServer) error {
+	if err := s.consistent(stream.Context(), req.Stale); err != nil {
+		return err
+	}
+	limit := int(req.Limit)
+	var keys []string
+	if req.Filter != "" || req.ValueFilter != "" {
+		var err error
+		keys, err = engine.FilterKeys(s.storage, req.Filter, req.ValueFilter)
+		if err != nil {
+			return status.Error(codes.InvalidArgument, err.Error())
+		}
+		if limit > 0 && len(keys) > limit {
+			keys = keys[:limit]
+		}
+	} else {
+		rng := engine.Range{Prefix: req.Prefix, Start: req.Start, End: req.End}
+		s.storage.Scan(rng, func(record engine.Record) bool {
+			if limit > 0 && len(keys) == limit {
+				return false
+			}
+			keys = append(keys, record.Key)
+			return true
+		})
+	}
+	for _, key := range keys {
+		if err := stream.Send(&ListResponse{Key: key}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+var eventTypes = map[engine.EventType]WatchEvent_Type{
+	engine.EventSet:      WatchEvent_SET,
+	engine.EventDelete:   WatchEvent_DELETE,
+	engine.EventExpired:  WatchEvent_EXPIRED,
+	engine.EventExpire:   WatchEvent_EXPIRE,
+	engine.EventOverflow: WatchEvent_OVERFLOW,
+}
+
+// Watch streams changes of values with keys starting with the prefix until the client is gone.
+// A watcher which falls behind gets OVERFLOW event and the stream ends, so it has to reload the values and watch again.
+// Headers are sent once the watcher is subscribed, so a client knows no change is missed after it receives them.
+func (s *Server) Watch(req *WatchRequest, stream Storage_WatchServer) error {
+	events := s.storage.Watch(stream.Context(), req.Prefix)
+	if err := stream.SendHeader(metadata.MD{}); err != nil {
+		return err
+	}
+	for e := range events {
+		event := &WatchEvent{
+			Type:           eventTypes[e.Type],
+			Key:            e.Record.Key,
+			Version:        e.Record.Version,
+			ExpirationTime: unixNano(e.Record.ExpirationTime),
+		}
+		if err := stream.Send(event); err != nil {
+			s.log.Debugf("watcher is gone: %s", err)
+			return err
+		}
+	}
+	return nil
+}
+
+// Batch applies sets and deletes atomically, either all operations succeed or none of them
+func (s *Server) Batch(ctx context.Context, req *BatchRequest) (*BatchResponse, error) {
+	now := time.Now()
+	ops := make([]engine.Op, 0, len(req.Ops))
+	for _, v := range req.Ops {
+		if v.Key == "" {
+			return nil, status.Error(codes.InvalidArgument, "key is empty")
+		}
+		op := engine.Op{Record: engine.Record{Key: v.Key}, Condition: toCondition(v.Condition)}
+		switch v.Type {
+		case Op_SET:
+			op.Type = engine.OpSet
+			op.Record.Value = v.Value
+			op.Record.ContentType = v.ContentType
+			op.Record.ExpirationTime, op.Record.SlidingTTL = expiration(v.ExpireIn, v.Sliding, now)
+		case Op_DELETE:
+			op.Type = engine.OpDelete
+		default:
+			return nil, status.Errorf(codes.InvalidArgument, "unknown operation %s", v.Type)
+		}
+		ops = append(ops, op)
+	}
+	if err := s.storage.Batch(ctx, ops); err != nil {
+		return nil, s.statusError(err)
+	}
+	return &BatchResponse{}, nil
+}
@@ -0,0 +1,257 @@
+package rpc_test
+
+import (
+	"context"
+	"io"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/filatovw/ni-storage/engine"
+	"github.com/filatovw/ni-storage/internal/storagetest"
+	"github.com/filatovw/ni-storage/rpc"
+)
+
+// startServer serves the storage at a random port
+func startServer(t *testing.T, storage *storagetest.Storage) (rpc.StorageClient, func()) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := rpc.New(storage.Log, storage.Service)
+	done := make(chan error)
+	go func() {
+		done <- server.Serve(l)
+	}()
+	conn, err := grpc.Dial(l.Addr().String(), grpc.WithInsecure())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rpc.NewStorageClient(conn), func() {
+		conn.Close()
+		server.Stop()
+		if err := <-done; err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+		storage.Close()
+	}
+}
+
+func TestKeys(t *testing.T) {
+	client, stop := startServer(t, storagetest.New(t))
+	defer stop()
+	ctx := context.TODO()
+
+	if _, err := client.Get(ctx, &rpc.GetRequest{Key: "key1"}); status.Code(err) != codes.NotFound {
+		t.Errorf("expected %s, got %v", codes.NotFound, err)
+	}
+	if _, err := client.Set(ctx, &rpc.SetRequest{Key: "key1", Value: []byte("value1"), ContentType: "text/plain"}); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	record, err := client.Get(ctx, &rpc.GetRequest{Key: "key1"})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if record.Key != "key1" || string(record.Value) != "value1" || record.ContentType != "text/plain" || record.Version == 0 || record.ExpirationTime != 0 {
+		t.Errorf("unexpected record: %v", record)
+	}
+	exists, err := client.Exists(ctx, &rpc.ExistsRequest{Key: "key1"})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !exists.Exists || exists.Version != record.Version {
+		t.Errorf("unexpected response: %v", exists)
+	}
+
+	tests := []struct {
+		name string
+		req  *rpc.SetRequest
+		code codes.Code
+	}{
+		{
+			name: "empty key",
+			req:  &rpc.SetRequest{Value: []byte("value")},
+			code: codes.InvalidArgument,
+		},
+		{
+			name: "absent key is required",
+			req:  &rpc.SetRequest{Key: "key1", Condition: &rpc.Condition{Presence: rpc.Condition_ABSENT}},
+			code: codes.FailedPrecondition,
+		},
+		{
+			name: "stale version",
+			req:  &rpc.SetRequest{Key: "key1", Condition: &rpc.Condition{Match: []uint64{record.Version + 100}}},
+			code: codes.FailedPrecondition,
+		},
+		{
+			name: "current version",
+			req:  &rpc.SetRequest{Key: "key1", Value: []byte("value2"), Condition: &rpc.Condition{Match: []uint64{record.Version}}},
+			code: codes.OK,
+		},
+		{
+			name: "new key",
+			req:  &rpc.SetRequest{Key: "key2", Value: []byte("value2"), ExpireIn: 60, Condition: &rpc.Condition{Presence: rpc.Condition_ABSENT}},
+			code: codes.OK,
+		},
+	}
+	for _, tt := range tests {
+		if _, err := client.Set(ctx, tt.req); status.Code(err) != tt.code {
+			t.Errorf("%s: expected %s, got %v", tt.name, tt.code, err)
+		}
+	}
+
+	record, err = client.Get(ctx, &rpc.GetRequest{Key: "key2"})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if until := time.Unix(0, record.ExpirationTime); until.Before(time.Now().Add(59*time.Second)) || until.After(time.Now().Add(60*time.Second)) {
+		t.Errorf("unexpected expiration time: %s", until)
+	}
+
+	if _, err := client.Delete(ctx, &rpc.DeleteRequest{Key: "key2", Condition: &rpc.Condition{NoneMatch: []uint64{record.Version}}}); status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("expected %s, got %v", codes.FailedPrecondition, err)
+	}
+	if _, err := client.Delete(ctx, &rpc.DeleteRequest{Key: "key2"}); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	exists, err = client.Exists(ctx, &rpc.ExistsRequest{Key: "key2"})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if exists.Exists {
+		t.Errorf("expected key2 to be deleted")
+	}
+}
+
+// list reads all keys of the stream
+func list(t *testing.T, client rpc.StorageClient, req *rpc.ListRequest) []string {
+	stream, err := client.List(context.TODO(), req)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	keys := []string{}
+	for {
+		resp, err := stream.Recv()
+		if err == io.EOF {
+			return keys
+		}
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		keys = append(keys, resp.Key)
+	}
+}
+
+func TestList(t *testing.T) {
+	storage := storagetest.New(t)
+	client, stop := startServer(t, storage)
+	defer stop()
+	for k, v := range map[string]string{"user:1": "alice", "user:2": "bob", "user:10": "carol", "word": "polar", "world": "bear"} {
+		storage.Set(context.TODO(), engine.Record{Key: k, Value: []byte(v)})
+	}
+
+	tests := []struct {
+		name string
+		req  *rpc.ListRequest
+		keys []string
+	}{
+		{name: "all", req: &rpc.ListRequest{}, keys: []string{"user:1", "user:10", "user:2", "word", "world"}},
+		{name: "prefix", req: &rpc.ListRequest{Prefix: "user:"}, keys: []string{"user:1", "user:10", "user:2"}},
+		{name: "range", req: &rpc.ListRequest{Start: "user:10", End: "word"}, keys: []string{"user:10", "user:2"}},
+		{name: "limit", req: &rpc.ListRequest{Limit: 2}, keys: []string{"user:1", "user:10"}},
+		{name: "filter", req: &rpc.ListRequest{Filter: "wo$d"}, keys: []string{"word", "world"}},
+		{name: "value filter", req: &rpc.ListRequest{ValueFilter: "$o$"}, keys: []string{"user:10", "user:2", "word"}},
+		{name: "both filters", req: &rpc.ListRequest{Filter: "user:$", ValueFilter: "$o$"}, keys: []string{"user:10", "user:2"}},
+		{name: "nothing", req: &rpc.ListRequest{Prefix: "missing"}, keys: []string{}},
+	}
+	for _, tt := range tests {
+		if keys := list(t, client, tt.req); !reflect.DeepEqual(keys, tt.keys) {
+			t.Errorf("%s: expected %v, got %v", tt.name, tt.keys, keys)
+		}
+	}
+}
+
+func TestWatch(t *testing.T) {
+	storage := storagetest.New(t)
+	client, stop := startServer(t, storage)
+	defer stop()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	stream, err := client.Watch(ctx, &rpc.WatchRequest{Prefix: "user:"})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	// headers are sent once the watcher is subscribed
+	if _, err := stream.Header(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	storage.Set(context.TODO(), engine.Record{Key: "other", Value: []byte("value")})
+	storage.Set(context.TODO(), engine.Record{Key: "user:1", Value: []byte("value")})
+	storage.Delete(context.TODO(), "user:1")
+
+	expected := []rpc.WatchEvent_Type{rpc.WatchEvent_SET, rpc.WatchEvent_DELETE}
+	for _, typ := range expected {
+		e, err := stream.Recv()
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if e.Type != typ || e.Key != "user:1" || e.Version == 0 {
+			t.Errorf("expected %s of user:1, got %v", typ, e)
+		}
+	}
+}
+
+func TestBatch(t *testing.T) {
+	storage := storagetest.New(t)
+	client, stop := startServer(t, storage)
+	defer stop()
+	storage.Set(context.TODO(), engine.Record{Key: "key1", Value: []byte("value1")})
+
+	// the whole batch fails when a condition doesn't hold
+	req := &rpc.BatchRequest{Ops: []*rpc.Op{
+		{Type: rpc.Op_SET, Key: "key2", Value: []byte("value2")},
+		{Type: rpc.Op_DELETE, Key: "key1", Condition: &rpc.Condition{Presence: rpc.Condition_ABSENT}},
+	}}
+	if _, err := client.Batch(context.TODO(), req); status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("expected %s, got %v", codes.FailedPrecondition, err)
+	}
+	if storage.Exists("key2") {
+		t.Errorf("expected key2 not to be set")
+	}
+
+	req.Ops[1].Condition.Presence = rpc.Condition_PRESENT
+	if _, err := client.Batch(context.TODO(), req); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !storage.Exists("key2") || storage.Exists("key1") {
+		t.Errorf("expected key2 to be set and key1 to be deleted")
+	}
+
+	req = &rpc.BatchRequest{Ops: []*rpc.Op{{Type: rpc.Op_SET, Value: []byte("value")}}}
+	if _, err := client.Batch(context.TODO(), req); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("expected %s, got %v", codes.InvalidArgument, err)
+	}
+}
+
+func TestReadOnly(t *testing.T) {
+	client, stop := startServer(t, storagetest.NewReadOnly(t))
+	defer stop()
+
+	record, err := client.Get(context.TODO(), &rpc.GetRequest{Key: "key1"})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if string(record.Value) != "value1" {
+		t.Errorf("unexpected record: %v", record)
+	}
+	if _, err := client.Set(context.TODO(), &rpc.SetRequest{Key: "key1", Value: []byte("value2")}); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("expected %s, got %v", codes.PermissionDenied, err)
+	}
+}
@@ -0,0 +1,1421 @@
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// source: rpc/storage.proto
+
+// gRPC API of the storage, it mirrors /keys routes of the HTTP API
+
+package rpc
+
+import (
+	context "context"
+	fmt "fmt"
+	proto "github.com/golang/protobuf/proto"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+	math "math"
+)
+
+// Reference imports to suppress errors if they are not otherwise used.
+var _ = proto.Marshal
+var _ = fmt.Errorf
+var _ = math.Inf
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the proto package it is being compiled against.
+// A compilation error at this line likely means your copy of the
+// proto package needs to be updated.
+const _ = proto.ProtoPackageIsVersion3 // please upgrade the proto package
+
+type Condition_Presence int32
+
+const (
+	Condition_ANY Condition_Presence = 0
+	// PRESENT requires the key to exist
+	Condition_PRESENT Condition_Presence = 1
+	// ABSENT requires the key to be missing
+	Condition_ABSENT Condition_Presence = 2
+)
+
+var Condition_Presence_name = map[int32]string{
+	0: "ANY",
+	1: "PRESENT",
+	2: "ABSENT",
+}
+
+var Condition_Presence_value = map[string]int32{
+	"ANY":     0,
+	"PRESENT": 1,
+	"ABSENT":  2,
+}
+
+func (x Condition_Presence) String() string {
+	return proto.EnumName(Condition_Presence_name, int32(x))
+}
+
+func (Condition_Presence) EnumDescriptor() ([]byte, []int) {
+	return fileDescriptor_4fcfcf4422c0f324, []int{1, 0}
+}
+
+type WatchEvent_Type int32
+
+const (
+	WatchEvent_SET     WatchEvent_Type = 0
+	WatchEvent_DELETE  WatchEvent_Type = 1
+	WatchEvent_EXPIRED WatchEvent_Type = 2
+	// EXPIRE is sent when expiration time of a value is changed
+	WatchEvent_EXPIRE   WatchEvent_Type = 3
+	WatchEvent_OVERFLOW WatchEvent_Type = 4
+)
+
+var WatchEvent_Type_name = map[int32]string{
+	0: "SET",
+	1: "DELETE",
+	2: "EXPIRED",
+	3: "EXPIRE",
+	4: "OVERFLOW",
+}
+
+var WatchEvent_Type_value = map[string]int32{
+	"SET":      0,
+	"DELETE":   1,
+	"EXPIRED":  2,
+	"EXPIRE":   3,
+	"OVERFLOW": 4,
+}
+
+func (x WatchEvent_Type) String() string {
+	return proto.EnumName(WatchEvent_Type_name, int32(x))
+}
+
+func (WatchEvent_Type) EnumDescriptor() ([]byte, []int) {
+	return fileDescriptor_4fcfcf4422c0f324, []int{12, 0}
+}
+
+type Op_Type int32
+
+const (
+	Op_SET    Op_Type = 0
+	Op_DELETE Op_Type = 1
+)
+
+var Op_Type_name = map[int32]string{
+	0: "SET",
+	1: "DELETE",
+}
+
+var Op_Type_value = map[string]int32{
+	"SET":    0,
+	"DELETE": 1,
+}
+
+func (x Op_Type) String() string {
+	return proto.EnumName(Op_Type_name, int32(x))
+}
+
+func (Op_Type) EnumDescriptor() ([]byte, []int) {
+	return fileDescriptor_4fcfcf4422c0f324, []int{13, 0}
+}
+
+// Record is a stored value
+type Record struct {
+	Key   string `protobuf:"bytes,1,opt,name=key,proto3" json:"key,omitempty"`
+	Value []byte `protobuf:"bytes,2,opt,name=value,proto3" json:"value,omitempty"`
+	// content_type is a MIME type of the value, can be empty
+	ContentType string `protobuf:"bytes,3,opt,name=content_type,json=contentType,proto3" json:"content_type,omitempty"`
+	// version is assigned on every change, it grows monotonically
+	Version uint64 `protobuf:"varint,4,opt,name=version,proto3" json:"version,omitempty"`
+	// expiration_time is unix time in nanoseconds, it's 0 for permanent values
+	ExpirationTime       int64    `protobuf:"varint,5,opt,name=expiration_time,json=expirationTime,proto3" json:"expiration_time,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *Record) Reset()         { *m = Record{} }
+func (m *Record) String() string { return proto.CompactTextString(m) }
+func (*Record) ProtoMessage()    {}
+func (*Record) Descriptor() ([]byte, []int) {
+	return fileDescriptor_4fcfcf4422c0f324, []int{0}
+}
+
+func (m *Record) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_Record.Unmarshal(m, b)
+}
+func (m *Record) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_Record.Marshal(b, m, deterministic)
+}
+func (m *Record) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_Record.Merge(m, src)
+}
+func (m *Record) XXX_Size() int {
+	return xxx_messageInfo_Record.Size(m)
+}
+func (m *Record) XXX_DiscardUnknown() {
+	xxx_messageInfo_Record.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_Record proto.InternalMessageInfo
+
+func (m *Record) GetKey() string {
+	if m != nil {
+		return m.Key
+	}
+	return ""
+}
+
+func (m *Record) GetValue() []byte {
+	if m != nil {
+		return m.Value
+	}
+	return nil
+}
+
+func (m *Record) GetContentType() string {
+	if m != nil {
+		return m.ContentType
+	}
+	return ""
+}
+
+func (m *Record) GetVersion() uint64 {
+	if m != nil {
+		return m.Version
+	}
+	return 0
+}
+
+func (m *Record) GetExpirationTime() int64 {
+	if m != nil {
+		return m.ExpirationTime
+	}
+	return 0
+}
+
+// Condition is a precondition of a mutation, like If-Match and If-None-Match headers. Empty condition always holds.
+type Condition struct {
+	Presence Condition_Presence `protobuf:"varint,1,opt,name=presence,proto3,enum=nistorage.Condition_Presence" json:"presence,omitempty"`
+	// match lists versions one of which the value must have
+	Match []uint64 `protobuf:"varint,2,rep,packed,name=match,proto3" json:"match,omitempty"`
+	// none_match lists versions the value must not have
+	NoneMatch            []uint64 `protobuf:"varint,3,rep,packed,name=none_match,json=noneMatch,proto3" json:"none_match,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *Condition) Reset()         { *m = Condition{} }
+func (m *Condition) String() string { return proto.CompactTextString(m) }
+func (*Condition) ProtoMessage()    {}
+func (*Condition) Descriptor() ([]byte, []int) {
+	return fileDescriptor_4fcfcf4422c0f324, []int{1}
+}
+
+func (m *Condition) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_Condition.Unmarshal(m, b)
+}
+func (m *Condition) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_Condition.Marshal(b, m, deterministic)
+}
+func (m *Condition) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_Condition.Merge(m, src)
+}
+func (m *Condition) XXX_Size() int {
+	return xxx_messageInfo_Condition.Size(m)
+}
+func (m *Condition) XXX_DiscardUnknown() {
+	xxx_messageInfo_Condition.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_Condition proto.InternalMessageInfo
+
+func (m *Condition) GetPresence() Condition_Presence {
+	if m != nil {
+		return m.Presence
+	}
+	return Condition_ANY
+}
+
+func (m *Condition) GetMatch() []uint64 {
+	if m != nil {
+		return m.Match
+	}
+	return nil
+}
+
+func (m *Condition) GetNoneMatch() []uint64 {
+	if m != nil {
+		return m.NoneMatch
+	}
+	return nil
+}
+
+type GetRequest struct {
+	Key string `protobuf:"bytes,1,opt,name=key,proto3" json:"key,omitempty"`
+	// stale lets a node of a cluster skip confirming its leadership before the read
+	Stale                bool     `protobuf:"varint,2,opt,name=stale,proto3" json:"stale,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *GetRequest) Reset()         { *m = GetRequest{} }
+func (m *GetRequest) String() string { return proto.CompactTextString(m) }
+func (*GetRequest) ProtoMessage()    {}
+func (*GetRequest) Descriptor() ([]byte, []int) {
+	return fileDescriptor_4fcfcf4422c0f324, []int{2}
+}
+
+func (m *GetRequest) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_GetRequest.Unmarshal(m, b)
+}
+func (m *GetRequest) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_GetRequest.Marshal(b, m, deterministic)
+}
+func (m *GetRequest) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_GetRequest.Merge(m, src)
+}
+func (m *GetRequest) XXX_Size() int {
+	return xxx_messageInfo_GetRequest.Size(m)
+}
+func (m *GetRequest) XXX_DiscardUnknown() {
+	xxx_messageInfo_GetRequest.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_GetRequest proto.InternalMessageInfo
+
+func (m *GetRequest) GetKey() string {
+	if m != nil {
+		return m.Key
+	}
+	return ""
+}
+
+func (m *GetRequest) GetStale() bool {
+	if m != nil {
+		return m.Stale
+	}
+	return false
+}
+
+type SetRequest struct {
+	Key         string `protobuf:"bytes,1,opt,name=key,proto3" json:"key,omitempty"`
+	Value       []byte `protobuf:"bytes,2,opt,name=value,proto3" json:"value,omitempty"`
+	ContentType string `protobuf:"bytes,3,opt,name=content_type,json=contentType,proto3" json:"content_type,omitempty"`
+	// expire_in is a lifetime of the value in seconds, the value is permanent when it's 0
+	ExpireIn int64 `protobuf:"varint,4,opt,name=expire_in,json=expireIn,proto3" json:"expire_in,omitempty"`
+	// sliding prolongs the lifetime by expire_in on every read of the value
+	Sliding              bool       `protobuf:"varint,5,opt,name=sliding,proto3" json:"sliding,omitempty"`
+	Condition            *Condition `protobuf:"bytes,6,opt,name=condition,proto3" json:"condition,omitempty"`
+	XXX_NoUnkeyedLiteral struct{}   `json:"-"`
+	XXX_unrecognized     []byte     `json:"-"`
+	XXX_sizecache        int32      `json:"-"`
+}
+
+func (m *SetRequest) Reset()         { *m = SetRequest{} }
+func (m *SetRequest) String() string { return proto.CompactTextString(m) }
+func (*SetRequest) ProtoMessage()    {}
+func (*SetRequest) Descriptor() ([]byte, []int) {
+	return fileDescriptor_4fcfcf4422c0f324, []int{3}
+}
+
+func (m *SetRequest) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_SetRequest.Unmarshal(m, b)
+}
+func (m *SetRequest) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_SetRequest.Marshal(b, m, deterministic)
+}
+func (m *SetRequest) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_SetRequest.Merge(m, src)
+}
+func (m *SetRequest) XXX_Size() int {
+	return xxx_messageInfo_SetRequest.Size(m)
+}
+func (m *SetRequest) XXX_DiscardUnknown() {
+	xxx_messageInfo_SetRequest.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_SetRequest proto.InternalMessageInfo
+
+func (m *SetRequest) GetKey() string {
+	if m != nil {
+		return m.Key
+	}
+	return ""
+}
+
+func (m *SetRequest) GetValue() []byte {
+	if m != nil {
+		return m.Value
+	}
+	return nil
+}
+
+func (m *SetRequest) GetContentType() string {
+	if m != nil {
+		return m.ContentType
+	}
+	return ""
+}
+
+func (m *SetRequest) GetExpireIn() int64 {
+	if m != nil {
+		return m.ExpireIn
+	}
+	return 0
+}
+
+func (m *SetRequest) GetSliding() bool {
+	if m != nil {
+		return m.Sliding
+	}
+	return false
+}
+
+func (m *SetRequest) GetCondition() *Condition {
+	if m != nil {
+		return m.Condition
+	}
+	return nil
+}
+
+type SetResponse struct {
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *SetResponse) Reset()         { *m = SetResponse{} }
+func (m *SetResponse) String() string { return proto.CompactTextString(m) }
+func (*SetResponse) ProtoMessage()    {}
+func (*SetResponse) Descriptor() ([]byte, []int) {
+	return fileDescriptor_4fcfcf4422c0f324, []int{4}
+}
+
+func (m *SetResponse) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_SetResponse.Unmarshal(m, b)
+}
+func (m *SetResponse) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_SetResponse.Marshal(b, m, deterministic)
+}
+func (m *SetResponse) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_SetResponse.Merge(m, src)
+}
+func (m *SetResponse) XXX_Size() int {
+	return xxx_messageInfo_SetResponse.Size(m)
+}
+func (m *SetResponse) XXX_DiscardUnknown() {
+	xxx_messageInfo_SetResponse.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_SetResponse proto.InternalMessageInfo
+
+type DeleteRequest struct {
+	Key                  string     `protobuf:"bytes,1,opt,name=key,proto3" json:"key,omitempty"`
+	Condition            *Condition `protobuf:"bytes,2,opt,name=condition,proto3" json:"condition,omitempty"`
+	XXX_NoUnkeyedLiteral struct{}   `json:"-"`
+	XXX_unrecognized     []byte     `json:"-"`
+	XXX_sizecache        int32      `json:"-"`
+}
+
+func (m *DeleteRequest) Reset()         { *m = DeleteRequest{} }
+func (m *DeleteRequest) String() string { return proto.CompactTextString(m) }
+func (*DeleteRequest) ProtoMessage()    {}
+func (*DeleteRequest) Descriptor() ([]byte, []int) {
+	return fileDescriptor_4fcfcf4422c0f324, []int{5}
+}
+
+func (m *DeleteRequest) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_DeleteRequest.Unmarshal(m, b)
+}
+func (m *DeleteRequest) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_DeleteRequest.Marshal(b, m, deterministic)
+}
+func (m *DeleteRequest) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_DeleteRequest.Merge(m, src)
+}
+func (m *DeleteRequest) XXX_Size() int {
+	return xxx_messageInfo_DeleteRequest.Size(m)
+}
+func (m *DeleteRequest) XXX_DiscardUnknown() {
+	xxx_messageInfo_DeleteRequest.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_DeleteRequest proto.InternalMessageInfo
+
+func (m *DeleteRequest) GetKey() string {
+	if m != nil {
+		return m.Key
+	}
+	return ""
+}
+
+func (m *DeleteRequest) GetCondition() *Condition {
+	if m != nil {
+		return m.Condition
+	}
+	return nil
+}
+
+type DeleteResponse struct {
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *DeleteResponse) Reset()         { *m = DeleteResponse{} }
+func (m *DeleteResponse) String() string { return proto.CompactTextString(m) }
+func (*DeleteResponse) ProtoMessage()    {}
+func (*DeleteResponse) Descriptor() ([]byte, []int) {
+	return fileDescriptor_4fcfcf4422c0f324, []int{6}
+}
+
+func (m *DeleteResponse) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_DeleteResponse.Unmarshal(m, b)
+}
+func (m *DeleteResponse) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_DeleteResponse.Marshal(b, m, deterministic)
+}
+func (m *DeleteResponse) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_DeleteResponse.Merge(m, src)
+}
+func (m *DeleteResponse) XXX_Size() int {
+	return xxx_messageInfo_DeleteResponse.Size(m)
+}
+func (m *DeleteResponse) XXX_DiscardUnknown() {
+	xxx_messageInfo_DeleteResponse.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_DeleteResponse proto.InternalMessageInfo
+
+type ExistsRequest struct {
+	Key                  string   `protobuf:"bytes,1,opt,name=key,proto3" json:"key,omitempty"`
+	Stale                bool     `protobuf:"varint,2,opt,name=stale,proto3" json:"stale,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *ExistsRequest) Reset()         { *m = ExistsRequest{} }
+func (m *ExistsRequest) String() string { return proto.CompactTextString(m) }
+func (*ExistsRequest) ProtoMessage()    {}
+func (*ExistsRequest) Descriptor() ([]byte, []int) {
+	return fileDescriptor_4fcfcf4422c0f324, []int{7}
+}
+
+func (m *ExistsRequest) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_ExistsRequest.Unmarshal(m, b)
+}
+func (m *ExistsRequest) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_ExistsRequest.Marshal(b, m, deterministic)
+}
+func (m *ExistsRequest) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_ExistsRequest.Merge(m, src)
+}
+func (m *ExistsRequest) XXX_Size() int {
+	return xxx_messageInfo_ExistsRequest.Size(m)
+}
+func (m *ExistsRequest) XXX_DiscardUnknown() {
+	xxx_messageInfo_ExistsRequest.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_ExistsRequest proto.InternalMessageInfo
+
+func (m *ExistsRequest) GetKey() string {
+	if m != nil {
+		return m.Key
+	}
+	return ""
+}
+
+func (m *ExistsRequest) GetStale() bool {
+	if m != nil {
+		return m.Stale
+	}
+	return false
+}
+
+type ExistsResponse struct {
+	Exists               bool     `protobuf:"varint,1,opt,name=exists,proto3" json:"exists,omitempty"`
+	Version              uint64   `protobuf:"varint,2,opt,name=version,proto3" json:"version,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *ExistsResponse) Reset()         { *m = ExistsResponse{} }
+func (m *ExistsResponse) String() string { return proto.CompactTextString(m) }
+func (*ExistsResponse) ProtoMessage()    {}
+func (*ExistsResponse) Descriptor() ([]byte, []int) {
+	return fileDescriptor_4fcfcf4422c0f324, []int{8}
+}
+
+func (m *ExistsResponse) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_ExistsResponse.Unmarshal(m, b)
+}
+func (m *ExistsResponse) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_ExistsResponse.Marshal(b, m, deterministic)
+}
+func (m *ExistsResponse) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_ExistsResponse.Merge(m, src)
+}
+func (m *ExistsResponse) XXX_Size() int {
+	return xxx_messageInfo_ExistsResponse.Size(m)
+}
+func (m *ExistsResponse) XXX_DiscardUnknown() {
+	xxx_messageInfo_ExistsResponse.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_ExistsResponse proto.InternalMessageInfo
+
+func (m *ExistsResponse) GetExists() bool {
+	if m != nil {
+		return m.Exists
+	}
+	return false
+}
+
+func (m *ExistsResponse) GetVersion() uint64 {
+	if m != nil {
+		return m.Version
+	}
+	return 0
+}
+
+// ListRequest limits keys by prefix, start (inclusive) and end (exclusive), empty fields are not applied.
+// With filter or value_filter keys and values are matched by patterns where $ matches any number of characters,
+// the range is not applied then.
+type ListRequest struct {
+	Prefix string `protobuf:"bytes,1,opt,name=prefix,proto3" json:"prefix,omitempty"`
+	Start  string `protobuf:"bytes,2,opt,name=start,proto3" json:"start,omitempty"`
+	End    string `protobuf:"bytes,3,opt,name=end,proto3" json:"end,omitempty"`
+	// limit is the maximal number of keys, all keys are streamed when it's 0
+	Limit                uint32   `protobuf:"varint,4,opt,name=limit,proto3" json:"limit,omitempty"`
+	Filter               string   `protobuf:"bytes,5,opt,name=filter,proto3" json:"filter,omitempty"`
+	ValueFilter          string   `protobuf:"bytes,6,opt,name=value_filter,json=valueFilter,proto3" json:"value_filter,omitempty"`
+	Stale                bool     `protobuf:"varint,7,opt,name=stale,proto3" json:"stale,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *ListRequest) Reset()         { *m = ListRequest{} }
+func (m *ListRequest) String() string { return proto.CompactTextString(m) }
+func (*ListRequest) ProtoMessage()    {}
+func (*ListRequest) Descriptor() ([]byte, []int) {
+	return fileDescriptor_4fcfcf4422c0f324, []int{9}
+}
+
+func (m *ListRequest) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_ListRequest.Unmarshal(m, b)
+}
+func (m *ListRequest) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_ListRequest.Marshal(b, m, deterministic)
+}
+func (m *ListRequest) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_ListRequest.Merge(m, src)
+}
+func (m *ListRequest) XXX_Size() int {
+	return xxx_messageInfo_ListRequest.Size(m)
+}
+func (m *ListRequest) XXX_DiscardUnknown() {
+	xxx_messageInfo_ListRequest.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_ListRequest proto.InternalMessageInfo
+
+func (m *ListRequest) GetPrefix() string {
+	if m != nil {
+		return m.Prefix
+	}
+	return ""
+}
+
+func (m *ListRequest) GetStart() string {
+	if m != nil {
+		return m.Start
+	}
+	return ""
+}
+
+func (m *ListRequest) GetEnd() string {
+	if m != nil {
+		return m.End
+	}
+	return ""
+}
+
+func (m *ListRequest) GetLimit() uint32 {
+	if m != nil {
+		return m.Limit
+	}
+	return 0
+}
+
+func (m *ListRequest) GetFilter() string {
+	if m != nil {
+		return m.Filter
+	}
+	return ""
+}
+
+func (m *ListRequest) GetValueFilter() string {
+	if m != nil {
+		return m.ValueFilter
+	}
+	return ""
+}
+
+func (m *ListRequest) GetStale() bool {
+	if m != nil {
+		return m.Stale
+	}
+	return false
+}
+
+type ListResponse struct {
+	Key                  string   `protobuf:"bytes,1,opt,name=key,proto3" json:"key,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *ListResponse) Reset()         { *m = ListResponse{} }
+func (m *ListResponse) String() string { return proto.CompactTextString(m) }
+func (*ListResponse) ProtoMessage()    {}
+func (*ListResponse) Descriptor() ([]byte, []int) {
+	return fileDescriptor_4fcfcf4422c0f324, []int{10}
+}
+
+func (m *ListResponse) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_ListResponse.Unmarshal(m, b)
+}
+func (m *ListResponse) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_ListResponse.Marshal(b, m, deterministic)
+}
+func (m *ListResponse) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_ListResponse.Merge(m, src)
+}
+func (m *ListResponse) XXX_Size() int {
+	return xxx_messageInfo_ListResponse.Size(m)
+}
+func (m *ListResponse) XXX_DiscardUnknown() {
+	xxx_messageInfo_ListResponse.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_ListResponse proto.InternalMessageInfo
+
+func (m *ListResponse) GetKey() string {
+	if m != nil {
+		return m.Key
+	}
+	return ""
+}
+
+type WatchRequest struct {
+	// prefix of watched keys
+	Prefix               string   `protobuf:"bytes,1,opt,name=prefix,proto3" json:"prefix,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *WatchRequest) Reset()         { *m = WatchRequest{} }
+func (m *WatchRequest) String() string { return proto.CompactTextString(m) }
+func (*WatchRequest) ProtoMessage()    {}
+func (*WatchRequest) Descriptor() ([]byte, []int) {
+	return fileDescriptor_4fcfcf4422c0f324, []int{11}
+}
+
+func (m *WatchRequest) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_WatchRequest.Unmarshal(m, b)
+}
+func (m *WatchRequest) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_WatchRequest.Marshal(b, m, deterministic)
+}
+func (m *WatchRequest) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_WatchRequest.Merge(m, src)
+}
+func (m *WatchRequest) XXX_Size() int {
+	return xxx_messageInfo_WatchRequest.Size(m)
+}
+func (m *WatchRequest) XXX_DiscardUnknown() {
+	xxx_messageInfo_WatchRequest.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_WatchRequest proto.InternalMessageInfo
+
+func (m *WatchRequest) GetPrefix() string {
+	if m != nil {
+		return m.Prefix
+	}
+	return ""
+}
+
+type WatchEvent struct {
+	Type                 WatchEvent_Type `protobuf:"varint,1,opt,name=type,proto3,enum=nistorage.WatchEvent_Type" json:"type,omitempty"`
+	Key                  string          `protobuf:"bytes,2,opt,name=key,proto3" json:"key,omitempty"`
+	Version              uint64          `protobuf:"varint,3,opt,name=version,proto3" json:"version,omitempty"`
+	ExpirationTime       int64           `protobuf:"varint,4,opt,name=expiration_time,json=expirationTime,proto3" json:"expiration_time,omitempty"`
+	XXX_NoUnkeyedLiteral struct{}        `json:"-"`
+	XXX_unrecognized     []byte          `json:"-"`
+	XXX_sizecache        int32           `json:"-"`
+}
+
+func (m *WatchEvent) Reset()         { *m = WatchEvent{} }
+func (m *WatchEvent) String() string { return proto.CompactTextString(m) }
+func (*WatchEvent) ProtoMessage()    {}
+func (*WatchEvent) Descriptor() ([]byte, []int) {
+	return fileDescriptor_4fcfcf4422c0f324, []int{12}
+}
+
+func (m *WatchEvent) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_WatchEvent.Unmarshal(m, b)
+}
+func (m *WatchEvent) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_WatchEvent.Marshal(b, m, deterministic)
+}
+func (m *WatchEvent) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_WatchEvent.Merge(m, src)
+}
+func (m *WatchEvent) XXX_Size() int {
+	return xxx_messageInfo_WatchEvent.Size(m)
+}
+func (m *WatchEvent) XXX_DiscardUnknown() {
+	xxx_messageInfo_WatchEvent.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_WatchEvent proto.InternalMessageInfo
+
+func (m *WatchEvent) GetType() WatchEvent_Type {
+	if m != nil {
+		return m.Type
+	}
+	return WatchEvent_SET
+}
+
+func (m *WatchEvent) GetKey() string {
+	if m != nil {
+		return m.Key
+	}
+	return ""
+}
+
+func (m *WatchEvent) GetVersion() uint64 {
+	if m != nil {
+		return m.Version
+	}
+	return 0
+}
+
+func (m *WatchEvent) GetExpirationTime() int64 {
+	if m != nil {
+		return m.ExpirationTime
+	}
+	return 0
+}
+
+type Op struct {
+	Type Op_Type `protobuf:"varint,1,opt,name=type,proto3,enum=nistorage.Op_Type" json:"type,omitempty"`
+	Key  string  `protobuf:"bytes,2,opt,name=key,proto3" json:"key,omitempty"`
+	// value, content_type, expire_in and sliding are used by SET
+	Value                []byte     `protobuf:"bytes,3,opt,name=value,proto3" json:"value,omitempty"`
+	ContentType          string     `protobuf:"bytes,4,opt,name=content_type,json=contentType,proto3" json:"content_type,omitempty"`
+	ExpireIn             int64      `protobuf:"varint,5,opt,name=expire_in,json=expireIn,proto3" json:"expire_in,omitempty"`
+	Sliding              bool       `protobuf:"varint,6,opt,name=sliding,proto3" json:"sliding,omitempty"`
+	Condition            *Condition `protobuf:"bytes,7,opt,name=condition,proto3" json:"condition,omitempty"`
+	XXX_NoUnkeyedLiteral struct{}   `json:"-"`
+	XXX_unrecognized     []byte     `json:"-"`
+	XXX_sizecache        int32      `json:"-"`
+}
+
+func (m *Op) Reset()         { *m = Op{} }
+func (m *Op) String() string { return proto.CompactTextString(m) }
+func (*Op) ProtoMessage()    {}
+func (*Op) Descriptor() ([]byte, []int) {
+	return fileDescriptor_4fcfcf4422c0f324, []int{13}
+}
+
+func (m *Op) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_Op.Unmarshal(m, b)
+}
+func (m *Op) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_Op.Marshal(b, m, deterministic)
+}
+func (m *Op) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_Op.Merge(m, src)
+}
+func (m *Op) XXX_Size() int {
+	return xxx_messageInfo_Op.Size(m)
+}
+func (m *Op) XXX_DiscardUnknown() {
+	xxx_messageInfo_Op.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_Op proto.InternalMessageInfo
+
+func (m *Op) GetType() Op_Type {
+	if m != nil {
+		return m.Type
+	}
+	return Op_SET
+}
+
+func (m *Op) GetKey() string {
+	if m != nil {
+		return m.Key
+	}
+	return ""
+}
+
+func (m *Op) GetValue() []byte {
+	if m != nil {
+		return m.Value
+	}
+	return nil
+}
+
+func (m *Op) GetContentType() string {
+	if m != nil {
+		return m.ContentType
+	}
+	return ""
+}
+
+func (m *Op) GetExpireIn() int64 {
+	if m != nil {
+		return m.ExpireIn
+	}
+	return 0
+}
+
+func (m *Op) GetSliding() bool {
+	if m != nil {
+		return m.Sliding
+	}
+	return false
+}
+
+func (m *Op) GetCondition() *Condition {
+	if m != nil {
+		return m.Condition
+	}
+	return nil
+}
+
+type BatchRequest struct {
+	Ops                  []*Op    `protobuf:"bytes,1,rep,name=ops,proto3" json:"ops,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *BatchRequest) Reset()         { *m = BatchRequest{} }
+func (m *BatchRequest) String() string { return proto.CompactTextString(m) }
+func (*BatchRequest) ProtoMessage()    {}
+func (*BatchRequest) Descriptor() ([]byte, []int) {
+	return fileDescriptor_4fcfcf4422c0f324, []int{14}
+}
+
+func (m *BatchRequest) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_BatchRequest.Unmarshal(m, b)
+}
+func (m *BatchRequest) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_BatchRequest.Marshal(b, m, deterministic)
+}
+func (m *BatchRequest) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_BatchRequest.Merge(m, src)
+}
+func (m *BatchRequest) XXX_Size() int {
+	return xxx_messageInfo_BatchRequest.Size(m)
+}
+func (m *BatchRequest) XXX_DiscardUnknown() {
+	xxx_messageInfo_BatchRequest.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_BatchRequest proto.InternalMessageInfo
+
+func (m *BatchRequest) GetOps() []*Op {
+	if m != nil {
+		return m.Ops
+	}
+	return nil
+}
+
+type BatchResponse struct {
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *BatchResponse) Reset()         { *m = BatchResponse{} }
+func (m *BatchResponse) String() string { return proto.CompactTextString(m) }
+func (*BatchResponse) ProtoMessage()    {}
+func (*BatchResponse) Descriptor() ([]byte, []int) {
+	return fileDescriptor_4fcfcf4422c0f324, []int{15}
+}
+
+func (m *BatchResponse) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_BatchResponse.Unmarshal(m, b)
+}
+func (m *BatchResponse) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_BatchResponse.Marshal(b, m, deterministic)
+}
+func (m *BatchResponse) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_BatchResponse.Merge(m, src)
+}
+func (m *BatchResponse) XXX_Size() int {
+	return xxx_messageInfo_BatchResponse.Size(m)
+}
+func (m *BatchResponse) XXX_DiscardUnknown() {
+	xxx_messageInfo_BatchResponse.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_BatchResponse proto.InternalMessageInfo
+
+func init() {
+	proto.RegisterEnum("nistorage.Condition_Presence", Condition_Presence_name, Condition_Presence_value)
+	proto.RegisterEnum("nistorage.WatchEvent_Type", WatchEvent_Type_name, WatchEvent_Type_value)
+	proto.RegisterEnum("nistorage.Op_Type", Op_Type_name, Op_Type_value)
+	proto.RegisterType((*Record)(nil), "nistorage.Record")
+	proto.RegisterType((*Condition)(nil), "nistorage.Condition")
+	proto.RegisterType((*GetRequest)(nil), "nistorage.GetRequest")
+	proto.RegisterType((*SetRequest)(nil), "nistorage.SetRequest")
+	proto.RegisterType((*SetResponse)(nil), "nistorage.SetResponse")
+	proto.RegisterType((*DeleteRequest)(nil), "nistorage.DeleteRequest")
+	proto.RegisterType((*DeleteResponse)(nil), "nistorage.DeleteResponse")
+	proto.RegisterType((*ExistsRequest)(nil), "nistorage.ExistsRequest")
+	proto.RegisterType((*ExistsResponse)(nil), "nistorage.ExistsResponse")
+	proto.RegisterType((*ListRequest)(nil), "nistorage.ListRequest")
+	proto.RegisterType((*ListResponse)(nil), "nistorage.ListResponse")
+	proto.RegisterType((*WatchRequest)(nil), "nistorage.WatchRequest")
+	proto.RegisterType((*WatchEvent)(nil), "nistorage.WatchEvent")
+	proto.RegisterType((*Op)(nil), "nistorage.Op")
+	proto.RegisterType((*BatchRequest)(nil), "nistorage.BatchRequest")
+	proto.RegisterType((*BatchResponse)(nil), "nistorage.BatchResponse")
+}
+
+func init() {
+	proto.RegisterFile("rpc/storage.proto", fileDescriptor_4fcfcf4422c0f324)
+}
+
+var fileDescriptor_4fcfcf4422c0f324 = []byte{
+	// 840 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x9c, 0x56, 0xdd, 0x72, 0xdb, 0x44,
+	0x14, 0xee, 0x6a, 0x65, 0xd9, 0x3a, 0xb6, 0x53, 0x75, 0xa7, 0x4d, 0x55, 0x77, 0x3a, 0x18, 0x5d,
+	0x04, 0x5d, 0x80, 0xdd, 0x31, 0x9d, 0x61, 0x02, 0xc3, 0x45, 0x4d, 0xd4, 0x4e, 0x67, 0x42, 0x93,
+	0x59, 0x1b, 0x0a, 0xdc, 0x78, 0x5c, 0x65, 0x93, 0xee, 0x60, 0x4b, 0x42, 0xda, 0x84, 0xe4, 0x45,
+	0xb8, 0xe6, 0x96, 0x7b, 0x9e, 0x80, 0x77, 0xe0, 0x79, 0x60, 0xf6, 0x47, 0xb6, 0x1c, 0xbb, 0x76,
+	0xe1, 0x4e, 0xe7, 0x9c, 0xef, 0xdb, 0xdd, 0xf3, 0xf3, 0x1d, 0x1b, 0xee, 0xe5, 0x59, 0xdc, 0x2f,
+	0x44, 0x9a, 0x4f, 0x2f, 0x58, 0x2f, 0xcb, 0x53, 0x91, 0x12, 0x37, 0xe1, 0xc6, 0x11, 0xfc, 0x86,
+	0xc0, 0xa1, 0x2c, 0x4e, 0xf3, 0x33, 0xe2, 0x01, 0xfe, 0x99, 0xdd, 0xf8, 0xa8, 0x8b, 0x42, 0x97,
+	0xca, 0x4f, 0x72, 0x1f, 0x6a, 0x57, 0xd3, 0xd9, 0x25, 0xf3, 0xad, 0x2e, 0x0a, 0x5b, 0x54, 0x1b,
+	0xe4, 0x63, 0x68, 0xc5, 0x69, 0x22, 0x58, 0x22, 0x26, 0xe2, 0x26, 0x63, 0x3e, 0x56, 0x84, 0xa6,
+	0xf1, 0x8d, 0x6f, 0x32, 0x46, 0x7c, 0xa8, 0x5f, 0xb1, 0xbc, 0xe0, 0x69, 0xe2, 0xdb, 0x5d, 0x14,
+	0xda, 0xb4, 0x34, 0xc9, 0x27, 0x70, 0x97, 0x5d, 0x67, 0x3c, 0x9f, 0x0a, 0x9e, 0x26, 0x13, 0xc1,
+	0xe7, 0xcc, 0xaf, 0x75, 0x51, 0x88, 0xe9, 0xde, 0xd2, 0x3d, 0xe6, 0x73, 0x16, 0xfc, 0x81, 0xc0,
+	0xfd, 0x26, 0x4d, 0xce, 0xb8, 0xf4, 0x90, 0x43, 0x68, 0x64, 0x39, 0x2b, 0x58, 0x12, 0x33, 0xf5,
+	0xc0, 0xbd, 0xc1, 0x93, 0xde, 0x22, 0x89, 0xde, 0x02, 0xd7, 0x3b, 0x35, 0x20, 0xba, 0x80, 0xcb,
+	0x24, 0xe6, 0x53, 0x11, 0xbf, 0xf3, 0xad, 0x2e, 0x0e, 0x6d, 0xaa, 0x0d, 0xf2, 0x04, 0x20, 0x49,
+	0x13, 0x36, 0xd1, 0x21, 0xac, 0x42, 0xae, 0xf4, 0x7c, 0x2b, 0x1d, 0xc1, 0xa7, 0xd0, 0x28, 0x8f,
+	0x22, 0x75, 0xc0, 0xcf, 0x5f, 0xff, 0xe8, 0xdd, 0x21, 0x4d, 0xa8, 0x9f, 0xd2, 0x68, 0x14, 0xbd,
+	0x1e, 0x7b, 0x88, 0x00, 0x38, 0xcf, 0x87, 0xea, 0xdb, 0x0a, 0x9e, 0x01, 0xbc, 0x64, 0x82, 0xb2,
+	0x5f, 0x2e, 0x59, 0x21, 0x36, 0xd7, 0xb1, 0x10, 0xd3, 0x99, 0xae, 0x63, 0x83, 0x6a, 0x23, 0xf8,
+	0x0b, 0x01, 0x8c, 0x76, 0xd0, 0xfe, 0x5f, 0xf9, 0x1f, 0x83, 0xab, 0xaa, 0xc9, 0x26, 0x5c, 0x37,
+	0x00, 0xd3, 0x86, 0x76, 0xbc, 0x4a, 0x64, 0x6f, 0x8a, 0x19, 0x3f, 0xe3, 0xc9, 0x85, 0xaa, 0x7c,
+	0x83, 0x96, 0x26, 0x19, 0x80, 0x1b, 0x97, 0x95, 0xf4, 0x9d, 0x2e, 0x0a, 0x9b, 0x83, 0xfb, 0x9b,
+	0xaa, 0x4c, 0x97, 0xb0, 0xa0, 0x0d, 0x4d, 0x95, 0x43, 0x91, 0xa5, 0x49, 0xc1, 0x82, 0xef, 0xa0,
+	0x7d, 0xc4, 0x66, 0x4c, 0xb0, 0xf7, 0x67, 0xb5, 0x72, 0x8b, 0xf5, 0x61, 0xb7, 0x78, 0xb0, 0x57,
+	0x1e, 0x6b, 0x2e, 0xfa, 0x02, 0xda, 0xd1, 0x35, 0x2f, 0x44, 0xf1, 0x5f, 0xab, 0x3e, 0x84, 0xbd,
+	0x92, 0xa8, 0x8f, 0x22, 0xfb, 0xe0, 0x30, 0xe5, 0x51, 0xe4, 0x06, 0x35, 0x56, 0x75, 0x88, 0xad,
+	0x95, 0x21, 0x0e, 0xfe, 0x44, 0xd0, 0x3c, 0xe6, 0xc5, 0xa2, 0x75, 0xfb, 0xe0, 0x64, 0x39, 0x3b,
+	0xe7, 0xd7, 0xe6, 0x7a, 0x63, 0x99, 0x17, 0xe4, 0x42, 0xf1, 0x5d, 0xaa, 0x0d, 0xf9, 0x52, 0x96,
+	0x9c, 0x99, 0xbe, 0xc9, 0x4f, 0x89, 0x9b, 0xf1, 0x39, 0x17, 0xaa, 0x57, 0x6d, 0xaa, 0x0d, 0x79,
+	0xea, 0x39, 0x9f, 0x09, 0x96, 0xab, 0x3e, 0xb9, 0xd4, 0x58, 0x72, 0x00, 0xd4, 0x24, 0x4c, 0x4c,
+	0xd4, 0xd1, 0x03, 0xa0, 0x7c, 0x2f, 0x34, 0x64, 0x91, 0x7a, 0xbd, 0x9a, 0x7a, 0x17, 0x5a, 0xfa,
+	0xd5, 0x26, 0xf1, 0xb5, 0x92, 0x05, 0x07, 0xd0, 0x7a, 0x23, 0xe7, 0x7f, 0x47, 0x62, 0xc1, 0xdf,
+	0x08, 0x40, 0x01, 0xa3, 0x2b, 0x96, 0x08, 0xd2, 0x03, 0x5b, 0x8d, 0xa2, 0x56, 0x66, 0xa7, 0xd2,
+	0xcd, 0x25, 0xa8, 0x27, 0x27, 0x93, 0x2a, 0x5c, 0x79, 0xb1, 0xb5, 0xec, 0x55, 0xa5, 0xd6, 0x78,
+	0xe7, 0xc2, 0xb0, 0x37, 0x2e, 0x8c, 0x21, 0xd8, 0x6a, 0xf8, 0xeb, 0x80, 0x47, 0xd1, 0xd8, 0xbb,
+	0x23, 0x15, 0x7a, 0x14, 0x1d, 0x47, 0xe3, 0xc8, 0x43, 0x52, 0xba, 0xd1, 0x0f, 0xa7, 0xaf, 0x68,
+	0x74, 0xe4, 0x59, 0x32, 0xa0, 0x0d, 0x0f, 0x93, 0x16, 0x34, 0x4e, 0xbe, 0x8f, 0xe8, 0x8b, 0xe3,
+	0x93, 0x37, 0x9e, 0x1d, 0xfc, 0x83, 0xc0, 0x3a, 0xc9, 0xc8, 0xc1, 0x4a, 0x3e, 0xa4, 0x92, 0xcf,
+	0x49, 0xb6, 0x3d, 0x8f, 0x85, 0x64, 0xf1, 0x36, 0xc9, 0xda, 0x3b, 0x24, 0x5b, 0x7b, 0xbf, 0x64,
+	0x9d, 0x2d, 0x92, 0xad, 0x7f, 0x98, 0x98, 0x1e, 0x6f, 0x29, 0x54, 0xd0, 0x87, 0xd6, 0xb0, 0x3a,
+	0x01, 0x1f, 0x01, 0x4e, 0x33, 0xa9, 0x0c, 0x1c, 0x36, 0x07, 0xed, 0x95, 0x4a, 0x50, 0x19, 0x09,
+	0xee, 0x42, 0xdb, 0x10, 0xf4, 0x54, 0x0d, 0x7e, 0xc7, 0x50, 0x1f, 0x69, 0x10, 0xe9, 0x03, 0x7e,
+	0xc9, 0x04, 0x79, 0x50, 0xe1, 0x2d, 0x17, 0x65, 0xe7, 0x5e, 0xc5, 0x6d, 0x7e, 0x83, 0x9e, 0x01,
+	0x1e, 0xdd, 0x22, 0x2c, 0x57, 0x64, 0x67, 0xff, 0xb6, 0xdb, 0x0c, 0xf2, 0xd7, 0xe0, 0xe8, 0xf5,
+	0x40, 0xfc, 0x0a, 0x62, 0x65, 0x11, 0x75, 0x1e, 0x6d, 0x88, 0x2c, 0xe9, 0x91, 0x91, 0x7c, 0x05,
+	0xb4, 0xb2, 0x5e, 0x3a, 0x8f, 0x36, 0x44, 0x0c, 0xfd, 0x10, 0x6c, 0x29, 0x2b, 0x52, 0x7d, 0x5d,
+	0x65, 0x3b, 0x74, 0x1e, 0xae, 0xf9, 0x35, 0xf1, 0x29, 0x22, 0x87, 0x50, 0x53, 0x0a, 0x21, 0x0f,
+	0x6f, 0x6b, 0xa6, 0x24, 0x3f, 0xd8, 0x28, 0xa6, 0xa7, 0x88, 0x7c, 0x09, 0xb5, 0xe1, 0x1a, 0xb5,
+	0xda, 0xba, 0x8e, 0xbf, 0x1e, 0xd0, 0x17, 0x0f, 0xc3, 0x9f, 0x0e, 0x2e, 0xb8, 0x78, 0x77, 0xf9,
+	0xb6, 0x17, 0xa7, 0xf3, 0xfe, 0x39, 0x9f, 0x4d, 0x45, 0x7a, 0xf5, 0x6b, 0x3f, 0xe1, 0x9f, 0x19,
+	0x7c, 0x3f, 0xcf, 0xe2, 0xaf, 0xf2, 0x2c, 0x7e, 0xeb, 0xa8, 0x3f, 0x0c, 0x9f, 0xff, 0x3b, 0x00,
+	0x34, 0x65, 0xbf, 0xd9, 0x45, 0x08, 0x00, 0x00,
+}
+
+// Reference imports to suppress errors if they are not otherwise used.
+var _ context.Context
+var _ grpc.ClientConnInterface
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+const _ = grpc.SupportPackageIsVersion6
+
+// StorageClient is the client API for Storage service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://godoc.org/google.golang.org/grpc#ClientConn.NewStream.
+type StorageClient interface {
+	// Get returns a value with its content type and version, NOT_FOUND is returned for a missing key
+	Get(ctx context.Context, in *GetRequest, opts ...grpc.CallOption) (*Record, error)
+	// Set saves a value, a condition makes the update conditional
+	Set(ctx context.Context, in *SetRequest, opts ...grpc.CallOption) (*SetResponse, error)
+	// Delete removes a value, a condition makes the removal conditional
+	Delete(ctx context.Context, in *DeleteRequest, opts ...grpc.CallOption) (*DeleteResponse, error)
+	// Exists checks if a value exists and returns its version
+	Exists(ctx context.Context, in *ExistsRequest, opts ...grpc.CallOption) (*ExistsResponse, error)
+	// List streams keys in ascending order
+	List(ctx context.Context, in *ListRequest, opts ...grpc.CallOption) (Storage_ListClient, error)
+	// Watch streams changes of values, a watcher which falls behind gets OVERFLOW event and the stream ends
+	Watch(ctx context.Context, in *WatchRequest, opts ...grpc.CallOption) (Storage_WatchClient, error)
+	// Batch applies sets and deletes atomically, either all operations succeed or none of them
+	Batch(ctx context.Context, in *BatchRequest, opts ...grpc.CallOption) (*BatchResponse, error)
+}
+
+type storageClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewStorageClient(cc grpc.ClientConnInterface) StorageClient {
+	return &storageClient{cc}
+}
+
+func (c *storageClient) Get(ctx context.Context, in *GetRequest, opts ...grpc.CallOption) (*Record, error) {
+	out := new(Record)
+	err := c.cc.Invoke(ctx, "/nistorage.Storage/Get", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *storageClient) Set(ctx context.Context, in *SetRequest, opts ...grpc.CallOption) (*SetResponse, error) {
+	out := new(SetResponse)
+	err := c.cc.Invoke(ctx, "/nistorage.Storage/Set", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *storageClient) Delete(ctx context.Context, in *DeleteRequest, opts ...grpc.CallOption) (*DeleteResponse, error) {
+	out := new(DeleteResponse)
+	err := c.cc.Invoke(ctx, "/nistorage.Storage/Delete", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *storageClient) Exists(ctx context.Context, in *ExistsRequest, opts ...grpc.CallOption) (*ExistsResponse, error) {
+	out := new(ExistsResponse)
+	err := c.cc.Invoke(ctx, "/nistorage.Storage/Exists", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *storageClient) List(ctx context.Context, in *ListRequest, opts ...grpc.CallOption) (Storage_ListClient, error) {
+	stream, err := c.cc.NewStream(ctx, &_Storage_serviceDesc.Streams[0], "/nistorage.Storage/List", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &storageListClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type Storage_ListClient interface {
+	Recv() (*ListResponse, error)
+	grpc.ClientStream
+}
+
+type storageListClient struct {
+	grpc.ClientStream
+}
+
+func (x *storageListClient) Recv() (*ListResponse, error) {
+	m := new(ListResponse)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *storageClient) Watch(ctx context.Context, in *WatchRequest, opts ...grpc.CallOption) (Storage_WatchClient, error) {
+	stream, err := c.cc.NewStream(ctx, &_Storage_serviceDesc.Streams[1], "/nistorage.Storage/Watch", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &storageWatchClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type Storage_WatchClient interface {
+	Recv() (*WatchEvent, error)
+	grpc.ClientStream
+}
+
+type storageWatchClient struct {
+	grpc.ClientStream
+}
+
+func (x *storageWatchClient) Recv() (*WatchEvent, error) {
+	m := new(WatchEvent)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *storageClient) Batch(ctx context.Context, in *BatchRequest, opts ...grpc.CallOption) (*BatchResponse, error) {
+	out := new(BatchResponse)
+	err := c.cc.Invoke(ctx, "/nistorage.Storage/Batch", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// StorageServer is the server API for Storage service.
+type StorageServer interface {
+	// Get returns a value with its content type and version, NOT_FOUND is returned for a missing key
+	Get(context.Context, *GetRequest) (*Record, error)
+	// Set saves a value, a condition makes the update conditional
+	Set(context.Context, *SetRequest) (*SetResponse, error)
+	// Delete removes a value, a condition makes the removal conditional
+	Delete(context.Context, *DeleteRequest) (*DeleteResponse, error)
+	// Exists checks if a value exists and returns its version
+	Exists(context.Context, *ExistsRequest) (*ExistsResponse, error)
+	// List streams keys in ascending order
+	List(*ListRequest, Storage_ListServer) error
+	// Watch streams changes of values, a watcher which falls behind gets OVERFLOW event and the stream ends
+	Watch(*WatchRequest, Storage_WatchServer) error
+	// Batch applies sets and deletes atomically, either all operations succeed or none of them
+	Batch(context.Context, *BatchRequest) (*BatchResponse, error)
+}
+
+// UnimplementedStorageServer can be embedded to have forward compatible implementations.
+type UnimplementedStorageServer struct {
+}
+
+func (*UnimplementedStorageServer) Get(ctx context.Context, req *GetRequest) (*Record, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Get not implemented")
+}
+func (*UnimplementedStorageServer) Set(ctx context.Context, req *SetRequest) (*SetResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Set not implemented")
+}
+func (*UnimplementedStorageServer) Delete(ctx context.Context, req *DeleteRequest) (*DeleteResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Delete not implemented")
+}
+func (*UnimplementedStorageServer) Exists(ctx context.Context, req *ExistsRequest) (*ExistsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Exists not implemented")
+}
+func (*UnimplementedStorageServer) List(req *ListRequest, srv Storage_ListServer) error {
+	return status.Errorf(codes.Unimplemented, "method List not implemented")
+}
+func (*UnimplementedStorageServer) Watch(req *WatchRequest, srv Storage_WatchServer) error {
+	return status.Errorf(codes.Unimplemented, "method Watch not implemented")
+}
+func (*UnimplementedStorageServer) Batch(ctx context.Context, req *BatchRequest) (*BatchResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Batch not implemented")
+}
+
+func RegisterStorageServer(s *grpc.Server, srv StorageServer) {
+	s.RegisterService(&_Storage_serviceDesc, srv)
+}
+
+func _Storage_Get_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(StorageServer).Get(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/nistorage.Storage/Get",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(StorageServer).Get(ctx, req.(*GetRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Storage_Set_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(SetRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(StorageServer).Set(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/nistorage.Storage/Set",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(StorageServer).Set(ctx, req.(*SetRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Storage_Delete_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(DeleteRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(StorageServer).Delete(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/nistorage.Storage/Delete",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(StorageServer).Delete(ctx, req.(*DeleteRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Storage_Exists_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ExistsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(StorageServer).Exists(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/nistorage.Storage/Exists",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(StorageServer).Exists(ctx, req.(*ExistsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Storage_List_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(ListRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(StorageServer).List(m, &storageListServer{stream})
+}
+
+type Storage_ListServer interface {
+	Send(*ListResponse) error
+	grpc.ServerStream
+}
+
+type storageListServer struct {
+	grpc.ServerStream
+}
+
+func (x *storageListServer) Send(m *ListResponse) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func _Storage_Watch_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(WatchRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(StorageServer).Watch(m, &storageWatchServer{stream})
+}
+
+type Storage_WatchServer interface {
+	Send(*WatchEvent) error
+	grpc.ServerStream
+}
+
+type storageWatchServer struct {
+	grpc.ServerStream
+}
+
+func (x *storageWatchServer) Send(m *WatchEvent) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func _Storage_Batch_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(BatchRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(StorageServer).Batch(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/nistorage.Storage/Batch",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(StorageServer).Batch(ctx, req.(*BatchRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+var _Storage_serviceDesc = grpc.ServiceDesc{
+	ServiceName: "nistorage.Storage",
+	HandlerType: (*StorageServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Get",
+			Handler:    _Storage_Get_Handler,
+		},
+		{
+			MethodName: "Set",
+			Handler:    _Storage_Set_Handler,
+		},
+		{
+			MethodName: "Delete",
+			Handler:    _Storage_Delete_Handler,
+		},
+		{
+			MethodName: "Exists",
+			Handler:    _Storage_Exists_Handler,
+		},
+		{
+			MethodName: "Batch",
+			Handler:    _Storage_Batch_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "List",
+			Handler:       _Storage_List_Handler,
+			ServerStreams: true,
+		},
+		{
+			StreamName:    "Watch",
+			Handler:       _Storage_Watch_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "rpc/storage.proto",
+}
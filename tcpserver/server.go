@@ -0,0 +1,126 @@
+package tcpserver
+
+// TCP listener shared by servers of text protocols.
+// The server accepts connections and runs a handler for each of them in its own goroutine.
+// It keeps listeners and connections, so Close stops accepting and drops connected clients at once.
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/filatovw/ni-storage/logger"
+)
+
+// acceptRetryDelay is a pause after a temporary error of accept
+const acceptRetryDelay = 10 * time.Millisecond
+
+// Server accepts TCP clients and serves each of them with the handler
+type Server struct {
+	// Addr is the TCP address the server listens at
+	Addr string
+	log  logger.Logger
+	// handle serves a client, the connection is closed after it returns
+	handle func(net.Conn)
+	// errClosed is returned by Serve after the server is closed
+	errClosed error
+
+	lock      *sync.Mutex
+	listeners map[net.Listener]struct{}
+	conns     map[net.Conn]struct{}
+	closed    bool
+}
+
+// New creates a server which listens at the address, errClosed is returned by Serve after the server is closed
+func New(log logger.Logger, addr string, errClosed error, handle func(net.Conn)) *Server {
+	return &Server{
+		Addr:      addr,
+		log:       log,
+		handle:    handle,
+		errClosed: errClosed,
+		lock:      &sync.Mutex{},
+		listeners: make(map[net.Listener]struct{}),
+		conns:     make(map[net.Conn]struct{}),
+	}
+}
+
+// ListenAndServe listens at Addr and serves clients until the server is closed
+func (s *Server) ListenAndServe() error {
+	l, err := net.Listen("tcp", s.Addr)
+	if err != nil {
+		return errors.Wrap(err, "listen")
+	}
+	return s.Serve(l)
+}
+
+// Serve accepts clients of the listener until the server is closed, the listener is closed then
+func (s *Server) Serve(l net.Listener) error {
+	s.lock.Lock()
+	if s.closed {
+		s.lock.Unlock()
+		l.Close()
+		return s.errClosed
+	}
+	s.listeners[l] = struct{}{}
+	s.lock.Unlock()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			s.lock.Lock()
+			closed := s.closed
+			s.lock.Unlock()
+			if closed {
+				return s.errClosed
+			}
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				s.log.Warnf("accept failed: %s", err)
+				time.Sleep(acceptRetryDelay)
+				continue
+			}
+			return errors.Wrap(err, "accept")
+		}
+		if !s.track(conn) {
+			conn.Close()
+			return s.errClosed
+		}
+		go func() {
+			defer s.forget(conn)
+			s.handle(conn)
+		}()
+	}
+}
+
+// Close stops listeners and drops connections of clients
+func (s *Server) Close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.closed = true
+	for l := range s.listeners {
+		l.Close()
+	}
+	for conn := range s.conns {
+		conn.Close()
+	}
+	return nil
+}
+
+// track remembers a connection to drop it on close, false is returned when the server is closed
+func (s *Server) track(conn net.Conn) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.closed {
+		return false
+	}
+	s.conns[conn] = struct{}{}
+	return true
+}
+
+func (s *Server) forget(conn net.Conn) {
+	s.lock.Lock()
+	delete(s.conns, conn)
+	s.lock.Unlock()
+	conn.Close()
+}